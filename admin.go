@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Trims message_stream to ARGV[1] entries unless that would drop an entry at or after ARGV[2],
+// the oldest one the consumer group still needs. Returns the number removed, or -1 if refused.
+// Runs as one script so nothing is appended between the check and the XTRIM.
+var trimStreamScript = redis.NewScript(`
+local maxlen = tonumber(ARGV[1])
+local needed = redis.call('XRANGE', KEYS[1], ARGV[2], '+', 'COUNT', maxlen + 1)
+if #needed > maxlen then
+	return -1
+end
+return redis.call('XTRIM', KEYS[1], 'MAXLEN', maxlen)
+`)
+
+// StreamGroupInfo is one consumer group in GET /admin/stream
+type StreamGroupInfo struct {
+	Name            string `json:"name"`
+	Consumers       int64  `json:"consumers"`
+	Pending         int64  `json:"pending"`
+	LastDeliveredID string `json:"last_delivered_id"`
+	EntriesRead     int64  `json:"entries_read"`
+	Lag             int64  `json:"lag"`
+}
+
+// StreamPendingInfo summarizes message_group's pending entries list (XPENDING)
+type StreamPendingInfo struct {
+	Count     int64            `json:"count"`
+	OldestID  string           `json:"oldest_id"`
+	NewestID  string           `json:"newest_id"`
+	Consumers map[string]int64 `json:"consumers"`
+}
+
+// PendingEntry is one entry of message_group's pending entries list in GET /admin/pending
+type PendingEntry struct {
+	ID            string  `json:"id"`
+	Consumer      string  `json:"consumer"`
+	IdleSeconds   float64 `json:"idle_seconds"`   // since the entry was last delivered to a consumer
+	DeliveryCount int64   `json:"delivery_count"` // above 1 means it was reclaimed or redelivered
+}
+
+// Entries returned by GET /admin/pending
+const (
+	defaultPendingCount = 100
+	maxPendingCount     = 1000
+)
+
+// TrimStreamRequest is the body of POST /admin/stream/trim
+type TrimStreamRequest struct {
+	MaxLen *int64 `json:"maxlen"`
+}
+
+//! Handles reporting message_stream's length, consumer groups and pending entries
+func getStreamInfo(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	length, err := redisCli.XLen(ctx, "message_stream").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read stream length", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read stream info"})
+	}
+
+	rawGroups, err := redisCli.XInfoGroups(ctx, "message_stream").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read consumer groups", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read stream info"})
+	}
+	groups := make([]StreamGroupInfo, 0, len(rawGroups))
+	for _, g := range rawGroups {
+		groups = append(groups, StreamGroupInfo{
+			Name:            g.Name,
+			Consumers:       g.Consumers,
+			Pending:         g.Pending,
+			LastDeliveredID: g.LastDeliveredID,
+			EntriesRead:     g.EntriesRead,
+			Lag:             g.Lag,
+		})
+	}
+
+	pending, err := redisCli.XPending(ctx, "message_stream", "message_group").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read pending entries", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read stream info"})
+	}
+	consumers := pending.Consumers
+	if consumers == nil {
+		consumers = map[string]int64{}
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"stream": "message_stream",
+		"length": length,
+		"groups": groups,
+		"pending": StreamPendingInfo{
+			Count:     pending.Count,
+			OldestID:  pending.Lower,
+			NewestID:  pending.Higher,
+			Consumers: consumers,
+		},
+	})
+}
+
+//! Handles listing message_group's pending entries one by one (XPENDING in extended form),
+// for tracking down entries that keep failing. ?start and ?end bound the stream IDs (inclusive,
+// default "-" and "+"), ?count caps the entries, ?consumer and ?min_idle narrow them down.
+// next_start is set when there may be more entries; pass it as ?start to continue.
+func getPendingEntries(c echo.Context) error {
+	start := c.QueryParam("start")
+	if start == "" {
+		start = "-"
+	}
+	end := c.QueryParam("end")
+	if end == "" {
+		end = "+"
+	}
+
+	if !validStreamBound(start) || !validStreamBound(end) {
+		return c.JSON(400, map[string]string{"error": "start and end must be stream IDs, - or +"})
+	}
+
+	count := int64(defaultPendingCount)
+	if v := c.QueryParam("count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return c.JSON(400, map[string]string{"error": "count must be a positive integer"})
+		}
+		count = min(n, maxPendingCount)
+	}
+
+	var minIdle time.Duration
+	if v := c.QueryParam("min_idle"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return c.JSON(400, map[string]string{"error": "min_idle must be a duration such as 30s or 5m"})
+		}
+		minIdle = d
+	}
+
+	pending, err := redisCli.XPendingExt(c.Request().Context(), &redis.XPendingExtArgs{
+		Stream:   "message_stream",
+		Group:    "message_group",
+		Idle:     minIdle,
+		Start:    start,
+		End:      end,
+		Count:    count,
+		Consumer: c.QueryParam("consumer"),
+	}).Result()
+	if err != nil {
+		logFor(c).Error("Failed to read pending entries", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read pending entries"})
+	}
+
+	entries := make([]PendingEntry, 0, len(pending))
+	for _, p := range pending {
+		entries = append(entries, PendingEntry{
+			ID:            p.ID,
+			Consumer:      p.Consumer,
+			IdleSeconds:   p.Idle.Seconds(),
+			DeliveryCount: p.RetryCount,
+		})
+	}
+
+	var nextStart *string
+	if int64(len(entries)) == count {
+		next := "(" + entries[len(entries)-1].ID // exclusive range
+		nextStart = &next
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"stream":     "message_stream",
+		"group":      "message_group",
+		"entries":    entries,
+		"next_start": nextStart,
+	})
+}
+
+//! Reports whether v is an XPENDING range bound: "-", "+", or a stream ID ("ms" or "ms-seq"),
+// optionally prefixed with "(" to exclude it
+func validStreamBound(v string) bool {
+	if v == "-" || v == "+" {
+		return true
+	}
+	ms, seq, hasSeq := strings.Cut(strings.TrimPrefix(v, "("), "-")
+	if _, err := strconv.ParseUint(ms, 10, 64); err != nil {
+		return false
+	}
+	if hasSeq {
+		if _, err := strconv.ParseUint(seq, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+//! Handles capping message_stream at maxlen entries.
+// Entries message_group hasn't delivered or ACKed yet are never removed: if keeping maxlen
+// entries would drop one of them, the request is refused with 409 and nothing is trimmed.
+func trimStream(c echo.Context) error {
+	var req TrimStreamRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+	if req.MaxLen == nil || *req.MaxLen < 0 {
+		return c.JSON(400, map[string]string{"error": "maxlen must be a non-negative integer"})
+	}
+
+	needed, err := oldestNeededStreamID(c.Request().Context())
+	if err != nil {
+		logFor(c).Error("Failed to find oldest unacknowledged entry", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to trim stream"})
+	}
+
+	trimmed, err := trimStreamScript.Run(c.Request().Context(), redisCli,
+		[]string{"message_stream"}, *req.MaxLen, needed).Int64()
+	if err != nil {
+		logFor(c).Error("Failed to trim stream", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to trim stream"})
+	}
+	if trimmed < 0 {
+		return c.JSON(409, map[string]string{"error": "More than maxlen entries are not yet processed; trimming would lose messages"})
+	}
+
+	length, err := redisCli.XLen(c.Request().Context(), "message_stream").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read stream length", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read stream length"})
+	}
+
+	logFor(c).Info("Stream trimmed", "maxlen", *req.MaxLen, "trimmed", trimmed, "length", length)
+	return c.JSON(200, map[string]int64{"trimmed": trimmed, "length": length})
+}
+
+//! Returns the XRANGE start of the entries message_group still needs: its oldest pending
+// entry (inclusive), or everything after the last delivered entry when nothing is pending.
+// The group is read before XPENDING, so an entry delivered in between is either pending or
+// after the last delivered ID; the answer stays safe to use after further reads and ACKs.
+func oldestNeededStreamID(ctx context.Context) (string, error) {
+	groups, err := redisCli.XInfoGroups(ctx, "message_stream").Result()
+	if err != nil {
+		return "", err
+	}
+	lastDelivered := ""
+	for _, group := range groups {
+		if group.Name == "message_group" {
+			lastDelivered = group.LastDeliveredID
+		}
+	}
+	if lastDelivered == "" {
+		return "", errors.New("consumer group message_group not found")
+	}
+
+	pending, err := redisCli.XPending(ctx, "message_stream", "message_group").Result()
+	if err != nil {
+		return "", err
+	}
+	if pending.Count > 0 {
+		return pending.Lower, nil
+	}
+	return "(" + lastDelivered, nil // exclusive range
+}
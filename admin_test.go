@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+//! Stands in for trimStreamScript: refuses when more than maxlen entries from the start bound on
+// are still needed, otherwise trims to maxlen
+func fakeTrimStream(r *fakeRedis, keys, args []string) string {
+	maxlen, _ := strconv.Atoi(args[0])
+	start, exclusive := strings.CutPrefix(args[1], "(")
+	needed := 0
+	for _, e := range r.streams[keys[0]] {
+		if streamIDLess(start, e.ID) || (!exclusive && e.ID == start) {
+			needed++
+		}
+	}
+	if needed > maxlen {
+		return respInt(-1)
+	}
+	return r.run([]string{"XTRIM", keys[0], "MAXLEN", args[0]})
+}
+
+//! Calls an admin handler with body (empty for none) and decodes its JSON answer into out
+func callAdmin(t *testing.T, handler echo.HandlerFunc, method, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, "/admin/stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	if err := handler(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("handler returned %v", err)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code
+}
+
+func TestAdminStream(t *testing.T) {
+	r := useFakeRedis(t)
+	r.emulate(trimStreamScript, fakeTrimStream)
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for range 5 {
+		id, err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: map[string]interface{}{"content": "hi"}}).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// worker-1 took the first three and has stored one of them
+	if _, err := redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "message_group", Consumer: "worker-1", Streams: []string{"message_stream", ">"}, Count: 3,
+	}).Result(); err != nil {
+		t.Fatal(err)
+	}
+	redisCli.XAck(ctx, "message_stream", "message_group", ids[0])
+
+	var info struct {
+		Length  int64             `json:"length"`
+		Groups  []StreamGroupInfo `json:"groups"`
+		Pending StreamPendingInfo `json:"pending"`
+	}
+	if code := callAdmin(t, getStreamInfo, http.MethodGet, "", &info); code != 200 {
+		t.Fatalf("info: status = %d", code)
+	}
+	if info.Length != 5 {
+		t.Errorf("length = %d, want 5", info.Length)
+	}
+	p := info.Pending
+	if p.Count != 2 || p.OldestID != ids[1] || p.NewestID != ids[2] || p.Consumers["worker-1"] != 2 {
+		t.Errorf("pending = %+v, want 2 entries %s..%s held by worker-1", p, ids[1], ids[2])
+	}
+	if len(info.Groups) != 1 || info.Groups[0].Pending != 2 || info.Groups[0].Lag != 2 {
+		t.Errorf("groups = %+v, want message_group with 2 pending and 2 undelivered", info.Groups)
+	}
+
+	var refused map[string]string
+	if code := callAdmin(t, trimStream, http.MethodPost, `{}`, &refused); code != 400 {
+		t.Errorf("no maxlen: status = %d, want 400", code)
+	}
+	// Keeping 3 would drop the pending ids[1]
+	if code := callAdmin(t, trimStream, http.MethodPost, `{"maxlen": 3}`, &refused); code != 409 {
+		t.Errorf("trim below the pending entries: status = %d, want 409", code)
+	}
+	if got := len(r.entries("message_stream")); got != 5 {
+		t.Fatalf("a refused trim left %d entries, want 5", got)
+	}
+
+	// Once they are stored, the first three can go
+	redisCli.XAck(ctx, "message_stream", "message_group", ids[1], ids[2])
+	var trimmed map[string]int64
+	if code := callAdmin(t, trimStream, http.MethodPost, `{"maxlen": 2}`, &trimmed); code != 200 {
+		t.Fatalf("trim: status = %d (%v)", code, trimmed)
+	}
+	if trimmed["trimmed"] != 3 || trimmed["length"] != 2 {
+		t.Errorf("trim answered %v, want 3 trimmed and length 2", trimmed)
+	}
+	if entries := r.entries("message_stream"); len(entries) != 2 || entries[0].ID != ids[3] {
+		t.Errorf("stream kept %v, want the last two entries", entries)
+	}
+}
+
+// pendingPage is the body of GET /admin/pending
+type pendingPage struct {
+	Entries   []PendingEntry `json:"entries"`
+	NextStart *string        `json:"next_start"`
+}
+
+//! Calls getPendingEntries with query and decodes its answer
+func listPending(t *testing.T, query string) (int, pendingPage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := getPendingEntries(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/admin/pending?"+query, nil), rec)); err != nil {
+		t.Fatalf("getPendingEntries returned %v", err)
+	}
+	var page pendingPage
+	if rec.Code == 200 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, page
+}
+
+func TestAdminPending(t *testing.T) {
+	r := useFakeRedis(t)
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for range 4 {
+		id, err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: map[string]interface{}{"content": "hi"}}).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// worker-1 takes two, worker-2 one; the fourth is never delivered
+	for _, read := range []struct {
+		consumer string
+		count    int64
+	}{{"worker-1", 2}, {"worker-2", 1}} {
+		if _, err := redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "message_group", Consumer: read.consumer, Streams: []string{"message_stream", ">"}, Count: read.count,
+		}).Result(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// worker-2 reclaims ids[0], delivering it a second time, after it sat for ten minutes
+	r.mu.Lock()
+	r.groups["message_stream"]["message_group"].pending[ids[0]].deliveredAt = time.Now().Add(-10 * time.Minute)
+	r.mu.Unlock()
+	if err := redisCli.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream: "message_stream", Group: "message_group", Consumer: "worker-2", MinIdle: 5 * time.Minute, Start: "0-0",
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.groups["message_stream"]["message_group"].pending[ids[0]].deliveredAt = time.Now().Add(-10 * time.Minute)
+	r.mu.Unlock()
+
+	code, page := listPending(t, "")
+	if code != 200 {
+		t.Fatalf("status = %d", code)
+	}
+	want := []struct {
+		id       string
+		consumer string
+		count    int64
+	}{{ids[0], "worker-2", 2}, {ids[1], "worker-1", 1}, {ids[2], "worker-2", 1}}
+	if len(page.Entries) != len(want) {
+		t.Fatalf("entries = %+v, want %d", page.Entries, len(want))
+	}
+	for i, w := range want {
+		e := page.Entries[i]
+		if e.ID != w.id || e.Consumer != w.consumer || e.DeliveryCount != w.count {
+			t.Errorf("entry %d = %+v, want %s held by %s, delivered %d times", i, e, w.id, w.consumer, w.count)
+		}
+	}
+	if idle := page.Entries[0].IdleSeconds; idle < 599 || idle > 660 {
+		t.Errorf("idle_seconds of the reclaimed entry = %v, want about 600", idle)
+	}
+	if idle := page.Entries[1].IdleSeconds; idle > 60 {
+		t.Errorf("idle_seconds of a fresh entry = %v", idle)
+	}
+	if page.NextStart != nil {
+		t.Errorf("next_start = %q on the only page", *page.NextStart)
+	}
+
+	if _, page := listPending(t, "consumer=worker-1"); len(page.Entries) != 1 || page.Entries[0].ID != ids[1] {
+		t.Errorf("consumer=worker-1 listed %+v, want only %s", page.Entries, ids[1])
+	}
+	if _, page := listPending(t, "min_idle=5m"); len(page.Entries) != 1 || page.Entries[0].ID != ids[0] {
+		t.Errorf("min_idle=5m listed %+v, want only %s", page.Entries, ids[0])
+	}
+
+	// Paging one at a time walks the same entries
+	var paged []string
+	query := "count=1"
+	for range len(want) + 1 {
+		_, page := listPending(t, query)
+		for _, e := range page.Entries {
+			paged = append(paged, e.ID)
+		}
+		if page.NextStart == nil {
+			break
+		}
+		query = "count=1&start=" + url.QueryEscape(*page.NextStart)
+	}
+	if strings.Join(paged, ",") != strings.Join(ids[:3], ",") {
+		t.Errorf("paging listed %v, want %v", paged, ids[:3])
+	}
+
+	for _, query := range []string{"count=0", "count=x", "start=abc", "end=1-x", "min_idle=-1s", "min_idle=soon"} {
+		if code, _ := listPending(t, query); code != 400 {
+			t.Errorf("%s: status = %d, want 400", query, code)
+		}
+	}
+}
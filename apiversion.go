@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// API versions selectable with the X-API-Version header.
+//   - 1: the original message shape (no status); send response has only "status"
+//   - 2: adds the message "status" field and the send "timestamp" (default)
+//   - 3: paged message lists are wrapped in a MessagePage envelope
+//
+// The default stays at 2 so clients that never send the header keep getting bare arrays.
+const (
+	minAPIVersion     = 1
+	defaultAPIVersion = 2
+	latestAPIVersion  = 3
+)
+
+// First version with the full message shape (status and everything added since)
+const fullMessageAPIVersion = 2
+
+// First version that wraps paged lists in a MessagePage
+const envelopeAPIVersion = 3
+
+// MessagePage is a page of a message list for version 3 and later clients
+type MessagePage struct {
+	Messages   interface{} `json:"messages"`
+	Count      int         `json:"count"`       // messages in this page, not in the whole list
+	NextCursor *string     `json:"next_cursor"` // pass as ?before= for the next page; null on the last page
+}
+
+// messageV1 is the Message shape served to version 1 clients
+type messageV1 struct {
+	MessageID    string `json:"message_id"`
+	SenderID     string `json:"sender_id"`
+	ReceiverID   string `json:"receiver_id"`
+	Content      string `json:"content"`
+	TimestampStr string `json:"timestamp"`
+	Read         bool   `json:"read"`
+}
+
+//! Reads the API version requested via X-API-Version (defaultAPIVersion when absent)
+func apiVersion(c echo.Context) (int, error) {
+	v := c.Request().Header.Get("X-API-Version")
+	if v == "" {
+		return defaultAPIVersion, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < minAPIVersion || version > latestAPIVersion {
+		return 0, fmt.Errorf("unsupported X-API-Version %q: supported versions are %d to %d", v, minAPIVersion, latestAPIVersion)
+	}
+	return version, nil
+}
+
+//! Shapes messages for the requested API version, dropping fields old clients don't know
+func messagesForVersion(messages []Message, version int) interface{} {
+	// Deleted messages in a list read with ?tombstones=true keep their place as a Tombstone
+	for _, msg := range messages {
+		if msg.DeletedAt != nil {
+			return withTombstones(messages, version)
+		}
+	}
+
+	if version >= fullMessageAPIVersion {
+		return messages
+	}
+
+	shaped := make([]messageV1, 0, len(messages))
+	for _, msg := range messages {
+		shaped = append(shaped, messageV1{
+			MessageID:    msg.MessageID,
+			SenderID:     msg.SenderID,
+			ReceiverID:   msg.ReceiverID,
+			Content:      msg.Content,
+			TimestampStr: msg.TimestampStr,
+			Read:         msg.Read,
+		})
+	}
+	return shaped
+}
+
+//! Shapes messages like messagesForVersion, each deleted one as a Tombstone
+func withTombstones(messages []Message, version int) []interface{} {
+	shaped := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		if msg.DeletedAt != nil {
+			shaped[i] = Tombstone{MessageID: msg.MessageID, Deleted: true, DeletedAt: *msg.DeletedAt}
+		} else {
+			shaped[i] = messageForVersion(msg, version)
+		}
+	}
+	return shaped
+}
+
+//! Shapes a single message for the requested API version
+func messageForVersion(msg Message, version int) interface{} {
+	if version >= fullMessageAPIVersion {
+		return msg
+	}
+	return messagesForVersion([]Message{msg}, version).([]messageV1)[0]
+}
+
+//! Shapes one page of a cursor-paged message list: a bare array before version 3,
+// a MessagePage from then on. nextCursor is empty on the last page.
+func pageForVersion(messages []Message, nextCursor string, version int) interface{} {
+	if version < envelopeAPIVersion {
+		return messagesForVersion(messages, version)
+	}
+
+	if messages == nil {
+		messages = []Message{} // an empty page is [], not null
+	}
+	page := MessagePage{Messages: messagesForVersion(messages, version), Count: len(messages)}
+	if nextCursor != "" {
+		page.NextCursor = &nextCursor
+	}
+	return page
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Encodes v and decodes it back as generic JSON, to check the shape clients see
+func asJSON(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestPageForVersion(t *testing.T) {
+	messages := []Message{
+		{MessageID: "m2", SenderID: "bob", ReceiverID: "alice", Content: "hi", TimestampStr: "2025-03-15T12:01:00Z", Status: "read"},
+		{MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Content: "hey", TimestampStr: "2025-03-15T12:00:00Z", Status: "read"},
+	}
+
+	t.Run("envelope", func(t *testing.T) {
+		page, ok := asJSON(t, pageForVersion(messages, "m1", envelopeAPIVersion)).(map[string]interface{})
+		if !ok {
+			t.Fatalf("version %d page is not an object", envelopeAPIVersion)
+		}
+		if len(page) != 3 || page["count"] != float64(2) || page["next_cursor"] != "m1" {
+			t.Errorf("page = %v, want exactly messages, count 2 and next_cursor m1", page)
+		}
+		if list, ok := page["messages"].([]interface{}); !ok || len(list) != 2 || list[0].(map[string]interface{})["message_id"] != "m2" {
+			t.Errorf("messages = %v, want both messages in order", page["messages"])
+		}
+	})
+
+	t.Run("last page", func(t *testing.T) {
+		page := asJSON(t, pageForVersion(messages[1:], "", envelopeAPIVersion)).(map[string]interface{})
+		if cursor, ok := page["next_cursor"]; !ok || cursor != nil {
+			t.Errorf("next_cursor = %v (present %v), want null", cursor, ok)
+		}
+	})
+
+	t.Run("empty page", func(t *testing.T) {
+		want := map[string]interface{}{"messages": []interface{}{}, "count": float64(0), "next_cursor": nil}
+		if page := asJSON(t, pageForVersion(nil, "", envelopeAPIVersion)); !reflect.DeepEqual(page, want) {
+			t.Errorf("page = %v, want %v", page, want)
+		}
+	})
+
+	// Older clients keep the bare array, version 1 without the fields added since
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			list, ok := asJSON(t, pageForVersion(messages, "m1", version)).([]interface{})
+			if !ok || len(list) != 2 {
+				t.Fatalf("version %d page is not an array of both messages", version)
+			}
+			if _, hasStatus := list[0].(map[string]interface{})["status"]; hasStatus != (version >= fullMessageAPIVersion) {
+				t.Errorf("version %d message has status: %v", version, hasStatus)
+			}
+		})
+	}
+}
+
+func TestGetMessagesEnvelope(t *testing.T) {
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	var rows [][]interface{}
+	for i := 3; i >= 1; i-- {
+		rows = append(rows, messageRecord(Message{MessageID: fmt.Sprintf("m%d", i), SenderID: "alice", ReceiverID: "bob",
+			Content: "hi", Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1, Seq: int64(i)}))
+	}
+	f.on("ORDER BY "+newestFirst, pgRule{Rows: rows})
+
+	get := func(version string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/messages?user1=alice&user2=bob&limit=2", nil)
+		if version != "" {
+			req.Header.Set("X-API-Version", version)
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set(authUserKey, "alice")
+		if err := getMessages(c); err != nil {
+			t.Fatalf("getMessages returned %v", err)
+		}
+		return rec
+	}
+
+	// Three rows for a limit of 2: a full page and a cursor
+	var page struct {
+		Messages   []Message `json:"messages"`
+		Count      int       `json:"count"`
+		NextCursor *string   `json:"next_cursor"`
+	}
+	rec := get("3")
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("version 3 body %s is not an envelope: %v", rec.Body.String(), err)
+	}
+	if page.Count != 2 || len(page.Messages) != 2 || page.NextCursor == nil || *page.NextCursor != "m2" {
+		t.Errorf("envelope = %+v, want 2 messages and next_cursor m2", page)
+	}
+
+	// Without the header the body stays a bare array; the cursor is still in X-Next-Cursor
+	rec = get("")
+	var bare []Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &bare); err != nil || len(bare) != 2 {
+		t.Errorf("default body %s, want a bare array of 2", rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Next-Cursor"); got != "m2" {
+		t.Errorf("X-Next-Cursor = %q, want m2", got)
+	}
+
+	if rec := get("4"); rec.Code != 400 {
+		t.Errorf("X-API-Version 4: status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// BlobStore holds attachment bytes, keyed by attachment ID.
+// localBlobStore is the built-in implementation; an S3-backed store only needs these methods.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Attachment is the metadata stored for an uploaded file
+type Attachment struct {
+	AttachmentID string    `json:"attachment_id"`
+	OwnerID      string    `json:"owner_id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Attachment storage and limits, configured with ATTACHMENT_DIR and ATTACHMENT_MAX_BYTES
+var (
+	blobStore         BlobStore
+	attachmentDir           = "./attachments"
+	maxAttachmentSize int64 = 10 << 20 // 10 MiB
+)
+
+// Content types accepted for upload. The type is sniffed from the file's bytes,
+// not taken from the client's Content-Type header.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+//! Stores blobs as files in a directory (one file per attachment ID)
+type localBlobStore struct {
+	dir string
+}
+
+func (s localBlobStore) Put(_ context.Context, key string, r io.Reader) error {
+	f, err := os.Create(filepath.Join(s.dir, key))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+func (s localBlobStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, key))
+}
+
+func (s localBlobStore) Delete(_ context.Context, key string) error {
+	return os.Remove(filepath.Join(s.dir, key))
+}
+
+//! Reads the attachment settings and sets up the local blob store
+func loadBlobStore() error {
+	if v := os.Getenv("ATTACHMENT_DIR"); v != "" {
+		attachmentDir = v
+	}
+	maxAttachmentSize = envInt64("ATTACHMENT_MAX_BYTES", maxAttachmentSize)
+
+	if err := os.MkdirAll(attachmentDir, 0o750); err != nil {
+		return err
+	}
+	blobStore = localBlobStore{dir: attachmentDir}
+	return nil
+}
+
+//! Handles uploading an attachment (multipart form field "file")
+func uploadAttachment(c echo.Context) error {
+	owner := authUserID(c)
+
+	// Cap the whole body so an oversized upload is cut off instead of buffered to disk.
+	// The extra 1 MiB leaves room for the multipart headers.
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxAttachmentSize+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.JSON(413, map[string]string{"error": "Attachment is too large"})
+		}
+		return c.JSON(400, map[string]string{"error": "Expected a multipart upload with a \"file\" field"})
+	}
+	if fileHeader.Size > maxAttachmentSize {
+		return c.JSON(413, map[string]string{"error": "Attachment is too large"})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": "Failed to read upload"})
+	}
+	defer file.Close()
+
+	// Sniff the real type from the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return c.JSON(400, map[string]string{"error": "Failed to read upload"})
+	}
+	head = head[:n]
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !allowedAttachmentTypes[contentType] {
+		return c.JSON(415, map[string]string{"error": "Attachment type " + contentType + " is not allowed"})
+	}
+
+	attachment := Attachment{
+		AttachmentID: uuid.New().String(),
+		OwnerID:      owner,
+		Filename:     filepath.Base(fileHeader.Filename),
+		ContentType:  contentType,
+		Size:         fileHeader.Size,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	if err := blobStore.Put(c.Request().Context(), attachment.AttachmentID, io.MultiReader(bytes.NewReader(head), file)); err != nil {
+		logFor(c).Error("Failed to store attachment", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to store attachment"})
+	}
+
+	_, err = pool.Exec(c.Request().Context(),
+		`INSERT INTO attachments (attachment_id, owner_id, filename, content_type, size, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		attachment.AttachmentID, attachment.OwnerID, attachment.Filename, attachment.ContentType, attachment.Size, attachment.CreatedAt)
+	if err != nil {
+		logFor(c).Error("Failed to save attachment metadata", "error", err, "attachment_id", attachment.AttachmentID)
+		// Don't leave an orphaned blob behind
+		if delErr := blobStore.Delete(context.Background(), attachment.AttachmentID); delErr != nil {
+			logFor(c).Error("Failed to remove orphaned attachment", "error", delErr, "attachment_id", attachment.AttachmentID)
+		}
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to store attachment"})
+	}
+
+	logFor(c).Info("Attachment uploaded", "attachment_id", attachment.AttachmentID, "sender_id", owner, "size", attachment.Size)
+	return c.JSON(201, attachment)
+}
+
+//! Reports whether the attachment exists and whether it belongs to userID
+func attachmentOwnedBy(ctx context.Context, attachmentID, userID string) (exists, owned bool, err error) {
+	var owner string
+	err = pool.QueryRow(ctx, `SELECT owner_id FROM attachments WHERE attachment_id = $1`, attachmentID).Scan(&owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, owner == userID, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The first bytes of a PNG file, enough for content sniffing
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+//! Stores blobs in a temporary directory and caps uploads at maxSize for the rest of the test
+func useBlobStore(t *testing.T, maxSize int64) string {
+	dir := t.TempDir()
+	oldStore, oldMax := blobStore, maxAttachmentSize
+	blobStore, maxAttachmentSize = localBlobStore{dir: dir}, maxSize
+	t.Cleanup(func() { blobStore, maxAttachmentSize = oldStore, oldMax })
+	return dir
+}
+
+//! Uploads data as the "file" field of a multipart form, as user
+func upload(t *testing.T, user, filename string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/attachments", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, user)
+	if err := uploadAttachment(c); err != nil {
+		t.Fatalf("uploadAttachment returned %v", err)
+	}
+	return rec
+}
+
+func TestUploadAttachment(t *testing.T) {
+	t.Run("stored", func(t *testing.T) {
+		f := useFakePG(t)
+		f.on("INSERT INTO attachments", pgRule{Tag: "INSERT 0 1"})
+		dir := useBlobStore(t, 1024)
+
+		rec := upload(t, aliceID, "../../cat.png", pngHeader)
+		if rec.Code != 201 {
+			t.Fatalf("status = %d, want 201 (body %s)", rec.Code, rec.Body.String())
+		}
+		var got Attachment
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding body: %v", err)
+		}
+		// The path is dropped from the name and the type comes from the bytes
+		if !isUUID(got.AttachmentID) || got.OwnerID != aliceID || got.Filename != "cat.png" ||
+			got.ContentType != "image/png" || got.Size != int64(len(pngHeader)) {
+			t.Errorf("attachment = %+v", got)
+		}
+		stored, err := os.ReadFile(filepath.Join(dir, got.AttachmentID))
+		if err != nil || !bytes.Equal(stored, pngHeader) {
+			t.Errorf("stored blob = %q, %v; want the uploaded bytes", stored, err)
+		}
+		if len(f.queriesContaining("'"+got.AttachmentID+"'")) != 1 {
+			t.Errorf("metadata not saved: %q", f.queriesContaining("INSERT"))
+		}
+	})
+
+	tests := []struct {
+		name       string
+		filename   string
+		data       []byte
+		wantStatus int
+	}{
+		{"over the size limit", "notes.txt", bytes.Repeat([]byte("a"), 65), 413},
+		// Cut off while reading, before the form is parsed
+		{"far over the size limit", "notes.txt", bytes.Repeat([]byte("a"), 2<<20), 413},
+		{"disallowed type", "page.png", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), 415},
+		{"executable", "run.pdf", []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00"), 415},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakePG(t) // no rules: nothing may be saved
+			dir := useBlobStore(t, 64)
+
+			rec := upload(t, aliceID, tt.filename, tt.data)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if files, _ := os.ReadDir(dir); len(files) != 0 {
+				t.Errorf("%d blobs stored for a rejected upload", len(files))
+			}
+		})
+	}
+}
+
+func TestSendChecksAttachmentOwner(t *testing.T) {
+	const attachmentID = "5d9e3c1a-7b2f-4e6d-8a1c-0f9e8d7c6b5a"
+	tests := []struct {
+		name       string
+		owner      string // "" when the attachment doesn't exist
+		wantStatus int
+	}{
+		{"own attachment", aliceID, 200},
+		{"someone else's", bobID, 403},
+		{"unknown", "", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := useSendFakes(t)
+			if tt.owner != "" {
+				f.on("FROM attachments", pgRule{Rows: [][]interface{}{{tt.owner}}})
+			} else {
+				f.on("FROM attachments", pgRule{Rows: [][]interface{}{}, Cols: 1})
+			}
+
+			rec := postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "look", "attachment_id": "`+attachmentID+`"}`, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			// The stream entry carries the reference for the worker to store
+			entries := r.entries("message_stream")
+			if queued := len(entries) == 1 && entries[0].Values["attachment_id"] == attachmentID; queued != (tt.wantStatus == 200) {
+				t.Errorf("stream entries = %v", entries)
+			}
+		})
+	}
+}
+
+func TestParseStreamMessageAttachment(t *testing.T) {
+	values := validStreamEntry()
+	values["attachment_id"] = "5d9e3c1a-7b2f-4e6d-8a1c-0f9e8d7c6b5a"
+	msg, err := parseStreamMessage(values)
+	if err != nil || msg.AttachmentID != values["attachment_id"] {
+		t.Errorf("parseStreamMessage() = %+v, %v; want the attachment ID kept", msg, err)
+	}
+	if !strings.Contains(primaryStatements[stmtInsertMessage], "attachment_id") {
+		t.Error("the worker's insert doesn't store attachment_id")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Secret used to verify HS256 tokens, read from JWT_SECRET at startup
+var jwtSecret []byte
+
+// Echo context keys holding the authenticated user ID and role
+const (
+	authUserKey = "auth_user_id"
+	authRoleKey = "auth_role"
+)
+
+// Value of the token's "role" claim that grants access to the /admin endpoints
+const adminRole = "admin"
+
+//! Reads the JWT signing secret from the environment
+func loadJWTSecret() error {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return errors.New("JWT_SECRET is not set")
+	}
+	jwtSecret = []byte(secret)
+	return nil
+}
+
+//! Middleware that requires a valid "Authorization: Bearer <JWT>" header.
+// The token's "sub" claim becomes the authenticated user ID for the request,
+// and its optional "role" claim the user's role.
+func requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get("Authorization")
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || tokenString == "" {
+			return c.JSON(401, map[string]string{"error": "Missing bearer token"})
+		}
+
+		// Only accept HMAC-signed tokens; exp/nbf are validated by the parser
+		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+			return jwtSecret, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		if err != nil {
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				return c.JSON(401, map[string]string{"error": "Token expired"})
+			}
+			return c.JSON(401, map[string]string{"error": "Invalid token"})
+		}
+
+		subject, err := token.Claims.GetSubject()
+		userID := normalizeUserID(subject)
+		if err != nil || userID == "" {
+			return c.JSON(401, map[string]string{"error": "Token has no subject"})
+		}
+
+		// Tokens without a role are ordinary users
+		var role string
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			role, _ = claims["role"].(string)
+		}
+
+		c.Set(authUserKey, userID)
+		c.Set(authRoleKey, role)
+		return next(c)
+	}
+}
+
+//! Returns the user ID authenticated by requireAuth
+func authUserID(c echo.Context) string {
+	userID, _ := c.Get(authUserKey).(string)
+	return userID
+}
+
+//! Reports whether the token authenticated by requireAuth has the admin role
+func isAdmin(c echo.Context) bool {
+	role, _ := c.Get(authRoleKey).(string)
+	return role == adminRole
+}
+
+//! Middleware that only lets through tokens with the admin role. Must run after requireAuth.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isAdmin(c) {
+			return c.JSON(403, map[string]string{"error": "Admin role required"})
+		}
+		return next(c)
+	}
+}
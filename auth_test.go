@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+//! Sets the JWT secret for the rest of the test
+func useJWTSecret(t *testing.T, secret string) {
+	old := jwtSecret
+	jwtSecret = []byte(secret)
+	t.Cleanup(func() { jwtSecret = old })
+}
+
+//! Returns claims signed with method and key
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+func TestRequireAuth(t *testing.T) {
+	useJWTSecret(t, "test-secret")
+	secret := []byte("test-secret")
+	valid := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name      string
+		header    string
+		wantError string
+	}{
+		{"missing header", "", "Missing bearer token"},
+		{"not a bearer token", "Basic " + signToken(t, jwt.SigningMethodHS256, secret, valid), "Missing bearer token"},
+		{"bad signature", "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte("other-secret"), valid), "Invalid token"},
+		{"expired", "Bearer " + signToken(t, jwt.SigningMethodHS256, secret,
+			jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()}), "Token expired"},
+		{"no subject", "Bearer " + signToken(t, jwt.SigningMethodHS256, secret,
+			jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}), "Token has no subject"},
+		// Only HS256 is accepted, even when the signature checks out with the same secret
+		{"other HMAC algorithm", "Bearer " + signToken(t, jwt.SigningMethodHS512, secret, valid), "Invalid token"},
+		{"unsigned", "Bearer " + signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), "Invalid token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			called := false
+			err := requireAuth(func(echo.Context) error { called = true; return nil })(c)
+			if err != nil {
+				t.Fatalf("requireAuth returned %v", err)
+			}
+			if called {
+				t.Error("the handler ran")
+			}
+			if rec.Code != 401 {
+				t.Errorf("status = %d, want 401", rec.Code)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+			}
+			if body["error"] != tt.wantError {
+				t.Errorf("error = %q, want %q", body["error"], tt.wantError)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+		req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, secret,
+			jwt.MapClaims{"sub": " alice ", "role": adminRole, "exp": time.Now().Add(time.Hour).Unix()}))
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		var userID string
+		var admin bool
+		err := requireAuth(func(c echo.Context) error {
+			userID, admin = authUserID(c), isAdmin(c)
+			return nil
+		})(c)
+		if err != nil {
+			t.Fatalf("requireAuth returned %v", err)
+		}
+		// The subject is normalized like every other user ID
+		if userID != "alice" || !admin {
+			t.Errorf("authUserID = %q, isAdmin = %v; want %q, true", userID, admin, "alice")
+		}
+	})
+}
+
+func TestMessageEndpointsCheckTheCaller(t *testing.T) {
+	f := useFakePG(t)
+	f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{messageRecord(Message{
+		MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Content: "Hello!",
+		Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1, Seq: 1,
+	})}})
+
+	// mallory is neither side of the alice -> bob message
+	handlers := []struct {
+		name    string
+		method  string
+		handler echo.HandlerFunc
+	}{
+		{"read", http.MethodPatch, markMessageAsRead},
+		{"delivered", http.MethodPut, markMessageAsDelivered},
+		{"delete for everyone", http.MethodDelete, deleteMessage},
+	}
+	for _, h := range handlers {
+		t.Run(h.name, func(t *testing.T) {
+			c, rec := messageContext(h.method, "m1", "mallory")
+			if err := h.handler(c); err != nil {
+				t.Fatalf("handler returned %v", err)
+			}
+			if rec.Code != 403 {
+				t.Errorf("status = %d, want 403 (body %s)", rec.Code, rec.Body.String())
+			}
+		})
+	}
+	if got := f.queriesContaining("UPDATE"); len(got) != 0 {
+		t.Errorf("the message was changed: %q", got)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Most messages one POST /messages/batch may carry
+const maxBatchSize = 100
+
+// BatchItemResult is the outcome of one message in POST /messages/batch
+type BatchItemResult struct {
+	Index     int    `json:"index"`
+	Status    int    `json:"status"` // what POST /messages would have answered for this message
+	MessageID string `json:"message_id,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//! Handles sending several messages in one request (e.g. broadcasting to several receivers).
+// Each message is validated like POST /messages; the valid ones are queued with one pipelined
+// round trip to Redis. Answers 200 when every message was queued, 207 with per-item results otherwise.
+func sendMessageBatch(c echo.Context) error {
+	var batch []Message
+	if err := c.Bind(&batch); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input: expected a JSON array of messages"})
+	}
+	if len(batch) == 0 {
+		return c.JSON(400, map[string]string{"error": "Batch is empty"})
+	}
+	if len(batch) > maxBatchSize {
+		return c.JSON(400, map[string]string{"error": "Batch is too large"})
+	}
+
+	ctx := c.Request().Context()
+	sender := authUserID(c)
+	sendTime := time.Now().UTC()
+	sentAt := sendTime.Format(streamTimeFormat)
+
+	type pendingItem struct {
+		index  int
+		id     string
+		values map[string]interface{}
+	}
+	var pending []pendingItem
+
+	results := make([]BatchItemResult, len(batch))
+	for i := range batch {
+		msg := &batch[i]
+		results[i].Index = i
+		reject := func(status int, reason string) {
+			results[i].Status = status
+			results[i].Error = reason
+		}
+
+		msg.SenderID = sender
+		msg.ReceiverID = normalizeUserID(msg.ReceiverID)
+
+		if msg.SendAt != nil {
+			reject(400, "send_at is not supported in batches")
+			continue
+		}
+		if msg.ExpiresInSeconds < 0 {
+			reject(400, "expires_in_seconds must be positive")
+			continue
+		}
+
+		status, reason, err := validateOutgoing(ctx, msg)
+		if err != nil {
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			logFor(c).Error("Failed to validate message", "error", err, "index", i)
+			reject(500, "Failed to validate message")
+			continue
+		}
+		if status != 0 {
+			reject(status, reason)
+			continue
+		}
+
+		// Every message counts towards the sender's limit, as if sent one by one
+		allowed, _, err := allowSend(ctx, sender)
+		if err != nil {
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			logFor(c).Error("Failed to check send rate limit", "error", err, "sender_id", sender)
+			reject(500, "Failed to check rate limit")
+			continue
+		}
+		if !allowed {
+			reject(429, "Rate limit exceeded")
+			continue
+		}
+
+		// message_id works as a per-message idempotency key, as in POST /messages
+		id := msg.MessageID
+		if id == "" {
+			id = uuid.New().String()
+		} else if !isUUID(id) {
+			reject(400, "message_id must be a UUID")
+			continue
+		}
+
+		claimed, original, err := claimMessageID(ctx, id, idempotencyRecord{SenderID: sender, Timestamp: sentAt})
+		if err != nil {
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			logFor(c).Error("Failed to check idempotency key", "error", err, "message_id", id)
+			reject(500, "Failed to check idempotency key")
+			continue
+		}
+		if !claimed {
+			if original.SenderID != sender {
+				reject(409, "message_id is already in use")
+				continue
+			}
+			results[i] = BatchItemResult{Index: i, Status: 200, MessageID: id, Timestamp: original.Timestamp}
+			continue
+		}
+
+		expiresAt := ""
+		if msg.ExpiresInSeconds > 0 {
+			expiresAt = sendTime.Add(time.Duration(msg.ExpiresInSeconds) * time.Second).Format(streamTimeFormat)
+		}
+		pending = append(pending, pendingItem{index: i, id: id, values: messageValues(msg, id, sentAt, expiresAt)})
+	}
+
+	// One round trip numbers every valid message in its conversation (in request order),
+	// a second queues them; failures are reported per message
+	if len(pending) > 0 {
+		seqPipe := redisCli.Pipeline()
+		seqs := make([]*redis.IntCmd, len(pending))
+		for j, item := range pending {
+			conversationID, _ := item.values["conversation_id"].(string)
+			senderID, _ := item.values["sender_id"].(string)
+			receiverID, _ := item.values["receiver_id"].(string)
+			seqs[j] = seqPipe.Incr(ctx, sequenceKey(conversationID, senderID, receiverID))
+		}
+		seqPipe.Exec(ctx) // errors are also recorded on each command
+
+		pipe := redisCli.Pipeline()
+		cmds := make([]*redis.StringCmd, len(pending))
+		for j, item := range pending {
+			seq, err := seqs[j].Result()
+			if err != nil {
+				cmds[j] = redis.NewStringResult("", err)
+				continue
+			}
+			item.values["seq"] = seq
+			cmds[j] = pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: "message_stream",
+				Values: item.values,
+			})
+		}
+		pipe.Exec(ctx) // errors are also recorded on each command
+
+		for j, item := range pending {
+			if err := cmds[j].Err(); err != nil {
+				releaseMessageID(context.Background(), item.id) // the request context may already be done
+				logFor(c).Error("Failed to add message to stream", "error", err, "message_id", item.id)
+				results[item.index].Status = 500
+				results[item.index].Error = "Failed to add message to stream"
+				continue
+			}
+			messagesQueued.Inc()
+			results[item.index] = BatchItemResult{Index: item.index, Status: 200, MessageID: item.id, Timestamp: sentAt}
+		}
+	}
+
+	queued := 0
+	for _, r := range results {
+		if r.Status == 200 {
+			queued++
+		}
+	}
+	logFor(c).Info("Message batch processed", "sender_id", sender, "size", len(batch), "queued", queued)
+
+	status := 200
+	if queued < len(batch) {
+		status = 207
+	}
+	return c.JSON(status, map[string]interface{}{"results": results})
+}
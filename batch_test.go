@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Sends body as POST /messages/batch from sender; returns the status and the per-item results
+func postBatch(t *testing.T, sender, body string) (int, []BatchItemResult) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/messages/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, sender)
+	if err := sendMessageBatch(c); err != nil {
+		t.Fatalf("sendMessageBatch returned %v", err)
+	}
+	var out struct {
+		Results []BatchItemResult `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, out.Results
+}
+
+func TestSendMessageBatch(t *testing.T) {
+	t.Run("mixed", func(t *testing.T) {
+		_, r := useSendFakes(t)
+		status, results := postBatch(t, aliceID, `[
+			{"receiver_id": "`+bobID+`", "content": "one"},
+			{"content": "nobody to send it to"},
+			{"receiver_id": "`+bobID+`", "content": "   "},
+			{"receiver_id": "`+bobID+`", "content": "later", "send_at": "2099-01-01T00:00:00Z"},
+			{"receiver_id": "`+carolID+`", "content": "two"},
+			{"receiver_id": "`+bobID+`", "content": "three", "message_id": "not-a-uuid"}
+		]`)
+		if status != 207 {
+			t.Errorf("status = %d, want 207", status)
+		}
+		wantStatuses := []int{200, 400, 400, 400, 200, 400}
+		if len(results) != len(wantStatuses) {
+			t.Fatalf("%d results, want %d: %+v", len(results), len(wantStatuses), results)
+		}
+		for i, res := range results {
+			if res.Index != i || res.Status != wantStatuses[i] {
+				t.Errorf("result %d = %+v, want index %d status %d", i, res, i, wantStatuses[i])
+			}
+			if (res.Status == 200) != (res.MessageID != "" && res.Error == "") {
+				t.Errorf("result %d = %+v: a queued item has a message_id, a rejected one an error", i, res)
+			}
+		}
+
+		// Only the valid ones are queued, in request order, under the IDs reported back
+		entries := r.entries("message_stream")
+		if len(entries) != 2 {
+			t.Fatalf("%d stream entries, want 2", len(entries))
+		}
+		for j, i := range []int{0, 4} {
+			if entries[j].Values["message_id"] != results[i].MessageID {
+				t.Errorf("entry %d is %v, want item %d's %s", j, entries[j].Values["message_id"], i, results[i].MessageID)
+			}
+		}
+		if entries[0].Values["content"] != "one" || entries[1].Values["content"] != "two" {
+			t.Errorf("queued %v and %v, want one then two", entries[0].Values["content"], entries[1].Values["content"])
+		}
+	})
+
+	t.Run("all valid", func(t *testing.T) {
+		useSendFakes(t)
+		status, results := postBatch(t, aliceID, `[{"receiver_id": "`+bobID+`", "content": "a"}, {"receiver_id": "`+carolID+`", "content": "b"}]`)
+		if status != 200 || len(results) != 2 || results[0].Status != 200 || results[1].Status != 200 {
+			t.Errorf("status = %d, results %+v; want 200 with both queued", status, results)
+		}
+	})
+
+	t.Run("queueing fails", func(t *testing.T) {
+		_, r := useSendFakes(t)
+		r.fail("XADD")
+		const key = "5e2d8c1a-7b3f-4a6e-9d0c-1f2e3a4b5c6d"
+		status, results := postBatch(t, aliceID, `[{"receiver_id": "`+bobID+`", "content": "a", "message_id": "`+key+`"}]`)
+		if status != 207 || results[0].Status != 500 {
+			t.Errorf("status = %d, results %+v; want 207 with the item failed", status, results)
+		}
+		// The key is released, so retrying the same message works
+		r.restore("XADD")
+		if status, results := postBatch(t, aliceID, `[{"receiver_id": "`+bobID+`", "content": "a", "message_id": "`+key+`"}]`); status != 200 || results[0].MessageID != key {
+			t.Errorf("retry: status = %d, results %+v; want it queued as %s", status, results, key)
+		}
+	})
+
+	tooMany := "[" + strings.Repeat(`{"receiver_id": "`+bobID+`", "content": "x"},`, maxBatchSize) + `{"receiver_id": "` + bobID + `", "content": "x"}]`
+	refused := []struct{ name, body string }{
+		{"empty", "[]"},
+		{"not an array", `{"receiver_id": "` + bobID + `", "content": "x"}`},
+		{fmt.Sprintf("over %d", maxBatchSize), tooMany},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			_, r := useSendFakes(t)
+			if status, _ := postBatch(t, aliceID, tt.body); status != 400 {
+				t.Errorf("status = %d, want 400", status)
+			}
+			if n := len(r.entries("message_stream")); n != 0 {
+				t.Errorf("%d entries queued, want none", n)
+			}
+		})
+	}
+}
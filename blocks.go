@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Request body for POST /blocks
+type blockRequest struct {
+	UserID string `json:"user_id"`
+}
+
+//! Handles blocking a user: they can no longer send the caller 1-to-1 messages
+func blockUser(c echo.Context) error {
+	var req blockRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+
+	me := authUserID(c)
+	blocked := normalizeUserID(req.UserID)
+	if blocked == "" {
+		return c.JSON(400, map[string]string{"error": "user_id is required"})
+	}
+	if blocked == me {
+		return c.JSON(400, map[string]string{"error": "Cannot block yourself"})
+	}
+
+	// Blocking twice is a no-op, so retries are safe
+	_, err := pool.Exec(c.Request().Context(),
+		`INSERT INTO blocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, now()) ON CONFLICT (blocker_id, blocked_id) DO NOTHING`,
+		me, blocked)
+	if err != nil {
+		logFor(c).Error("Failed to block user", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to block user"})
+	}
+
+	logFor(c).Info("User blocked", "blocker_id", me, "blocked_id", blocked)
+	return c.JSON(201, map[string]string{"status": "User blocked", "user_id": blocked})
+}
+
+//! Handles unblocking a user
+func unblockUser(c echo.Context) error {
+	me := authUserID(c)
+	blocked := normalizeUserID(c.Param("userID"))
+
+	result, err := pool.Exec(c.Request().Context(),
+		`DELETE FROM blocks WHERE blocker_id = $1 AND blocked_id = $2`, me, blocked)
+	if err != nil {
+		logFor(c).Error("Failed to unblock user", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to unblock user"})
+	}
+	if result.RowsAffected() == 0 {
+		return c.JSON(404, map[string]string{"error": "User is not blocked"})
+	}
+
+	logFor(c).Info("User unblocked", "blocker_id", me, "blocked_id", blocked)
+	return c.JSON(200, map[string]string{"status": "User unblocked", "user_id": blocked})
+}
+
+//! Reports whether receiverID has blocked senderID
+func isBlocked(ctx context.Context, receiverID, senderID string) (bool, error) {
+	var blocked bool
+	err := pool.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM blocks WHERE blocker_id = $1 AND blocked_id = $2)",
+		receiverID, senderID).Scan(&blocked)
+	return blocked, err
+}
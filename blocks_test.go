@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestBlockedSenderCantSend(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	blocked := false // whether bob has blocked alice
+	f.on("INSERT INTO blocks", pgRule{Tag: "INSERT 0 1", Answer: func(string) [][]interface{} { blocked = true; return nil }})
+	f.on("DELETE FROM blocks", pgRule{Tag: "DELETE 1", Answer: func(string) [][]interface{} { blocked = false; return nil }})
+	f.on("FROM blocks", pgRule{Answer: func(string) [][]interface{} { return [][]interface{}{{blocked}} }})
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 1"})
+	send := func() *httptest.ResponseRecorder {
+		return postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "hi"}`, nil)
+	}
+	asBob := func(method, target, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set(authUserKey, bobID)
+		return c, rec
+	}
+
+	// Queued before the block
+	if rec := send(); rec.Code != 200 {
+		t.Fatalf("send before the block: status = %d (body %s)", rec.Code, rec.Body.String())
+	}
+
+	c, rec := asBob(http.MethodPost, "/blocks", `{"user_id": "`+aliceID+`"}`)
+	if err := blockUser(c); err != nil || rec.Code != 201 {
+		t.Fatalf("block = %v, %d %s", err, rec.Code, rec.Body.String())
+	}
+	if rec := send(); rec.Code != 403 || !strings.Contains(rec.Body.String(), "You cannot message this user") {
+		t.Errorf("send while blocked = %d %s, want 403", rec.Code, rec.Body.String())
+	}
+	if got := len(r.entries("message_stream")); got != 1 {
+		t.Errorf("%d messages queued, want only the one from before the block", got)
+	}
+
+	// The worker doesn't check blocks: what was queued before still arrives
+	if _, ok := processMessage(r.entries("message_stream")[0]); !ok {
+		t.Error("the message queued before the block was not delivered")
+	}
+
+	c, rec = asBob(http.MethodDelete, "/blocks/"+aliceID, "")
+	c.SetParamNames("userID")
+	c.SetParamValues(aliceID)
+	if err := unblockUser(c); err != nil || rec.Code != 200 {
+		t.Fatalf("unblock = %v, %d %s", err, rec.Code, rec.Body.String())
+	}
+	if rec := send(); rec.Code != 200 {
+		t.Errorf("send after unblocking: status = %d (body %s)", rec.Code, rec.Body.String())
+	}
+	if got := len(r.entries("message_stream")); got != 2 {
+		t.Errorf("%d messages queued, want 2", got)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// When a message last changed: changed_at, or its send time for rows stored before changed_at
+// existed. A disappearing message also changes when it expires, before the sweeper deletes it.
+const changedAtColumn = "GREATEST(COALESCE(changed_at, timestamp), CASE WHEN expires_at <= now() THEN expires_at END)"
+
+//! Reads ?changed_since, an RFC3339 time: a list then returns only the messages sent or changed
+// after it, with the deleted ones as tombstones. nil when absent.
+func parseChangedSince(c echo.Context) (*time.Time, error) {
+	v := c.QueryParam("changed_since")
+	if v == "" {
+		return nil, nil
+	}
+	since, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return nil, errors.New("changed_since must be an RFC3339 timestamp")
+	}
+	return &since, nil
+}
+
+//! Builds the SQL condition for ?changed_since, binding the time to $placeholder.
+// No time matches every row, like beforeCondition.
+func changedSinceCondition(since *time.Time, placeholder int) (string, interface{}) {
+	if since == nil {
+		return "TRUE", nil
+	}
+	return fmt.Sprintf("%s > $%d", changedAtColumn, placeholder), *since
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChangedSince(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string // RFC3339Nano in UTC, empty for nil
+		wantErr bool
+	}{
+		{"", "", false},
+		{"2025-03-15T12:00:00Z", "2025-03-15T12:00:00Z", false},
+		{"2025-03-15T13:00:00.5+01:00", "2025-03-15T12:00:00.5Z", false},
+		{"2025-03-15", "", true},
+		{"yesterday", "", true},
+	}
+	for _, tt := range tests {
+		c, _ := messageContext(http.MethodGet, "", "alice")
+		c.QueryParams().Set("changed_since", tt.in)
+		since, err := parseChangedSince(c)
+		got := ""
+		if since != nil {
+			got = since.UTC().Format(time.RFC3339Nano)
+		}
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseChangedSince(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGetMessagesChangedSince(t *testing.T) {
+	deletedAt := time.Date(2025, 3, 15, 12, 30, 0, 0, time.UTC)
+	record := func(id string, deleted *time.Time) []interface{} {
+		return append(messageRecord(Message{MessageID: id, SenderID: "alice", ReceiverID: "bob", Content: "edited",
+			Timestamp: time.Now(), Status: "read", ContentType: defaultContentType, Version: 3}), deleted)
+	}
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	f.on(changedAtColumn, pgRule{Rows: [][]interface{}{record("changed", nil), record("gone", &deletedAt)}})
+
+	// Deleted messages come back as tombstones without asking for them
+	code, page := historyWithTombstones(t, "changed_since=2025-03-15T12:00:00Z&before=m9")
+	if code != 200 || len(page) != 2 {
+		t.Fatalf("status = %d, page = %v; want 200 and 2 entries", code, page)
+	}
+	if page[0]["message_id"] != "changed" || page[0]["content"] != "edited" {
+		t.Errorf("changed message = %v", page[0])
+	}
+	if page[1]["message_id"] != "gone" || page[1]["deleted"] != true {
+		t.Errorf("deleted message = %v, want a tombstone", page[1])
+	}
+
+	queries := f.queriesContaining(changedAtColumn)
+	if len(queries) != 1 {
+		t.Fatalf("%d queries filter by change time, want 1", len(queries))
+	}
+	// The paging cursor still applies, bound after the change time
+	for _, want := range []string{tombstoneColumn, "2025-03-15 12:00:00Z", "message_id =  'm9'"} {
+		if !strings.Contains(queries[0], want) {
+			t.Errorf("query lacks %q: %s", want, queries[0])
+		}
+	}
+
+	if code, _ := historyWithTombstones(t, "changed_since=yesterday"); code != 400 {
+		t.Errorf("changed_since=yesterday: status = %d, want 400", code)
+	}
+}
+
+// changed_at is set by the UPDATE statements themselves, so this runs against a real database only
+func TestChangedSince(t *testing.T) {
+	useTestDB(t)
+	useFakeRedis(t) // deletion events
+	sent := time.Now().Add(-time.Minute).UTC()
+	for i, id := range []string{"same", "delivered", "deleted"} {
+		insertTestMessage(t, Message{MessageID: id, SenderID: "alice", ReceiverID: "bob", Content: "hi",
+			Timestamp: sent.Add(time.Duration(i) * time.Second), Status: "sent", ContentType: defaultContentType})
+	}
+
+	// The database's clock, which changed_at is taken from
+	var watermark time.Time
+	if err := pool.QueryRow(t.Context(), "SELECT clock_timestamp()").Scan(&watermark); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := updateMessageStatus(t.Context(), "delivered", "delivered", nil); err != nil {
+		t.Fatal(err)
+	}
+	c, rec := messageContext(http.MethodDelete, "deleted", "alice")
+	if err := deleteMessage(c); err != nil || rec.Code != 200 {
+		t.Fatalf("deleteMessage = %v, status %d (body %s)", err, rec.Code, rec.Body.String())
+	}
+	insertTestMessage(t, Message{MessageID: "new", SenderID: "bob", ReceiverID: "alice", Content: "hi",
+		Timestamp: time.Now().UTC(), Status: "sent", ContentType: defaultContentType})
+
+	changes := func(since time.Time) string {
+		code, page := historyWithTombstones(t, "changed_since="+since.Format(time.RFC3339Nano))
+		if code != 200 {
+			t.Fatalf("status = %d", code)
+		}
+		var got []string
+		for _, entry := range page {
+			id := entry["message_id"].(string)
+			if entry["deleted"] == true {
+				id += " (deleted)"
+			}
+			got = append(got, id)
+		}
+		return strings.Join(got, ",")
+	}
+	if got, want := changes(watermark), "new,deleted (deleted),delivered"; got != want {
+		t.Errorf("changes since the watermark = %s, want %s", got, want)
+	}
+	if got, want := changes(sent.Add(-time.Hour)), "new,deleted (deleted),delivered,same"; got != want {
+		t.Errorf("changes since before the first message = %s, want %s", got, want)
+	}
+}
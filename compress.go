@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Smallest response body, in bytes, that gets gzipped, configured with GZIP_MIN_LENGTH.
+// Below it the gzip header and CPU cost outweigh the saving.
+var gzipMinLength = 1024
+
+// Routes that are never compressed: Prometheus negotiates its own compression
+var gzipSkippedRoutes = map[string]bool{
+	"GET /metrics": true,
+}
+
+//! Parses GZIP_MIN_LENGTH
+func loadGzipConfig() error {
+	if v := os.Getenv("GZIP_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid GZIP_MIN_LENGTH %q: want a non-negative number of bytes", v)
+		}
+		gzipMinLength = n
+	}
+	return nil
+}
+
+//! Builds the gzip middleware for clients that send Accept-Encoding: gzip.
+// Must be registered with e.Use so the route (c.Path()) is already resolved for the skipper.
+func gzipMiddleware() echo.MiddlewareFunc {
+	return middleware.GzipWithConfig(middleware.GzipConfig{
+		MinLength: gzipMinLength,
+		Skipper: func(c echo.Context) bool {
+			// A WebSocket upgrade hijacks the connection, which a gzip writer can't pass through
+			if strings.EqualFold(c.Request().Header.Get(echo.HeaderUpgrade), "websocket") {
+				return true
+			}
+			return gzipSkippedRoutes[c.Request().Method+" "+c.Path()]
+		},
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Serves GET path with a body of size bytes through gzipMiddleware and returns the response
+func gzipResponse(t *testing.T, path string, size int, acceptGzip bool) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+	e.Use(gzipMiddleware())
+	body := strings.Repeat("a", size)
+	handler := func(c echo.Context) error { return c.String(200, body) }
+	e.GET("/messages", handler)
+	e.GET("/metrics", handler)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptGzip {
+		req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGzipThreshold(t *testing.T) {
+	defer func(n int) { gzipMinLength = n }(gzipMinLength)
+	gzipMinLength = 1024
+
+	tests := []struct {
+		name       string
+		path       string
+		size       int
+		acceptGzip bool
+		wantGzip   bool
+	}{
+		{"below the threshold", "/messages", 1023, true, false},
+		{"at the threshold", "/messages", 1024, true, true},
+		{"well above", "/messages", 64 * 1024, true, true},
+		{"client without gzip", "/messages", 64 * 1024, false, false},
+		{"skipped route", "/metrics", 64 * 1024, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := gzipResponse(t, tt.path, tt.size, tt.acceptGzip)
+			gzipped := rec.Header().Get(echo.HeaderContentEncoding) == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding gzip = %v, want %v", gzipped, tt.wantGzip)
+			}
+
+			// Either way the client must get the whole body back
+			var body io.Reader = rec.Body
+			if gzipped {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				body = zr
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if len(got) != tt.size {
+				t.Errorf("body is %d bytes, want %d", len(got), tt.size)
+			}
+		})
+	}
+}
+
+func TestLoadGzipConfig(t *testing.T) {
+	defer func(n int) { gzipMinLength = n }(gzipMinLength)
+
+	tests := []struct {
+		env     string
+		want    int
+		wantErr bool
+	}{
+		{"", 1024, false}, // unset keeps the default
+		{"0", 0, false},
+		{"2048", 2048, false},
+		{"-1", 1024, true},
+		{"1k", 1024, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			gzipMinLength = 1024
+			t.Setenv("GZIP_MIN_LENGTH", tt.env)
+			err := loadGzipConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadGzipConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if gzipMinLength != tt.want {
+				t.Errorf("gzipMinLength = %d, want %d", gzipMinLength, tt.want)
+			}
+		})
+	}
+}
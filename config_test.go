@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	const dbURL = "postgres://user:secret@db:5432/messaging"
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    Config
+		wantErr string // substring of the error; empty when LoadConfig should succeed
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"DATABASE_URL": dbURL},
+			want: Config{DatabaseURL: dbURL, RedisAddr: "localhost:6379"},
+		},
+		{
+			name: "everything set",
+			env: map[string]string{
+				"DATABASE_URL":      dbURL,
+				"READ_DATABASE_URL": "postgres://reader@replica:5432/messaging",
+				"REDIS_ADDR":        "redis:6380",
+				"REDIS_PASSWORD":    "hunter2",
+				"REDIS_DB":          "3",
+			},
+			want: Config{
+				DatabaseURL:     dbURL,
+				ReadDatabaseURL: "postgres://reader@replica:5432/messaging",
+				RedisAddr:       "redis:6380",
+				RedisPassword:   "hunter2",
+				RedisDB:         3,
+			},
+		},
+		{
+			name:    "missing DATABASE_URL",
+			env:     map[string]string{"REDIS_ADDR": "redis:6380"},
+			wantErr: "DATABASE_URL is not set",
+		},
+		{
+			name:    "REDIS_DB not a number",
+			env:     map[string]string{"DATABASE_URL": dbURL, "REDIS_DB": "one"},
+			wantErr: `invalid REDIS_DB "one"`,
+		},
+		{
+			name:    "REDIS_DB negative",
+			env:     map[string]string{"DATABASE_URL": dbURL, "REDIS_DB": "-1"},
+			wantErr: `invalid REDIS_DB "-1"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Clear every variable first so the developer's environment can't leak in
+			for _, key := range []string{"DATABASE_URL", "READ_DATABASE_URL", "REDIS_ADDR", "REDIS_PASSWORD", "REDIS_DB"} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			cfg, err := LoadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if cfg != tt.want {
+				t.Errorf("LoadConfig() = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Content types a message can declare. Clients render content based on it.
+const defaultContentType = "text/plain"
+
+var allowedContentTypes = map[string]bool{
+	"text/plain":       true,
+	"text/markdown":    true,
+	"application/json": true, // structured payloads, e.g. from bots
+}
+
+//! Checks the declared content type and that the content actually parses as it.
+// Returns the effective content type (text/plain when none was declared).
+func validateContentType(contentType, content string) (string, error) {
+	if contentType == "" {
+		return defaultContentType, nil
+	}
+	if !allowedContentTypes[contentType] {
+		return "", fmt.Errorf("unsupported content_type %q", contentType)
+	}
+	if contentType == "application/json" && !json.Valid([]byte(content)) {
+		return "", fmt.Errorf("content is not valid JSON")
+	}
+	return contentType, nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Upper bound on members per group conversation
+const maxConversationMembers = 256
+
+// Request body for POST /conversations
+type createConversationRequest struct {
+	MemberIDs      []string        `json:"member_ids"`
+	FullHistory    bool            `json:"full_history"`    // members added later see the messages from before they joined
+	InitialMessage *initialMessage `json:"initial_message"` // optional first message, sent by the creator
+}
+
+// First message of a conversation created with POST /conversations
+type initialMessage struct {
+	Content      string `json:"content"`
+	ContentType  string `json:"content_type"`
+	AttachmentID string `json:"attachment_id"`
+}
+
+// Request body for POST /conversations/:id/members
+type addMembersRequest struct {
+	MemberIDs []string `json:"member_ids"`
+}
+
+//! SQL condition for the group messages user $placeholder may read: those sent once they had joined,
+// or all of them in a group with full_history. It also requires membership; 1-to-1 messages always pass.
+func sinceJoined(placeholder int) string {
+	return fmt.Sprintf(`(messages.conversation_id IS NULL OR EXISTS (
+		SELECT 1 FROM conversation_members m JOIN conversations g ON g.conversation_id = m.conversation_id
+		WHERE m.conversation_id = messages.conversation_id AND m.user_id = $%d
+			AND (g.full_history OR messages.timestamp >= m.joined_at)))`, placeholder)
+}
+
+//! Handles creating a group conversation; the caller is always a member.
+// With an initial_message, the creator's first message is queued once the conversation exists;
+// if it can't be queued the conversation is deleted again, so no empty conversation is left behind.
+func createConversation(c echo.Context) error {
+	var req createConversationRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+
+	creator := authUserID(c)
+
+	// Normalize and de-duplicate members, always including the creator
+	seen := map[string]bool{creator: true}
+	members := []string{creator}
+	for _, id := range req.MemberIDs {
+		id = normalizeUserID(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		members = append(members, id)
+	}
+
+	if len(members) < 2 {
+		return c.JSON(400, map[string]string{"error": "A conversation needs at least one other member"})
+	}
+	if len(members) > maxConversationMembers {
+		return c.JSON(400, map[string]string{"error": "Too many members (max " + strconv.Itoa(maxConversationMembers) + ")"})
+	}
+
+	// Reject a bad first message before anything is created
+	if req.InitialMessage != nil {
+		if err := checkInitialContent(req.InitialMessage); err != nil {
+			return c.JSON(400, map[string]string{"error": err.Error()})
+		}
+	}
+
+	conversationID := uuid.New().String()
+	reqCtx := c.Request().Context()
+
+	// Create the conversation and its members together, or not at all
+	tx, err := pool.Begin(reqCtx)
+	if err != nil {
+		logFor(c).Error("Failed to start transaction", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to create conversation"})
+	}
+	defer tx.Rollback(context.Background()) // no-op after a successful commit
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(reqCtx,
+		"INSERT INTO conversations (conversation_id, created_by, created_at, full_history) VALUES ($1, $2, $3, $4)",
+		conversationID, creator, now, req.FullHistory)
+	if err != nil {
+		logFor(c).Error("Failed to insert conversation", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to create conversation"})
+	}
+
+	// One INSERT for all members
+	_, err = tx.Exec(reqCtx,
+		"INSERT INTO conversation_members (conversation_id, user_id, joined_at) SELECT $1, unnest($2::text[]), $3",
+		conversationID, members, now)
+	if err != nil {
+		logFor(c).Error("Failed to insert conversation members", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to create conversation"})
+	}
+
+	if err := tx.Commit(reqCtx); err != nil {
+		logFor(c).Error("Failed to commit conversation", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to create conversation"})
+	}
+
+	response := map[string]interface{}{
+		"conversation_id": conversationID,
+		"member_ids":      members,
+		"full_history":    req.FullHistory,
+	}
+
+	// The first message goes through the normal send path, now that the creator is a member
+	if req.InitialMessage != nil {
+		first := Message{
+			ConversationID: conversationID,
+			Content:        req.InitialMessage.Content,
+			ContentType:    req.InitialMessage.ContentType,
+			AttachmentID:   req.InitialMessage.AttachmentID,
+		}
+		sent, err := queueMessage(c, first, uuid.New().String())
+		if err != nil {
+			deleteConversation(c, conversationID)
+			return sendFailure(c, err)
+		}
+		setRateLimitHeaders(c, sent.RateLimit)
+		response["message_id"] = sent.MessageID
+		response["timestamp"] = sent.Timestamp
+	}
+
+	logFor(c).Info("Conversation created", "conversation_id", conversationID, "sender_id", creator, "members", len(members))
+	return c.JSON(201, response)
+}
+
+//! Checks the content of an initial message, the part that can be checked before the conversation exists.
+// queueMessage checks the whole message again when it is sent.
+func checkInitialContent(msg *initialMessage) error {
+	content, err := validateContent(msg.Content)
+	if err != nil {
+		return err
+	}
+	if content, err = filterContent(content); err != nil {
+		return err
+	}
+	_, err = validateContentType(msg.ContentType, content)
+	return err
+}
+
+//! Undoes createConversation after its first message failed; the members go with the conversation
+func deleteConversation(c echo.Context, conversationID string) {
+	// The request context may already be done
+	if _, err := pool.Exec(context.Background(), "DELETE FROM conversations WHERE conversation_id = $1", conversationID); err != nil {
+		logFor(c).Error("Failed to delete conversation after its first message failed", "error", err, "conversation_id", conversationID)
+	}
+}
+
+//! Handles adding members to a group conversation; any member can add others.
+// New members join now: unless the group has full_history, they only see later messages.
+// Users who are already members keep their original join time.
+func addConversationMembers(c echo.Context) error {
+	conversationID := c.Param("id")
+	var req addMembersRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+
+	seen := map[string]bool{}
+	var members []string
+	for _, id := range req.MemberIDs {
+		id = normalizeUserID(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		members = append(members, id)
+	}
+	if len(members) == 0 {
+		return c.JSON(400, map[string]string{"error": "member_ids must name at least one user"})
+	}
+
+	member, err := isConversationMember(c.Request().Context(), conversationID, authUserID(c))
+	if err != nil {
+		logFor(c).Error("Failed to check conversation membership", "error", err, "conversation_id", conversationID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to add members"})
+	}
+	if !member {
+		return c.JSON(403, map[string]string{"error": "Not a member of this conversation"})
+	}
+
+	added, full, err := insertMembers(c.Request().Context(), conversationID, members)
+	if err != nil {
+		logFor(c).Error("Failed to add conversation members", "error", err, "conversation_id", conversationID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to add members"})
+	}
+	if full {
+		return c.JSON(400, map[string]string{"error": "Too many members (max " + strconv.Itoa(maxConversationMembers) + ")"})
+	}
+
+	logFor(c).Info("Conversation members added", "conversation_id", conversationID, "added", len(added))
+	return c.JSON(200, map[string]interface{}{
+		"conversation_id": conversationID,
+		"added":           added,
+	})
+}
+
+//! Adds the users who aren't members yet, joining now, and returns them.
+// The conversation row is locked while its members are counted, so concurrent additions can't take
+// it past maxConversationMembers; full is true (and nobody is added) when these would.
+func insertMembers(ctx context.Context, conversationID string, userIDs []string) (added []string, full bool, err error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(context.Background()) // no-op after a successful commit
+
+	var count, newcomers int
+	err = tx.QueryRow(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM conversation_members WHERE conversation_id = $1),
+			(SELECT COUNT(*) FROM unnest($2::text[]) AS n(user_id)
+			 WHERE NOT EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = $1 AND user_id = n.user_id))
+		FROM conversations WHERE conversation_id = $1
+		FOR UPDATE`, conversationID, userIDs).Scan(&count, &newcomers)
+	if err != nil {
+		return nil, false, err
+	}
+	if count+newcomers > maxConversationMembers {
+		return nil, true, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+		INSERT INTO conversation_members (conversation_id, user_id, joined_at)
+		SELECT $1, unnest($2::text[]), now()
+		ON CONFLICT (conversation_id, user_id) DO NOTHING
+		RETURNING user_id`, conversationID, userIDs)
+	if err != nil {
+		return nil, false, err
+	}
+	added = []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		added = append(added, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return added, false, tx.Commit(ctx)
+}
+
+//! Handles retrieving the message history of a group conversation (members only)
+func getConversationMessages(c echo.Context) error {
+	conversationID := c.Param("id")
+
+	member, err := isConversationMember(c.Request().Context(), conversationID, authUserID(c))
+	if err != nil {
+		logFor(c).Error("Failed to check conversation membership", "error", err, "conversation_id", conversationID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch messages"})
+	}
+	if !member {
+		return c.JSON(403, map[string]string{"error": "Not a member of this conversation"})
+	}
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	// Same paging contract as getMessages: ?limit=N&before=<next_cursor>
+	limit, err := parseLimit(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	tombstones, err := parseTombstones(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	changedSince, err := parseChangedSince(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	tombstones = tombstones || changedSince != nil
+	columns, listedCond := listedMessages(tombstones)
+	args := []interface{}{conversationID, authUserID(c)}
+	changedCond, changedArg := changedSinceCondition(changedSince, len(args)+1)
+	if changedArg != nil {
+		args = append(args, changedArg)
+	}
+	cursorCond, cursorArg := beforeCondition(c.QueryParam("before"), len(args)+1)
+	if cursorArg != nil {
+		args = append(args, cursorArg)
+	}
+	args = append(args, limit+1) // bound like getMessages so the statement is reused
+
+	query := `
+		SELECT ` + columns + `
+		FROM messages
+		WHERE conversation_id = $1
+			AND ` + listedCond + `
+			AND ` + notHiddenFor(2) + `
+			AND ` + sinceJoined(2) + `
+			AND ` + changedCond + `
+			AND ` + cursorCond + `
+		ORDER BY ` + newestFirst + `
+		LIMIT $` + strconv.Itoa(len(args))
+
+	return queryAndRespondMessages(c, query, args, limit, version, tombstones)
+}
+
+// ConversationSummary is one inbox row: a contact and the latest 1-to-1 message with them
+type ConversationSummary struct {
+	OtherUserID   string     `json:"other_user_id"`
+	LastMessageID string     `json:"last_message_id"`
+	LastMessage   string     `json:"last_message"`
+	LastSenderID  string     `json:"last_sender_id"`
+	LastMessageAt time.Time  `json:"last_message_at"`
+	UnreadCount   int64      `json:"unread_count"`
+	Muted         bool       `json:"muted"`       // the caller muted this conversation
+	MutedUntil    *time.Time `json:"muted_until"` // end of a timed mute; null when not muted or muted indefinitely
+}
+
+//! Handles the inbox view: one row per contact with the latest message and unread count, newest first
+func listConversations(c echo.Context) error {
+	me := authUserID(c)
+
+	// ?user is optional, but if given it must be the caller
+	if user := c.QueryParam("user"); user != "" && normalizeUserID(user) != me {
+		return c.JSON(403, map[string]string{"error": "You can only list your own conversations"})
+	}
+
+	// DISTINCT ON keeps the newest message per contact; the window count runs over
+	// all of that contact's messages before DISTINCT ON drops the older rows.
+	query := `
+		SELECT latest.other_user_id, message_id, content, sender_id, timestamp, unread,
+			cm.user_id IS NOT NULL, cm.muted_until
+		FROM (
+			SELECT DISTINCT ON (other_user_id)
+				other_user_id, message_id, content, sender_id, timestamp,
+				COUNT(*) FILTER (WHERE receiver_id = $1 AND read = FALSE) OVER (PARTITION BY other_user_id) AS unread
+			FROM (
+				SELECT
+					CASE WHEN sender_id = $1 THEN receiver_id ELSE sender_id END AS other_user_id,
+					message_id, content, sender_id, receiver_id, timestamp, read
+				FROM messages
+				WHERE (sender_id = $1 OR receiver_id = $1) AND conversation_id IS NULL
+					AND ` + visibleMessage + `
+					AND ` + notHiddenFor(1) + `
+			) mine
+			ORDER BY other_user_id, timestamp DESC, seq DESC, message_id DESC
+		) latest
+		LEFT JOIN conversation_mutes cm
+			ON cm.user_id = $1 AND cm.other_user_id = latest.other_user_id AND ` + activeMute + `
+		ORDER BY timestamp DESC, latest.other_user_id
+	`
+
+	rows, err := readDB(c).Query(c.Request().Context(), query, me)
+	if err != nil {
+		logFor(c).Error("Failed to list conversations", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to list conversations"})
+	}
+	defer rows.Close()
+
+	// A brand-new user gets an empty list, not null
+	conversations := []ConversationSummary{}
+	for rows.Next() {
+		var summary ConversationSummary
+		if err := rows.Scan(&summary.OtherUserID, &summary.LastMessageID, &summary.LastMessage, &summary.LastSenderID, &summary.LastMessageAt, &summary.UnreadCount, &summary.Muted, &summary.MutedUntil); err != nil {
+			logFor(c).Error("Failed to scan row", "error", err)
+			return c.JSON(500, map[string]string{"error": "Failed to list conversations"})
+		}
+		conversations = append(conversations, summary)
+	}
+	if err := rows.Err(); err != nil {
+		logFor(c).Error("Rows iteration error", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to list conversations"})
+	}
+
+	return c.JSON(200, conversations)
+}
+
+//! Reports whether userID is a member of the conversation
+func isConversationMember(ctx context.Context, conversationID, userID string) (bool, error) {
+	var member bool
+	err := pool.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = $1 AND user_id = $2)",
+		conversationID, userID).Scan(&member)
+	return member, err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Runs GET /conversations as user and returns the decoded inbox
+func inboxOf(t *testing.T, user string) []ConversationSummary {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/conversations", nil), rec)
+	c.Set(authUserKey, user)
+	if err := listConversations(c); err != nil {
+		t.Fatalf("listConversations() = %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	var inbox []ConversationSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &inbox); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body, err)
+	}
+	return inbox
+}
+
+// DISTINCT ON and the window count are the subject, so this runs against a real database only
+func TestListConversations(t *testing.T) {
+	useTestDB(t)
+	base := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	for _, m := range []struct {
+		id, sender, receiver string
+		hour                 int
+		read                 bool
+	}{
+		{"ab1", "alice", "bob", 0, true},
+		{"ab2", "bob", "alice", 2, false},
+		{"ab3", "bob", "alice", 3, false}, // latest with bob
+		{"ac1", "carol", "alice", 1, false},
+		{"ac2", "alice", "carol", 5, false}, // latest overall, sent by alice
+		{"ad1", "dave", "alice", 4, true},
+		{"bc1", "bob", "carol", 6, false}, // not alice's
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: m.sender, ReceiverID: m.receiver, Content: "text of " + m.id,
+			Timestamp: base.Add(time.Duration(m.hour) * time.Hour), Read: m.read, Status: "delivered", ContentType: defaultContentType})
+	}
+
+	inbox := inboxOf(t, "alice")
+	want := []ConversationSummary{
+		{OtherUserID: "carol", LastMessageID: "ac2", LastSenderID: "alice", UnreadCount: 1}, // alice's own unread message doesn't count
+		{OtherUserID: "dave", LastMessageID: "ad1", LastSenderID: "dave", UnreadCount: 0},
+		{OtherUserID: "bob", LastMessageID: "ab3", LastSenderID: "bob", UnreadCount: 2},
+	}
+	if len(inbox) != len(want) {
+		t.Fatalf("inbox = %+v, want %d conversations", inbox, len(want))
+	}
+	for i, w := range want {
+		got := inbox[i]
+		if got.OtherUserID != w.OtherUserID || got.LastMessageID != w.LastMessageID || got.LastSenderID != w.LastSenderID ||
+			got.LastMessage != "text of "+w.LastMessageID || got.UnreadCount != w.UnreadCount {
+			t.Errorf("inbox[%d] = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestListConversationsNewUser(t *testing.T) {
+	f := useFakePG(t)
+	f.on("DISTINCT ON (other_user_id)", pgRule{Rows: [][]interface{}{}, Cols: 8})
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/conversations", nil), rec)
+	c.Set(authUserKey, "erin")
+	if err := listConversations(c); err != nil {
+		t.Fatalf("listConversations() = %v", err)
+	}
+	if rec.Code != 200 || rec.Body.String() != "[]\n" {
+		t.Errorf("response = %d %q, want 200 and an empty array", rec.Code, rec.Body.String())
+	}
+}
+
+//! Calls handler as user on group id with body and returns the recorder
+func callGroup(t *testing.T, handler echo.HandlerFunc, method, id, user, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/conversations/"+id, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, user)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned %v", err)
+	}
+	return rec
+}
+
+func TestAddConversationMembers(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		member     bool
+		counts     []interface{} // members now, and newcomers among member_ids
+		wantStatus int
+		wantAdded  bool
+	}{
+		{"added", `{"member_ids": ["carol", " dave ", "carol"]}`, true, []interface{}{2, 2}, 200, true},
+		{"no users", `{"member_ids": [" "]}`, true, nil, 400, false},
+		{"not a member", `{"member_ids": ["carol"]}`, false, nil, 403, false},
+		{"group full", `{"member_ids": ["carol", "dave"]}`, true, []interface{}{maxConversationMembers - 1, 2}, 400, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			f.on("FOR UPDATE", pgRule{Rows: [][]interface{}{tt.counts}})
+			f.on("INSERT INTO conversation_members", pgRule{Rows: [][]interface{}{{"carol"}, {"dave"}}})
+			f.on("FROM conversation_members WHERE", pgRule{Rows: [][]interface{}{{tt.member}}})
+
+			rec := callGroup(t, addConversationMembers, http.MethodPost, "group-1", "alice", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			inserts := f.queriesContaining("INSERT INTO conversation_members")
+			if (len(inserts) == 1) != tt.wantAdded {
+				t.Errorf("%d inserts, want added = %v", len(inserts), tt.wantAdded)
+			}
+			// The normalized, de-duplicated IDs are inserted
+			if tt.wantAdded && !strings.Contains(inserts[0], "'{carol,dave}'") {
+				t.Errorf("insert = %q, want carol and dave once each", inserts[0])
+			}
+		})
+	}
+}
+
+func TestCreateConversationWithInitialMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		failQueue  bool
+		wantStatus int
+		wantInsert bool // the conversation was created
+		wantDelete bool // and deleted again
+	}{
+		{"sent", "hi all", false, 201, true, false},
+		{"empty message", "  ", false, 400, false, false},
+		{"queueing fails", "hi all", true, 500, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, r := useSendFakes(t)
+			f.on("INSERT INTO conversations", pgRule{Tag: "INSERT 0 1"})
+			f.on("INSERT INTO conversation_members", pgRule{Tag: "INSERT 0 2"})
+			f.on("DELETE FROM conversations", pgRule{Tag: "DELETE 1"})
+			f.on("FROM conversation_members WHERE", pgRule{Rows: [][]interface{}{{true}}})
+			if tt.failQueue {
+				r.fail("XADD")
+			}
+
+			body := `{"member_ids": ["` + bobID + `"], "initial_message": {"content": "` + tt.content + `"}}`
+			rec := callGroup(t, createConversation, http.MethodPost, "", aliceID, body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if got := len(f.queriesContaining("INSERT INTO conversations")) == 1; got != tt.wantInsert {
+				t.Errorf("conversation inserted = %v, want %v", got, tt.wantInsert)
+			}
+			if got := len(f.queriesContaining("DELETE FROM conversations")) == 1; got != tt.wantDelete {
+				t.Errorf("conversation deleted = %v, want %v", got, tt.wantDelete)
+			}
+			if tt.wantStatus != 201 {
+				return
+			}
+
+			var created struct {
+				ConversationID string `json:"conversation_id"`
+				MessageID      string `json:"message_id"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body, err)
+			}
+			entries := r.entries("message_stream")
+			if len(entries) != 1 {
+				t.Fatalf("%d stream entries, want 1", len(entries))
+			}
+			msg, err := parseStreamMessage(entries[0].Values)
+			if err != nil {
+				t.Fatalf("parseStreamMessage: %v", err)
+			}
+			if msg.MessageID != created.MessageID || msg.ConversationID != created.ConversationID ||
+				msg.SenderID != aliceID || msg.Content != tt.content {
+				t.Errorf("queued %+v, want %q from alice in %q", msg, tt.content, created.ConversationID)
+			}
+		})
+	}
+}
+
+// Join times are compared in SQL, so this runs against a real database only
+func TestGroupHistorySinceJoining(t *testing.T) {
+	useTestDB(t)
+	base := time.Now().Add(-time.Hour).UTC()
+	for _, fullHistory := range []bool{false, true} {
+		group := fmt.Sprintf("group-%v", fullHistory)
+		if _, err := pool.Exec(t.Context(), `
+			INSERT INTO conversations (conversation_id, created_by, created_at, full_history) VALUES ($1, 'alice', $2, $3);
+			INSERT INTO conversation_members (conversation_id, user_id, joined_at) VALUES ($1, 'alice', $2), ($1, 'bob', $2)`,
+			group, base, fullHistory); err != nil {
+			t.Fatal(err)
+		}
+		insertTestMessage(t, Message{MessageID: group + "-before", SenderID: "alice", Content: "before carol",
+			Timestamp: base.Add(time.Minute), Status: "sent", ContentType: defaultContentType, ConversationID: group})
+
+		if rec := callGroup(t, addConversationMembers, http.MethodPost, group, "bob", `{"member_ids": ["carol", "alice"]}`); rec.Code != 200 ||
+			!strings.Contains(rec.Body.String(), `"added":["carol"]`) {
+			t.Fatalf("adding carol: %d %s, want only carol added", rec.Code, rec.Body.String())
+		}
+		insertTestMessage(t, Message{MessageID: group + "-after", SenderID: "alice", Content: "welcome",
+			Timestamp: time.Now().UTC().Add(time.Second), Status: "sent", ContentType: defaultContentType, ConversationID: group})
+
+		want := map[string]string{"bob": group + "-after," + group + "-before", "carol": group + "-after"}
+		if fullHistory {
+			want["carol"] = want["bob"]
+		}
+		for user, wantIDs := range want {
+			rec := callGroup(t, getConversationMessages, http.MethodGet, group, user, "")
+			var page []Message
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("decoding %s: %v", rec.Body.String(), err)
+			}
+			if got := messageIDs(page); got != wantIDs {
+				t.Errorf("full_history %v: %s sees %q, want %q", fullHistory, user, got, wantIDs)
+			}
+
+			// Fetching the earlier message by ID follows the same rule
+			c, rec := messageContext(http.MethodGet, group+"-before", user)
+			if err := getMessage(c); err != nil {
+				t.Fatal(err)
+			}
+			if visible := strings.Contains(wantIDs, "-before"); (rec.Code == 200) != visible {
+				t.Errorf("full_history %v: %s fetching the earlier message got %d", fullHistory, user, rec.Code)
+			}
+		}
+	}
+}
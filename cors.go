@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Origins allowed to call the API from a browser, configured with ALLOWED_ORIGINS
+// (comma-separated, e.g. "https://app.example.com,http://localhost:3000").
+// Empty means no cross-origin access at all; "*" is never the default.
+var allowedOrigins []string
+
+//! Parses ALLOWED_ORIGINS
+func loadAllowedOrigins() error {
+	allowedOrigins = nil
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("invalid origin %q in ALLOWED_ORIGINS: must start with http:// or https://", origin)
+		}
+		allowedOrigins = append(allowedOrigins, origin)
+	}
+	return nil
+}
+
+//! Builds the CORS middleware for allowedOrigins, or nil when cross-origin access is disabled.
+// Echo's CORS middleware treats an empty list as "*", so it must not be installed then.
+func corsMiddleware() echo.MiddlewareFunc {
+	if len(allowedOrigins) == 0 {
+		return nil
+	}
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: allowedOrigins,
+		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete},
+		AllowHeaders: []string{echo.HeaderAuthorization, echo.HeaderContentType, "X-API-Version", "If-None-Match", "If-Match"},
+		// Let browser code read the headers the API uses for paging, caching and throttling
+		ExposeHeaders: []string{"X-Next-Cursor", "ETag", echo.HeaderRetryAfter, echo.HeaderXRequestID,
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Sends a CORS preflight for GET /messages from origin through a server built like main's,
+// with ALLOWED_ORIGINS set to allowed
+func preflight(t *testing.T, allowed, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Setenv("ALLOWED_ORIGINS", allowed)
+	if err := loadAllowedOrigins(); err != nil {
+		t.Fatalf("loadAllowedOrigins() error = %v", err)
+	}
+
+	e := echo.New()
+	if cors := corsMiddleware(); cors != nil {
+		e.Use(cors)
+	}
+	e.GET("/messages", func(c echo.Context) error { return c.NoContent(200) }, requireAuth)
+
+	req := httptest.NewRequest(http.MethodOptions, "/messages", nil)
+	req.Header.Set(echo.HeaderOrigin, origin)
+	req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodGet)
+	req.Header.Set(echo.HeaderAccessControlRequestHeaders, "Authorization")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	defer func(origins []string) { allowedOrigins = origins }(allowedOrigins)
+
+	tests := []struct {
+		name       string
+		allowed    string
+		origin     string
+		wantOrigin string // Access-Control-Allow-Origin; empty when the browser must block the call
+	}{
+		{"no ALLOWED_ORIGINS", "", "https://app.example.com", ""},
+		{"listed origin", "https://app.example.com, http://localhost:3000", "https://app.example.com", "https://app.example.com"},
+		{"second listed origin", "https://app.example.com, http://localhost:3000", "http://localhost:3000", "http://localhost:3000"},
+		{"unlisted origin", "https://app.example.com", "https://evil.example.com", ""},
+		{"wildcard", "*", "https://anywhere.example.com", "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := preflight(t, tt.allowed, tt.origin)
+			if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if tt.wantOrigin == "" {
+				return
+			}
+			// An allowed preflight is answered by the CORS middleware, before requireAuth asks for a token
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+			if got := rec.Header().Get(echo.HeaderAccessControlAllowHeaders); got == "" {
+				t.Errorf("Access-Control-Allow-Headers is empty, want the allowed request headers")
+			}
+		})
+	}
+}
+
+func TestLoadAllowedOrigins(t *testing.T) {
+	defer func(origins []string) { allowedOrigins = origins }(allowedOrigins)
+
+	tests := []struct {
+		env     string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"https://app.example.com", []string{"https://app.example.com"}, false},
+		{" https://a.example.com ,http://localhost:3000,", []string{"https://a.example.com", "http://localhost:3000"}, false},
+		{"*", []string{"*"}, false},
+		{"app.example.com", nil, true},
+		{"https://ok.example.com,ftp://files.example.com", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("ALLOWED_ORIGINS", tt.env)
+			err := loadAllowedOrigins()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadAllowedOrigins() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(allowedOrigins) != len(tt.want) {
+				t.Fatalf("allowedOrigins = %q, want %q", allowedOrigins, tt.want)
+			}
+			for i := range tt.want {
+				if allowedOrigins[i] != tt.want[i] {
+					t.Errorf("allowedOrigins = %q, want %q", allowedOrigins, tt.want)
+				}
+			}
+		})
+	}
+}
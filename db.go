@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Connection pool sizing, configured with DB_MAX_CONNS and DB_MIN_CONNS
+var (
+	dbMaxConns int64 = 10
+	dbMinConns int64 = 2
+)
+
+// Statements the worker runs for every message, prepared once per connection in the primary pool.
+// Exec them by name (e.g. tx.Exec(ctx, stmtInsertMessage, ...)); pgx then skips the parse step.
+const (
+	stmtInsertMessage       = "insert_message"
+	stmtMarkStoredDelivered = "mark_stored_delivered"
+)
+
+var primaryStatements = map[string]string{
+	// ON CONFLICT makes a replayed message_id a no-op instead of a duplicate or a stuck entry.
+	stmtInsertMessage: `INSERT INTO messages (message_id, sender_id, receiver_id, content, timestamp, read, status, content_type, conversation_id, attachment_id, expires_at, reply_to_message_id, forwarded_from, seq)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), $11, NULLIF($12, ''), NULLIF($13, ''), $14)
+		ON CONFLICT (message_id) DO NOTHING`,
+	stmtMarkStoredDelivered: `UPDATE messages SET status = 'delivered', version = version + 1, changed_at = now() WHERE message_id = $1 AND status = $2`,
+}
+
+//! Opens a PostgreSQL connection pool sized by dbMaxConns/dbMinConns and checks it can connect.
+// statements (name -> SQL) are prepared on every new connection; the schema must already exist.
+func newPool(connString string, statements map[string]string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+	if dbMinConns > dbMaxConns {
+		return nil, fmt.Errorf("DB_MIN_CONNS (%d) is larger than DB_MAX_CONNS (%d)", dbMinConns, dbMaxConns)
+	}
+	config.MaxConns = int32(dbMaxConns)
+	config.MinConns = int32(dbMinConns)
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for name, sql := range statements {
+			if _, err := conn.Prepare(ctx, name, sql); err != nil {
+				return fmt.Errorf("prepare %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+
+	p, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	// NewWithConfig connects lazily; ping so a bad URL fails at startup
+	if err := p.Ping(context.Background()); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Rows inserted per benchmark iteration
+const benchmarkInsertCount = 1000
+
+// Every table the migrations create, emptied before each test that uses the test database
+const testTables = "messages, message_edits, conversations, conversation_members, attachments, blocks, " +
+	"message_hidden, conversation_mutes, webhooks, webhook_dead_letters"
+
+//! Opens a pool with the primary statements prepared on a migrated TEST_DATABASE_URL.
+// Skips when TEST_DATABASE_URL is not set: it needs a real, disposable database.
+func testDBPool(tb testing.TB) *pgxpool.Pool {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL is not set")
+	}
+	if err := runMigrations(context.Background(), url); err != nil {
+		tb.Fatalf("runMigrations: %v", err)
+	}
+	p, err := newPool(url, primaryStatements)
+	if err != nil {
+		tb.Fatalf("newPool: %v", err)
+	}
+	tb.Cleanup(p.Close)
+	return p
+}
+
+//! Points the handlers at the emptied test database for the rest of the test.
+// For tests whose subject is the SQL itself (ranking, aggregates, indexes), which the fake can't judge.
+func useTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	p := testDBPool(t)
+	if _, err := p.Exec(t.Context(), "TRUNCATE "+testTables+" CASCADE"); err != nil {
+		t.Fatalf("emptying the test database: %v", err)
+	}
+	oldPool, oldReplica := pool, replicaPool
+	pool, replicaPool = p, nil
+	t.Cleanup(func() { pool, replicaPool = oldPool, oldReplica })
+	return p
+}
+
+//! Inserts msg as the worker would have stored it
+func insertTestMessage(t *testing.T, msg Message) {
+	t.Helper()
+	_, err := pool.Exec(t.Context(), stmtInsertMessage, msg.MessageID, msg.SenderID, msg.ReceiverID,
+		msg.Content, msg.Timestamp, msg.Read, msg.Status, msg.ContentType, msg.ConversationID, msg.AttachmentID,
+		msg.ExpiresAt, msg.ReplyToMessageID, msg.ForwardedFrom, msg.Seq)
+	if err != nil {
+		t.Fatalf("inserting %s: %v", msg.MessageID, err)
+	}
+}
+
+//! Opens the test database for a benchmark
+func benchmarkPool(b *testing.B) *pgxpool.Pool {
+	return testDBPool(b)
+}
+
+//! Inserts benchmarkInsertCount messages per iteration with exec, in a transaction that is
+// rolled back so every iteration starts from the same table
+func benchmarkInserts(b *testing.B, exec func(tx pgx.Tx, args ...interface{}) error) {
+	p := benchmarkPool(b)
+	ctx := context.Background()
+	sentAt := time.Now().UTC()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := p.Begin(ctx)
+		if err != nil {
+			b.Fatalf("begin: %v", err)
+		}
+		for j := 0; j < benchmarkInsertCount; j++ {
+			err := exec(tx, uuid.New().String(), "bench-sender", "bench-receiver", "hello", sentAt,
+				false, initialStatus, defaultContentType, "", "", (*time.Time)(nil), "", "", int64(j+1))
+			if err != nil {
+				tx.Rollback(ctx)
+				b.Fatalf("insert: %v", err)
+			}
+		}
+		if err := tx.Rollback(ctx); err != nil {
+			b.Fatalf("rollback: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchmarkInsertCount), "ns/insert")
+}
+
+// Run with: TEST_DATABASE_URL=postgres://... go test -run '^$' -bench Insert
+func BenchmarkInsertPrepared(b *testing.B) {
+	benchmarkInserts(b, func(tx pgx.Tx, args ...interface{}) error {
+		_, err := tx.Exec(context.Background(), stmtInsertMessage, args...)
+		return err
+	})
+}
+
+func BenchmarkInsertAdHoc(b *testing.B) {
+	// QueryExecModeExec sends the SQL text on every call, as an unnamed statement Postgres parses each time
+	sql := primaryStatements[stmtInsertMessage]
+	benchmarkInserts(b, func(tx pgx.Tx, args ...interface{}) error {
+		_, err := tx.Exec(context.Background(), sql, append([]interface{}{pgx.QueryExecModeExec}, args...)...)
+		return err
+	})
+}
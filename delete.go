@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Scopes of DELETE /messages/:id?scope=
+const (
+	deleteScopeMe       = "me"       // hide the message from the caller only
+	deleteScopeEveryone = "everyone" // soft-delete it for all participants (sender only)
+)
+
+// How long after sending the sender can still delete a message for everyone.
+// Configured with DELETE_FOR_EVERYONE_WINDOW (Go duration, e.g. "1h"); "0" disables the check.
+// MESSAGE_MUTABLE_WINDOW applies as well, so the tighter of the two limits wins.
+var deleteForEveryoneWindow = time.Hour
+
+//! Reports whether a message sent at sentAt can still be deleted for everyone: inside both
+// deleteForEveryoneWindow and mutableWindow
+func withinDeleteWindow(sentAt time.Time) bool {
+	if !withinMutableWindow(sentAt) {
+		return false
+	}
+	if deleteForEveryoneWindow == 0 {
+		return true // window disabled
+	}
+	return time.Since(sentAt) <= deleteForEveryoneWindow
+}
+
+//! SQL condition excluding the messages the user bound to $placeholder deleted for themselves
+func notHiddenFor(placeholder int) string {
+	return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.message_id AND h.user_id = $%d)", placeholder)
+}
+
+//! Hides a message from userID's view; hiding it again is a no-op
+func hideMessage(ctx context.Context, messageID, userID string) error {
+	_, err := pool.Exec(ctx,
+		"INSERT INTO message_hidden (message_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		messageID, userID)
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestWithinDeleteWindow(t *testing.T) {
+	defer func(w time.Duration) { deleteForEveryoneWindow = w }(deleteForEveryoneWindow)
+	defer func(w time.Duration) { mutableWindow = w }(mutableWindow)
+
+	tests := []struct {
+		name    string
+		window  time.Duration
+		mutable time.Duration
+		age     time.Duration
+		want    bool
+	}{
+		{"just sent", time.Hour, 0, 0, true},
+		{"inside the window", time.Hour, 0, 59 * time.Minute, true},
+		{"window passed", time.Hour, 0, 61 * time.Minute, false},
+		{"long ago", time.Hour, 0, 48 * time.Hour, false},
+		{"window disabled", 0, 0, 48 * time.Hour, true},
+
+		// Both limits apply; the tighter one wins
+		{"mutable window passed", time.Hour, 15 * time.Minute, 20 * time.Minute, false},
+		{"inside both", time.Hour, 15 * time.Minute, 10 * time.Minute, true},
+		{"only the mutable window", 0, 15 * time.Minute, 20 * time.Minute, false},
+		{"mutable window wider", 10 * time.Minute, time.Hour, 20 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleteForEveryoneWindow, mutableWindow = tt.window, tt.mutable
+			if got := withinDeleteWindow(time.Now().Add(-tt.age)); got != tt.want {
+				t.Errorf("withinDeleteWindow(now-%v) with windows %v/%v = %v, want %v", tt.age, tt.window, tt.mutable, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotHiddenFor(t *testing.T) {
+	cond := notHiddenFor(3)
+	if !strings.Contains(cond, "h.user_id = $3") {
+		t.Errorf("notHiddenFor(3) = %q, want it bound to $3", cond)
+	}
+	if !strings.HasPrefix(cond, "NOT EXISTS") {
+		t.Errorf("notHiddenFor(3) = %q, want a NOT EXISTS condition", cond)
+	}
+}
+
+func TestDeleteForEveryone(t *testing.T) {
+	defer func(w time.Duration) { deleteForEveryoneWindow = w }(deleteForEveryoneWindow)
+	defer func(w time.Duration) { mutableWindow = w }(mutableWindow)
+	deleteForEveryoneWindow, mutableWindow = time.Hour, 15*time.Minute
+
+	tests := []struct {
+		name       string
+		user       string
+		age        time.Duration
+		wantStatus int
+		wantError  string
+	}{
+		{"sender inside the window", "alice", time.Minute, 200, ""},
+		{"receiver", "bob", time.Minute, 403, "Only the sender can delete a message for everyone"},
+		{"sender after the window", "alice", 2 * time.Hour, 403, "Message can no longer be deleted for everyone"},
+		{"sender after the mutable window", "alice", 20 * time.Minute, 403, "Message can no longer be deleted for everyone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			f.on("UPDATE messages SET deleted_at", pgRule{Rows: [][]interface{}{{time.Now(), []string{"alice", "bob"}}}})
+			f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{messageRecord(Message{
+				MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Timestamp: time.Now().Add(-tt.age),
+				Status: "sent", ContentType: defaultContentType, Version: 1})}})
+			f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+			r := useFakeRedis(t)
+
+			c, rec := messageContext(http.MethodDelete, "m1", tt.user)
+			c.Request().URL.RawQuery = "scope=everyone"
+			if err := deleteMessage(c); err != nil {
+				t.Fatalf("deleteMessage returned %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantError != "" && !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("body = %s, want error %q", rec.Body.String(), tt.wantError)
+			}
+			if deleted := len(f.queriesContaining("SET deleted_at")) > 0; deleted != (tt.wantStatus == 200) {
+				t.Errorf("message deleted = %v, want %v", deleted, tt.wantStatus == 200)
+			}
+			// Both participants hear about a delete, and nobody about a refused one
+			for _, user := range []string{"alice", "bob"} {
+				events := r.publishedOn(deletionChannelPrefix + user)
+				if len(events) != 0 != (tt.wantStatus == 200) {
+					t.Errorf("%d deletion events for %s", len(events), user)
+				}
+				if len(events) > 0 && !strings.Contains(events[0], `"message_id":"m1","deleted":true`) {
+					t.Errorf("deletion event %s, want a tombstone for m1", events[0])
+				}
+			}
+		})
+	}
+}
+
+func TestInboxLeavesOutHiddenMessages(t *testing.T) {
+	handlers := []struct {
+		name    string
+		handler echo.HandlerFunc
+		match   string // the query to answer, with no rows
+	}{
+		{"list conversations", listConversations, "DISTINCT ON"},
+		{"unread counts", getUnreadCounts, "COUNT(*)"},
+		{"mark conversation read", markConversationRead, "UPDATE messages SET read"},
+	}
+	for _, h := range handlers {
+		t.Run(h.name, func(t *testing.T) {
+			f := useFakePG(t)
+			f.on(h.match, pgRule{Rows: [][]interface{}{}, Cols: 2})
+
+			c, rec := newTestContext()
+			c.SetParamNames("otherUser")
+			c.SetParamValues("alice")
+			c.Set(authUserKey, "bob")
+			if err := h.handler(c); err != nil {
+				t.Fatalf("handler returned %v", err)
+			}
+			if rec.Code != 200 {
+				t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+			}
+			// notHiddenFor is bound to the caller (arguments are interpolated with padding spaces)
+			queries := f.queriesContaining(h.match)
+			if len(queries) != 1 || !strings.Contains(queries[0], "h.message_id = messages.message_id AND h.user_id =  'bob' )") {
+				t.Errorf("query doesn't leave out the caller's hidden messages: %q", queries)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Drafts live in Redis only, never in message_stream: one draft:<user>:<conversation> hash per
+// user and conversation (the receiver's ID, or the group's conversation ID), plus a
+// draft_id:<id> key pointing at that hash so a draft can be addressed by its ID.
+const (
+	draftKeyPrefix   = "draft:"
+	draftIDKeyPrefix = "draft_id:"
+)
+
+// How long a draft survives without being saved again, configured with DRAFT_TTL
+var draftTTL = 7 * 24 * time.Hour
+
+// Deletes a sent draft: the hash only if it still holds the same draft (it may have been
+// overwritten in the meantime), and the draft's ID key in any case.
+var discardDraftScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'draft_id') == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return redis.call('DEL', KEYS[2])
+`)
+
+// Draft is an unsent message saved with POST /drafts. The same fields as a message, minus send_at.
+type Draft struct {
+	DraftID          string `json:"draft_id" redis:"draft_id"` // becomes the message_id when sent
+	UserID           string `json:"-" redis:"user_id"`
+	ReceiverID       string `json:"receiver_id" redis:"receiver_id"`
+	ConversationID   string `json:"conversation_id" redis:"conversation_id"`
+	Content          string `json:"content" redis:"content"`
+	ContentType      string `json:"content_type" redis:"content_type"`
+	AttachmentID     string `json:"attachment_id" redis:"attachment_id"`
+	ReplyToMessageID string `json:"reply_to_message_id" redis:"reply_to_message_id"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds" redis:"expires_in_seconds"`
+	UpdatedAt        string `json:"updated_at" redis:"updated_at"`
+	ExpiresAt        string `json:"expires_at" redis:"-"` // unless saved again before then
+}
+
+// DraftRequest is the body of POST /drafts
+type DraftRequest struct {
+	DraftID          string `json:"draft_id"` // update this draft instead, e.g. to change its receiver
+	ReceiverID       string `json:"receiver_id"`
+	ConversationID   string `json:"conversation_id"`
+	Content          string `json:"content"`
+	ContentType      string `json:"content_type"`
+	AttachmentID     string `json:"attachment_id"`
+	ReplyToMessageID string `json:"reply_to_message_id"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+}
+
+//! Returns the Redis key of userID's draft for a conversation
+func draftKey(userID, conversation string) string {
+	return draftKeyPrefix + userID + ":" + conversation
+}
+
+//! Returns the draft's conversation: its group, or else its receiver
+func (d Draft) conversation() string {
+	if d.ConversationID != "" {
+		return d.ConversationID
+	}
+	return d.ReceiverID
+}
+
+//! Loads userID's draft by ID, together with its key. ok is false if there is no such draft
+// (never saved, sent, expired, or someone else's).
+func loadDraft(ctx context.Context, userID, draftID string) (draft Draft, key string, ok bool, err error) {
+	key, err = redisCli.Get(ctx, draftIDKeyPrefix+draftID).Result()
+	if errors.Is(err, redis.Nil) {
+		return draft, "", false, nil
+	}
+	if err != nil {
+		return draft, "", false, err
+	}
+	if !strings.HasPrefix(key, draftKey(userID, "")) {
+		return draft, "", false, nil
+	}
+	draft, ok, err = readDraft(ctx, key)
+	if ok && draft.DraftID != draftID {
+		ok = false // the conversation's draft was replaced by another one
+	}
+	return draft, key, ok, err
+}
+
+//! Reads the draft stored at key; ok is false if there is none
+func readDraft(ctx context.Context, key string) (draft Draft, ok bool, err error) {
+	cmd := redisCli.HGetAll(ctx, key)
+	if err := cmd.Err(); err != nil {
+		return draft, false, err
+	}
+	if len(cmd.Val()) == 0 {
+		return draft, false, nil
+	}
+	if err := cmd.Scan(&draft); err != nil {
+		return draft, false, err
+	}
+	return draft, true, nil
+}
+
+//! Writes the draft response, filling in when the draft expires
+func draftResponse(c echo.Context, draft Draft) error {
+	if updated, err := time.Parse(time.RFC3339Nano, draft.UpdatedAt); err == nil {
+		draft.ExpiresAt = updated.Add(draftTTL).Format(time.RFC3339Nano)
+	}
+	return c.JSON(200, draft)
+}
+
+//! Handles saving the caller's draft for a conversation, replacing any draft they already have there.
+// With draft_id, that draft is updated instead and may move to another conversation (a new receiver),
+// where it replaces whatever draft was there. Each save restarts the draft's DRAFT_TTL.
+func saveDraft(c echo.Context) error {
+	var req DraftRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+	me := authUserID(c)
+	reqCtx := c.Request().Context()
+	req.ReceiverID = normalizeUserID(req.ReceiverID)
+
+	// A draft belongs to exactly one conversation the caller takes part in
+	switch {
+	case req.ReceiverID != "" && req.ConversationID != "":
+		return c.JSON(400, map[string]string{"error": "Send either conversation_id or receiver_id, not both"})
+	case req.ReceiverID == "" && req.ConversationID == "":
+		return c.JSON(400, map[string]string{"error": "receiver_id or conversation_id is required"})
+	case req.ReceiverID != "" && !isUUID(req.ReceiverID):
+		return c.JSON(400, map[string]string{"error": "receiver_id must be a UUID"})
+	}
+
+	content, err := validateContent(req.Content)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	if req.ExpiresInSeconds < 0 {
+		return c.JSON(400, map[string]string{"error": "expires_in_seconds must be positive"})
+	}
+
+	draft := Draft{
+		UserID:           me,
+		ReceiverID:       req.ReceiverID,
+		ConversationID:   req.ConversationID,
+		Content:          content,
+		ContentType:      req.ContentType,
+		AttachmentID:     req.AttachmentID,
+		ReplyToMessageID: req.ReplyToMessageID,
+		ExpiresInSeconds: req.ExpiresInSeconds,
+		UpdatedAt:        time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if ok, err := requireParticipant(c, draft.conversation(), "Failed to save draft"); !ok {
+		return err
+	}
+	key := draftKey(me, draft.conversation())
+
+	// The draft being updated, if any
+	var oldKey string
+	if req.DraftID != "" {
+		var found bool
+		_, oldKey, found, err = loadDraft(reqCtx, me, req.DraftID)
+		if err != nil {
+			logFor(c).Error("Failed to load draft", "error", err, "draft_id", req.DraftID)
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			return c.JSON(500, map[string]string{"error": "Failed to save draft"})
+		}
+		if !found {
+			return c.JSON(404, map[string]string{"error": "Draft not found"})
+		}
+		draft.DraftID = req.DraftID
+	}
+
+	// The conversation's current draft, which this one replaces
+	replacedID, err := redisCli.HGet(reqCtx, key, "draft_id").Result()
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	if err != nil {
+		logFor(c).Error("Failed to look up draft", "error", err, "user_id", me)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to save draft"})
+	}
+	if draft.DraftID == "" {
+		// Saving over a conversation's draft keeps its ID
+		draft.DraftID = replacedID
+	}
+	if draft.DraftID == "" {
+		draft.DraftID = uuid.New().String()
+	}
+
+	_, err = redisCli.TxPipelined(reqCtx, func(pipe redis.Pipeliner) error {
+		if oldKey != "" && oldKey != key {
+			pipe.Del(reqCtx, oldKey)
+		}
+		if replacedID != "" && replacedID != draft.DraftID {
+			pipe.Del(reqCtx, draftIDKeyPrefix+replacedID)
+		}
+		pipe.Del(reqCtx, key) // drop fields the new draft leaves out
+		pipe.HSet(reqCtx, key, draft)
+		pipe.Expire(reqCtx, key, draftTTL)
+		pipe.Set(reqCtx, draftIDKeyPrefix+draft.DraftID, key, draftTTL)
+		return nil
+	})
+	if err != nil {
+		logFor(c).Error("Failed to save draft", "error", err, "draft_id", draft.DraftID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to save draft"})
+	}
+
+	logFor(c).Info("Draft saved", "draft_id", draft.DraftID, "user_id", me)
+	return draftResponse(c, draft)
+}
+
+//! Handles fetching the caller's draft for ?conversation= (a receiver ID or a group conversation ID)
+func getDraft(c echo.Context) error {
+	conversation := c.QueryParam("conversation")
+	if conversation == "" {
+		return c.JSON(400, map[string]string{"error": "conversation is required"})
+	}
+	conversation = normalizeUserID(conversation) // receiver IDs are stored normalized
+
+	draft, ok, err := readDraft(c.Request().Context(), draftKey(authUserID(c), conversation))
+	if err != nil {
+		logFor(c).Error("Failed to read draft", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch draft"})
+	}
+	if !ok {
+		return c.JSON(404, map[string]string{"error": "Draft not found"})
+	}
+	return draftResponse(c, draft)
+}
+
+//! Handles sending a draft through the same path as POST /messages, with the draft ID as the
+// message_id, so a retried send can't queue it twice. The draft is removed once the message is queued.
+func sendDraft(c echo.Context) error {
+	draftID := c.Param("id")
+	me := authUserID(c)
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	draft, key, ok, err := loadDraft(c.Request().Context(), me, draftID)
+	if err != nil {
+		logFor(c).Error("Failed to load draft", "error", err, "draft_id", draftID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to send draft"})
+	}
+	if !ok {
+		return c.JSON(404, map[string]string{"error": "Draft not found"})
+	}
+
+	msg := Message{
+		ReceiverID:       draft.ReceiverID,
+		ConversationID:   draft.ConversationID,
+		Content:          draft.Content,
+		ContentType:      draft.ContentType,
+		AttachmentID:     draft.AttachmentID,
+		ReplyToMessageID: draft.ReplyToMessageID,
+		ExpiresInSeconds: draft.ExpiresInSeconds,
+	}
+	result, err := queueMessage(c, msg, draft.DraftID)
+	if err != nil {
+		return sendFailure(c, err) // rejected or failed: the draft stays for the user to fix or retry
+	}
+
+	// The message is queued; a draft left behind would only expire, so a failure here is just logged
+	if err := discardDraftScript.Run(context.Background(), redisCli,
+		[]string{key, draftIDKeyPrefix + draftID}, draftID).Err(); err != nil {
+		logFor(c).Error("Failed to remove sent draft", "error", err, "draft_id", draftID)
+	}
+	logFor(c).Info("Draft sent", "draft_id", draftID, "user_id", me)
+	return sendResponse(c, version, result)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Request body for PATCH /messages/:id/content
+type editMessageRequest struct {
+	Content string `json:"content"`
+}
+
+//! Handles editing a message's content; only the original sender may edit.
+// The previous content is appended to message_edits before the message is updated.
+func editMessage(c echo.Context) error {
+	messageID := c.Param("id")
+
+	// The client must say which version it saw, so a concurrent edit isn't silently overwritten
+	expected, err := ifMatchVersion(c)
+	if err != nil {
+		return badIfMatch(c, err)
+	}
+
+	var req editMessageRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+
+	content, err := validateContent(req.Content)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	// Edits go through the same filter as new messages
+	content, err = filterContent(content)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	reqCtx := c.Request().Context()
+	tx, err := pool.Begin(reqCtx)
+	if err != nil {
+		logFor(c).Error("Failed to start transaction", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to edit message"})
+	}
+	defer tx.Rollback(context.Background()) // no-op after a successful commit
+
+	// Lock the row so concurrent edits record history in order
+	// Deleted messages are read too, so editing one is a conflict rather than a 404
+	var senderID, oldContent, contentType string
+	var sentAt time.Time
+	var deletedAt *time.Time
+	var version int64
+	err = tx.QueryRow(reqCtx,
+		"SELECT sender_id, content, content_type, timestamp, deleted_at, version FROM messages WHERE message_id = $1 AND (expires_at IS NULL OR expires_at > now()) FOR UPDATE",
+		messageID).Scan(&senderID, &oldContent, &contentType, &sentAt, &deletedAt, &version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(404, map[string]string{"error": "Message not found"})
+	}
+	if err != nil {
+		logFor(c).Error("Failed to look up message", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to edit message"})
+	}
+
+	if senderID != authUserID(c) {
+		return c.JSON(403, map[string]string{"error": "Only the sender can edit this message"})
+	}
+	if deletedAt != nil {
+		return c.JSON(409, map[string]string{"error": "Message has been deleted"})
+	}
+	if !withinMutableWindow(sentAt) {
+		return c.JSON(403, map[string]string{"error": "Message can no longer be edited"})
+	}
+	if expected != nil && *expected != version {
+		return preconditionFailed(c, version)
+	}
+
+	// The new content must still match the message's declared type
+	if _, err := validateContentType(contentType, content); err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	editedAt := time.Now().UTC()
+	_, err = tx.Exec(reqCtx,
+		"INSERT INTO message_edits (message_id, previous_content, edited_at) VALUES ($1, $2, $3)",
+		messageID, oldContent, editedAt)
+	if err != nil {
+		logFor(c).Error("Failed to record edit history", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to edit message"})
+	}
+
+	var msg Message
+	err = scanMessage(tx.QueryRow(reqCtx,
+		"UPDATE messages SET content = $1, edited_at = $2, version = version + 1, changed_at = now() WHERE message_id = $3 RETURNING "+messageColumns,
+		content, editedAt, messageID), &msg)
+	if err != nil {
+		logFor(c).Error("Failed to update message content", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to edit message"})
+	}
+
+	if err := tx.Commit(reqCtx); err != nil {
+		logFor(c).Error("Failed to commit edit", "error", err, "message_id", messageID)
+		return c.JSON(500, map[string]string{"error": "Failed to edit message"})
+	}
+
+	logFor(c).Info("Message edited", "message_id", messageID, "sender_id", senderID)
+	c.Response().Header().Set("ETag", messageETag(msg.Version))
+	return c.JSON(200, msg)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Returns a PATCH /messages/:id/content request context from user, with If-Match "*"
+func editContext(id, user, content string) (echo.Context, *httptest.ResponseRecorder) {
+	body, _ := json.Marshal(map[string]string{"content": content})
+	req := httptest.NewRequest(http.MethodPatch, "/messages/"+id+"/content", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", "*")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	c.Set(authUserKey, user)
+	return c, rec
+}
+
+//! Answers editMessage's queries from msg, applying each update to it
+func useEditFakes(t *testing.T, msg *Message, deletedAt *time.Time) *fakePG {
+	f := useFakePG(t)
+	f.on("SELECT sender_id, content, content_type, timestamp, deleted_at, version FROM messages", pgRule{Answer: func(string) [][]interface{} {
+		return [][]interface{}{{msg.SenderID, msg.Content, msg.ContentType, msg.Timestamp, deletedAt, msg.Version}}
+	}})
+	f.on("INSERT INTO message_edits", pgRule{Tag: "INSERT 0 1"})
+	newContent := regexp.MustCompile(`SET content = \s*'([^']*)'`)
+	f.on("UPDATE messages SET content", pgRule{Answer: func(query string) [][]interface{} {
+		editedAt := time.Now().UTC()
+		msg.Content = newContent.FindStringSubmatch(query)[1]
+		msg.EditedAt = &editedAt
+		msg.Version++
+		return [][]interface{}{messageRecord(*msg)}
+	}})
+	return f
+}
+
+func TestEditMessage(t *testing.T) {
+	sent := func() *Message {
+		return &Message{MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Content: "helo",
+			Timestamp: time.Now().UTC(), Status: "delivered", ContentType: defaultContentType, Version: 1, Seq: 1}
+	}
+
+	t.Run("history accumulates", func(t *testing.T) {
+		msg := sent()
+		f := useEditFakes(t, msg, nil)
+
+		for _, content := range []string{"hello", "hello!"} {
+			c, rec := editContext("m1", "alice", content)
+			if err := editMessage(c); err != nil {
+				t.Fatalf("editMessage returned %v", err)
+			}
+			if rec.Code != 200 {
+				t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+			}
+			var got Message
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding body: %v", err)
+			}
+			if got.Content != content || !got.Edited || got.EditedAt == nil {
+				t.Errorf("edited message = %+v, want content %q and edited", got, content)
+			}
+		}
+
+		// One history row per edit, each holding the content it replaced
+		history := f.queriesContaining("INSERT INTO message_edits")
+		if len(history) != 2 || !strings.Contains(history[0], "'helo'") || !strings.Contains(history[1], "'hello'") {
+			t.Errorf("history inserts = %q, want the previous contents helo then hello", history)
+		}
+		if msg.Version != 3 {
+			t.Errorf("version = %d after two edits, want 3", msg.Version)
+		}
+	})
+
+	t.Run("not the sender", func(t *testing.T) {
+		f := useEditFakes(t, sent(), nil)
+		c, rec := editContext("m1", "bob", "hijacked")
+		if err := editMessage(c); err != nil {
+			t.Fatalf("editMessage returned %v", err)
+		}
+		if rec.Code != 403 {
+			t.Errorf("status = %d, want 403", rec.Code)
+		}
+		if got := f.queriesContaining("message_edits"); len(got) != 0 {
+			t.Errorf("history recorded for a rejected edit: %q", got)
+		}
+		if got := f.queriesContaining("UPDATE messages"); len(got) != 0 {
+			t.Errorf("message updated by a non-sender: %q", got)
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		deletedAt := time.Now().UTC()
+		f := useEditFakes(t, sent(), &deletedAt)
+		c, rec := editContext("m1", "alice", "hello")
+		if err := editMessage(c); err != nil {
+			t.Fatalf("editMessage returned %v", err)
+		}
+		if rec.Code != 409 {
+			t.Errorf("status = %d, want 409", rec.Code)
+		}
+		if got := f.queriesContaining("UPDATE messages"); len(got) != 0 {
+			t.Errorf("deleted message updated: %q", got)
+		}
+	})
+}
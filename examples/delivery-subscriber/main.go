@@ -0,0 +1,59 @@
+// Example consumer for the worker's delivery events.
+//
+// It subscribes to the "message_delivered" Redis pub/sub channel and prints
+// every message ID the worker reports as delivered, noting which ones are in
+// a muted conversation and shouldn't trigger a notification.
+//
+//	go run ./examples/delivery-subscriber
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deliveryEvent mirrors the payload published by the worker
+type deliveryEvent struct {
+	MessageIDs      []string `json:"message_ids"`
+	MutedMessageIDs []string `json:"muted_message_ids"` // delivered, but the receiver muted the conversation
+}
+
+func main() {
+	ctx := context.Background()
+
+	redisCli := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379", // Same Redis the API server uses
+	})
+	defer redisCli.Close()
+
+	// Subscribe to the channel the worker publishes to
+	sub := redisCli.Subscribe(ctx, "message_delivered")
+	defer sub.Close()
+
+	log.Println("Waiting for delivery events...")
+
+	// Channel() delivers messages until the subscription is closed
+	for msg := range sub.Channel() {
+		var event deliveryEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			log.Printf("Skipping malformed event: %v", err)
+			continue
+		}
+
+		muted := make(map[string]bool, len(event.MutedMessageIDs))
+		for _, id := range event.MutedMessageIDs {
+			muted[id] = true
+		}
+
+		for _, id := range event.MessageIDs {
+			if muted[id] {
+				log.Printf("Message delivered (muted, no notification): %s", id)
+				continue
+			}
+			log.Printf("Message delivered: %s", id)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// SQL condition for messages that may still be shown: not soft-deleted and not past
+// their expiry. Reads use it so an expired message disappears even before the sweep.
+const visibleMessage = "deleted_at IS NULL AND (expires_at IS NULL OR expires_at > now())"
+
+// How often expired messages are soft-deleted, configured with EXPIRY_SWEEP_INTERVAL
+var expirySweepInterval = time.Minute
+
+//! Sweeper goroutine: every expirySweepInterval, soft-deletes messages past their expiry.
+// Started and stopped with the workers (see workerManager).
+func runExpirySweeper() {
+	quit := workers.stopping()
+
+	slog.Info("Starting expiry sweeper", "interval", expirySweepInterval.String())
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			slog.Info("Stopping expiry sweeper")
+			return
+		case <-ticker.C:
+			sweepExpired()
+		}
+	}
+}
+
+//! Marks every expired, not yet deleted message as deleted
+func sweepExpired() {
+	opCtx, cancel := operationContext()
+	defer cancel()
+
+	result, err := pool.Exec(opCtx,
+		"UPDATE messages SET deleted_at = now(), version = version + 1, changed_at = now() WHERE expires_at <= now() AND deleted_at IS NULL")
+	if err != nil {
+		slog.Error("Failed to sweep expired messages", "error", err)
+		return
+	}
+	if n := result.RowsAffected(); n > 0 {
+		slog.Info("Expired messages deleted", "count", n)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestExpirySweeperRuns(t *testing.T) {
+	f := useFakePG(t)
+	f.on("UPDATE messages SET deleted_at = now()", pgRule{Tag: "UPDATE 1"})
+	interval := expirySweepInterval
+	expirySweepInterval = 5 * time.Millisecond
+	t.Cleanup(func() { expirySweepInterval = interval })
+
+	old := workers
+	workers = newManager(nil, []func(){runExpirySweeper})
+	t.Cleanup(func() { workers = old })
+	if _, err := workers.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer workers.Stop()
+
+	// It keeps sweeping on its interval
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.queriesContaining("SET deleted_at")) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("swept %d times, want at least 2", len(f.queriesContaining("SET deleted_at")))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	workers.Stop()
+
+	// Only expired messages that aren't deleted yet are touched
+	for _, q := range f.queriesContaining("SET deleted_at") {
+		if !strings.Contains(q, "expires_at <= now()") || !strings.Contains(q, "deleted_at IS NULL") {
+			t.Errorf("sweep query %q", q)
+		}
+	}
+}
+
+// Expiry is compared with the database's now(), so this runs against a real database only
+func TestExpiredMessages(t *testing.T) {
+	p := useTestDB(t)
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	for i, m := range []struct {
+		id        string
+		expiresAt *time.Time
+	}{
+		{"expired", &past},
+		{"expiring", &future},
+		{"lasting", nil},
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: "alice", ReceiverID: "bob", Content: "hi",
+			Timestamp: now.Add(-time.Duration(i+1) * time.Minute), Status: "delivered", ContentType: defaultContentType, ExpiresAt: m.expiresAt})
+	}
+	history := func() []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/messages?user1=alice&user2=bob", nil)
+		req.Header.Set("X-API-Version", "3")
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set(authUserKey, "bob")
+		if err := getMessages(c); err != nil || rec.Code != 200 {
+			t.Fatalf("getMessages = %v, %d %s", err, rec.Code, rec.Body.String())
+		}
+		var body struct {
+			Messages []Message `json:"messages"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding body: %v", err)
+		}
+		var ids []string
+		for _, msg := range body.Messages {
+			ids = append(ids, msg.MessageID)
+		}
+		return ids
+	}
+	deleted := func(id string) bool {
+		var deletedAt *time.Time
+		if err := p.QueryRow(t.Context(), "SELECT deleted_at FROM messages WHERE message_id = $1", id).Scan(&deletedAt); err != nil {
+			t.Fatal(err)
+		}
+		return deletedAt != nil
+	}
+
+	// Left out as soon as it expires, before any sweep
+	if got := history(); strings.Join(got, ",") != "expiring,lasting" {
+		t.Errorf("history = %q, want the unexpired messages only", got)
+	}
+	if deleted("expired") {
+		t.Fatal("the expired message is deleted before the sweep")
+	}
+
+	sweepExpired()
+	if !deleted("expired") || deleted("expiring") || deleted("lasting") {
+		t.Errorf("after the sweep, deleted = expired %v, expiring %v, lasting %v; want only the expired one",
+			deleted("expired"), deleted("expiring"), deleted("lasting"))
+	}
+	if got := history(); len(got) != 2 {
+		t.Errorf("history after the sweep = %q, want the same two messages", got)
+	}
+}
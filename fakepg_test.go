@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// fakePG is an in-process PostgreSQL server for handler tests. It speaks just enough of the
+// simple query protocol for pgx: each query is answered by the first rule whose Match it contains.
+// The pool talking to it interpolates arguments client-side, so rules and recorded queries
+// see the literal values. The worker's primaryStatements are prepared too; their executions are
+// matched by SQL text and recorded with their first argument appended; they can't return rows.
+type fakePG struct {
+	mu        sync.Mutex
+	rules     []*pgRule
+	queries   []string // every query received, in order
+	unmatched []string // queries no rule answered
+}
+
+// pgRule answers the queries containing Match
+type pgRule struct {
+	Match string
+	Rows  [][]interface{} // result rows; nil for a statement without a result set
+	// Answer, if set, computes the result rows from the query (with its interpolated arguments) instead of Rows
+	Answer func(query string) [][]interface{}
+	Cols  int             // columns of an empty result set
+	Tag   string          // command tag; defaults to "SELECT <rows>"
+	Err   *pgconn.PgError // answered instead of a result
+	Times int             // answers this many queries, then the next matching rule takes over; 0 is no limit
+	Wait  <-chan struct{} // if set, the answer is held back until it is closed
+	used  int
+}
+
+//! Starts a fake PostgreSQL for the rest of the test and points pool at it (replicaPool is cleared).
+// A query that no rule answers fails the test.
+func useFakePG(t *testing.T) *fakePG {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakePG{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	config, err := pgxpool.ParseConfig("postgres://test@" + ln.Addr().String() + "/test?sslmode=disable")
+	if err != nil {
+		t.Fatalf("pgxpool.ParseConfig: %v", err)
+	}
+	config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	config.MaxConns = 4
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for name, sql := range primaryStatements {
+			if _, err := conn.Prepare(ctx, name, sql); err != nil {
+				return fmt.Errorf("prepare %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+	p, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		t.Fatalf("pgxpool.NewWithConfig: %v", err)
+	}
+
+	oldPool, oldReplica := pool, replicaPool
+	pool, replicaPool = p, nil
+	t.Cleanup(func() {
+		pool, replicaPool = oldPool, oldReplica
+		p.Close()
+		ln.Close()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, q := range f.unmatched {
+			t.Errorf("fakepg: no rule for query: %s", q)
+		}
+	})
+	return f
+}
+
+// Parameter types of the primaryStatements, as PostgreSQL would describe them
+var fakeStatementParams = map[string][]uint32{
+	stmtInsertMessage:       {25, 25, 25, 25, 1184, 16, 25, 25, 25, 25, 1184, 25, 25, 20},
+	stmtMarkStoredDelivered: {25, 25},
+}
+
+//! Adds a rule answering the queries containing match
+func (f *fakePG) on(match string, rule pgRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule.Match = match
+	f.rules = append(f.rules, &rule)
+}
+
+//! Returns the queries received so far that contain s
+func (f *fakePG) queriesContaining(s string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []string
+	for _, q := range f.queries {
+		if strings.Contains(q, s) {
+			found = append(found, q)
+		}
+	}
+	return found
+}
+
+//! Returns the rule for query, or nil; transaction control and pings need none
+func (f *fakePG) match(query string) *pgRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	for _, rule := range f.rules {
+		if strings.Contains(query, rule.Match) && (rule.Times == 0 || rule.used < rule.Times) {
+			rule.used++
+			return rule
+		}
+	}
+	if !isTxControl(query) && strings.TrimSpace(query) != "-- ping" {
+		f.unmatched = append(f.unmatched, query)
+	}
+	return nil
+}
+
+//! Reports whether query only begins or ends a transaction
+func isTxControl(query string) bool {
+	q := strings.ToLower(strings.TrimSpace(query))
+	return strings.HasPrefix(q, "begin") || q == "commit" || q == "rollback"
+}
+
+//! Serves one client connection until it terminates
+func (f *fakePG) serve(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+
+	startup, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if _, ok := startup.(*pgproto3.CancelRequest); ok {
+		return // the client gave up on a query; the held-back answer is simply never read
+	}
+	if _, ok := startup.(*pgproto3.SSLRequest); ok {
+		conn.Write([]byte("N"))
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range map[string]string{
+		"server_version":              "16.0",
+		"client_encoding":             "UTF8",
+		"standard_conforming_strings": "on",
+		"DateStyle":                   "ISO, MDY",
+		"TimeZone":                    "UTC",
+		"integer_datetimes":           "on",
+	} {
+		backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	txStatus := byte('I')
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	statements := map[string]string{} // prepared statement name -> SQL
+	var portal string                  // SQL of the statement bound last, with its first argument
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+
+		// The extended protocol, for the prepared primaryStatements only
+		switch m := msg.(type) {
+		case *pgproto3.Parse:
+			if _, ok := fakeStatementParams[m.Name]; !ok {
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "0A000", Message: "fakepg: only primaryStatements can be prepared"})
+				continue
+			}
+			statements[m.Name] = m.Query
+			backend.Send(&pgproto3.ParseComplete{})
+			continue
+		case *pgproto3.Describe:
+			if m.ObjectType == 'S' {
+				backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: fakeStatementParams[m.Name]})
+			}
+			backend.Send(&pgproto3.NoData{})
+			continue
+		case *pgproto3.Bind:
+			// Recorded with the first argument (a message ID in every prepared statement), so tests can tell executions apart.
+			// Text is sent as its raw bytes in either format.
+			portal = statements[m.PreparedStatement]
+			if len(m.Parameters) > 0 {
+				portal += " -- $1 = " + string(m.Parameters[0])
+			}
+			backend.Send(&pgproto3.BindComplete{})
+			continue
+		case *pgproto3.Execute:
+			rule := f.match(portal)
+			if rule != nil && rule.Wait != nil {
+				<-rule.Wait
+			}
+			switch {
+			case rule != nil && rule.Err != nil:
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: rule.Err.Code, Message: rule.Err.Message})
+				if txStatus == 'T' {
+					txStatus = 'E'
+				}
+			case rule != nil:
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(rule.Tag)})
+			default:
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "fakepg: no rule for query"})
+				if txStatus == 'T' {
+					txStatus = 'E'
+				}
+			}
+			continue
+		case *pgproto3.Sync:
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+			if err := backend.Flush(); err != nil {
+				return
+			}
+			continue
+		}
+
+		query, ok := msg.(*pgproto3.Query)
+		if !ok {
+			return // Terminate, or a message this fake doesn't speak
+		}
+
+		rule := f.match(query.String)
+		if rule != nil && rule.Wait != nil {
+			<-rule.Wait
+		}
+		switch q := strings.ToLower(strings.TrimSpace(query.String)); {
+		case rule != nil && rule.Err != nil:
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: rule.Err.Code, Message: rule.Err.Message})
+			if txStatus == 'T' {
+				txStatus = 'E'
+			}
+		case rule != nil && rule.Answer != nil:
+			answered := *rule
+			answered.Rows = rule.Answer(query.String)
+			if answered.Rows == nil {
+				answered.Rows = [][]interface{}{}
+			}
+			sendRuleResult(backend, &answered)
+		case rule != nil:
+			sendRuleResult(backend, rule)
+		case strings.HasPrefix(q, "begin"):
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")})
+			txStatus = 'T'
+		case q == "commit" || q == "rollback":
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(strings.ToUpper(q))})
+			txStatus = 'I'
+		case q == "-- ping":
+			backend.Send(&pgproto3.EmptyQueryResponse{})
+		default:
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "fakepg: no rule for query"})
+			if txStatus == 'T' {
+				txStatus = 'E'
+			}
+		}
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		if err := backend.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+//! Sends a rule's result set (if any) and command tag
+func sendRuleResult(backend *pgproto3.Backend, rule *pgRule) {
+	tag := rule.Tag
+	if rule.Rows != nil {
+		cols := rule.Cols
+		if len(rule.Rows) > 0 {
+			cols = len(rule.Rows[0])
+		}
+		fields := make([]pgproto3.FieldDescription, cols)
+		for i := range fields {
+			fields[i] = pgproto3.FieldDescription{Name: []byte("c" + strconv.Itoa(i)), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1}
+			// The first non-null value of a column decides its type
+			for _, row := range rule.Rows {
+				if oid, _ := pgText(row[i]); oid != 0 {
+					fields[i].DataTypeOID = oid
+					break
+				}
+			}
+		}
+		backend.Send(&pgproto3.RowDescription{Fields: fields})
+		for _, row := range rule.Rows {
+			values := make([][]byte, len(row))
+			for i, v := range row {
+				_, values[i] = pgText(v)
+			}
+			backend.Send(&pgproto3.DataRow{Values: values})
+		}
+		if tag == "" {
+			tag = "SELECT " + strconv.Itoa(len(rule.Rows))
+		}
+	}
+	backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+}
+
+//! Returns the type OID and text encoding of a result value; nil encodes NULL.
+// Typed nil pointers keep their type; an untyped nil has OID 0.
+func pgText(v interface{}) (uint32, []byte) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return 25, []byte(v)
+	case *string:
+		if v == nil {
+			return 25, nil
+		}
+		return pgText(*v)
+	case bool:
+		if v {
+			return 16, []byte("t")
+		}
+		return 16, []byte("f")
+	case int:
+		return 20, []byte(strconv.Itoa(v))
+	case int64:
+		return 20, []byte(strconv.FormatInt(v, 10))
+	case *int64:
+		if v == nil {
+			return 20, nil
+		}
+		return pgText(*v)
+	case float64:
+		return 701, []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case time.Time:
+		return 1184, []byte(v.UTC().Format("2006-01-02 15:04:05.999999999Z07:00"))
+	case *time.Time:
+		if v == nil {
+			return 1184, nil
+		}
+		return pgText(*v)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		return 1009, []byte("{" + strings.Join(quoted, ",") + "}")
+	}
+	panic(fmt.Sprintf("fakepg: unsupported value %T", v))
+}
+
+//! Returns a row of messageColumns for msg, as scanMessage reads it
+func messageRecord(msg Message) []interface{} {
+	return []interface{}{msg.MessageID, msg.SenderID, msg.ReceiverID, msg.Content, msg.Timestamp, msg.Read,
+		msg.Status, msg.ContentType, msg.ConversationID, msg.EditedAt, msg.AttachmentID, msg.ExpiresAt,
+		msg.ReplyToMessageID, msg.ForwardedFrom, msg.Version, msg.Seq}
+}
+
+func TestFakePG(t *testing.T) {
+	f := useFakePG(t)
+	sentAt := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	f.on("FROM things", pgRule{Rows: [][]interface{}{{"a", true, int64(7), sentAt, (*time.Time)(nil)}}})
+	f.on("UPDATE things", pgRule{Tag: "UPDATE 2"})
+	f.on("FROM broken", pgRule{Err: &pgconn.PgError{Code: "40P01", Message: "deadlock detected"}})
+
+	var (
+		name  string
+		ok    bool
+		n     int64
+		at    time.Time
+		never *time.Time
+	)
+	err := pool.QueryRow(t.Context(), "SELECT name, ok, n, at, never FROM things WHERE id = $1", "x").Scan(&name, &ok, &n, &at, &never)
+	if err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if name != "a" || !ok || n != 7 || !at.Equal(sentAt) || never != nil {
+		t.Errorf("scanned %q %v %d %v %v", name, ok, n, at, never)
+	}
+	if len(f.queriesContaining("'x'")) != 1 {
+		t.Errorf("the argument was not interpolated: %q", f.queriesContaining("FROM things"))
+	}
+
+	tag, err := pool.Exec(t.Context(), "UPDATE things SET ok = $1", false)
+	if err != nil || tag.RowsAffected() != 2 {
+		t.Errorf("Exec = %v, %v; want 2 rows affected", tag, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if err := pool.QueryRow(t.Context(), "SELECT 1 FROM broken").Scan(&n); !errors.As(err, &pgErr) || pgErr.Code != "40P01" {
+		t.Errorf("QueryRow(broken) = %v, want SQLSTATE 40P01", err)
+	}
+
+	tx, err := pool.Begin(t.Context())
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	tag, err = tx.Exec(t.Context(), stmtInsertMessage, "m1", "alice", "bob", "hi", sentAt, false, "sent",
+		defaultContentType, "", "", (*time.Time)(nil), "", "", int64(1))
+	if err != nil || tag.RowsAffected() != 1 {
+		t.Errorf("Exec(%s) = %v, %v; want 1 row affected", stmtInsertMessage, tag, err)
+	}
+	if err := tx.Commit(t.Context()); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
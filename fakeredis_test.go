@@ -0,0 +1,887 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is an in-process Redis for handler tests: the RESP2 commands the handlers use, on
+// in-memory data. TTLs are recorded but never expire. An unknown command fails the test.
+// Streams support consumer groups; a blocking XREADGROUP waits at most fakeBlockLimit.
+// Lua scripts can't run: a test registers a Go stand-in for each script it needs (see emulate).
+type fakeRedis struct {
+	mu        sync.Mutex
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	zsets     map[string]map[string]float64
+	streams   map[string][]redis.XMessage
+	groups    map[string]map[string]*fakeGroup // stream -> group name -> group
+	ttls      map[string]time.Duration
+	published []redisPublish
+	acked     []string              // stream IDs acknowledged with XACK, in order
+	failing   map[string]string     // command -> error message it answers with
+	scripts   map[string]fakeScript // SHA1 -> stand-in for the Lua script
+	unknown   []string
+	lastMs    int64 // of the last stream entry ID handed out
+	lastSeq   int64
+}
+
+// fakeScript stands in for a Lua script the fake can't run. It is called with the fake locked,
+// and should make the same calls as the script, through run.
+type fakeScript func(r *fakeRedis, keys, args []string) string
+
+// redisPublish is one PUBLISH the fake received
+type redisPublish struct {
+	Channel string
+	Message string
+}
+
+//! Starts a fake Redis for the rest of the test and points redisCli at it
+func useFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	r := &fakeRedis{
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+		zsets:   map[string]map[string]float64{},
+		streams: map[string][]redis.XMessage{},
+		groups:  map[string]map[string]*fakeGroup{},
+		ttls:    map[string]time.Duration{},
+		failing: map[string]string{},
+		scripts: map[string]fakeScript{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	cli := redis.NewClient(&redis.Options{Addr: ln.Addr().String(), Protocol: 2, DisableIndentity: true, ContextTimeoutEnabled: true})
+	old := redisCli
+	redisCli = cli
+	t.Cleanup(func() {
+		redisCli = old
+		cli.Close()
+		ln.Close()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, cmd := range r.unknown {
+			t.Errorf("fakeredis: unsupported command %s", cmd)
+		}
+	})
+	return r
+}
+
+//! Makes every later call of command (e.g. "INCR") answer with an error
+func (r *fakeRedis) fail(command string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failing[command] = "ERR fakeredis: " + strings.ToLower(command) + " failed"
+}
+
+//! Undoes fail: command works again
+func (r *fakeRedis) restore(command string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failing, command)
+}
+
+//! Returns the TTL last set on key, or 0
+func (r *fakeRedis) ttl(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ttls[key]
+}
+
+//! Returns the stream IDs acknowledged so far
+func (r *fakeRedis) acks() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.acked...)
+}
+
+//! Returns the messages published on channel so far
+func (r *fakeRedis) publishedOn(channel string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []string
+	for _, p := range r.published {
+		if p.Channel == channel {
+			messages = append(messages, p.Message)
+		}
+	}
+	return messages
+}
+
+//! Serves one client connection until it closes
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var queued [][]string // commands between MULTI and EXEC
+	inMulti := false
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch name := strings.ToUpper(args[0]); {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			reply = "+OK\r\n"
+		case name == "EXEC":
+			replies := make([]string, len(queued))
+			for i, cmd := range queued {
+				replies[i] = r.exec(cmd)
+			}
+			inMulti = false
+			reply = "*" + strconv.Itoa(len(replies)) + "\r\n" + strings.Join(replies, "")
+		case name == "DISCARD":
+			inMulti = false
+			reply = "+OK\r\n"
+		case inMulti:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = r.exec(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+//! Reads one RESP command (an array of bulk strings)
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("fakeredis: bad command header %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("fakeredis: bad bulk header %q", header)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// RESP2 replies
+func respOK() string              { return "+OK\r\n" }
+func respInt(n int64) string      { return ":" + strconv.FormatInt(n, 10) + "\r\n" }
+func respNil() string             { return "$-1\r\n" }
+func respError(msg string) string { return "-" + msg + "\r\n" }
+func respBulk(s string) string    { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+func respArray(items []string) string {
+	return "*" + strconv.Itoa(len(items)) + "\r\n" + strings.Join(items, "")
+}
+
+//! Returns the bulk-string array reply of values
+func respBulks(values []string) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = respBulk(v)
+	}
+	return respArray(items)
+}
+
+//! Runs one command and returns its encoded reply
+func (r *fakeRedis) exec(args []string) string {
+	name := strings.ToUpper(args[0])
+	if name == "XREADGROUP" {
+		return r.xreadgroup(args) // may block, so it takes the lock itself
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if msg, ok := r.failing[name]; ok {
+		return respError(msg)
+	}
+	return r.run(args)
+}
+
+//! Runs one command with the fake locked and returns its encoded reply
+func (r *fakeRedis) run(args []string) string {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "EVALSHA", "EVAL":
+		sha := args[1]
+		if name == "EVAL" {
+			sha = fmt.Sprintf("%x", sha1.Sum([]byte(args[1])))
+		}
+		script, ok := r.scripts[sha]
+		if !ok && name == "EVALSHA" {
+			return respError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		if ok {
+			numKeys, _ := strconv.Atoi(args[2])
+			return script(r, args[3:3+numKeys], args[3+numKeys:])
+		}
+	case "HELLO":
+		return respError("ERR unknown command 'HELLO'") // keeps the client on RESP2
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return respOK()
+	case "GET":
+		v, ok := r.strings[args[1]]
+		if !ok {
+			return respNil()
+		}
+		return respBulk(v)
+	case "SET":
+		key, value := args[1], args[2]
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, exists := r.strings[key]; exists {
+					return respNil()
+				}
+			case "EX":
+				s, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(s) * time.Second
+				i++
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		r.strings[key] = value
+		if ttl > 0 {
+			r.ttls[key] = ttl
+		}
+		return respOK()
+	case "INCR":
+		n, _ := strconv.ParseInt(r.strings[args[1]], 10, 64)
+		n++
+		r.strings[args[1]] = strconv.FormatInt(n, 10)
+		return respInt(n)
+	case "EXPIRE":
+		s, _ := strconv.Atoi(args[2])
+		r.ttls[args[1]] = time.Duration(s) * time.Second
+		return respInt(1)
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		r.ttls[args[1]] = time.Duration(ms) * time.Millisecond
+		return respInt(1)
+	case "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if r.delete(key) {
+				n++
+			}
+		}
+		return respInt(n)
+	case "EXISTS":
+		var n int64
+		for _, key := range args[1:] {
+			if r.exists(key) {
+				n++
+			}
+		}
+		return respInt(n)
+	case "PUBLISH":
+		r.published = append(r.published, redisPublish{Channel: args[1], Message: args[2]})
+		return respInt(0)
+	case "HSET":
+		h := r.hashes[args[1]]
+		if h == nil {
+			h = map[string]string{}
+			r.hashes[args[1]] = h
+		}
+		var added int64
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return respInt(added)
+	case "HGET":
+		v, ok := r.hashes[args[1]][args[2]]
+		if !ok {
+			return respNil()
+		}
+		return respBulk(v)
+	case "HMGET":
+		items := make([]string, 0, len(args)-2)
+		for _, field := range args[2:] {
+			if v, ok := r.hashes[args[1]][field]; ok {
+				items = append(items, respBulk(v))
+			} else {
+				items = append(items, respNil())
+			}
+		}
+		return respArray(items)
+	case "HGETALL":
+		h := r.hashes[args[1]]
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		var values []string
+		for _, field := range fields {
+			values = append(values, field, h[field])
+		}
+		return respBulks(values)
+	case "ZADD":
+		z := r.zsets[args[1]]
+		if z == nil {
+			z = map[string]float64{}
+			r.zsets[args[1]] = z
+		}
+		var added int64
+		for i := 2; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := z[args[i+1]]; !ok {
+				added++
+			}
+			z[args[i+1]] = score
+		}
+		return respInt(added)
+	case "ZREM":
+		var n int64
+		for _, member := range args[2:] {
+			if _, ok := r.zsets[args[1]][member]; ok {
+				delete(r.zsets[args[1]], member)
+				n++
+			}
+		}
+		return respInt(n)
+	case "ZRANGEBYSCORE":
+		return respBulks(r.zrangeByScore(args))
+	case "XADD":
+		return respBulk(r.xadd(args))
+	case "XACK":
+		var n int64
+		if g := r.groups[args[1]][args[2]]; g != nil {
+			for _, id := range args[3:] {
+				if _, ok := g.pending[id]; ok {
+					delete(g.pending, id)
+					n++
+				}
+			}
+		}
+		r.acked = append(r.acked, args[3:]...)
+		return respInt(n)
+	case "XLEN":
+		return respInt(int64(len(r.streams[args[1]])))
+	case "XGROUP":
+		return r.xgroup(args)
+	case "XAUTOCLAIM":
+		return r.xautoclaim(args)
+	case "XPENDING":
+		return r.xpending(args)
+	case "XINFO":
+		return r.xinfo(args)
+	case "XTRIM":
+		return r.xtrim(args)
+	}
+	r.unknown = append(r.unknown, strings.Join(args, " "))
+	return respError("ERR fakeredis: unknown command " + name)
+}
+
+//! Runs fn in place of script, which the fake can't run itself
+func (r *fakeRedis) emulate(script *redis.Script, fn fakeScript) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scripts[script.Hash()] = fn
+}
+
+//! Removes key of any type; reports whether it existed
+func (r *fakeRedis) delete(key string) bool {
+	existed := r.exists(key)
+	delete(r.strings, key)
+	delete(r.hashes, key)
+	delete(r.zsets, key)
+	delete(r.streams, key)
+	delete(r.ttls, key)
+	return existed
+}
+
+//! Reports whether key exists, of any type
+func (r *fakeRedis) exists(key string) bool {
+	_, s := r.strings[key]
+	return s || len(r.hashes[key]) > 0 || len(r.zsets[key]) > 0 || len(r.streams[key]) > 0
+}
+
+//! ZRANGEBYSCORE key min max [LIMIT offset count], members in score order
+func (r *fakeRedis) zrangeByScore(args []string) []string {
+	bound := func(s string) float64 {
+		switch s {
+		case "-inf":
+			return -math.MaxFloat64
+		case "+inf", "inf":
+			return math.MaxFloat64
+		}
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	lo, hi := bound(args[2]), bound(args[3])
+	var members []string
+	for member, score := range r.zsets[args[1]] {
+		if score >= lo && score <= hi {
+			members = append(members, member)
+		}
+	}
+	z := r.zsets[args[1]]
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	if len(args) == 7 && strings.ToUpper(args[4]) == "LIMIT" {
+		offset, _ := strconv.Atoi(args[5])
+		count, _ := strconv.Atoi(args[6])
+		members = members[min(offset, len(members)):]
+		if count >= 0 && count < len(members) {
+			members = members[:count]
+		}
+	}
+	return members
+}
+
+//! XADD key [NOMKSTREAM] [MAXLEN ...] * field value ...; returns the new entry ID
+func (r *fakeRedis) xadd(args []string) string {
+	i := 2
+	for args[i] != "*" {
+		i++
+	}
+	// Like Redis: the current time in milliseconds, and a sequence for entries within one millisecond
+	if ms := time.Now().UnixMilli(); ms > r.lastMs {
+		r.lastMs, r.lastSeq = ms, 0
+	} else {
+		r.lastSeq++
+	}
+	id := strconv.FormatInt(r.lastMs, 10) + "-" + strconv.FormatInt(r.lastSeq, 10)
+	values := map[string]interface{}{}
+	for j := i + 1; j+1 < len(args); j += 2 {
+		values[args[j]] = args[j+1]
+	}
+	r.streams[args[1]] = append(r.streams[args[1]], redis.XMessage{ID: id, Values: values})
+	return id
+}
+
+// fakeGroup is a consumer group of a fake stream
+type fakeGroup struct {
+	lastDelivered string                  // ID of the last entry delivered with ">"
+	pending       map[string]*fakePending // stream ID -> its delivery
+	consumers     map[string]time.Time    // consumer -> when it last read or claimed
+}
+
+// fakePending is an entry delivered to a consumer and not yet acknowledged
+type fakePending struct {
+	consumer    string
+	deliveredAt time.Time
+	count       int64
+}
+
+// Longest a fake XREADGROUP BLOCK waits, whatever the client asked for, so stopping workers is quick
+const fakeBlockLimit = 20 * time.Millisecond
+
+//! Reports whether stream ID a sorts before b
+func streamIDLess(a, b string) bool {
+	parse := func(id string) (int64, int64) {
+		ms, seq, _ := strings.Cut(id, "-")
+		m, _ := strconv.ParseInt(ms, 10, 64)
+		n, _ := strconv.ParseInt(seq, 10, 64)
+		return m, n
+	}
+	am, as := parse(a)
+	bm, bs := parse(b)
+	return am < bm || (am == bm && as < bs)
+}
+
+//! Encodes stream entries as RESP: [[id, [field, value, ...]], ...]
+func respEntries(entries []redis.XMessage) string {
+	items := make([]string, len(entries))
+	for i, e := range entries {
+		fields := make([]string, 0, len(e.Values))
+		for field := range e.Values {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		var kv []string
+		for _, field := range fields {
+			kv = append(kv, field, fmt.Sprint(e.Values[field]))
+		}
+		items[i] = respArray([]string{respBulk(e.ID), respBulks(kv)})
+	}
+	return respArray(items)
+}
+
+//! XGROUP CREATE key group id [MKSTREAM] | CREATECONSUMER key group consumer | DELCONSUMER key group consumer
+func (r *fakeRedis) xgroup(args []string) string {
+	stream, name := args[2], args[3]
+	switch strings.ToUpper(args[1]) {
+	case "CREATE":
+		if r.groups[stream][name] != nil {
+			return respError("BUSYGROUP Consumer Group name already exists")
+		}
+		last := "0-0"
+		if entries := r.streams[stream]; args[4] == "$" && len(entries) > 0 {
+			last = entries[len(entries)-1].ID
+		}
+		if r.groups[stream] == nil {
+			r.groups[stream] = map[string]*fakeGroup{}
+		}
+		r.groups[stream][name] = &fakeGroup{lastDelivered: last, pending: map[string]*fakePending{}, consumers: map[string]time.Time{}}
+		return respOK()
+	case "CREATECONSUMER":
+		g := r.groups[stream][name]
+		if _, ok := g.consumers[args[4]]; ok {
+			return respInt(0)
+		}
+		g.consumers[args[4]] = time.Now()
+		return respInt(1)
+	case "DELCONSUMER":
+		g := r.groups[stream][name]
+		var pending int64
+		for id, p := range g.pending {
+			if p.consumer == args[4] {
+				delete(g.pending, id)
+				pending++
+			}
+		}
+		delete(g.consumers, args[4])
+		return respInt(pending)
+	}
+	return respError("ERR fakeredis: unsupported XGROUP " + args[1])
+}
+
+//! XREADGROUP GROUP group consumer [COUNT n] [BLOCK ms] STREAMS key id, for one stream.
+// ">" reads new entries, any other ID the consumer's own pending ones. BLOCK waits at most fakeBlockLimit.
+func (r *fakeRedis) xreadgroup(args []string) string {
+	group, consumer := args[2], args[3]
+	count, block := -1, false
+	var stream, from string
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+			i++
+		case "BLOCK":
+			block = true
+			i++
+		case "STREAMS":
+			stream, from = args[i+1], args[i+2]
+			i = len(args)
+		}
+	}
+
+	deadline := time.Now().Add(fakeBlockLimit)
+	for {
+		r.mu.Lock()
+		if msg, ok := r.failing["XREADGROUP"]; ok {
+			r.mu.Unlock()
+			return respError(msg)
+		}
+		g := r.groups[stream][group]
+		if g == nil {
+			r.mu.Unlock()
+			return respError("NOGROUP No such key '" + stream + "' or consumer group '" + group + "'")
+		}
+		g.consumers[consumer] = time.Now()
+		var read []redis.XMessage
+		for _, e := range r.streams[stream] {
+			if count >= 0 && len(read) == count {
+				break
+			}
+			if from == ">" && streamIDLess(g.lastDelivered, e.ID) {
+				g.lastDelivered = e.ID
+				g.pending[e.ID] = &fakePending{consumer: consumer, deliveredAt: time.Now(), count: 1}
+				read = append(read, e)
+			} else if p := g.pending[e.ID]; from != ">" && p != nil && p.consumer == consumer && streamIDLess(from, e.ID) {
+				read = append(read, e)
+			}
+		}
+		r.mu.Unlock()
+
+		if len(read) > 0 || from != ">" {
+			return respArray([]string{respArray([]string{respBulk(stream), respEntries(read)})})
+		}
+		if !block || time.Now().After(deadline) {
+			return "*-1\r\n" // nothing new: redis.Nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//! XAUTOCLAIM key group consumer min-idle-time start [COUNT n]; scans the whole pending list at once
+func (r *fakeRedis) xautoclaim(args []string) string {
+	g := r.groups[args[1]][args[2]]
+	if g == nil {
+		return respError("NOGROUP No such key or consumer group")
+	}
+	consumer, start := args[3], args[5]
+	minIdle, _ := strconv.ParseInt(args[4], 10, 64)
+	count := 100
+	if len(args) > 7 && strings.ToUpper(args[6]) == "COUNT" {
+		count, _ = strconv.Atoi(args[7])
+	}
+
+	var claimed []redis.XMessage
+	for _, e := range r.streams[args[1]] {
+		p := g.pending[e.ID]
+		if p == nil || streamIDLess(e.ID, start) || time.Since(p.deliveredAt) < time.Duration(minIdle)*time.Millisecond {
+			continue
+		}
+		if len(claimed) == count {
+			break
+		}
+		p.consumer, p.deliveredAt = consumer, time.Now()
+		p.count++
+		claimed = append(claimed, e)
+	}
+	g.consumers[consumer] = time.Now()
+	return respArray([]string{respBulk("0-0"), respEntries(claimed), respArray(nil)})
+}
+
+//! XPENDING key group, the summary, or XPENDING key group [IDLE ms] start end count [consumer];
+// start and end may be exclusive, (id
+func (r *fakeRedis) xpending(args []string) string {
+	g := r.groups[args[1]][args[2]]
+	if g == nil {
+		return respError("NOGROUP No such key or consumer group")
+	}
+	var ids []string
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return streamIDLess(ids[i], ids[j]) })
+
+	if len(args) == 3 {
+		if len(ids) == 0 {
+			return respArray([]string{respInt(0), respNil(), respNil(), "*-1\r\n"})
+		}
+		perConsumer := map[string]int64{}
+		for _, id := range ids {
+			perConsumer[g.pending[id].consumer]++
+		}
+		var names []string
+		for name := range perConsumer {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		consumers := make([]string, len(names))
+		for i, name := range names {
+			consumers[i] = respBulks([]string{name, strconv.FormatInt(perConsumer[name], 10)})
+		}
+		return respArray([]string{respInt(int64(len(ids))), respBulk(ids[0]), respBulk(ids[len(ids)-1]), respArray(consumers)})
+	}
+
+	rest := args[3:]
+	var minIdle time.Duration
+	if strings.ToUpper(rest[0]) == "IDLE" {
+		ms, _ := strconv.ParseInt(rest[1], 10, 64)
+		minIdle, rest = time.Duration(ms)*time.Millisecond, rest[2:]
+	}
+	count, _ := strconv.Atoi(rest[2])
+	start, startExclusive := strings.CutPrefix(rest[0], "(")
+	end, endExclusive := strings.CutPrefix(rest[1], "(")
+	var items []string
+	for _, id := range ids {
+		p := g.pending[id]
+		switch {
+		case len(items) == count:
+		case start != "-" && (streamIDLess(id, start) || startExclusive && id == start),
+			end != "+" && (streamIDLess(end, id) || endExclusive && id == end):
+		case len(rest) > 3 && p.consumer != rest[3], time.Since(p.deliveredAt) < minIdle:
+		default:
+			items = append(items, respArray([]string{respBulk(id), respBulk(p.consumer),
+				respInt(time.Since(p.deliveredAt).Milliseconds()), respInt(p.count)}))
+		}
+	}
+	return respArray(items)
+}
+
+//! XINFO GROUPS key | XINFO CONSUMERS key group
+func (r *fakeRedis) xinfo(args []string) string {
+	groups := r.groups[args[2]]
+	switch strings.ToUpper(args[1]) {
+	case "GROUPS":
+		if _, ok := r.streams[args[2]]; !ok && groups == nil {
+			return respError("ERR no such key")
+		}
+		var names []string
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items := make([]string, len(names))
+		for i, name := range names {
+			g := groups[name]
+			var lag, read int64
+			for _, e := range r.streams[args[2]] {
+				if streamIDLess(g.lastDelivered, e.ID) {
+					lag++
+				} else {
+					read++
+				}
+			}
+			items[i] = respArray([]string{
+				respBulk("name"), respBulk(name),
+				respBulk("consumers"), respInt(int64(len(g.consumers))),
+				respBulk("pending"), respInt(int64(len(g.pending))),
+				respBulk("last-delivered-id"), respBulk(g.lastDelivered),
+				respBulk("entries-read"), respInt(read),
+				respBulk("lag"), respInt(lag),
+			})
+		}
+		return respArray(items)
+	case "CONSUMERS":
+		g := groups[args[3]]
+		if g == nil {
+			return respError("NOGROUP No such key or consumer group")
+		}
+		var names []string
+		for name := range g.consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items := make([]string, len(names))
+		for i, name := range names {
+			var pending int64
+			for _, p := range g.pending {
+				if p.consumer == name {
+					pending++
+				}
+			}
+			idle := time.Since(g.consumers[name]).Milliseconds()
+			items[i] = respArray([]string{
+				respBulk("name"), respBulk(name),
+				respBulk("pending"), respInt(pending),
+				respBulk("idle"), respInt(idle),
+				respBulk("inactive"), respInt(idle),
+			})
+		}
+		return respArray(items)
+	}
+	return respError("ERR fakeredis: unsupported XINFO " + args[1])
+}
+
+//! XTRIM key MAXLEN [=|~] n: drops the oldest entries beyond n
+func (r *fakeRedis) xtrim(args []string) string {
+	n, _ := strconv.Atoi(args[len(args)-1])
+	entries := r.streams[args[1]]
+	if len(entries) <= n {
+		return respInt(0)
+	}
+	trimmed := len(entries) - n
+	r.streams[args[1]] = append([]redis.XMessage(nil), entries[trimmed:]...)
+	return respInt(int64(trimmed))
+}
+
+//! Returns the consumers registered in the stream's group
+func (r *fakeRedis) consumers(stream, group string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	if g := r.groups[stream][group]; g != nil {
+		for name := range g.consumers {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//! Returns the IDs of the group's pending entries, oldest first
+func (r *fakeRedis) pending(stream, group string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []string
+	if g := r.groups[stream][group]; g != nil {
+		for id := range g.pending {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return streamIDLess(ids[i], ids[j]) })
+	return ids
+}
+
+//! Returns the entries added to stream so far
+func (r *fakeRedis) entries(stream string) []redis.XMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]redis.XMessage(nil), r.streams[stream]...)
+}
+
+func TestFakeRedis(t *testing.T) {
+	r := useFakeRedis(t)
+	c := t.Context()
+
+	pipe := redisCli.TxPipeline()
+	incr := pipe.Incr(c, "counter")
+	pipe.Expire(c, "counter", time.Minute)
+	if _, err := pipe.Exec(c); err != nil {
+		t.Fatalf("TxPipeline: %v", err)
+	}
+	if incr.Val() != 1 || r.ttl("counter") != time.Minute {
+		t.Errorf("INCR = %d, TTL %v; want 1, 1m", incr.Val(), r.ttl("counter"))
+	}
+
+	if err := redisCli.Get(c, "missing").Err(); err != redis.Nil {
+		t.Errorf("GET missing = %v, want redis.Nil", err)
+	}
+	if ok, _ := redisCli.SetNX(c, "k", "v", time.Hour).Result(); !ok {
+		t.Error("SET NX on a new key failed")
+	}
+	if ok, _ := redisCli.SetNX(c, "k", "w", time.Hour).Result(); ok {
+		t.Error("SET NX on an existing key succeeded")
+	}
+
+	redisCli.Publish(c, "chan", "hello")
+	if got := r.publishedOn("chan"); len(got) != 1 || got[0] != "hello" {
+		t.Errorf("published %q, want [hello]", got)
+	}
+
+	if _, err := redisCli.XAdd(c, &redis.XAddArgs{Stream: "s", Values: map[string]interface{}{"a": "1"}}).Result(); err != nil {
+		t.Fatalf("XADD: %v", err)
+	}
+	if got := r.entries("s"); len(got) != 1 || got[0].Values["a"] != "1" {
+		t.Errorf("stream entries = %v", got)
+	}
+
+	r.fail("INCR")
+	if err := redisCli.Incr(c, "counter").Err(); err == nil {
+		t.Error("INCR succeeded after fail(INCR)")
+	}
+}
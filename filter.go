@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// ContentFilter decides whether message content is acceptable.
+// Check returns the content with every flagged word masked, and the flagged words (none if clean).
+type ContentFilter interface {
+	Check(content string) (masked string, flagged []string)
+}
+
+// Active filter; nil when no banned words are configured (BANNED_WORDS / BANNED_WORDS_FILE)
+var contentFilter ContentFilter
+
+// What happens to flagged content, configured with FILTER_MODE:
+// "reject" (400) or "mask" (flagged words replaced with asterisks)
+var filterMode = "reject"
+
+var errContentFlagged = errors.New("content contains words that are not allowed")
+
+// wordListFilter flags whole words from a banned list, case-insensitively.
+// Matching is on whole words only, so a banned word inside a longer word ("class" for "ass") is not flagged.
+type wordListFilter struct {
+	banned map[string]bool // folded with foldWord
+}
+
+//! Builds a filter from a list of banned words; blank entries are ignored
+func newWordListFilter(words []string) *wordListFilter {
+	f := &wordListFilter{banned: make(map[string]bool)}
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			f.banned[foldWord(w)] = true
+		}
+	}
+	return f
+}
+
+//! Splits content into words (runs of letters, digits and combining marks in any script)
+// and masks every banned one rune by rune, leaving everything else untouched.
+func (f *wordListFilter) Check(content string) (string, []string) {
+	var flagged []string
+	var out strings.Builder
+	runes := []rune(content)
+
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			out.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		if f.banned[foldWord(word)] {
+			flagged = append(flagged, word)
+			out.WriteString(strings.Repeat("*", j-i))
+		} else {
+			out.WriteString(word)
+		}
+		i = j
+	}
+
+	if len(flagged) == 0 {
+		return content, nil
+	}
+	return out.String(), flagged
+}
+
+//! Reports whether r belongs to a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r)
+}
+
+//! Case-folds a word so "BAD", "Bad" and "bad" compare equal in every script
+func foldWord(w string) string {
+	return strings.Map(func(r rune) rune {
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, w)
+}
+
+//! Sets up the content filter from FILTER_MODE and the banned words in
+// BANNED_WORDS (comma-separated) and/or BANNED_WORDS_FILE (one per line, # starts a comment).
+// With no banned words the filter stays disabled.
+func loadContentFilter() error {
+	switch mode := os.Getenv("FILTER_MODE"); mode {
+	case "":
+	case "reject", "mask":
+		filterMode = mode
+	default:
+		return fmt.Errorf("invalid FILTER_MODE %q: want reject or mask", mode)
+	}
+
+	var words []string
+	if v := os.Getenv("BANNED_WORDS"); v != "" {
+		words = append(words, strings.Split(v, ",")...)
+	}
+	if path := os.Getenv("BANNED_WORDS_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open BANNED_WORDS_FILE: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			words = append(words, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("read BANNED_WORDS_FILE: %w", err)
+		}
+	}
+
+	filter := newWordListFilter(words)
+	if len(filter.banned) > 0 {
+		contentFilter = filter
+	}
+	return nil
+}
+
+//! Runs content through the content filter.
+// Returns errContentFlagged in reject mode, or the masked content in mask mode.
+func filterContent(content string) (string, error) {
+	if contentFilter == nil {
+		return content, nil
+	}
+	masked, flagged := contentFilter.Check(content)
+	if len(flagged) == 0 {
+		return content, nil
+	}
+	if filterMode == "mask" {
+		return masked, nil
+	}
+	return "", errContentFlagged
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//! Loads the content filter from the given FILTER_MODE and BANNED_WORDS for the rest of the test
+func useContentFilter(t *testing.T, mode, banned string) {
+	t.Helper()
+	oldFilter, oldMode := contentFilter, filterMode
+	t.Cleanup(func() { contentFilter, filterMode = oldFilter, oldMode })
+	t.Setenv("FILTER_MODE", mode)
+	t.Setenv("BANNED_WORDS", banned)
+	t.Setenv("BANNED_WORDS_FILE", "")
+	if err := loadContentFilter(); err != nil {
+		t.Fatalf("loadContentFilter: %v", err)
+	}
+}
+
+func TestWordListFilter(t *testing.T) {
+	f := newWordListFilter([]string{"darn", " heck ", "", "плохо"})
+
+	tests := []struct {
+		name        string
+		content     string
+		wantMasked  string
+		wantFlagged []string
+	}{
+		{"clean", "Hello, world!", "Hello, world!", nil},
+		{"whole word", "well darn it", "well **** it", []string{"darn"}},
+		{"any case, around punctuation", "DARN! Heck...", "****! ****...", []string{"DARN", "Heck"}},
+		{"inside a longer word", "darned checked hecklers", "darned checked hecklers", nil},
+		{"other scripts", "это ПЛОХО", "это *****", []string{"ПЛОХО"}},
+		{"digits belong to the word", "darn2 2darn", "darn2 2darn", nil},
+		{"one asterisk per character", "плохо darn", "***** ****", []string{"плохо", "darn"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masked, flagged := f.Check(tt.content)
+			if masked != tt.wantMasked || !reflect.DeepEqual(flagged, tt.wantFlagged) {
+				t.Errorf("Check(%q) = %q, %q; want %q, %q", tt.content, masked, flagged, tt.wantMasked, tt.wantFlagged)
+			}
+		})
+	}
+}
+
+func TestLoadContentFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banned.txt")
+	if err := os.WriteFile(path, []byte("# one word per line\nfrak   # from a show\n\ngorram\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	useContentFilter(t, "mask", "darn")
+	t.Setenv("BANNED_WORDS_FILE", path)
+	if err := loadContentFilter(); err != nil {
+		t.Fatalf("loadContentFilter: %v", err)
+	}
+	// Words from both sources; the comments are not words
+	if masked, _ := contentFilter.Check("darn frak gorram one show"); masked != "**** **** ****** one show" {
+		t.Errorf("masked = %q", masked)
+	}
+
+	t.Setenv("FILTER_MODE", "shout")
+	if err := loadContentFilter(); err == nil || !strings.Contains(err.Error(), "FILTER_MODE") {
+		t.Errorf("FILTER_MODE=shout: err = %v, want an error naming FILTER_MODE", err)
+	}
+
+	// Nothing banned leaves the filter off
+	contentFilter = nil
+	t.Setenv("FILTER_MODE", "")
+	t.Setenv("BANNED_WORDS", " , ")
+	t.Setenv("BANNED_WORDS_FILE", "")
+	if err := loadContentFilter(); err != nil || contentFilter != nil {
+		t.Errorf("no banned words: err = %v, filter = %v; want no filter", err, contentFilter)
+	}
+}
+
+func TestSendFiltersContent(t *testing.T) {
+	body := func(content string) string {
+		return `{"receiver_id": "` + bobID + `", "content": "` + content + `"}`
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		_, r := useSendFakes(t)
+		useContentFilter(t, "reject", "darn")
+		rec := postMessage(t, aliceID, body("well darn it"), nil)
+		if rec.Code != 400 || !strings.Contains(rec.Body.String(), errContentFlagged.Error()) {
+			t.Errorf("flagged send = %d %s, want 400 %q", rec.Code, rec.Body.String(), errContentFlagged)
+		}
+		if rec := postMessage(t, aliceID, body("darned good"), nil); rec.Code != 200 {
+			t.Errorf("clean send = %d %s, want 200", rec.Code, rec.Body.String())
+		}
+		entries := r.entries("message_stream")
+		if len(entries) != 1 || entries[0].Values["content"] != "darned good" {
+			t.Errorf("stream = %v, want only the clean message, untouched", entries)
+		}
+	})
+
+	t.Run("mask", func(t *testing.T) {
+		_, r := useSendFakes(t)
+		useContentFilter(t, "mask", "darn")
+		for _, content := range []string{"well darn it", "darned good"} {
+			if rec := postMessage(t, aliceID, body(content), nil); rec.Code != 200 {
+				t.Fatalf("send %q = %d %s, want 200", content, rec.Code, rec.Body.String())
+			}
+		}
+		entries := r.entries("message_stream")
+		if len(entries) != 2 || entries[0].Values["content"] != "well **** it" || entries[1].Values["content"] != "darned good" {
+			t.Errorf("stream = %v, want the flagged word masked and the clean message untouched", entries)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// ForwardRequest is the body of POST /messages/:id/forward
+type ForwardRequest struct {
+	ReceiverID     string `json:"receiver_id"`
+	ConversationID string `json:"conversation_id"`
+}
+
+//! Handles forwarding a stored message to another user or group conversation.
+// The copy keeps the original's content, content type and attachment, and records the source in forwarded_from.
+func forwardMessage(c echo.Context) error {
+	sourceID := c.Param("id")
+	me := authUserID(c)
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	var req ForwardRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+	req.ReceiverID = normalizeUserID(req.ReceiverID)
+
+	// Load the original; deleted and expired messages can't be forwarded
+	var source Message
+	err = pool.QueryRow(c.Request().Context(), `
+		SELECT sender_id, receiver_id, COALESCE(conversation_id, ''), content, content_type, COALESCE(attachment_id, '')
+		FROM messages
+		WHERE message_id = $1 AND `+visibleMessage,
+		sourceID).Scan(&source.SenderID, &source.ReceiverID, &source.ConversationID, &source.Content, &source.ContentType, &source.AttachmentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(404, map[string]string{"error": "Message not found"})
+	}
+	if err != nil {
+		logFor(c).Error("Failed to load message to forward", "error", err, "message_id", sourceID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to load message"})
+	}
+
+	// Only someone who can see the original may forward it
+	canSee, err := canSeeMessage(c.Request().Context(), source, me)
+	if err != nil {
+		logFor(c).Error("Failed to check conversation membership", "error", err, "conversation_id", source.ConversationID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to check conversation membership"})
+	}
+	if !canSee {
+		return c.JSON(403, map[string]string{"error": "Not a participant in this message's conversation"})
+	}
+
+	// The forward goes through the same recipient checks and rate limit as a new message
+	status, reason, err := checkRecipient(c.Request().Context(), me, req.ReceiverID, req.ConversationID)
+	if err != nil {
+		logFor(c).Error("Failed to check recipient", "error", err, "sender_id", me)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to check recipient"})
+	}
+	if status != 0 {
+		return c.JSON(status, map[string]string{"error": reason})
+	}
+
+	allowed, rate, err := allowSend(c.Request().Context(), me)
+	if err != nil {
+		logFor(c).Error("Failed to check send rate limit", "error", err, "sender_id", me)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to check rate limit"})
+	}
+	setRateLimitHeaders(c, rate)
+	if !allowed {
+		c.Response().Header().Set("Retry-After", strconv.FormatInt(rate.ResetInSeconds, 10))
+		return c.JSON(429, map[string]string{"error": "Rate limit exceeded"})
+	}
+
+	id := uuid.New().String()
+	sentAt := time.Now().UTC().Format(streamTimeFormat)
+
+	values := map[string]interface{}{
+		"message_id":      id,
+		"sender_id":       me,
+		"receiver_id":     req.ReceiverID,
+		"content":         source.Content,
+		"timestamp":       sentAt,
+		"read":            false,
+		"status":          "sent",
+		"content_type":    source.ContentType,
+		"conversation_id": req.ConversationID,
+		"attachment_id":   source.AttachmentID,
+		"forwarded_from":  sourceID,
+	}
+
+	if err := enqueueMessage(c.Request().Context(), values); err != nil {
+		logFor(c).Error("Failed to queue forwarded message", "error", err, "forwarded_from", sourceID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to add message to stream"})
+	}
+
+	logFor(c).Info("Message forwarded", "message_id", id, "forwarded_from", sourceID, "sender_id", me)
+	return queuedResponse(c, version, id, sentAt)
+}
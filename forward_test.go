@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A third user for conversations that need someone besides alice and bob
+const carolID = "c4a1d2e3-5f60-4b7c-8d9e-0a1b2c3d4e5f"
+
+//! Forwards message id to body's recipient as user and returns the response
+func forward(t *testing.T, user, id, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/messages/"+id+"/forward", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	c.Set(authUserKey, user)
+	if err := forwardMessage(c); err != nil {
+		t.Fatalf("forwardMessage returned %v", err)
+	}
+	return rec
+}
+
+func TestForwardMessage(t *testing.T) {
+	f, r := useSendFakes(t)
+	// m1 is an image alice sent bob; any other ID is gone
+	f.on("content_type, COALESCE(attachment_id, '')", pgRule{Answer: func(query string) [][]interface{} {
+		if !strings.Contains(query, "'m1'") {
+			return nil
+		}
+		return [][]interface{}{{aliceID, bobID, "", "look at this", "image/png", "att-1"}}
+	}, Cols: 6})
+	// alice and bob are not a group, so they are each other's participants
+	f.on("FROM conversations WHERE conversation_id", pgRule{Rows: [][]interface{}{{true}}})
+
+	rec := forward(t, bobID, "m1", `{"receiver_id": "`+carolID+`"}`)
+	if rec.Code != 200 {
+		t.Fatalf("forward: status = %d (body %s)", rec.Code, rec.Body.String())
+	}
+	entries := r.entries("message_stream")
+	if len(entries) != 1 {
+		t.Fatalf("%d stream entries, want 1", len(entries))
+	}
+	msg, err := parseStreamMessage(entries[0].Values)
+	if err != nil {
+		t.Fatalf("parseStreamMessage: %v", err)
+	}
+	// A copy from the forwarder, tagged with where it came from
+	if msg.SenderID != bobID || msg.ReceiverID != carolID || msg.Content != "look at this" ||
+		msg.ContentType != "image/png" || msg.AttachmentID != "att-1" || msg.ForwardedFrom != "m1" {
+		t.Errorf("forwarded entry = %+v, want bob -> carol copying m1's content, type and attachment", msg)
+	}
+	if msg.MessageID == "m1" {
+		t.Error("the forward reuses the original's message_id")
+	}
+
+	refused := []struct {
+		name, user, id string
+		wantStatus     int
+	}{
+		{"caller isn't in the conversation", carolID, "m1", 403},
+		{"deleted or missing original", bobID, "gone", 404},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := forward(t, tt.user, tt.id, `{"receiver_id": "`+aliceID+`"}`)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d (body %s), want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+		})
+	}
+	if got := len(r.entries("message_stream")); got != 1 {
+		t.Errorf("%d stream entries, want still 1", got)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Upper bound on the readiness checks so a hung dependency can't stall the probe
+const readinessTimeout = 2 * time.Second
+
+//! Liveness probe: the process is up and serving HTTP
+func healthz(c echo.Context) error {
+	return c.JSON(200, map[string]string{"status": "ok"})
+}
+
+//! Readiness probe: pings PostgreSQL and Redis and reports 503 with the failing dependencies
+func readyz(c echo.Context) error {
+	checkCtx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]string{"postgres": "ok", "redis": "ok"}
+	var down []string
+
+	if err := pool.Ping(checkCtx); err != nil {
+		logFor(c).Warn("Readiness check failed", "dependency", "postgres", "error", err)
+		checks["postgres"] = err.Error()
+		down = append(down, "postgres")
+	}
+	if err := redisCli.Ping(checkCtx).Err(); err != nil {
+		logFor(c).Warn("Readiness check failed", "dependency", "redis", "error", err)
+		checks["redis"] = err.Error()
+		down = append(down, "redis")
+	}
+
+	if len(down) > 0 {
+		return c.JSON(503, map[string]interface{}{"status": "unavailable", "down": down, "checks": checks})
+	}
+	return c.JSON(200, map[string]interface{}{"status": "ok", "checks": checks})
+}
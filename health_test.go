@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/labstack/echo/v4"
+)
+
+//! Runs a probe handler and returns its status and decoded body
+func probe(t *testing.T, handler echo.HandlerFunc) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if err := handler(c); err != nil {
+		t.Fatalf("probe returned %v", err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestProbes(t *testing.T) {
+	tests := []struct {
+		name       string
+		postgres   bool
+		redis      bool
+		wantStatus int
+		wantDown   []string
+	}{
+		{"all up", true, true, 200, nil},
+		{"redis down", true, false, 503, []string{"redis"}},
+		{"postgres down", false, true, 503, []string{"postgres"}},
+		{"both down", false, false, 503, []string{"postgres", "redis"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			r := useFakeRedis(t)
+			if !tt.postgres {
+				f.on("-- ping", pgRule{Err: &pgconn.PgError{Code: "57P03", Message: "the database system is starting up"}})
+			}
+			if !tt.redis {
+				r.fail("PING")
+			}
+
+			status, body := probe(t, readyz)
+			if status != tt.wantStatus {
+				t.Errorf("/readyz status = %d, want %d (body %v)", status, tt.wantStatus, body)
+			}
+			var down []string
+			if list, ok := body["down"].([]interface{}); ok {
+				for _, d := range list {
+					down = append(down, d.(string))
+				}
+			}
+			if !slices.Equal(down, tt.wantDown) {
+				t.Errorf("down = %v, want %v", down, tt.wantDown)
+			}
+
+			// Liveness doesn't depend on either
+			if status, _ := probe(t, healthz); status != 200 {
+				t.Errorf("/healthz status = %d, want 200", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a used message_id is remembered in Redis. Past this, a replayed ID is still
+// never stored twice (the worker's insert is ON CONFLICT DO NOTHING), but it is queued again.
+const idempotencyTTL = 24 * time.Hour
+
+// What is remembered about a queued message so a retry can get the original response
+type idempotencyRecord struct {
+	SenderID  string `json:"sender_id"`
+	Timestamp string `json:"timestamp"`
+}
+
+//! Reserves messageID for a new send (SET NX on idempotency:<id>).
+// Returns false and the original record when the ID has already been used.
+func claimMessageID(ctx context.Context, messageID string, record idempotencyRecord) (bool, idempotencyRecord, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return false, idempotencyRecord{}, err
+	}
+
+	key := "idempotency:" + messageID
+	claimed, err := redisCli.SetNX(ctx, key, payload, idempotencyTTL).Result()
+	if err != nil || claimed {
+		return claimed, record, err
+	}
+
+	// Already used: load what the first request stored
+	stored, err := redisCli.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		// Expired between SETNX and GET; try once more
+		claimed, err = redisCli.SetNX(ctx, key, payload, idempotencyTTL).Result()
+		if err == nil && !claimed {
+			err = errors.New("idempotency key was reused concurrently")
+		}
+		return claimed, record, err
+	}
+	if err != nil {
+		return false, idempotencyRecord{}, err
+	}
+
+	var original idempotencyRecord
+	if err := json.Unmarshal([]byte(stored), &original); err != nil {
+		return false, idempotencyRecord{}, err
+	}
+	return false, original, nil
+}
+
+//! Frees a claimed messageID after the send failed, so the client's retry can go through
+func releaseMessageID(ctx context.Context, messageID string) {
+	if err := redisCli.Del(ctx, "idempotency:"+messageID).Err(); err != nil {
+		slog.Error("Failed to release idempotency key", "error", err, "message_id", messageID)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WorkerLag is the body of GET /worker/lag
+type WorkerLag struct {
+	Pending                 int64   `json:"pending"`                    // delivered to a worker but not ACKed (XPENDING)
+	OldestPendingAgeSeconds float64 `json:"oldest_pending_age_seconds"` // since the oldest pending entry was queued; 0 when none
+	Consumers               int64   `json:"consumers"`                  // workers registered in message_group (XINFO GROUPS)
+	Undelivered             int64   `json:"undelivered"`                // queued but not yet read by any worker (0 if unknown)
+}
+
+//! Handles reporting message_group's backlog for autoscalers (e.g. KEDA's metrics-api scaler).
+// Admin only, like /admin/*: the autoscaler needs its own admin token.
+func getWorkerLag(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	pending, err := redisCli.XPending(ctx, "message_stream", "message_group").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read pending entries", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read worker lag"})
+	}
+
+	groups, err := redisCli.XInfoGroups(ctx, "message_stream").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read consumer groups", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read worker lag"})
+	}
+
+	lag := WorkerLag{Pending: pending.Count}
+	for _, group := range groups {
+		if group.Name == "message_group" {
+			lag.Consumers = group.Consumers
+			lag.Undelivered = group.Lag
+		}
+	}
+	if pending.Count > 0 {
+		if queuedAt, ok := streamIDTime(pending.Lower); ok {
+			lag.OldestPendingAgeSeconds = time.Since(queuedAt).Seconds()
+		}
+	}
+
+	return c.JSON(200, lag)
+}
+
+//! Returns when a stream entry was added, from the millisecond part of its ID ("1700000000000-0")
+func streamIDTime(id string) (time.Time, bool) {
+	ms, _, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(n), true
+}
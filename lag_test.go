@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStreamIDTime(t *testing.T) {
+	tests := []struct {
+		id     string
+		wantMs int64
+		wantOK bool
+	}{
+		{"1700000000000-0", 1700000000000, true},
+		{"1700000000000-42", 1700000000000, true},
+		{"1700000000000", 1700000000000, true},
+		{"", 0, false},
+		{"soon-0", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := streamIDTime(tt.id)
+		if ok != tt.wantOK || (ok && got.UnixMilli() != tt.wantMs) {
+			t.Errorf("streamIDTime(%q) = %v, %v; want %d ms, %v", tt.id, got, ok, tt.wantMs, tt.wantOK)
+		}
+	}
+}
+
+func TestGetWorkerLag(t *testing.T) {
+	useFakeRedis(t)
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for range 5 {
+		id, err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: map[string]interface{}{"content": "hi"}}).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// worker-1 takes three and ACKs none of them; two are still waiting to be read
+	if _, err := redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "message_group", Consumer: "worker-1", Streams: []string{"message_stream", ">"}, Count: 3,
+	}).Result(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	var lag WorkerLag
+	if code := callAdmin(t, getWorkerLag, http.MethodGet, "", &lag); code != 200 {
+		t.Fatalf("status = %d", code)
+	}
+	if lag.Pending != 3 || lag.Consumers != 1 || lag.Undelivered != 2 {
+		t.Errorf("lag = %+v, want 3 pending, 1 consumer, 2 undelivered", lag)
+	}
+	// The oldest pending entry was queued at least 30ms ago, going by its ID
+	if lag.OldestPendingAgeSeconds < 0.03 || lag.OldestPendingAgeSeconds > 5 {
+		t.Errorf("oldest_pending_age_seconds = %v, want about 0.03", lag.OldestPendingAgeSeconds)
+	}
+
+	redisCli.XAck(ctx, "message_stream", "message_group", ids[:3]...)
+	if callAdmin(t, getWorkerLag, http.MethodGet, "", &lag); lag.Pending != 0 || lag.OldestPendingAgeSeconds != 0 {
+		t.Errorf("after the ACKs lag = %+v, want nothing pending and age 0", lag)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+//! Sends the default logger's JSON lines to the returned buffer for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestRequestLogger(t *testing.T) {
+	logs := captureLogs(t)
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.Use(requestLogger)
+	authenticated := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(authUserKey, "alice")
+			return next(c)
+		}
+	}
+	e.PATCH("/messages/:id/read", func(c echo.Context) error {
+		logFor(c).Info("Message marked as read", "message_id", c.Param("id"))
+		return c.NoContent(204)
+	}, authenticated)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/messages/m1/read", nil))
+	requestID := rec.Header().Get(echo.HeaderXRequestID)
+	if requestID == "" {
+		t.Fatal("no X-Request-Id on the response")
+	}
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want the handler's and the request's: %s", len(lines), logs)
+	}
+
+	// The handler's line carries the request ID along with its own fields
+	if handler := lines[0]; handler["msg"] != "Message marked as read" || handler["message_id"] != "m1" || handler["request_id"] != requestID {
+		t.Errorf("handler log line = %v", handler)
+	}
+	request := lines[1]
+	for field, want := range map[string]interface{}{
+		"msg":        "Request handled",
+		"level":      "INFO",
+		"request_id": requestID,
+		"method":     "PATCH",
+		"path":       "/messages/:id/read",
+		"status":     float64(204),
+		"user_id":    "alice",
+	} {
+		if request[field] != want {
+			t.Errorf("request log %s = %v, want %v", field, request[field], want)
+		}
+	}
+	if _, ok := request["latency_ms"].(float64); !ok {
+		t.Errorf("request log has no latency_ms: %v", request)
+	}
+}
+
+func TestLoadLogger(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	for _, tt := range []struct {
+		env     string
+		debug   bool
+		info    bool
+		wantErr bool
+	}{
+		{"", false, true, false}, // info by default
+		{"debug", true, true, false},
+		{"WARN", false, false, false},
+		{"error", false, false, false},
+		{"verbose", false, false, true},
+	} {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", tt.env)
+			err := loadLogger()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadLogger() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			handler := slog.Default().Handler()
+			if got := handler.Enabled(t.Context(), slog.LevelDebug); got != tt.debug {
+				t.Errorf("debug enabled = %v, want %v", got, tt.debug)
+			}
+			if got := handler.Enabled(t.Context(), slog.LevelInfo); got != tt.info {
+				t.Errorf("info enabled = %v, want %v", got, tt.info)
+			}
+		})
+	}
+}
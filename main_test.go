@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+//! Returns an echo context for a bare GET request, and the recorder holding its response
+func newTestContext() (echo.Context, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec), rec
+}
+
+func TestSendFailure(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantError      string
+		wantRetryAfter string
+	}{
+		{"rejected", &sendError{Status: 400, Reason: "content is required"}, 400, "content is required", ""},
+		{"conflict", &sendError{Status: 409, Reason: "message_id is already in use"}, 409, "message_id is already in use", ""},
+		{"rate limited", &sendError{Status: 429, Reason: "Rate limit exceeded", RateLimit: limitedRate(60, 0, 2)}, 429, "Rate limit exceeded", "2"},
+		{"internal", &sendError{Status: 500, Reason: "Failed to add message to stream", Err: errors.New("redis down")}, 500, "Failed to add message to stream", ""},
+		{"not a sendError", errors.New("boom"), 500, "Failed to send message", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newTestContext()
+			if err := sendFailure(c, tt.err); err != nil {
+				t.Fatalf("sendFailure returned %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+			}
+			if body["error"] != tt.wantError {
+				t.Errorf("error = %q, want %q", body["error"], tt.wantError)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			// The advisory headers come with every answer made after the send was counted
+			if got := rec.Header().Get("X-RateLimit-Remaining"); tt.wantRetryAfter != "" && got != "0" {
+				t.Errorf("X-RateLimit-Remaining = %q, want %q", got, "0")
+			}
+		})
+	}
+}
+
+//! Returns the SendRate of a sender with remaining sends left of limit, resetting in resetIn seconds
+func limitedRate(limit, remaining, resetIn int64) SendRate {
+	return SendRate{Limit: limit, Remaining: &remaining, ResetInSeconds: resetIn}
+}
+
+func TestSendErrorUnwrap(t *testing.T) {
+	cause := errors.New("redis down")
+	err := error(&sendError{Status: 500, Reason: "Failed to schedule message", Err: cause})
+	if !errors.Is(err, cause) {
+		t.Errorf("errors.Is(%v, cause) = false, want true", err)
+	}
+}
+
+func TestSendResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      int
+		result       sendResult
+		wantBody     map[string]string
+		wantReplayed bool
+	}{
+		{
+			name:     "queued",
+			version:  fullMessageAPIVersion,
+			result:   sendResult{MessageID: "m1", Timestamp: "2025-03-15T12:00:00Z"},
+			wantBody: map[string]string{"status": "Message queued", "message_id": "m1", "timestamp": "2025-03-15T12:00:00Z"},
+		},
+		{
+			name:     "queued, old client",
+			version:  fullMessageAPIVersion - 1,
+			result:   sendResult{MessageID: "m1", Timestamp: "2025-03-15T12:00:00Z"},
+			wantBody: map[string]string{"status": "Message queued"},
+		},
+		{
+			name:     "scheduled",
+			version:  fullMessageAPIVersion,
+			result:   sendResult{MessageID: "m2", Timestamp: "2025-03-16T09:00:00Z", Scheduled: true},
+			wantBody: map[string]string{"status": "Message scheduled", "message_id": "m2", "timestamp": "2025-03-16T09:00:00Z"},
+		},
+		{
+			name:     "with rate limit",
+			version:  fullMessageAPIVersion,
+			result:   sendResult{MessageID: "m4", Timestamp: "2025-03-15T12:00:00Z", RateLimit: limitedRate(60, 15, 40)},
+			wantBody: map[string]string{"status": "Message queued", "message_id": "m4", "timestamp": "2025-03-15T12:00:00Z"},
+		},
+		{
+			name:         "replayed",
+			version:      fullMessageAPIVersion,
+			result:       sendResult{MessageID: "m3", Timestamp: "2025-03-15T12:00:00Z", Replayed: true},
+			wantBody:     map[string]string{"status": "Message queued", "message_id": "m3", "timestamp": "2025-03-15T12:00:00Z"},
+			wantReplayed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newTestContext()
+			if err := sendResponse(c, tt.version, tt.result); err != nil {
+				t.Fatalf("sendResponse returned %v", err)
+			}
+			if rec.Code != 200 {
+				t.Errorf("status = %d, want 200", rec.Code)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+			}
+			if len(body) != len(tt.wantBody) {
+				t.Errorf("body = %v, want %v", body, tt.wantBody)
+			}
+			for k, v := range tt.wantBody {
+				if body[k] != v {
+					t.Errorf("body[%q] = %q, want %q", k, body[k], v)
+				}
+			}
+			if got := rec.Header().Get("Idempotent-Replayed") == "true"; got != tt.wantReplayed {
+				t.Errorf("Idempotent-Replayed set = %v, want %v", got, tt.wantReplayed)
+			}
+			wantRemaining := ""
+			if tt.result.RateLimit.Remaining != nil {
+				wantRemaining = "15"
+			}
+			if got := rec.Header().Get("X-RateLimit-Remaining"); got != wantRemaining {
+				t.Errorf("X-RateLimit-Remaining = %q, want %q", got, wantRemaining)
+			}
+		})
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	defer func(n int64) { maxMessageLength = n }(maxMessageLength)
+	maxMessageLength = 10
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr string
+	}{
+		{"plain", "hello", "hello", ""},
+		{"trimmed", "  hello\n\t", "hello", ""},
+		{"empty", "", "", "Invalid message data"},
+		{"empty after trim", " \t\n ", "", "Invalid message data"},
+		{"exactly at limit", strings.Repeat("a", 10), strings.Repeat("a", 10), ""},
+		{"at limit after trim", "  " + strings.Repeat("a", 10) + "  ", strings.Repeat("a", 10), ""},
+		{"over limit", strings.Repeat("a", 11), "", "Message content exceeds 10 characters"},
+		// The limit counts characters, not bytes: ten 3-byte characters still fit
+		{"multibyte at limit", strings.Repeat("€", 10), strings.Repeat("€", 10), ""},
+		{"multibyte over limit", strings.Repeat("€", 11), "", "Message content exceeds 10 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateContent(tt.content)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("validateContent(%q) error = %v, want %q", tt.content, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateContent(%q) error = %v", tt.content, err)
+			}
+			if got != tt.want {
+				t.Errorf("validateContent(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+//! Returns a well-formed message_stream entry as Redis hands it to the worker (every value a string)
+func validStreamEntry() map[string]interface{} {
+	return map[string]interface{}{
+		"message_id":   "3f2a8c1d-6b4e-4f9a-9d2c-7e1b5a0c8f62",
+		"sender_id":    "alice",
+		"receiver_id":  "bob",
+		"content":      "hello",
+		"timestamp":    "2025-03-15T12:00:00.123456789Z",
+		"read":         "0",
+		"status":       "sent",
+		"content_type": "text/plain",
+		"seq":          "42",
+	}
+}
+
+func TestParseStreamMessage(t *testing.T) {
+	msg, err := parseStreamMessage(validStreamEntry())
+	if err != nil {
+		t.Fatalf("parseStreamMessage(valid entry) error = %v", err)
+	}
+	wantTime := time.Date(2025, 3, 15, 12, 0, 0, 123456789, time.UTC)
+	if msg.MessageID != "3f2a8c1d-6b4e-4f9a-9d2c-7e1b5a0c8f62" || msg.SenderID != "alice" || msg.ReceiverID != "bob" ||
+		msg.Content != "hello" || msg.Status != "sent" || msg.ContentType != "text/plain" || msg.Seq != 42 ||
+		!msg.Timestamp.Equal(wantTime) || msg.ExpiresAt != nil {
+		t.Errorf("parseStreamMessage(valid entry) = %+v", msg)
+	}
+
+	// Group messages have no receiver; old entries have no content_type or seq
+	group := validStreamEntry()
+	delete(group, "receiver_id")
+	delete(group, "content_type")
+	delete(group, "seq")
+	group["conversation_id"] = "team"
+	group["expires_at"] = "2025-03-15T13:00:00Z"
+	msg, err = parseStreamMessage(group)
+	if err != nil {
+		t.Fatalf("parseStreamMessage(group entry) error = %v", err)
+	}
+	if msg.ConversationID != "team" || msg.ReceiverID != "" || msg.ContentType != defaultContentType || msg.Seq != 0 ||
+		msg.ExpiresAt == nil || !msg.ExpiresAt.Equal(time.Date(2025, 3, 15, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseStreamMessage(group entry) = %+v", msg)
+	}
+}
+
+func TestParseStreamMessageBrokenEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(values map[string]interface{})
+		wantErr string
+	}{
+		{"missing sender", func(v map[string]interface{}) { delete(v, "sender_id") }, `missing field "sender_id"`},
+		{"non-string content", func(v map[string]interface{}) { v["content"] = 42 }, `field "content" is int, not a string`},
+		{"empty message_id", func(v map[string]interface{}) { v["message_id"] = "" }, `field "message_id" is empty`},
+		{"no receiver nor group", func(v map[string]interface{}) { delete(v, "receiver_id") }, `missing field "receiver_id"`},
+		{"bad timestamp", func(v map[string]interface{}) { v["timestamp"] = "yesterday" }, `field "timestamp" is not an RFC3339 timestamp`},
+		{"bad expires_at", func(v map[string]interface{}) { v["expires_at"] = "soon" }, `field "expires_at" is not an RFC3339 timestamp`},
+		{"non-numeric seq", func(v map[string]interface{}) { v["seq"] = "first" }, `field "seq" is not a positive integer`},
+		{"zero seq", func(v map[string]interface{}) { v["seq"] = "0" }, `field "seq" is not a positive integer`},
+		{"empty content_type", func(v map[string]interface{}) { v["content_type"] = "" }, `field "content_type" is empty`},
+		{"nothing at all", func(v map[string]interface{}) { clear(v) }, `missing field "message_id"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := validStreamEntry()
+			tt.change(values)
+
+			// A broken entry is an error for the worker to dead-letter, never a panic
+			msg, err := parseStreamMessage(values)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseStreamMessage() error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if msg != (streamMessage{}) {
+				t.Errorf("parseStreamMessage() = %+v with an error, want the zero streamMessage", msg)
+			}
+		})
+	}
+}
+
+func TestParseStreamTime(t *testing.T) {
+	noon := time.Date(2025, 3, 15, 12, 0, 0, 500000001, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2025-03-15T12:00:00.500000001Z", noon, false},
+		// Other offsets are the same instant, returned in UTC
+		{"2025-03-15T13:00:00.500000001+01:00", noon, false},
+		{"2025-03-15T07:00:00.500000001-05:00", noon, false},
+		{"2025-03-15T12:00:00Z", noon.Truncate(time.Second), false},
+		{"2025-03-15T12:00:00", time.Time{}, true}, // no zone: ambiguous
+		{"2025-03-15 12:00:00Z", time.Time{}, true},
+		{"2025-03-15", time.Time{}, true},
+		{"1742040000", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseStreamTime("timestamp", tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStreamTime(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) || (err == nil && got.Location() != time.UTC) {
+				t.Errorf("parseStreamTime(%q) = %v, want %v in UTC", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	// What sendMessage writes, the worker reads back to the nanosecond, wherever it was sent from
+	tokyo := time.FixedZone("JST", 9*60*60)
+	for _, sent := range []time.Time{noon, noon.In(tokyo), time.Date(2025, 12, 31, 23, 59, 59, 999999999, tokyo)} {
+		got, err := parseStreamTime("timestamp", sent.UTC().Format(streamTimeFormat))
+		if err != nil || !got.Equal(sent) || got.Location() != time.UTC {
+			t.Errorf("round trip of %v = %v, %v", sent, got, err)
+		}
+	}
+}
+
+// messageRow is a pgx.Row holding one row of messageColumns
+type messageRow []interface{}
+
+func (r messageRow) Scan(dest ...interface{}) error {
+	if len(dest) != len(r) {
+		return errors.New("column count mismatch")
+	}
+	for i, v := range r {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+//! Returns a stored row in messageColumns order with the given edit time and version
+func storedMessage(editedAt *time.Time, version int64) messageRow {
+	sentAt := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	return messageRow{"m1", "alice", "bob", "Hello!", sentAt, false, "sent", defaultContentType, "",
+		editedAt, "", (*time.Time)(nil), "", "", version, int64(1)}
+}
+
+func TestScanMessageEditStatus(t *testing.T) {
+	editedAt := time.Date(2025, 3, 15, 12, 1, 30, 0, time.UTC)
+	tests := []struct {
+		name string
+		row  messageRow
+		want string // the edit fields as GET /messages returns them
+	}{
+		{"never edited", storedMessage(nil, 1), `"edited":false,"edited_at":null,"version":1`},
+		{"edited", storedMessage(&editedAt, 3), `"edited":true,"edited_at":"2025-03-15T12:01:30Z","version":3`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg Message
+			if err := scanMessage(tt.row, &msg); err != nil {
+				t.Fatalf("scanMessage() = %v", err)
+			}
+			body, err := json.Marshal(messagesForVersion([]Message{msg}, defaultAPIVersion))
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var got []map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte("{"+tt.want+"}"), &want); err != nil {
+				t.Fatalf("bad want: %v", err)
+			}
+			for field, v := range want {
+				if gv, ok := got[0][field]; !ok || !reflect.DeepEqual(gv, v) {
+					t.Errorf("%s = %v (present %v), want %v", field, gv, ok, v)
+				}
+			}
+
+			// Version 1 clients keep the original shape
+			body, _ = json.Marshal(messagesForVersion([]Message{msg}, 1))
+			for field := range want {
+				if strings.Contains(string(body), `"`+field+`"`) {
+					t.Errorf("version 1 body has %s: %s", field, body)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMessagesAbortsOnCancel(t *testing.T) {
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	// The history query never finishes on its own
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	f.on("FROM messages", pgRule{Rows: [][]interface{}{}, Cols: 16, Wait: stuck})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	req := httptest.NewRequest(http.MethodGet, "/messages?user1=alice&user2=bob", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, "alice")
+
+	done := make(chan error, 1)
+	go func() { done <- getMessages(c) }()
+	// Hang up once the query is running
+	for len(f.queriesContaining("FROM messages")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("getMessages returned %v, want context.Canceled", err)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("a response was written to the gone client: %s", rec.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("getMessages kept waiting for the query after the request was cancelled")
+	}
+}
+
+// UUID users for the send tests; the send path only accepts UUID senders and receivers
+const (
+	aliceID = "0b6e2f0a-3c1d-4e5f-8a9b-1c2d3e4f5a6b"
+	bobID   = "7d8e9fa0-b1c2-4d3e-9f40-5a6b7c8d9e0f"
+)
+
+//! Sends body as POST /messages from sender and returns the response.
+// The caller sets up the fakes; headers holds extra request headers.
+func postMessage(t *testing.T, sender, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, sender)
+	if err := sendMessage(c); err != nil {
+		t.Fatalf("sendMessage returned %v", err)
+	}
+	return rec
+}
+
+//! Starts both fakes for a 1-to-1 send: nobody is blocked
+func useSendFakes(t *testing.T) (*fakePG, *fakeRedis) {
+	f := useFakePG(t)
+	f.on("FROM blocks", pgRule{Rows: [][]interface{}{{false}}})
+	return f, useFakeRedis(t)
+}
+
+func TestSendIgnoresClientTimestamp(t *testing.T) {
+	_, r := useSendFakes(t)
+
+	before := time.Now().UTC()
+	rec := postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "hi", "timestamp": "2001-02-03T04:05:06Z"}`, nil)
+	after := time.Now().UTC()
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	sentAt, err := time.Parse(streamTimeFormat, body["timestamp"])
+	if err != nil || sentAt.Before(before) || sentAt.After(after) {
+		t.Fatalf("timestamp = %q, want the server's clock between %v and %v", body["timestamp"], before, after)
+	}
+
+	// The worker stores exactly the time the response promised
+	entries := r.entries("message_stream")
+	if len(entries) != 1 {
+		t.Fatalf("%d stream entries, want 1", len(entries))
+	}
+	msg, err := parseStreamMessage(entries[0].Values)
+	if err != nil {
+		t.Fatalf("parseStreamMessage: %v", err)
+	}
+	if !msg.Timestamp.Equal(sentAt) {
+		t.Errorf("the worker would store %v, want %v", msg.Timestamp, sentAt)
+	}
+}
+
+func TestReprocessSkipsStoredEntry(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 1"})
+	entry := redis.XMessage{ID: "1700000000000-0", Values: validStreamEntry()}
+
+	// The first run commits the message, then dies before its ACK gets through
+	r.fail("XACK")
+	if _, ok := processMessage(entry); !ok {
+		t.Fatal("the first run didn't deliver the message")
+	}
+	if len(r.acks()) != 0 {
+		t.Fatalf("acked %v while XACK was failing", r.acks())
+	}
+	r.restore("XACK")
+
+	// After the restart the entry is still pending and gets processed again: only the ACK is redone
+	if _, ok := processMessage(entry); ok {
+		t.Error("the reprocessed entry was reported as newly delivered")
+	}
+	if got := f.queriesContaining("INSERT INTO messages"); len(got) != 1 {
+		t.Errorf("message inserted %d times, want once", len(got))
+	}
+	if got := r.acks(); len(got) != 1 || got[0] != entry.ID {
+		t.Errorf("acked %v, want [%s]", got, entry.ID)
+	}
+	// The marker expires, so the tracking stays bounded
+	if ttl := r.ttl("processed:" + entry.ID); ttl != processedTTL {
+		t.Errorf("processed marker TTL = %v, want %v", ttl, processedTTL)
+	}
+}
+
+func TestReplayedEntryEmitsNoWebhookEvents(t *testing.T) {
+	defer webhooksRegistered.Store(webhooksRegistered.Load())
+	webhooksRegistered.Store(true)
+	drain := func() {
+		for len(webhookEvents) > 0 {
+			<-webhookEvents
+		}
+	}
+	drain()
+	defer drain()
+
+	f := useFakePG(t)
+	useFakeRedis(t)
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 0"})
+
+	// Reclaimed after a crash that came between the commit and the processed marker:
+	// the insert conflicts, and the events already went out the first time
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 0", Times: 1})
+	if _, ok := processMessage(redis.XMessage{ID: "1700000000000-0", Values: validStreamEntry()}); !ok {
+		t.Fatal("the replayed entry was not processed")
+	}
+	if n := len(webhookEvents); n != 0 {
+		t.Errorf("%d webhook events queued for an already stored message, want 0", n)
+	}
+
+	// A first-time insert emits message.sent, message.delivered and message.incoming
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	processMessage(redis.XMessage{ID: "1700000000001-0", Values: validStreamEntry()})
+	if n := len(webhookEvents); n != 3 {
+		t.Errorf("%d webhook events queued for a new message, want 3", n)
+	}
+}
+
+func TestGetMessagesPages(t *testing.T) {
+	// 120 messages between alice and bob, m000 the oldest
+	base := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	var newest []Message // newest first, as the query orders them
+	for i := 119; i >= 0; i-- {
+		sender, receiver := "alice", "bob"
+		if i%2 == 1 {
+			sender, receiver = receiver, sender
+		}
+		newest = append(newest, Message{MessageID: fmt.Sprintf("m%03d", i), SenderID: sender, ReceiverID: receiver,
+			Content: "hi", Timestamp: base.Add(time.Duration(i) * time.Second), Status: "sent",
+			ContentType: defaultContentType, Version: 1, Seq: int64(i + 1)})
+	}
+
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	// Stands in for the database: the rows after the ?before cursor, LIMIT of them
+	limitArg := regexp.MustCompile(`LIMIT \s*'(\d+)'`)
+	cursorArg := regexp.MustCompile(`WHERE message_id = \s*'([^']+)'`)
+	f.on("ORDER BY "+newestFirst, pgRule{Answer: func(query string) [][]interface{} {
+		limit, _ := strconv.Atoi(limitArg.FindStringSubmatch(query)[1])
+		start := 0
+		if m := cursorArg.FindStringSubmatch(query); m != nil {
+			for i, msg := range newest {
+				if msg.MessageID == m[1] {
+					start = i + 1
+				}
+			}
+		}
+		var rows [][]interface{}
+		for _, msg := range newest[start:min(start+limit, len(newest))] {
+			rows = append(rows, messageRecord(msg))
+		}
+		return rows
+	}})
+
+	var seen []string
+	cursor := ""
+	for page := 1; ; page++ {
+		target := "/messages?user1=alice&user2=bob&limit=50"
+		if cursor != "" {
+			target += "&before=" + cursor
+		}
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-API-Version", "3")
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set(authUserKey, "alice")
+		if err := getMessages(c); err != nil {
+			t.Fatalf("page %d: getMessages returned %v", page, err)
+		}
+		if rec.Code != 200 {
+			t.Fatalf("page %d: status = %d (body %s)", page, rec.Code, rec.Body.String())
+		}
+		var body struct {
+			Messages   []Message `json:"messages"`
+			Count      int       `json:"count"`
+			NextCursor *string   `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("page %d: decoding body: %v", page, err)
+		}
+		wantCount := []int{50, 50, 20}[page-1]
+		if body.Count != wantCount || len(body.Messages) != wantCount {
+			t.Errorf("page %d: count %d with %d messages, want %d", page, body.Count, len(body.Messages), wantCount)
+		}
+		for _, msg := range body.Messages {
+			seen = append(seen, msg.MessageID)
+		}
+		if body.NextCursor == nil {
+			if page != 3 {
+				t.Fatalf("page %d has no next_cursor, want 3 pages", page)
+			}
+			break
+		}
+		if page == 3 {
+			t.Fatalf("page 3 has next_cursor %q, want null on the last page", *body.NextCursor)
+		}
+		cursor = *body.NextCursor
+	}
+
+	// Every message exactly once, newest first
+	if len(seen) != len(newest) {
+		t.Fatalf("got %d messages over all pages, want %d", len(seen), len(newest))
+	}
+	for i, msg := range newest {
+		if seen[i] != msg.MessageID {
+			t.Fatalf("message %d is %s, want %s (a gap or a duplicate)", i, seen[i], msg.MessageID)
+		}
+	}
+}
+
+func TestSendRejectsBadParticipants(t *testing.T) {
+	tests := []struct {
+		name      string
+		sender    string
+		body      string
+		wantError string
+	}{
+		{"to yourself", aliceID, `{"receiver_id": "` + aliceID + `", "content": "hi"}`, "Cannot send a message to yourself"},
+		// Normalized first, so a differently written ID is still the sender
+		{"to yourself padded", aliceID, `{"receiver_id": " ` + aliceID + ` ", "content": "hi"}`, "Cannot send a message to yourself"},
+		{"receiver not a UUID", aliceID, `{"receiver_id": "bob", "content": "hi"}`, "receiver_id must be a UUID"},
+		{"receiver missing", aliceID, `{"content": "hi"}`, "Invalid message data"},
+		{"sender not a UUID", "alice", `{"receiver_id": "` + bobID + `", "content": "hi"}`, "sender_id (token subject) must be a UUID"},
+		{"receiver and conversation", aliceID, `{"receiver_id": "` + bobID + `", "conversation_id": "team", "content": "hi"}`,
+			"Send either conversation_id or receiver_id, not both"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, r := useSendFakes(t)
+			rec := postMessage(t, tt.sender, tt.body, nil)
+			if rec.Code != 400 {
+				t.Fatalf("status = %d, want 400 (body %s)", rec.Code, rec.Body.String())
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+			}
+			if body["error"] != tt.wantError {
+				t.Errorf("error = %q, want %q", body["error"], tt.wantError)
+			}
+			if entries := r.entries("message_stream"); len(entries) != 0 {
+				t.Errorf("queued %v", entries)
+			}
+		})
+	}
+}
+
+func TestSendIsIdempotent(t *testing.T) {
+	f, r := useSendFakes(t)
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 1"})
+	const key = "0b7c6a3e-2f41-4d8e-9a5b-c1d2e3f4a5b6"
+	body := `{"receiver_id": "` + bobID + `", "content": "hi"}`
+
+	first := postMessage(t, aliceID, body, map[string]string{"Idempotency-Key": key})
+	if first.Code != 200 {
+		t.Fatalf("first send: status = %d (body %s)", first.Code, first.Body.String())
+	}
+	// The retry may carry the key in the body instead; either way it is the same message
+	retry := postMessage(t, aliceID, `{"message_id": "`+key+`", "receiver_id": "`+bobID+`", "content": "hi"}`, nil)
+	if retry.Code != 200 || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry = %d %s, want the original response %s", retry.Code, retry.Body.String(), first.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("the retry is not marked Idempotent-Replayed")
+	}
+
+	entries := r.entries("message_stream")
+	if len(entries) != 1 || entries[0].Values["message_id"] != key {
+		t.Fatalf("stream entries = %v, want one carrying message_id %s", entries, key)
+	}
+	// The worker stores it under the client's key
+	processMessage(entries[0])
+	if n := countArg(f.queriesContaining("INSERT INTO messages"), key); n != 1 {
+		t.Errorf("inserted %d times under %s, want once", n, key)
+	}
+
+	// Keys are message IDs, so another sender can't reuse one, and they must be UUIDs
+	if rec := postMessage(t, bobID, `{"receiver_id": "`+aliceID+`", "content": "hi"}`, map[string]string{"Idempotency-Key": key}); rec.Code != 409 {
+		t.Errorf("another sender reusing the key: status = %d, want 409", rec.Code)
+	}
+	if rec := postMessage(t, aliceID, body, map[string]string{"Idempotency-Key": "retry-1"}); rec.Code != 400 {
+		t.Errorf("non-UUID key: status = %d, want 400", rec.Code)
+	}
+	if got := len(r.entries("message_stream")); got != 1 {
+		t.Errorf("%d stream entries, want still 1", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+//! Handles fetching one message by ID (participants only).
+// Deleted, expired and hidden-for-me messages are 404, except that
+// ?include_deleted=true lets the sender still fetch their own.
+func getMessage(c echo.Context) error {
+	messageID := c.Param("id")
+	me := authUserID(c)
+
+	includeDeleted := false
+	if v := c.QueryParam("include_deleted"); v != "" {
+		var err error
+		if includeDeleted, err = strconv.ParseBool(v); err != nil {
+			return c.JSON(400, map[string]string{"error": "include_deleted must be true or false"})
+		}
+	}
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE message_id = $1
+			AND (($2 AND sender_id = $3) OR (` + visibleMessage + ` AND ` + notHiddenFor(3) + `))`
+
+	var msg Message
+	err = scanMessage(readDB(c).QueryRow(c.Request().Context(), query, messageID, includeDeleted, me), &msg)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(404, map[string]string{"error": "Message not found"})
+	}
+	if err != nil {
+		logFor(c).Error("Failed to read message", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch message"})
+	}
+
+	if ok, err := requireMessageParticipant(c, msg, "Failed to fetch message"); !ok {
+		return err
+	}
+
+	// Quote the parent like the list endpoints do
+	messages := []Message{msg}
+	if err := attachReplyPreviews(c.Request().Context(), readDB(c), messages); err != nil {
+		logFor(c).Error("Failed to load reply previews", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch message"})
+	}
+
+	c.Response().Header().Set("ETag", messageETag(messages[0].Version))
+	return c.JSON(200, messageForVersion(messages[0], version))
+}
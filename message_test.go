@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestGetMessage(t *testing.T) {
+	at := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	stored := map[string]Message{
+		"m1":   {MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Content: "Hello!", Timestamp: at, Status: "read", ContentType: defaultContentType, Version: 4, Seq: 1},
+		"gone": {MessageID: "gone", SenderID: "alice", ReceiverID: "bob", Content: "oops", Timestamp: at, Status: "sent", ContentType: defaultContentType, Version: 2, Seq: 2},
+	}
+	deleted := map[string]bool{"gone": true}
+
+	f := useFakePG(t)
+	f.on("FROM conversations WHERE conversation_id", pgRule{Rows: [][]interface{}{{true}}})
+	// Stands in for the lookup: deleted messages only come back to their sender asking with include_deleted
+	idArg := regexp.MustCompile(`WHERE message_id = \s*'([^']+)'`)
+	callerArg := regexp.MustCompile(`sender_id = \s*'([^']+)'`)
+	f.on(messageColumns, pgRule{Answer: func(query string) [][]interface{} {
+		msg, ok := stored[idArg.FindStringSubmatch(query)[1]]
+		if !ok {
+			return nil
+		}
+		includeDeleted := strings.Contains(query, "(( 't'")
+		if deleted[msg.MessageID] && !(includeDeleted && callerArg.FindStringSubmatch(query)[1] == msg.SenderID) {
+			return nil
+		}
+		return [][]interface{}{messageRecord(msg)}
+	}, Cols: 16})
+
+	tests := []struct {
+		name, id, user, query string
+		wantStatus            int
+	}{
+		{"sender", "m1", "alice", "", 200},
+		{"receiver", "m1", "bob", "", 200},
+		{"not a participant", "m1", "mallory", "", 403},
+		{"unknown", "nope", "alice", "", 404},
+		{"deleted", "gone", "alice", "", 404},
+		{"deleted, sender asks to include it", "gone", "alice", "include_deleted=true", 200},
+		{"deleted, receiver asks to include it", "gone", "bob", "include_deleted=true", 404},
+		{"bad include_deleted", "m1", "alice", "include_deleted=maybe", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages/"+tt.id+"?"+tt.query, nil), rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tt.id)
+			c.Set(authUserKey, tt.user)
+			if err := getMessage(c); err != nil {
+				t.Fatalf("getMessage returned %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if rec.Code != 200 {
+				return
+			}
+			var got Message
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding body: %v", err)
+			}
+			want := stored[tt.id]
+			if got.MessageID != want.MessageID || got.Content != want.Content || got.Status != want.Status || got.Version != want.Version {
+				t.Errorf("message = %+v, want %+v", got, want)
+			}
+			if etag := rec.Header().Get("ETag"); etag != messageETag(want.Version) {
+				t.Errorf("ETag = %q, want %q", etag, messageETag(want.Version))
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on GET /metrics
+var (
+	messagesQueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_queued_total",
+		Help: "Messages added to message_stream, by the send endpoints and by the scheduler.",
+	})
+	messagesInserted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_inserted_total",
+		Help: "Messages committed to PostgreSQL by the stream workers.",
+	})
+	messagesAcked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "messages_acked_total",
+		Help: "Stream entries ACKed by the stream workers.",
+	})
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messages_failed_total",
+		Help: "Stream entries the workers failed to process, by the step that failed.",
+	}, []string{"step"})
+	webhookEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_events_dropped_total",
+		Help: "Webhook events dropped because the dispatch queue was full.",
+	})
+	messageInsertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "message_insert_duration_seconds",
+		Help:    "Time to insert a message and mark it delivered in one transaction.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// Upper bound on the XPENDING call made during a scrape
+const pendingScrapeTimeout = 2 * time.Second
+
+//! Registers the pending-backlog gauge. It runs XPENDING on every scrape, so the value is
+// never stale; a growing value means the workers are falling behind.
+func registerStreamMetrics() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "message_stream_pending",
+		Help: "Entries delivered to message_group but not yet ACKed (XPENDING).",
+	}, func() float64 {
+		scrapeCtx, cancel := context.WithTimeout(context.Background(), pendingScrapeTimeout)
+		defer cancel()
+
+		pending, err := redisCli.XPending(scrapeCtx, "message_stream", "message_group").Result()
+		if err != nil {
+			slog.Error("Failed to read pending entries for metrics", "error", err)
+			return 0
+		}
+		return float64(pending.Count)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// The pending gauge registers with the default registry, which allows it only once per process
+var registerStreamMetricsOnce sync.Once
+
+//! Scrapes GET /metrics as main serves it and returns the value of each unlabelled sample
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	e := echo.New()
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("/metrics status = %d", rec.Code)
+	}
+
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || strings.HasPrefix(name, "#") || strings.Contains(name, "{") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			samples[name] = v
+		}
+	}
+	return samples
+}
+
+func TestMetricsScrape(t *testing.T) {
+	useSendFakes(t)
+	registerStreamMetricsOnce.Do(registerStreamMetrics)
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	before := scrapeMetrics(t)
+
+	if rec := postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "hi"}`, nil); rec.Code != 200 {
+		t.Fatalf("send status = %d (body %s)", rec.Code, rec.Body.String())
+	}
+	after := scrapeMetrics(t)
+	if got := after["messages_queued_total"] - before["messages_queued_total"]; got != 1 {
+		t.Errorf("messages_queued_total went up by %v, want 1", got)
+	}
+	if got := after["message_stream_pending"]; got != 0 {
+		t.Errorf("message_stream_pending = %v before any worker read, want 0", got)
+	}
+
+	// Read by a consumer but not ACKed: the backlog the gauge alerts on
+	err := redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "message_group", Consumer: "worker-1", Streams: []string{"message_stream", ">"}, Count: 1,
+	}).Err()
+	if err != nil {
+		t.Fatalf("XREADGROUP: %v", err)
+	}
+	if got := scrapeMetrics(t)["message_stream_pending"]; got != 1 {
+		t.Errorf("message_stream_pending = %v, want 1", got)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	// Versions run 1, 2, 3, ... with no gaps, so a missing or misnamed file shows up here
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d is %s, want version %d", i, m.Name, i+1)
+		}
+		if m.SQL == "" {
+			t.Errorf("%s is empty", m.Name)
+		}
+	}
+	if len(migrations) == 0 || migrations[0].Name != "0001_create_messages.sql" {
+		t.Errorf("the first migration isn't 0001_create_messages.sql: %+v", migrations)
+	}
+}
+
+//! Creates an empty database next to TEST_DATABASE_URL, dropped when the test ends,
+// and returns its connection string. Skips when the test role can't create databases.
+func throwawayDatabase(t *testing.T) string {
+	t.Helper()
+	base := os.Getenv("TEST_DATABASE_URL")
+	if base == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme == "" {
+		t.Skip("TEST_DATABASE_URL is not a postgres:// URL")
+	}
+
+	conn, err := pgx.Connect(t.Context(), base)
+	if err != nil {
+		t.Fatalf("connecting to TEST_DATABASE_URL: %v", err)
+	}
+	defer conn.Close(context.Background())
+
+	name := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(t.Context(), "CREATE DATABASE "+name); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42501" {
+			t.Skip("the TEST_DATABASE_URL role can't create databases")
+		}
+		t.Fatalf("CREATE DATABASE: %v", err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(context.Background(), base)
+		if err != nil {
+			t.Errorf("dropping %s: %v", name, err)
+			return
+		}
+		defer conn.Close(context.Background())
+		if _, err := conn.Exec(context.Background(), "DROP DATABASE IF EXISTS "+name+" WITH (FORCE)"); err != nil {
+			t.Errorf("dropping %s: %v", name, err)
+		}
+	})
+
+	u.Path = "/" + name
+	return u.String()
+}
+
+func TestRunMigrationsFromScratch(t *testing.T) {
+	connString := throwawayDatabase(t)
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+
+	// The second run finds everything applied and must not fail on existing objects
+	for run := 1; run <= 2; run++ {
+		if err := runMigrations(t.Context(), connString); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+
+	conn, err := pgx.Connect(t.Context(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	var applied, latest int
+	err = conn.QueryRow(t.Context(), "SELECT count(*), max(version) FROM schema_migrations").Scan(&applied, &latest)
+	if err != nil {
+		t.Fatalf("reading schema_migrations: %v", err)
+	}
+	if applied != len(migrations) || latest != migrations[len(migrations)-1].Version {
+		t.Errorf("schema_migrations has %d rows up to %d, want %d up to %d",
+			applied, latest, len(migrations), migrations[len(migrations)-1].Version)
+	}
+
+	for _, column := range []string{"message_id", "status", "read", "timestamp", "seq", "version"} {
+		var found bool
+		err := conn.QueryRow(t.Context(), `
+			SELECT EXISTS (SELECT 1 FROM information_schema.columns
+			               WHERE table_name = 'messages' AND column_name = $1)`, column).Scan(&found)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Errorf("messages has no %s column", column)
+		}
+	}
+
+	// The worker's statements prepare only if every column they name exists
+	p, err := newPool(connString, primaryStatements)
+	if err != nil {
+		t.Fatalf("preparing the primary statements on the migrated schema: %v", err)
+	}
+	p.Close()
+}
@@ -0,0 +1,14 @@
+-- The original messages table: one row per 1-to-1 message
+CREATE TABLE IF NOT EXISTS messages (
+    message_id  TEXT PRIMARY KEY,
+    sender_id   TEXT NOT NULL,
+    receiver_id TEXT NOT NULL,
+    content     TEXT NOT NULL,
+    timestamp   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    read        BOOLEAN NOT NULL DEFAULT false,
+    status      TEXT NOT NULL DEFAULT 'sent'
+);
+
+-- Conversation history is always fetched per pair, newest first
+CREATE INDEX IF NOT EXISTS messages_pair_timestamp
+    ON messages (sender_id, receiver_id, timestamp DESC, message_id DESC);
@@ -0,0 +1,24 @@
+-- Columns added to messages after the first release.
+-- ADD COLUMN IF NOT EXISTS keeps this safe on databases that were set up by hand.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_type    TEXT NOT NULL DEFAULT 'text/plain';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS conversation_id TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at       TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_id   TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at      TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at      TIMESTAMPTZ;
+
+-- Group messages have no receiver
+ALTER TABLE messages ALTER COLUMN receiver_id DROP NOT NULL;
+
+CREATE INDEX IF NOT EXISTS messages_conversation_timestamp
+    ON messages (conversation_id, timestamp DESC, message_id DESC)
+    WHERE conversation_id IS NOT NULL;
+
+-- Full-text search
+CREATE INDEX IF NOT EXISTS messages_content_fts
+    ON messages USING GIN (to_tsvector('english', content));
+
+-- The expiry sweeper only looks at live messages with an expiry
+CREATE INDEX IF NOT EXISTS messages_expires_at
+    ON messages (expires_at)
+    WHERE expires_at IS NOT NULL AND deleted_at IS NULL;
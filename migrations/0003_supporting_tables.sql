@@ -0,0 +1,39 @@
+-- Edit history: one row per edit, holding the content it replaced
+CREATE TABLE IF NOT EXISTS message_edits (
+    message_id       TEXT NOT NULL REFERENCES messages (message_id) ON DELETE CASCADE,
+    previous_content TEXT NOT NULL,
+    edited_at        TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS message_edits_message_id ON message_edits (message_id);
+
+-- Group conversations
+CREATE TABLE IF NOT EXISTS conversations (
+    conversation_id TEXT PRIMARY KEY,
+    created_by      TEXT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id TEXT NOT NULL REFERENCES conversations (conversation_id) ON DELETE CASCADE,
+    user_id         TEXT NOT NULL,
+    joined_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+-- Uploaded files; the bytes live in the blob store
+CREATE TABLE IF NOT EXISTS attachments (
+    attachment_id TEXT PRIMARY KEY,
+    owner_id      TEXT NOT NULL,
+    filename      TEXT NOT NULL,
+    content_type  TEXT NOT NULL,
+    size          BIGINT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- blocker_id doesn't receive 1-to-1 messages from blocked_id
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id TEXT NOT NULL,
+    blocked_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (blocker_id, blocked_id)
+);
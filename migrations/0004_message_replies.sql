@@ -0,0 +1,3 @@
+-- Replies quote another message. No foreign key: the parent may later be
+-- deleted, and the reply should still say what it was replying to.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_message_id TEXT;
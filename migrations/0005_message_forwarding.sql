@@ -0,0 +1,3 @@
+-- Forwarded messages point at the message they were copied from.
+-- No foreign key, for the same reason as reply_to_message_id.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS forwarded_from TEXT;
@@ -0,0 +1,3 @@
+-- GET /messages/sent lists one sender's messages across all conversations
+CREATE INDEX IF NOT EXISTS messages_sender_timestamp
+    ON messages (sender_id, timestamp DESC, message_id DESC);
@@ -0,0 +1,3 @@
+-- Optimistic concurrency: every change to a message bumps its version,
+-- and updates carry the version the client last saw in If-Match.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
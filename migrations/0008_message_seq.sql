@@ -0,0 +1,3 @@
+-- Per-conversation send order, taken from a Redis counter when the message is queued.
+-- Breaks ties between messages with the same timestamp; rows stored before this are 0.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- "Delete for me": messages a user has hidden from their own view only
+CREATE TABLE IF NOT EXISTS message_hidden (
+    message_id TEXT NOT NULL REFERENCES messages (message_id) ON DELETE CASCADE,
+    user_id    TEXT NOT NULL,
+    hidden_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, user_id)
+);
@@ -0,0 +1,9 @@
+-- user_id has muted their 1-to-1 conversation with other_user_id: messages are still
+-- delivered, but without notifications. muted_until is NULL for a mute with no end.
+CREATE TABLE IF NOT EXISTS conversation_mutes (
+    user_id       TEXT NOT NULL,
+    other_user_id TEXT NOT NULL,
+    muted_until   TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, other_user_id)
+);
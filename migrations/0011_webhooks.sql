@@ -0,0 +1,22 @@
+-- Webhooks registered by users for events on their messages
+CREATE TABLE IF NOT EXISTS webhooks (
+    webhook_id TEXT PRIMARY KEY,
+    owner_id   TEXT NOT NULL,
+    url        TEXT NOT NULL,
+    events     TEXT[] NOT NULL,
+    secret     TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhooks_owner ON webhooks (owner_id);
+
+-- Deliveries that still failed after the last retry
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id          BIGSERIAL PRIMARY KEY,
+    webhook_id  TEXT NOT NULL REFERENCES webhooks (webhook_id) ON DELETE CASCADE,
+    delivery_id TEXT NOT NULL,
+    event       TEXT NOT NULL,
+    payload     JSONB NOT NULL,
+    attempts    INTEGER NOT NULL,
+    last_error  TEXT NOT NULL,
+    failed_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,19 @@
+-- GET /messages/search?mode=trigram matches by trigram word similarity ($2 <% content).
+-- CREATE EXTENSION needs a role allowed to create it (pg_trgm is a trusted extension from
+-- PostgreSQL 13), and some managed services don't offer it. Without it this migration only
+-- warns: the server still starts, and ?mode=trigram answers 503 until pg_trgm is installed
+-- and the index below is created by hand (see README).
+DO $$
+BEGIN
+    CREATE EXTENSION IF NOT EXISTS pg_trgm;
+EXCEPTION WHEN OTHERS THEN
+    RAISE WARNING 'pg_trgm is not available (%): trigram search is disabled. Run CREATE EXTENSION pg_trgm as a role allowed to, then create messages_content_trgm (see README).', SQLERRM;
+END $$;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm') THEN
+        CREATE INDEX IF NOT EXISTS messages_content_trgm
+            ON messages USING GIN (content gin_trgm_ops);
+    END IF;
+END $$;
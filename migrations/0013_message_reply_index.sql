@@ -0,0 +1,4 @@
+-- GET /messages/:id/thread-tree looks up the replies to a set of messages, one level at a time
+CREATE INDEX IF NOT EXISTS messages_reply_to
+    ON messages (reply_to_message_id, timestamp, seq, message_id)
+    WHERE reply_to_message_id IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Members added to a group only see the messages sent after they joined, unless the group
+-- shares its full history. Existing members all joined when their group was created.
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS full_history BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,5 @@
+-- When a message last changed (status, read flag, content or deletion), for ?changed_since.
+-- Every UPDATE that bumps version sets it. Rows from before this have none and count as
+-- changed when they were sent; later rows start at the time they are stored.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS changed_at TIMESTAMPTZ;
+ALTER TABLE messages ALTER COLUMN changed_at SET DEFAULT now();
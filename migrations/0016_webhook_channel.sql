@@ -0,0 +1,14 @@
+-- Webhooks as a delivery channel (message.incoming): the owner must prove they control the URL
+-- with POST /webhooks/:id/verify before any message is POSTed to it
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS verified_at TIMESTAMPTZ;
+
+-- Messages a recipient's webhook accepted, one row per message and webhook
+CREATE TABLE IF NOT EXISTS webhook_message_deliveries (
+    message_id   TEXT NOT NULL,
+    webhook_id   TEXT NOT NULL REFERENCES webhooks (webhook_id) ON DELETE CASCADE,
+    user_id      TEXT NOT NULL,
+    delivery_id  TEXT NOT NULL,
+    attempts     INTEGER NOT NULL,
+    delivered_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, webhook_id)
+);
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SQL condition for a conversation_mutes row (aliased cm) that is still in effect
+const activeMute = "(cm.muted_until IS NULL OR cm.muted_until > now())"
+
+// Request body for POST /conversations/:otherUser/mute; the body is optional
+type muteRequest struct {
+	Until *time.Time `json:"until"` // RFC3339; omit to mute until unmuted
+}
+
+//! Handles muting the caller's 1-to-1 conversation with :otherUser.
+// Muting again replaces the previous mute, so it can also extend or shorten one.
+func muteConversation(c echo.Context) error {
+	var req muteRequest
+	if err := c.Bind(&req); err != nil { // an empty body binds to a mute with no end
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+
+	me := authUserID(c)
+	other := normalizeUserID(c.Param("otherUser"))
+	if other == "" {
+		return c.JSON(400, map[string]string{"error": "otherUser is required"})
+	}
+	if other == me {
+		return c.JSON(400, map[string]string{"error": "Cannot mute a conversation with yourself"})
+	}
+	if req.Until != nil && !req.Until.After(time.Now()) {
+		return c.JSON(400, map[string]string{"error": "until must be in the future"})
+	}
+
+	_, err := pool.Exec(c.Request().Context(), `
+		INSERT INTO conversation_mutes (user_id, other_user_id, muted_until, created_at) VALUES ($1, $2, $3, now())
+		ON CONFLICT (user_id, other_user_id) DO UPDATE SET muted_until = EXCLUDED.muted_until`,
+		me, other, req.Until)
+	if err != nil {
+		logFor(c).Error("Failed to mute conversation", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to mute conversation"})
+	}
+
+	logFor(c).Info("Conversation muted", "user_id", me, "other_user_id", other)
+	return c.JSON(200, map[string]interface{}{"status": "Conversation muted", "user_id": other, "muted_until": req.Until})
+}
+
+//! Handles unmuting the caller's 1-to-1 conversation with :otherUser
+func unmuteConversation(c echo.Context) error {
+	me := authUserID(c)
+	other := normalizeUserID(c.Param("otherUser"))
+
+	// A timed mute that already ran out counts as not muted
+	result, err := pool.Exec(c.Request().Context(), `
+		DELETE FROM conversation_mutes cm
+		WHERE cm.user_id = $1 AND cm.other_user_id = $2 AND `+activeMute,
+		me, other)
+	if err != nil {
+		logFor(c).Error("Failed to unmute conversation", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to unmute conversation"})
+	}
+	if result.RowsAffected() == 0 {
+		return c.JSON(404, map[string]string{"error": "Conversation is not muted"})
+	}
+
+	logFor(c).Info("Conversation unmuted", "user_id", me, "other_user_id", other)
+	return c.JSON(200, map[string]string{"status": "Conversation unmuted", "user_id": other})
+}
+
+//! Returns which of the given messages were sent into a conversation their receiver has muted.
+// Group messages are never muted: mutes are per 1-to-1 conversation.
+func mutedMessageIDs(ctx context.Context, messageIDs []string) ([]string, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT m.message_id
+		FROM messages m
+		JOIN conversation_mutes cm ON cm.user_id = m.receiver_id AND cm.other_user_id = m.sender_id
+		WHERE m.message_id = ANY($1) AND m.conversation_id IS NULL AND `+activeMute,
+		messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	muted := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		muted = append(muted, id)
+	}
+	return muted, rows.Err()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Runs handler for /conversations/:otherUser/mute as user with body (empty for none); returns the status
+func muteRequestAs(t *testing.T, handler echo.HandlerFunc, method, user, other, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, "/conversations/"+other+"/mute", strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("otherUser")
+	c.SetParamValues(other)
+	c.Set(authUserKey, user)
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned %v", err)
+	}
+	return rec.Code
+}
+
+func TestMuteValidation(t *testing.T) {
+	f := useFakePG(t)
+	f.on("DELETE FROM conversation_mutes", pgRule{Tag: "DELETE 0"})
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name, other, body string
+	}{
+		{"yourself", "alice", ""},
+		{"until in the past", "bob", `{"until": "` + past + `"}`},
+		{"until not a time", "bob", `{"until": "tomorrow"}`},
+	}
+	for _, tt := range tests {
+		if code := muteRequestAs(t, muteConversation, http.MethodPost, "alice", tt.other, tt.body); code != 400 {
+			t.Errorf("%s: status = %d, want 400", tt.name, code)
+		}
+	}
+	if got := f.queriesContaining("conversation_mutes"); len(got) != 0 {
+		t.Errorf("refused mutes were stored: %q", got)
+	}
+	if code := muteRequestAs(t, unmuteConversation, http.MethodDelete, "alice", "bob", ""); code != 404 {
+		t.Errorf("unmuting a conversation that isn't muted: status = %d, want 404", code)
+	}
+}
+
+func TestDeliveryEventFlagsMutedMessages(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("JOIN conversation_mutes", pgRule{Rows: [][]interface{}{{"m2"}}})
+
+	publishDelivered([]string{"m1", "m2"})
+	events := r.publishedOn(deliveryChannel)
+	if len(events) != 1 {
+		t.Fatalf("%d delivery events, want 1", len(events))
+	}
+	var event map[string][]string
+	if err := json.Unmarshal([]byte(events[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	// Both are delivered; only m2's notification is suppressed
+	if !slices.Equal(event["message_ids"], []string{"m1", "m2"}) || !slices.Equal(event["muted_message_ids"], []string{"m2"}) {
+		t.Errorf("delivery event = %v, want both delivered and m2 muted", event)
+	}
+}
+
+//! Returns user's mute state for the conversation with other, as their inbox shows it
+func muteStateOf(t *testing.T, user, other string) (bool, *time.Time) {
+	t.Helper()
+	for _, conv := range inboxOf(t, user) {
+		if conv.OtherUserID == other {
+			return conv.Muted, conv.MutedUntil
+		}
+	}
+	t.Fatalf("%s is not in %s's inbox", other, user)
+	return false, nil
+}
+
+// Whether a mute is still in effect is decided with now() in SQL, so this runs against a real database only
+func TestMuteUnmuteAndExpiry(t *testing.T) {
+	p := useTestDB(t)
+	insertTestMessage(t, Message{MessageID: "from bob", SenderID: "bob", ReceiverID: "alice", Content: "hi",
+		Timestamp: time.Now().UTC(), Status: "delivered", ContentType: defaultContentType, Seq: 1})
+	notified := func() bool {
+		t.Helper()
+		muted, err := mutedMessageIDs(t.Context(), []string{"from bob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(muted) == 0
+	}
+
+	if code := muteRequestAs(t, muteConversation, http.MethodPost, "alice", "bob", ""); code != 200 {
+		t.Fatalf("mute: status = %d", code)
+	}
+	if muted, until := muteStateOf(t, "alice", "bob"); !muted || until != nil || notified() {
+		t.Errorf("after mute: muted %v until %v, notified %v; want muted indefinitely, no notification", muted, until, notified())
+	}
+	if muted, _ := muteStateOf(t, "bob", "alice"); muted {
+		t.Error("alice's mute shows in bob's inbox")
+	}
+
+	// Muting again with an end replaces the indefinite mute
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if code := muteRequestAs(t, muteConversation, http.MethodPost, "alice", "bob", `{"until": "`+until.Format(time.RFC3339)+`"}`); code != 200 {
+		t.Fatalf("timed mute: status = %d", code)
+	}
+	if muted, got := muteStateOf(t, "alice", "bob"); !muted || got == nil || !got.Equal(until) {
+		t.Errorf("after timed mute: muted %v until %v, want until %v", muted, got, until)
+	}
+
+	// Once until has passed the mute is over on its own
+	if _, err := p.Exec(t.Context(), "UPDATE conversation_mutes SET muted_until = now() - interval '1 second'"); err != nil {
+		t.Fatal(err)
+	}
+	if muted, _ := muteStateOf(t, "alice", "bob"); muted || !notified() {
+		t.Errorf("after expiry: muted %v, notified %v; want unmuted and notified", muted, notified())
+	}
+	if code := muteRequestAs(t, unmuteConversation, http.MethodDelete, "alice", "bob", ""); code != 404 {
+		t.Errorf("unmuting an expired mute: status = %d, want 404", code)
+	}
+
+	muteRequestAs(t, muteConversation, http.MethodPost, "alice", "bob", "")
+	if code := muteRequestAs(t, unmuteConversation, http.MethodDelete, "alice", "bob", ""); code != 200 {
+		t.Fatalf("unmute: status = %d", code)
+	}
+	if muted, _ := muteStateOf(t, "alice", "bob"); muted || !notified() {
+		t.Errorf("after unmute: muted %v, notified %v; want unmuted and notified", muted, notified())
+	}
+}
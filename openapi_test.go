@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestServeOpenAPISpec(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	rec := httptest.NewRecorder()
+	if err := serveOpenAPISpec(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("serveOpenAPISpec returned %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, echo.MIMEApplicationJSON) {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+
+	var spec struct {
+		OpenAPI    string                     `json:"openapi"`
+		Paths      map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("the spec isn't valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", spec.OpenAPI)
+	}
+	if _, ok := spec.Paths["/messages"]; !ok {
+		t.Error("the spec has no /messages path")
+	}
+	if _, ok := spec.Components.Schemas["Message"]; !ok {
+		t.Error("the spec has no Message schema")
+	}
+}
+
+// A route added in main without a matching entry in api/openapi.json fails here
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	source, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("the spec isn't valid JSON: %v", err)
+	}
+
+	route := regexp.MustCompile(`e\.(GET|POST|PUT|PATCH|DELETE)\("([^"]+)"`)
+	param := regexp.MustCompile(`:(\w+)`)
+	routes := route.FindAllStringSubmatch(string(source), -1)
+	if len(routes) == 0 {
+		t.Fatal("no routes found in main.go")
+	}
+	for _, m := range routes {
+		method, path := strings.ToLower(m[1]), param.ReplaceAllString(m[2], "{$1}")
+		if _, ok := spec.Paths[path][method]; !ok {
+			t.Errorf("%s %s isn't in the spec", m[1], path)
+		}
+	}
+}
+
+func TestServeSwaggerUI(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/swagger", nil)
+	rec := httptest.NewRecorder()
+	if err := serveSwaggerUI(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("serveSwaggerUI returned %v", err)
+	}
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "/openapi.json") {
+		t.Errorf("status = %d, body %q; want a page loading /openapi.json", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Page sizes for list endpoints
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+//! Reads the ?limit query parameter (default 50, capped at 100)
+func parseLimit(c echo.Context) (int, error) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, nil
+}
+
+// Order of every message list: newest first. seq keeps messages sent within the same
+// timestamp in send order; message_id makes the order total for rows from before seq existed.
+const newestFirst = "timestamp DESC, seq DESC, message_id DESC"
+
+//! Builds the SQL condition for a ?before cursor on lists ordered by newestFirst.
+// The cursor is either an RFC3339 timestamp or a message_id (as returned in next_cursor).
+// placeholder is the positional parameter ($N) the returned argument binds to.
+// An empty cursor matches every row.
+func beforeCondition(before string, placeholder int) (string, interface{}) {
+	if before == "" {
+		return "TRUE", nil
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, before); err == nil {
+		return fmt.Sprintf("timestamp < $%d", placeholder), ts
+	}
+	// Row comparison keeps pages gap-free when several messages share a timestamp
+	return fmt.Sprintf("(timestamp, seq, message_id) < (SELECT timestamp, seq, message_id FROM messages WHERE message_id = $%d)", placeholder), before
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+//! Reports whether userID takes part in the conversation with otherID.
+// otherID is either a group conversation ID, whose members take part, or the other user of a
+// 1-to-1 conversation, which any two distinct users share.
+func isParticipant(ctx context.Context, userID, otherID string) (bool, error) {
+	if userID == "" || otherID == "" {
+		return false, nil
+	}
+	var ok bool
+	err := pool.QueryRow(ctx, `
+		SELECT CASE
+			WHEN EXISTS (SELECT 1 FROM conversations WHERE conversation_id = $2)
+				THEN EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = $2 AND user_id = $1)
+			ELSE $1 <> $2
+		END`, userID, otherID).Scan(&ok)
+	return ok, err
+}
+
+//! Returns who or what userID talks to through msg: its group, or the other user of a 1-to-1 message.
+// ok is false when userID is neither the sender nor the receiver of a 1-to-1 message.
+func messagePeer(msg Message, userID string) (otherID string, ok bool) {
+	switch {
+	case msg.ConversationID != "":
+		return msg.ConversationID, true
+	case userID == msg.SenderID:
+		return msg.ReceiverID, true
+	case userID == msg.ReceiverID:
+		return msg.SenderID, true
+	}
+	return "", false
+}
+
+//! Returns the other user of the user1/user2 conversation as seen by userID; ok is false if userID is neither
+func pairPeer(userID, user1, user2 string) (otherID string, ok bool) {
+	switch userID {
+	case user1:
+		return user2, true
+	case user2:
+		return user1, true
+	}
+	return "", false
+}
+
+//! Reports whether userID can see msg: a participant of a 1-to-1 message or a member of its group
+func canSeeMessage(ctx context.Context, msg Message, userID string) (bool, error) {
+	if msg.ConversationID != "" {
+		// A member who joined after the message only sees it if the group shares its full history
+		var ok bool
+		err := pool.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM conversation_members m JOIN conversations g ON g.conversation_id = m.conversation_id
+				WHERE m.conversation_id = $1 AND m.user_id = $2 AND (g.full_history OR m.joined_at <= $3)
+			)`, msg.ConversationID, userID, msg.Timestamp).Scan(&ok)
+		return ok, err
+	}
+	otherID, ok := messagePeer(msg, userID)
+	if !ok {
+		return false, nil
+	}
+	return isParticipant(ctx, userID, otherID)
+}
+
+//! Answers 403 unless the caller takes part in the conversation with otherID (see isParticipant).
+// failure is the 500 message if the check itself fails. When ok is false the response has been
+// written (or the request timed out) and the handler must return err.
+func requireParticipant(c echo.Context, otherID, failure string) (ok bool, err error) {
+	participant, err := isParticipant(c.Request().Context(), authUserID(c), otherID)
+	return participantCheck(c, participant, err, failure)
+}
+
+//! Like requireParticipant, for the conversation msg belongs to
+func requireMessageParticipant(c echo.Context, msg Message, failure string) (ok bool, err error) {
+	participant, err := canSeeMessage(c.Request().Context(), msg, authUserID(c))
+	return participantCheck(c, participant, err, failure)
+}
+
+//! Turns the result of a participant check into the handler's response
+func participantCheck(c echo.Context, participant bool, err error, failure string) (bool, error) {
+	if err != nil {
+		logFor(c).Error("Failed to check conversation access", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return false, ctxErr // let the timeout middleware answer
+		}
+		return false, c.JSON(500, map[string]string{"error": failure})
+	}
+	if !participant {
+		return false, c.JSON(403, map[string]string{"error": "Not a participant in this conversation"})
+	}
+	return true, nil
+}
+
+//! Loads a visible message and checks the caller takes part in its conversation.
+// Answers 404 for a missing, deleted or expired message and 403 for anyone else; when ok is
+// false the response has been written and the handler must return err.
+func requireMessageAccess(c echo.Context, messageID, failure string) (msg Message, ok bool, err error) {
+	err = scanMessage(pool.QueryRow(c.Request().Context(),
+		`SELECT `+messageColumns+` FROM messages WHERE message_id = $1 AND `+visibleMessage, messageID), &msg)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return msg, false, c.JSON(404, map[string]string{"error": "Message not found"})
+	}
+	if err != nil {
+		logFor(c).Error("Failed to look up message", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return msg, false, ctxErr // let the timeout middleware answer
+		}
+		return msg, false, c.JSON(500, map[string]string{"error": failure})
+	}
+	ok, err = requireMessageParticipant(c, msg, failure)
+	return msg, ok, err
+}
+
+//! Like requireMessageAccess, but only for a recipient of the message: the receiver of a 1-to-1
+// message, or a group member other than the sender. Everyone else, the sender included, gets 403.
+func requireMessageRecipient(c echo.Context, messageID, failure string) (msg Message, ok bool, err error) {
+	msg, ok, err = requireMessageAccess(c, messageID, failure)
+	if !ok {
+		return msg, false, err
+	}
+	me := authUserID(c)
+	// A group member passed requireMessageAccess; a 1-to-1 message has exactly one recipient
+	recipient := msg.SenderID != me && (msg.ConversationID != "" || msg.ReceiverID == me)
+	if !recipient {
+		return msg, false, c.JSON(403, map[string]string{"error": "Only a recipient can acknowledge this message"})
+	}
+	return msg, true, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPairPeer(t *testing.T) {
+	tests := []struct {
+		name         string
+		userID       string
+		user1, user2 string
+		wantOther    string
+		wantOK       bool
+	}{
+		{"caller is user1", "alice", "alice", "bob", "bob", true},
+		{"caller is user2", "bob", "alice", "bob", "alice", true},
+		{"caller is neither", "mallory", "alice", "bob", "", false},
+		{"no caller", "", "alice", "bob", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other, ok := pairPeer(tt.userID, tt.user1, tt.user2)
+			if other != tt.wantOther || ok != tt.wantOK {
+				t.Errorf("pairPeer(%q, %q, %q) = %q, %v, want %q, %v",
+					tt.userID, tt.user1, tt.user2, other, ok, tt.wantOther, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMessagePeer(t *testing.T) {
+	direct := Message{SenderID: "alice", ReceiverID: "bob"}
+	group := Message{SenderID: "alice", ConversationID: "team"}
+
+	tests := []struct {
+		name      string
+		msg       Message
+		userID    string
+		wantOther string
+		wantOK    bool
+	}{
+		{"sender of a direct message", direct, "alice", "bob", true},
+		{"receiver of a direct message", direct, "bob", "alice", true},
+		{"outsider of a direct message", direct, "mallory", "", false},
+		{"sender of a group message", group, "alice", "team", true},
+		// Group membership is checked by isParticipant, so anyone gets the group back here
+		{"anyone on a group message", group, "mallory", "team", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other, ok := messagePeer(tt.msg, tt.userID)
+			if other != tt.wantOther || ok != tt.wantOK {
+				t.Errorf("messagePeer(%+v, %q) = %q, %v, want %q, %v",
+					tt.msg, tt.userID, other, ok, tt.wantOther, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsParticipantWithoutIDs(t *testing.T) {
+	// Missing IDs are answered without touching the database
+	for _, ids := range [][2]string{{"", "bob"}, {"alice", ""}, {"", ""}} {
+		ok, err := isParticipant(context.Background(), ids[0], ids[1])
+		if ok || err != nil {
+			t.Errorf("isParticipant(%q, %q) = %v, %v, want false, nil", ids[0], ids[1], ok, err)
+		}
+	}
+}
+
+func TestIsParticipant(t *testing.T) {
+	f := useFakePG(t)
+	// "team" is a group with alice and bob as members; the query decides membership itself,
+	// so the fake answers by the user it is asked about
+	f.on("'mallory'", pgRule{Rows: [][]interface{}{{false}}})
+	f.on("'team'", pgRule{Rows: [][]interface{}{{true}}})
+
+	for _, tt := range []struct {
+		userID string
+		want   bool
+	}{{"alice", true}, {"mallory", false}} {
+		ok, err := isParticipant(t.Context(), tt.userID, "team")
+		if err != nil || ok != tt.want {
+			t.Errorf("isParticipant(%q, team) = %v, %v, want %v, nil", tt.userID, ok, err, tt.want)
+		}
+	}
+	if got := f.queriesContaining("conversation_members"); len(got) != 2 {
+		t.Errorf("membership was checked %d times, want 2", len(got))
+	}
+}
+
+// Matches the query of isParticipant alone: lists also mention conversation_members (see sinceJoined),
+// so a rule for the participant check that must not answer them uses this
+const participantQuery = "THEN EXISTS (SELECT 1 FROM conversation_members"
+
+//! Returns an echo context for a request on message id by user, and the recorder holding its response
+func messageContext(method, id, user string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, "/messages/"+id, nil)
+	req.Header.Set("If-Match", "*")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	c.Set(authUserKey, user)
+	return c, rec
+}
+
+func TestOnlyRecipientsAcknowledge(t *testing.T) {
+	direct := Message{MessageID: "m1", SenderID: "alice", ReceiverID: "bob"}
+	group := Message{MessageID: "m1", SenderID: "alice", ConversationID: "team"}
+
+	acknowledge := []struct {
+		name    string
+		method  string
+		handler echo.HandlerFunc
+	}{
+		{"read", http.MethodPatch, markMessageAsRead},
+		{"delivered", http.MethodPut, markMessageAsDelivered},
+	}
+	tests := []struct {
+		name       string
+		msg        Message
+		user       string
+		wantStatus int
+	}{
+		{"sender of a direct message", direct, "alice", 403},
+		{"receiver of a direct message", direct, "bob", 200},
+		{"sender of a group message", group, "alice", 403},
+		{"member of a group", group, "carol", 200},
+	}
+	for _, a := range acknowledge {
+		for _, tt := range tests {
+			t.Run(a.name+"/"+tt.name, func(t *testing.T) {
+				f := useFakePG(t)
+				useFakeRedis(t)
+				msg := tt.msg
+				msg.Timestamp, msg.Status, msg.ContentType, msg.Version = time.Now(), "sent", defaultContentType, 1
+				f.on("SELECT status, version FROM messages", pgRule{Rows: [][]interface{}{{"sent", int64(1)}}})
+				f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{messageRecord(msg)}})
+				f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+				f.on("UPDATE messages SET status", pgRule{Rows: [][]interface{}{{"alice", int64(2)}}})
+
+				c, rec := messageContext(a.method, "m1", tt.user)
+				if err := a.handler(c); err != nil {
+					t.Fatalf("handler returned %v", err)
+				}
+				if rec.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+				}
+				if updated := len(f.queriesContaining("UPDATE messages")) > 0; updated != (tt.wantStatus == 200) {
+					t.Errorf("message updated = %v, want %v", updated, tt.wantStatus == 200)
+				}
+			})
+		}
+	}
+}
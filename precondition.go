@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errMissingIfMatch = errors.New("If-Match header is required: send the message's ETag, or * to skip the check")
+
+//! Formats a message version as the ETag clients send back in If-Match
+func messageETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+//! Reads the message version the client expects from If-Match.
+// Returns nil for "*" (any version). A missing header returns errMissingIfMatch.
+func ifMatchVersion(c echo.Context) (*int64, error) {
+	header := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if header == "" {
+		return nil, errMissingIfMatch
+	}
+	if header == "*" {
+		return nil, nil
+	}
+
+	// Accept the ETag as sent ("3"), weak (W/"3") or bare (3)
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return nil, errors.New("If-Match must be a message ETag such as \"3\", or *")
+	}
+	return &version, nil
+}
+
+//! Writes the response for an unusable If-Match header: 428 when it is missing, 400 when malformed
+func badIfMatch(c echo.Context, err error) error {
+	if errors.Is(err, errMissingIfMatch) {
+		return c.JSON(428, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(400, map[string]string{"error": err.Error()})
+}
+
+//! Writes 412 for a stale If-Match, with the current ETag so the client can refetch and retry
+func preconditionFailed(c echo.Context, current int64) error {
+	c.Response().Header().Set("ETag", messageETag(current))
+	return c.JSON(412, map[string]interface{}{"error": "Message was modified by someone else", "version": current})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header     string
+		want       int64 // -1 for any version
+		wantStatus int   // badIfMatch's answer; 0 when the header is usable
+	}{
+		{`"3"`, 3, 0},
+		{`W/"3"`, 3, 0},
+		{"3", 3, 0},
+		{" * ", -1, 0},
+		{"", 0, 428},
+		{`"three"`, 0, 400},
+		{`"3", "4"`, 0, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			c, rec := messageContext(http.MethodPatch, "m1", "alice")
+			c.Request().Header.Set("If-Match", tt.header)
+			got, err := ifMatchVersion(c)
+			if tt.wantStatus != 0 {
+				if err == nil {
+					t.Fatalf("ifMatchVersion = %v, want an error", got)
+				}
+				badIfMatch(c, err)
+				if rec.Code != tt.wantStatus {
+					t.Errorf("badIfMatch answered %d, want %d", rec.Code, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ifMatchVersion: %v", err)
+			}
+			if (got == nil) != (tt.want == -1) || (got != nil && *got != tt.want) {
+				t.Errorf("ifMatchVersion = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+//! Sends c to handler and returns the status, the ETag and the decoded body
+func respond(t *testing.T, handler echo.HandlerFunc, c echo.Context, rec *httptest.ResponseRecorder) (int, string, map[string]interface{}) {
+	t.Helper()
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned %v", err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, rec.Header().Get("ETag"), body
+}
+
+func TestStaleEditIsRefused(t *testing.T) {
+	msg := &Message{MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Content: "helo",
+		Timestamp: time.Now().UTC(), Status: "delivered", ContentType: defaultContentType, Version: 1, Seq: 1}
+	f := useEditFakes(t, msg, nil)
+	f.on(messageColumns, pgRule{Answer: func(string) [][]interface{} { return [][]interface{}{messageRecord(*msg)} }})
+	f.on("FROM conversations WHERE conversation_id", pgRule{Rows: [][]interface{}{{true}}})
+
+	// alice has the message open on two devices, both at the same version
+	var etags [2]string
+	for i := range etags {
+		c, rec := messageContext(http.MethodGet, "m1", "alice")
+		_, etags[i], _ = respond(t, getMessage, c, rec)
+	}
+	if etags[0] != messageETag(1) || etags[1] != etags[0] {
+		t.Fatalf("ETags = %q, want both %q", etags, messageETag(1))
+	}
+
+	edit := func(content, ifMatch string) (int, string, map[string]interface{}) {
+		c, rec := editContext("m1", "alice", content)
+		c.Request().Header.Set("If-Match", ifMatch)
+		return respond(t, editMessage, c, rec)
+	}
+	if code, etag, _ := edit("hello", etags[0]); code != 200 || etag != messageETag(2) {
+		t.Fatalf("first edit = %d with ETag %q, want 200 with %q", code, etag, messageETag(2))
+	}
+	// The second device still holds version 1: its edit would overwrite the first one
+	code, etag, body := edit("hullo", etags[1])
+	if code != 412 || etag != messageETag(2) || body["version"] != float64(2) {
+		t.Errorf("stale edit = %d with ETag %q and body %v, want 412 pointing at version 2", code, etag, body)
+	}
+	if msg.Content != "hello" || len(f.queriesContaining("INSERT INTO message_edits")) != 1 {
+		t.Errorf("content = %q after the stale edit, want the first edit kept and one history row", msg.Content)
+	}
+	// After refetching it can edit again
+	if code, _, _ := edit("hullo", etag); code != 200 || msg.Content != "hullo" {
+		t.Errorf("edit with the fresh ETag = %d (content %q), want 200", code, msg.Content)
+	}
+	if code, _, _ := edit("again", ""); code != 428 {
+		t.Errorf("edit without If-Match = %d, want 428", code)
+	}
+}
+
+func TestStaleStatusChangeIsRefused(t *testing.T) {
+	f := useFakePG(t)
+	useFakeRedis(t)
+	// Someone already moved the message on to version 2
+	f.on("SELECT status, version FROM messages", pgRule{Rows: [][]interface{}{{"sent", int64(2)}}})
+	f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{messageRecord(Message{MessageID: "m1",
+		SenderID: "alice", ReceiverID: "bob", Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 2})}})
+	f.on("FROM conversations WHERE conversation_id", pgRule{Rows: [][]interface{}{{true}}})
+
+	c, rec := messageContext(http.MethodPut, "m1", "bob")
+	c.Request().Header.Set("If-Match", messageETag(1))
+	code, etag, _ := respond(t, markMessageAsDelivered, c, rec)
+	if code != 412 || etag != messageETag(2) {
+		t.Errorf("stale status change = %d with ETag %q, want 412 with %q", code, etag, messageETag(2))
+	}
+	if got := f.queriesContaining("UPDATE messages"); len(got) != 0 {
+		t.Errorf("the message was updated: %q", got)
+	}
+}
+
+// Two edits really racing each other, serialized by the row lock; runs against a real database only
+func TestConcurrentEditsOneWins(t *testing.T) {
+	useTestDB(t)
+	insertTestMessage(t, Message{MessageID: "m1", SenderID: "alice", ReceiverID: "bob", Content: "helo",
+		Timestamp: time.Now().UTC(), Status: "delivered", ContentType: defaultContentType, Seq: 1})
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i, content := range []string{"hello", "hullo"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, rec := editContext("m1", "alice", content)
+			c.Request().Header.Set("If-Match", messageETag(1))
+			if err := editMessage(c); err != nil {
+				t.Errorf("editMessage returned %v", err)
+			}
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+
+	if !(codes[0] == 200 && codes[1] == 412) && !(codes[0] == 412 && codes[1] == 200) {
+		t.Errorf("statuses = %v, want one 200 and one 412", codes)
+	}
+	var version, edits int64
+	if err := pool.QueryRow(t.Context(), "SELECT version, (SELECT count(*) FROM message_edits) FROM messages WHERE message_id = 'm1'").Scan(&version, &edits); err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || edits != 1 {
+		t.Errorf("version %d with %d history rows, want 2 and 1", version, edits)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Messages a sender may queue per minute, configured with SEND_RATE_LIMIT; 0 disables the limit
+var sendRateLimit int64 = 60
+
+// Length of one rate-limit window
+const sendRateWindow = time.Minute
+
+// The clock windows are measured by; tests replace it
+var rateLimitNow = time.Now
+
+// SendRate is the response for GET /users/:id/send-rate
+type SendRate struct {
+	UserID         string `json:"user_id"`
+	Sent           int64  `json:"sent"`             // sends counted in the current window
+	Limit          int64  `json:"limit"`            // SEND_RATE_LIMIT; 0 when there is no limit
+	Remaining      *int64 `json:"remaining"`        // sends left in this window; null when there is no limit
+	ResetAt        string `json:"reset_at"`         // RFC3339, when the window ends and the count starts over
+	ResetInSeconds int64  `json:"reset_in_seconds"` // rounded up, like Retry-After
+}
+
+//! Returns the Redis counter of senderID's sends in the window starting at windowStart
+func sendRateKey(senderID string, windowStart time.Time) string {
+	return fmt.Sprintf("ratelimit:send:%s:%d", senderID, windowStart.Unix())
+}
+
+//! Counts a send against the sender's current window (fixed window: INCR + EXPIRE in Redis).
+// Returns false once the sender is over the limit, and the window's use after this send either way
+// (for the X-RateLimit-* headers, at no extra round trip).
+func allowSend(ctx context.Context, senderID string) (bool, SendRate, error) {
+	if sendRateLimit <= 0 {
+		return true, SendRate{UserID: senderID}, nil
+	}
+
+	now := rateLimitNow()
+	windowStart := now.Truncate(sendRateWindow)
+	key := sendRateKey(senderID, windowStart)
+
+	// INCR and EXPIRE together so a counter never outlives its window
+	pipe := redisCli.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, sendRateWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, SendRate{}, err
+	}
+
+	return count.Val() <= sendRateLimit, newSendRate(senderID, count.Val(), windowStart, now), nil
+}
+
+//! Sets the advisory X-RateLimit-* headers from the sender's window, so clients can slow down
+// before a 429. Sets nothing when there is no limit.
+func setRateLimitHeaders(c echo.Context, rate SendRate) {
+	if rate.Remaining == nil {
+		return
+	}
+	header := c.Response().Header()
+	header.Set("X-RateLimit-Limit", strconv.FormatInt(rate.Limit, 10))
+	header.Set("X-RateLimit-Remaining", strconv.FormatInt(*rate.Remaining, 10))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(rate.ResetInSeconds, 10))
+}
+
+//! Builds senderID's SendRate from the count of its current window, which started at windowStart
+func newSendRate(senderID string, sent int64, windowStart, now time.Time) SendRate {
+	reset := windowStart.Add(sendRateWindow)
+	rate := SendRate{
+		UserID:         senderID,
+		Sent:           sent,
+		ResetAt:        reset.UTC().Format(time.RFC3339),
+		ResetInSeconds: int64((reset.Sub(now) + time.Second - 1) / time.Second),
+	}
+	if sendRateLimit > 0 {
+		rate.Limit = sendRateLimit
+		remaining := max(sendRateLimit-sent, 0) // rejected sends are counted too
+		rate.Remaining = &remaining
+	}
+	return rate
+}
+
+//! Reads senderID's use of the current window without counting a send
+func currentSendRate(ctx context.Context, senderID string) (SendRate, error) {
+	now := rateLimitNow()
+	windowStart := now.Truncate(sendRateWindow)
+	sent, err := redisCli.Get(ctx, sendRateKey(senderID, windowStart)).Int64()
+	if errors.Is(err, redis.Nil) {
+		sent, err = 0, nil // nothing sent in this window yet
+	}
+	if err != nil {
+		return SendRate{}, err
+	}
+	return newSendRate(senderID, sent, windowStart, now), nil
+}
+
+//! Handles reporting a user's use of the send rate limit, so clients can slow down before a 429.
+// Only the user themselves and admins may look.
+func getSendRate(c echo.Context) error {
+	userID := normalizeUserID(c.Param("id"))
+	if userID != authUserID(c) && !isAdmin(c) {
+		return c.JSON(403, map[string]string{"error": "Only the user or an admin can see this send rate"})
+	}
+
+	rate, err := currentSendRate(c.Request().Context(), userID)
+	if err != nil {
+		logFor(c).Error("Failed to read send rate", "error", err, "user_id", userID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch send rate"})
+	}
+	return c.JSON(200, rate)
+}
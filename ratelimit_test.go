@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestNewSendRate(t *testing.T) {
+	defer func(n int64) { sendRateLimit = n }(sendRateLimit)
+
+	windowStart := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	now := windowStart.Add(20*time.Second + 300*time.Millisecond)
+
+	tests := []struct {
+		name          string
+		limit         int64
+		sent          int64
+		wantRemaining int64 // -1 for null
+	}{
+		{"nothing sent", 60, 0, 60},
+		{"some sent", 60, 45, 15},
+		{"at the limit", 60, 60, 0},
+		{"over the limit", 60, 75, 0},
+		{"no limit", 0, 0, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendRateLimit = tt.limit
+			rate := newSendRate("alice", tt.sent, windowStart, now)
+
+			if rate.UserID != "alice" || rate.Sent != tt.sent || rate.Limit != tt.limit {
+				t.Errorf("newSendRate() = %+v", rate)
+			}
+			if tt.wantRemaining < 0 {
+				if rate.Remaining != nil {
+					t.Errorf("remaining = %d, want null", *rate.Remaining)
+				}
+			} else if rate.Remaining == nil || *rate.Remaining != tt.wantRemaining {
+				t.Errorf("remaining = %v, want %d", rate.Remaining, tt.wantRemaining)
+			}
+			if rate.ResetAt != "2025-03-15T12:01:00Z" {
+				t.Errorf("reset_at = %q, want the end of the window", rate.ResetAt)
+			}
+			if rate.ResetInSeconds != 40 { // 39.7s, rounded up
+				t.Errorf("reset_in_seconds = %d, want 40", rate.ResetInSeconds)
+			}
+		})
+	}
+}
+
+func TestGetSendRateForbidden(t *testing.T) {
+	// Refused before Redis is read, so no Redis is needed
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/users/bob/send-rate", nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues("bob")
+	c.Set(authUserKey, "alice")
+	c.Set(authRoleKey, "")
+
+	if err := getSendRate(c); err != nil {
+		t.Fatalf("getSendRate() = %v", err)
+	}
+	if rec.Code != 403 {
+		t.Errorf("status = %d for another user's send rate, want 403", rec.Code)
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	c, rec := newTestContext()
+	remaining := int64(15)
+	setRateLimitHeaders(c, SendRate{Limit: 60, Remaining: &remaining, ResetInSeconds: 40})
+	for header, want := range map[string]string{
+		"X-RateLimit-Limit":     "60",
+		"X-RateLimit-Remaining": "15",
+		"X-RateLimit-Reset":     "40",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// Without a limit there is nothing to advise
+	c, rec = newTestContext()
+	setRateLimitHeaders(c, SendRate{UserID: "alice"})
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "" {
+		t.Errorf("X-RateLimit-Remaining = %q without a limit, want none", got)
+	}
+}
+
+func TestSendRateLimit(t *testing.T) {
+	useSendFakes(t)
+	defer func(n int64) { sendRateLimit = n }(sendRateLimit)
+	sendRateLimit = 3
+	now := time.Date(2025, 3, 15, 12, 0, 10, 0, time.UTC)
+	rateLimitNow = func() time.Time { return now }
+	t.Cleanup(func() { rateLimitNow = time.Now })
+
+	send := func() *httptest.ResponseRecorder {
+		return postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "hi"}`, nil)
+	}
+	for i := 1; i <= 3; i++ {
+		if rec := send(); rec.Code != 200 {
+			t.Fatalf("send %d: status = %d, want 200 (body %s)", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	// The 4th send in the window is refused, with how long until the window ends
+	now = now.Add(30 * time.Second)
+	rec := send()
+	if rec.Code != 429 {
+		t.Fatalf("send 4: status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "20" {
+		t.Errorf("Retry-After = %q, want 20", got)
+	}
+
+	// A new window starts the count over
+	now = now.Add(20 * time.Second)
+	rec = send()
+	if rec.Code != 200 {
+		t.Fatalf("send in the next window: status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "2" {
+		t.Errorf("X-RateLimit-Remaining = %q in the new window, want 2", got)
+	}
+}
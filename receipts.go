@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// Receipts are published on a per-sender channel (receipts:<sender_id>), so whatever
+// relays them to clients only ever sees the receipts for the user it subscribed for.
+const receiptChannelPrefix = "receipts:"
+
+// receiptEvent is the payload published when a message is delivered or read
+type receiptEvent struct {
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`            // "delivered" or "read"
+	At        string `json:"at"`                // RFC3339 time of the status change
+	Via       string `json:"via,omitempty"`     // "webhook" when a recipient's webhook took the message
+	UserID    string `json:"user_id,omitempty"` // with via: the recipient whose webhook it was
+}
+
+//! Publishes a delivery/read receipt to the original sender's receipt channel.
+// Best-effort like the delivery events: the status change is already committed.
+func publishReceipt(reqCtx context.Context, senderID, messageID, status string) {
+	publishReceiptVia(reqCtx, senderID, messageID, status, "", "")
+}
+
+//! Publishes a receipt like publishReceipt, marked with the channel via that recipient userID was reached through
+func publishReceiptVia(reqCtx context.Context, senderID, messageID, status, via, userID string) {
+	payload, err := json.Marshal(receiptEvent{
+		MessageID: messageID,
+		Status:    status,
+		At:        time.Now().UTC().Format(time.RFC3339Nano),
+		Via:       via,
+		UserID:    userID,
+	})
+	if err != nil {
+		slog.Error("Failed to encode receipt", "error", err, "message_id", messageID)
+		return
+	}
+
+	if err := redisCli.Publish(reqCtx, receiptChannelPrefix+senderID, payload).Err(); err != nil {
+		slog.Error("Failed to publish receipt", "error", err, "message_id", messageID, "sender_id", senderID)
+	}
+}
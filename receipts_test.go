@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Decodes the receipts published on sender's channel
+func receiptsFor(t *testing.T, r *fakeRedis, sender string) []receiptEvent {
+	t.Helper()
+	var receipts []receiptEvent
+	for _, payload := range r.publishedOn(receiptChannelPrefix + sender) {
+		var receipt receiptEvent
+		if err := json.Unmarshal([]byte(payload), &receipt); err != nil {
+			t.Fatalf("decoding receipt %q: %v", payload, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, receipt.At); err != nil {
+			t.Errorf("receipt at = %q: %v", receipt.At, err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts
+}
+
+func TestReadReceiptGoesToSender(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("SELECT status, version FROM messages", pgRule{Rows: [][]interface{}{{"delivered", int64(2)}}})
+	f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{messageRecord(Message{MessageID: "m1", SenderID: "alice",
+		ReceiverID: "bob", Timestamp: time.Now(), Status: "delivered", ContentType: defaultContentType, Version: 2})}})
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	f.on("UPDATE messages SET status", pgRule{Rows: [][]interface{}{{"alice", int64(3)}}})
+
+	c, rec := messageContext(http.MethodPatch, "m1", "bob")
+	if err := markMessageAsRead(c); err != nil {
+		t.Fatalf("markMessageAsRead returned %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	if got := receiptsFor(t, r, "alice"); len(got) != 1 || got[0].MessageID != "m1" || got[0].Status != "read" {
+		t.Errorf("alice's receipts = %+v, want one read receipt for m1", got)
+	}
+	// The reader's own channel stays quiet
+	if got := r.publishedOn(receiptChannelPrefix + "bob"); len(got) != 0 {
+		t.Errorf("bob got receipts %q", got)
+	}
+}
+
+func TestMarkConversationReadSendsReceipts(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("UPDATE messages SET read = TRUE", pgRule{Rows: [][]interface{}{{"m1"}, {"m2"}}})
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/conversations/alice/read", nil), rec)
+	c.SetParamNames("otherUser")
+	c.SetParamValues("alice")
+	c.Set(authUserKey, "bob")
+	if err := markConversationRead(c); err != nil {
+		t.Fatalf("markConversationRead returned %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+
+	// One receipt per message that changed, all to the sender
+	got := receiptsFor(t, r, "alice")
+	if len(got) != 2 || got[0].MessageID != "m1" || got[1].MessageID != "m2" || got[0].Status != "read" || got[1].Status != "read" {
+		t.Errorf("alice's receipts = %+v, want read receipts for m1 and m2", got)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+)
+
+// Characters of the parent's content quoted in a reply
+const replySnippetLength = 100
+
+// ReplyPreview is the quoted parent returned with a reply
+type ReplyPreview struct {
+	MessageID string `json:"message_id"`
+	SenderID  string `json:"sender_id"`
+	Snippet   string `json:"snippet"` // first replySnippetLength characters of the content
+}
+
+//! Reports whether parentID is a visible message in the conversation a new message is sent to:
+// the same group for group messages, otherwise the same pair of users.
+func replyParentInConversation(ctx context.Context, parentID, senderID, receiverID, conversationID string) (bool, error) {
+	var ok bool
+	var err error
+	if conversationID != "" {
+		err = pool.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM messages
+				WHERE message_id = $1 AND conversation_id = $2 AND `+visibleMessage+`
+			)`, parentID, conversationID).Scan(&ok)
+	} else {
+		err = pool.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM messages
+				WHERE message_id = $1 AND conversation_id IS NULL
+					AND ((sender_id = $2 AND receiver_id = $3) OR (sender_id = $3 AND receiver_id = $2))
+					AND `+visibleMessage+`
+			)`, parentID, senderID, receiverID).Scan(&ok)
+	}
+	return ok, err
+}
+
+//! Fills ReplyTo on every reply in messages with one query.
+// Parents that were deleted or have expired are left nil; the reply keeps its reply_to_message_id.
+func attachReplyPreviews(ctx context.Context, db *pgxpool.Pool, messages []Message) error {
+	var parentIDs []string
+	for _, msg := range messages {
+		if msg.ReplyToMessageID != "" {
+			parentIDs = append(parentIDs, msg.ReplyToMessageID)
+		}
+	}
+	if len(parentIDs) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT message_id, sender_id, LEFT(content, $2)
+		FROM messages
+		WHERE message_id = ANY($1) AND `+visibleMessage,
+		parentIDs, replySnippetLength)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	parents := make(map[string]*ReplyPreview)
+	for rows.Next() {
+		var p ReplyPreview
+		if err := rows.Scan(&p.MessageID, &p.SenderID, &p.Snippet); err != nil {
+			return err
+		}
+		parents[p.MessageID] = &p
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		if messages[i].ReplyToMessageID != "" {
+			messages[i].ReplyTo = parents[messages[i].ReplyToMessageID]
+		}
+	}
+	return nil
+}
+
+// Bounds of GET /messages/:id/thread-tree
+const (
+	defaultThreadDepth   = 3 // levels of replies below the message
+	maxThreadDepth       = 10
+	defaultThreadReplies = 20 // replies listed per message, at every level
+	maxThreadReplies     = 100
+	maxThreadNodes       = 500 // messages in one response, the root included
+)
+
+// ThreadNode is a message of a thread tree with the replies to it, oldest first
+type ThreadNode struct {
+	Message        interface{}   `json:"message"` // shaped for the API version
+	Replies        []*ThreadNode `json:"replies"`
+	HasMoreReplies bool          `json:"has_more_replies"` // more replies than listed: ask for this message's tree with after=next_cursor
+	NextCursor     *string       `json:"next_cursor"`      // the last listed reply; null when none are listed
+	id             string
+}
+
+// ThreadTree is the body of GET /messages/:id/thread-tree
+type ThreadTree struct {
+	Root      *ThreadNode `json:"root"`
+	Nodes     int         `json:"nodes"`     // messages in the tree, the root included
+	Truncated bool        `json:"truncated"` // maxThreadNodes was reached before depth
+}
+
+//! Handles returning the replies to a message as a tree, for threaded display.
+// ?depth levels are walked breadth first, each message listing at most ?limit replies, and the
+// whole tree stops at maxThreadNodes. ?after pages through the replies to the message itself;
+// deeper levels are paged by asking for the tree of the message whose replies were cut short.
+func getThreadTree(c echo.Context) error {
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	depth, err := threadParam(c, "depth", defaultThreadDepth, maxThreadDepth)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	limit, err := threadParam(c, "limit", defaultThreadReplies, maxThreadReplies)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	root, ok, err := requireMessageAccess(c, c.Param("id"), "Failed to fetch thread")
+	if !ok {
+		return err
+	}
+
+	reqCtx := c.Request().Context()
+	after := c.QueryParam("after")
+	if after != "" {
+		var isReply bool
+		err := readDB(c).QueryRow(reqCtx,
+			"SELECT EXISTS (SELECT 1 FROM messages WHERE message_id = $1 AND reply_to_message_id = $2)",
+			after, root.MessageID).Scan(&isReply)
+		if err == nil && !isReply {
+			return c.JSON(400, map[string]string{"error": "after must be a reply to this message"})
+		}
+		if err != nil {
+			logFor(c).Error("Failed to resolve thread cursor", "error", err, "after", after)
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			return c.JSON(500, map[string]string{"error": "Failed to fetch thread"})
+		}
+	}
+
+	tree, err := loadThreadTree(reqCtx, readDB(c), root, authUserID(c), depth, limit, after, version)
+	if err != nil {
+		logFor(c).Error("Failed to load thread", "error", err, "message_id", root.MessageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch thread"})
+	}
+	return c.JSON(200, tree)
+}
+
+//! Reads a positive integer query parameter, def when absent, capped at max
+func threadParam(c echo.Context, name string, def, max int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return min(n, max), nil
+}
+
+//! Walks the replies under root one level per query, as userID sees them.
+// reply_to_message_id has no foreign key, so references can loop (a message replying to its own
+// reply, say): a message already in the tree is never added again, which also ends the walk.
+func loadThreadTree(ctx context.Context, db *pgxpool.Pool, root Message, userID string, depth, limit int, after string, version int) (ThreadTree, error) {
+	tree := ThreadTree{Root: &ThreadNode{Message: messageForVersion(root, version), Replies: []*ThreadNode{}, id: root.MessageID}, Nodes: 1}
+	inTree := map[string]bool{root.MessageID: true}
+	level := map[string]*ThreadNode{root.MessageID: tree.Root}
+
+	for d := 0; len(level) > 0; d++ {
+		ids := make([]string, 0, len(level))
+		for id := range level {
+			ids = append(ids, id)
+		}
+		if d == depth || tree.Truncated {
+			// The walk stops here: flag the messages that have replies nobody listed
+			return tree, markUnlistedReplies(ctx, db, level, ids, userID, inTree)
+		}
+
+		cursor := ""
+		if d == 0 {
+			cursor = after
+		}
+		replies, err := threadReplies(ctx, db, ids, userID, limit+1, cursor)
+		if err != nil {
+			return tree, err
+		}
+
+		next := make(map[string]*ThreadNode)
+		for _, msg := range replies {
+			parent := level[msg.ReplyToMessageID]
+			switch {
+			case inTree[msg.MessageID]: // a loop in reply_to
+			case len(parent.Replies) == limit:
+				parent.HasMoreReplies = true
+			case tree.Nodes == maxThreadNodes:
+				parent.HasMoreReplies, tree.Truncated = true, true
+			default:
+				node := &ThreadNode{Message: messageForVersion(msg, version), Replies: []*ThreadNode{}, id: msg.MessageID}
+				parent.Replies = append(parent.Replies, node)
+				inTree[msg.MessageID] = true
+				next[msg.MessageID] = node
+				tree.Nodes++
+			}
+		}
+		for _, node := range level {
+			if node.HasMoreReplies && len(node.Replies) > 0 {
+				node.NextCursor = &node.Replies[len(node.Replies)-1].id
+			}
+		}
+		level = next
+	}
+	return tree, nil
+}
+
+//! Returns up to perParent visible replies to each of parentIDs (after cursor, when set), ranked so the
+// first reply of every parent comes before any second one: a tree cut short by maxThreadNodes stays broad.
+func threadReplies(ctx context.Context, db *pgxpool.Pool, parentIDs []string, userID string, perParent int, cursor string) ([]Message, error) {
+	args := []interface{}{parentIDs, userID, perParent}
+	cursorCond := "TRUE"
+	if cursor != "" {
+		cursorCond = "(timestamp, seq, message_id) > (SELECT timestamp, seq, message_id FROM messages WHERE message_id = $4)"
+		args = append(args, cursor)
+	}
+	rows, err := db.Query(ctx, `
+		SELECT `+messageColumns+`
+		FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY reply_to_message_id ORDER BY `+oldestFirst+`) AS reply_rank
+			FROM messages
+			WHERE reply_to_message_id = ANY($1)
+				AND `+visibleMessage+`
+				AND `+notHiddenFor(2)+`
+				AND `+sinceJoined(2)+`
+				AND `+cursorCond+`
+		) messages
+		WHERE reply_rank <= $3
+		ORDER BY reply_rank, reply_to_message_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []Message
+	for rows.Next() {
+		var msg Message
+		if err := scanMessage(rows, &msg); err != nil {
+			return nil, err
+		}
+		replies = append(replies, msg)
+	}
+	return replies, rows.Err()
+}
+
+//! Sets HasMoreReplies on the nodes of level (keyed by ids) that have visible replies not in the tree
+func markUnlistedReplies(ctx context.Context, db *pgxpool.Pool, level map[string]*ThreadNode, ids []string, userID string, inTree map[string]bool) error {
+	listed := make([]string, 0, len(inTree))
+	for id := range inTree {
+		listed = append(listed, id)
+	}
+	rows, err := db.Query(ctx, `
+		SELECT DISTINCT reply_to_message_id
+		FROM messages
+		WHERE reply_to_message_id = ANY($1)
+			AND message_id <> ALL($3)
+			AND `+visibleMessage+`
+			AND `+notHiddenFor(2)+`
+			AND `+sinceJoined(2), ids, userID, listed)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var parentID string
+		if err := rows.Scan(&parentID); err != nil {
+			return err
+		}
+		level[parentID].HasMoreReplies = true
+	}
+	return rows.Err()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSendReply(t *testing.T) {
+	f, r := useSendFakes(t)
+	// parent-1 is in the alice/bob conversation; nothing else is
+	f.on("conversation_id IS NULL", pgRule{Answer: func(query string) [][]interface{} {
+		return [][]interface{}{{strings.Contains(query, "'parent-1'")}}
+	}})
+
+	rec := postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "yes", "reply_to_message_id": "parent-1"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("reply: status = %d (body %s)", rec.Code, rec.Body.String())
+	}
+	entries := r.entries("message_stream")
+	if len(entries) != 1 {
+		t.Fatalf("%d stream entries, want 1", len(entries))
+	}
+	// The worker reads the reference back off the entry and stores it with the message
+	msg, err := parseStreamMessage(entries[0].Values)
+	if err != nil {
+		t.Fatalf("parseStreamMessage: %v", err)
+	}
+	if msg.ReplyToMessageID != "parent-1" {
+		t.Errorf("ReplyToMessageID = %q, want parent-1", msg.ReplyToMessageID)
+	}
+
+	// A reference to a message that doesn't exist, or lives in another conversation, is refused
+	rec = postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "yes", "reply_to_message_id": "elsewhere"}`, nil)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "reply_to_message_id") {
+		t.Errorf("dangling reply: status = %d (body %s), want 400 naming reply_to_message_id", rec.Code, rec.Body.String())
+	}
+	if got := len(r.entries("message_stream")); got != 1 {
+		t.Errorf("%d stream entries, want still 1", got)
+	}
+}
+
+func TestGetMessagesQuotesReplies(t *testing.T) {
+	at := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	message := func(id, replyTo string) Message {
+		return Message{MessageID: id, SenderID: "alice", ReceiverID: "bob", Content: "about " + id,
+			Timestamp: at, Status: "sent", ContentType: defaultContentType, ReplyToMessageID: replyTo, Version: 1, Seq: 1}
+	}
+
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	// m1 quotes a live parent; m2 quotes one that has since been deleted
+	f.on("ORDER BY "+newestFirst, pgRule{Rows: [][]interface{}{
+		messageRecord(message("m2", "deleted-parent")),
+		messageRecord(message("m1", "live-parent")),
+	}})
+	f.on("= ANY(", pgRule{Rows: [][]interface{}{{"live-parent", "bob", strings.Repeat("x", replySnippetLength)}}})
+
+	req := httptest.NewRequest(http.MethodGet, "/messages?user1=alice&user2=bob", nil)
+	req.Header.Set("X-API-Version", "3")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, "alice")
+	if err := getMessages(c); err != nil {
+		t.Fatalf("getMessages returned %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d (body %s)", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if len(body.Messages) != 2 {
+		t.Fatalf("%d messages, want 2", len(body.Messages))
+	}
+
+	dangling, quoted := body.Messages[0], body.Messages[1]
+	if dangling.ReplyToMessageID != "deleted-parent" || dangling.ReplyTo != nil {
+		t.Errorf("reply to a deleted parent: reply_to_message_id %q, reply_to %+v; want the id and a null parent",
+			dangling.ReplyToMessageID, dangling.ReplyTo)
+	}
+	if p := quoted.ReplyTo; p == nil || p.MessageID != "live-parent" || p.SenderID != "bob" || len(p.Snippet) != replySnippetLength {
+		t.Errorf("reply_to = %+v, want live-parent from bob with a %d-character snippet", p, replySnippetLength)
+	}
+	// One lookup covers every parent on the page
+	if got := f.queriesContaining("= ANY("); len(got) != 1 {
+		t.Errorf("%d parent lookups, want 1", len(got))
+	}
+}
+
+// fakeThread answers the thread-tree queries from a reply graph: parent -> replies, oldest first
+type fakeThread map[string][]string
+
+var (
+	anyArray   = regexp.MustCompile(`ANY\(\s*'\{([^}]*)\}'`)
+	allArray   = regexp.MustCompile(`ALL\(\s*'\{([^}]*)\}'`)
+	rankLimit  = regexp.MustCompile(`reply_rank <=\s*'?(\d+)`)
+	cursorFrom = regexp.MustCompile(`\(timestamp, seq, message_id\) > \(SELECT .* WHERE message_id =\s*'([^']*)'`)
+)
+
+//! Splits the array literal a regexp captured into its elements
+func arrayElements(re *regexp.Regexp, query string) []string {
+	m := re.FindStringSubmatch(query)
+	if m == nil || m[1] == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(m[1], `"`, ""), ",")
+}
+
+//! Registers the rules for GET /messages/:id/thread-tree on f; every message is alice -> bob
+func (g fakeThread) register(f *fakePG) {
+	record := func(id, parent string) []interface{} {
+		return messageRecord(Message{MessageID: id, SenderID: "alice", ReceiverID: "bob", Content: "re: " + parent,
+			Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1, ReplyToMessageID: parent})
+	}
+	f.on("reply_rank", pgRule{Answer: func(query string) [][]interface{} {
+		perParent, _ := strconv.Atoi(rankLimit.FindStringSubmatch(query)[1])
+		parents := arrayElements(anyArray, query)
+		cursor := ""
+		if m := cursorFrom.FindStringSubmatch(query); m != nil {
+			cursor = m[1]
+		}
+		var rows [][]interface{}
+		for rank := range perParent {
+			for _, parent := range parents {
+				replies := g[parent]
+				if cursor != "" {
+					replies = replies[slices.Index(replies, cursor)+1:]
+				}
+				if rank < len(replies) {
+					rows = append(rows, record(replies[rank], parent))
+				}
+			}
+		}
+		return rows
+	}})
+	f.on("SELECT DISTINCT reply_to_message_id", pgRule{Cols: 1, Answer: func(query string) [][]interface{} {
+		listed := arrayElements(allArray, query)
+		var rows [][]interface{}
+		for _, parent := range arrayElements(anyArray, query) {
+			for _, reply := range g[parent] {
+				if !slices.Contains(listed, reply) {
+					rows = append(rows, []interface{}{parent})
+					break
+				}
+			}
+		}
+		return rows
+	}})
+	f.on("AND reply_to_message_id =", pgRule{Answer: func(query string) [][]interface{} {
+		for parent, replies := range g {
+			for _, reply := range replies {
+				if strings.Contains(query, "'"+reply+"'") && strings.Contains(query, "'"+parent+"'") {
+					return [][]interface{}{{true}}
+				}
+			}
+		}
+		return [][]interface{}{{false}}
+	}})
+	f.on("FROM messages WHERE message_id", pgRule{Answer: func(query string) [][]interface{} {
+		for parent := range g {
+			if strings.Contains(query, "'"+parent+"'") {
+				return [][]interface{}{record(parent, "")}
+			}
+		}
+		return nil
+	}})
+}
+
+// threadNode is a decoded ThreadNode
+type threadNode struct {
+	Message        Message       `json:"message"`
+	Replies        []*threadNode `json:"replies"`
+	HasMoreReplies bool          `json:"has_more_replies"`
+	NextCursor     *string       `json:"next_cursor"`
+}
+
+//! Calls getThreadTree for id as alice with query and decodes a 200 answer
+func threadTreeOf(t *testing.T, id, query string) (code, nodes int, truncated bool, root *threadNode) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/messages/"+id+"/thread-tree?"+query, nil)
+	req.Header.Set("X-API-Version", "3")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, "alice")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	if err := getThreadTree(c); err != nil {
+		t.Fatalf("getThreadTree returned %v", err)
+	}
+	if rec.Code != 200 {
+		return rec.Code, 0, false, nil
+	}
+	var body struct {
+		Root      *threadNode `json:"root"`
+		Nodes     int         `json:"nodes"`
+		Truncated bool        `json:"truncated"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body.Nodes, body.Truncated, body.Root
+}
+
+//! Writes the tree under n as "id[+](child child ...)", + marking more replies than listed
+func (n *threadNode) String() string {
+	s := n.Message.MessageID
+	if n.HasMoreReplies {
+		s += "+"
+	}
+	if len(n.Replies) > 0 {
+		var replies []string
+		for _, r := range n.Replies {
+			replies = append(replies, r.String())
+		}
+		s += "(" + strings.Join(replies, " ") + ")"
+	}
+	return s
+}
+
+func TestGetThreadTree(t *testing.T) {
+	thread := fakeThread{
+		"root": {"r1", "r2", "r3"},
+		"r1":   {"r1a"},
+		"r1a":  {"r1a1"},
+		"r2":   {"root"}, // root says it replies to r2: a loop
+		"r3":   {},
+		"r1a1": {},
+	}
+
+	tests := []struct {
+		name, query string
+		want        string
+		wantNodes   int
+		wantCursor  string // of the root
+	}{
+		{"defaults", "", "root(r1(r1a(r1a1)) r2 r3)", 6, ""},
+		{"depth", "depth=2", "root(r1(r1a+) r2 r3)", 5, ""},
+		{"replies per level", "depth=2&limit=2", "root+(r1(r1a+) r2)", 4, "r2"},
+		{"next page", "depth=2&limit=2&after=r2", "root(r3)", 2, ""},
+		{"capped depth", "depth=1000", "root(r1(r1a(r1a1)) r2 r3)", 6, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			f.on(participantQuery, pgRule{Rows: [][]interface{}{{true}}})
+			thread.register(f)
+
+			code, nodes, truncated, root := threadTreeOf(t, "root", tt.query)
+			if code != 200 {
+				t.Fatalf("status = %d, want 200", code)
+			}
+			if got := root.String(); got != tt.want {
+				t.Errorf("tree = %s, want %s", got, tt.want)
+			}
+			if nodes != tt.wantNodes || truncated {
+				t.Errorf("nodes = %d, truncated = %v; want %d, false", nodes, truncated, tt.wantNodes)
+			}
+			if cursor := root.NextCursor; (cursor == nil) != (tt.wantCursor == "") || cursor != nil && *cursor != tt.wantCursor {
+				t.Errorf("next_cursor = %v, want %q", cursor, tt.wantCursor)
+			}
+		})
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		f := useFakePG(t)
+		f.on(participantQuery, pgRule{Rows: [][]interface{}{{true}}})
+		thread.register(f)
+		for _, query := range []string{"depth=0", "depth=x", "limit=-1", "after=r1a"} {
+			if code, _, _, _ := threadTreeOf(t, "root", query); code != 400 {
+				t.Errorf("%s: status = %d, want 400", query, code)
+			}
+		}
+		if code, _, _, _ := threadTreeOf(t, "missing", ""); code != 404 {
+			t.Errorf("unknown message: status = %d, want 404", code)
+		}
+	})
+
+	// 100 replies with 100 replies each is more than maxThreadNodes: every reply keeps some of its own
+	t.Run("node cap", func(t *testing.T) {
+		wide := fakeThread{"root": {}}
+		for i := range maxThreadReplies {
+			reply := fmt.Sprintf("r%d", i)
+			wide["root"] = append(wide["root"], reply)
+			for j := range maxThreadReplies {
+				wide[reply] = append(wide[reply], fmt.Sprintf("r%d-%d", i, j))
+			}
+		}
+		f := useFakePG(t)
+		f.on(participantQuery, pgRule{Rows: [][]interface{}{{true}}})
+		wide.register(f)
+
+		code, nodes, truncated, root := threadTreeOf(t, "root", "limit=100")
+		if code != 200 {
+			t.Fatalf("status = %d, want 200", code)
+		}
+		if nodes != maxThreadNodes || !truncated {
+			t.Errorf("nodes = %d, truncated = %v; want %d, true", nodes, truncated, maxThreadNodes)
+		}
+		if len(root.Replies) != maxThreadReplies {
+			t.Fatalf("root lists %d replies, want %d", len(root.Replies), maxThreadReplies)
+		}
+		for _, reply := range root.Replies {
+			if n := len(reply.Replies); n < 3 || n > 4 || !reply.HasMoreReplies || *reply.NextCursor != reply.Replies[n-1].Message.MessageID {
+				t.Fatalf("%s lists %d replies (more %v), want 3 or 4 and more to fetch", reply.Message.MessageID, n, reply.HasMoreReplies)
+			}
+		}
+	})
+}
+
+// The window ranking, visibility filters and cursor are SQL, so this runs against a real database only
+func TestThreadTreeQueries(t *testing.T) {
+	useTestDB(t)
+	base := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	for i, m := range []struct{ id, parent string }{
+		{"root", ""},
+		{"r1", "root"}, {"r2", "root"}, {"gone", "root"}, {"hidden", "root"}, {"r3", "root"},
+		{"r1a", "r1"}, {"r1b", "r1"},
+		{"r1a1", "r1a"},
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: "alice", ReceiverID: "bob", Content: "hi",
+			Timestamp: base.Add(time.Duration(i) * time.Minute), Status: "sent", ContentType: defaultContentType, ReplyToMessageID: m.parent})
+	}
+	if _, err := pool.Exec(t.Context(), `
+		UPDATE messages SET deleted_at = now() WHERE message_id = 'gone';
+		UPDATE messages SET reply_to_message_id = 'r2' WHERE message_id = 'root'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := hideMessage(t.Context(), "hidden", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ query, want string }{
+		{"", "root(r1(r1a(r1a1) r1b) r2 r3)"},
+		{"depth=1", "root(r1+ r2 r3)"},
+		{"depth=2&limit=1", "root+(r1+(r1a+))"},
+		{"depth=1&limit=1&after=r1", "root+(r2)"},
+		{"depth=1&after=r2", "root(r3)"},
+	} {
+		code, _, _, root := threadTreeOf(t, "root", tt.query)
+		if code != 200 {
+			t.Fatalf("%q: status = %d, want 200", tt.query, code)
+		}
+		if got := root.String(); got != tt.want {
+			t.Errorf("%q: tree = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
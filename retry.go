@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Backoff for transient database errors in the worker: 100ms, 200ms, 400ms, ... capped at 5s
+const (
+	storeMaxAttempts = 5
+	retryBaseDelay   = 100 * time.Millisecond
+	retryMaxDelay    = 5 * time.Second
+)
+
+//! Runs fn up to maxAttempts times with exponential backoff (plus jitter) between attempts.
+// Returns at once on success or a permanent error, and gives up early when the workers stop.
+func withRetry(fn func() error, maxAttempts int) error {
+	delay := retryBaseDelay
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		slog.Warn("Transient database error, retrying", "error", err, "attempt", attempt, "delay", delay.String())
+		select {
+		case <-workers.stopping():
+			return err
+		case <-time.After(delay + rand.N(delay/2)):
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+	return err
+}
+
+//! Reports whether a database error is transient. Lost connections, deadlocks and
+// serialization failures are; constraint violations (e.g. unique_violation) and other
+// query errors are permanent and would fail the same way again.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, "08") // connection_exception class
+	}
+
+	// No server error: the connection itself failed, or the attempt ran past operationTimeout
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) || pgconn.Timeout(err) || errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
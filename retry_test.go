@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+//! Replaces the process-wide workers with a running manager for the test, so withRetry keeps retrying
+func runningWorkers(t *testing.T) *workerManager {
+	t.Helper()
+	old := workers
+	t.Cleanup(func() { workers = old })
+
+	workers = newManager(nil, nil)
+	quit := make(chan struct{})
+	workers.quit.Store(&quit)
+	return workers
+}
+
+// flakyFunc fails with its errors in order, then succeeds
+type flakyFunc struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyFunc) call() error {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return f.errs[f.calls-1]
+	}
+	return nil
+}
+
+func TestWithRetry(t *testing.T) {
+	transient := &pgconn.PgError{Code: "40P01"} // deadlock_detected
+	permanent := &pgconn.PgError{Code: "23505"} // unique_violation
+
+	tests := []struct {
+		name        string
+		errs        []error
+		maxAttempts int
+		wantErr     error
+		wantCalls   int
+	}{
+		{"succeeds at once", nil, 3, nil, 1},
+		{"succeeds after transient errors", []error{transient, transient}, 3, nil, 3},
+		{"permanent error is not retried", []error{permanent}, 3, permanent, 1},
+		{"transient then permanent", []error{transient, permanent}, 3, permanent, 2},
+		{"gives up after maxAttempts", []error{transient, transient, transient, transient}, 3, transient, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runningWorkers(t)
+			f := &flakyFunc{errs: tt.errs}
+			err := withRetry(f.call, tt.maxAttempts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("withRetry() error = %v, want %v", err, tt.wantErr)
+			}
+			if f.calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", f.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsWithWorkers(t *testing.T) {
+	m := runningWorkers(t)
+	close(*m.quit.Load()) // the workers are stopping: no point waiting to retry
+
+	transient := &pgconn.PgError{Code: "08006"} // connection_failure
+	f := &flakyFunc{errs: []error{transient, transient}}
+	if err := withRetry(f.call, 5); !errors.Is(err, transient) {
+		t.Errorf("withRetry() error = %v, want %v", err, transient)
+	}
+	if f.calls != 1 {
+		t.Errorf("fn called %d times, want 1", f.calls)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, true},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"connection exception class", &pgconn.PgError{Code: "08006"}, true},
+		{"wrapped deadlock", fmt.Errorf("insert: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"syntax error", &pgconn.PgError{Code: "42601"}, false},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"EOF", io.EOF, true},
+		{"unexpected EOF", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"deadline", context.DeadlineExceeded, true},
+		{"canceled", context.Canceled, false},
+		{"other error", errors.New("bad message"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Scheduled messages wait in a sorted set (score = unix send time in milliseconds, member = message ID),
+// with their stream fields in a scheduled:<id> hash, until the scheduler promotes them.
+const (
+	scheduledSet       = "scheduled_messages"
+	scheduledKeyPrefix = "scheduled:"
+	promoteBatchSize   = 100
+)
+
+// How often the scheduler looks for due messages, configured with SCHEDULER_INTERVAL
+var schedulerInterval = time.Second
+
+// Moves the given due messages into message_stream. Runs as one script so the remove-and-XADD is
+// atomic: a message is promoted exactly once even with several replicas polling (ZREM decides).
+// KEYS: scheduledSet, message_stream, then per message its scheduled:<id> hash and sequence counter.
+// ARGV: the message IDs. Each message takes its sequence number now, when it is queued.
+// Returns how many messages were added to the stream.
+var promoteDueScript = redis.NewScript(`
+local promoted = 0
+for i, id in ipairs(ARGV) do
+	local payload, seqKey = KEYS[1 + 2 * i], KEYS[2 + 2 * i]
+	if redis.call('ZREM', KEYS[1], id) == 1 then
+		local fields = redis.call('HGETALL', payload)
+		if #fields > 0 then
+			table.insert(fields, 'seq')
+			table.insert(fields, redis.call('INCR', seqKey))
+			redis.call('XADD', KEYS[2], '*', unpack(fields))
+			promoted = promoted + 1
+		end
+		redis.call('DEL', payload)
+	end
+end
+return promoted
+`)
+
+// The clock send times are compared with; tests replace it
+var schedulerNow = time.Now
+
+//! Stores a message for delivery at sendAt instead of queueing it now
+func scheduleMessage(c echo.Context, messageID string, sendAt time.Time, values map[string]interface{}) error {
+	pipe := redisCli.TxPipeline()
+	pipe.HSet(c.Request().Context(), scheduledKeyPrefix+messageID, values)
+	pipe.ZAdd(c.Request().Context(), scheduledSet, redis.Z{Score: float64(sendAt.UnixMilli()), Member: messageID})
+	_, err := pipe.Exec(c.Request().Context())
+	return err
+}
+
+//! Scheduler goroutine: every schedulerInterval, promotes due messages into message_stream.
+// Started and stopped with the workers (see workerManager).
+func runScheduler() {
+	quit := workers.stopping()
+
+	slog.Info("Starting message scheduler", "interval", schedulerInterval.String())
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			slog.Info("Stopping message scheduler")
+			return
+		case <-ticker.C:
+			promoteDue()
+		}
+	}
+}
+
+//! Promotes every message whose send time has passed, in batches
+func promoteDue() {
+	for {
+		due, err := promoteDueBatch()
+		if err != nil {
+			slog.Error("Failed to promote scheduled messages", "error", err)
+			return
+		}
+		if due < promoteBatchSize {
+			return
+		}
+	}
+}
+
+//! Promotes up to promoteBatchSize due messages and returns how many were due.
+// The script's keys are looked up here first, so each message's counter key comes from sequenceKey.
+func promoteDueBatch() (int, error) {
+	opCtx, cancel := operationContext()
+	defer cancel()
+
+	now := strconv.FormatInt(schedulerNow().UnixMilli(), 10)
+	ids, err := redisCli.ZRangeByScore(opCtx, scheduledSet, &redis.ZRangeBy{
+		Min: "-inf", Max: now, Count: promoteBatchSize,
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	// Routing fields of each message, to find its conversation's counter
+	pipe := redisCli.Pipeline()
+	routes := make([]*redis.SliceCmd, len(ids))
+	for i, id := range ids {
+		routes[i] = pipe.HMGet(opCtx, scheduledKeyPrefix+id, "conversation_id", "sender_id", "receiver_id")
+	}
+	if _, err := pipe.Exec(opCtx); err != nil {
+		return 0, err
+	}
+
+	keys := []string{scheduledSet, "message_stream"}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		route := make([]string, 3) // a missing field (or hash) reads as ""
+		for j, v := range routes[i].Val() {
+			route[j], _ = v.(string)
+		}
+		keys = append(keys, scheduledKeyPrefix+id, sequenceKey(route[0], route[1], route[2]))
+		args[i] = id
+	}
+
+	promoted, err := promoteDueScript.Run(opCtx, redisCli, keys, args...).Int()
+	if err != nil {
+		return 0, err
+	}
+	if promoted > 0 {
+		messagesQueued.Add(float64(promoted))
+		slog.Info("Promoted scheduled messages", "count", promoted)
+	}
+	return len(ids), nil
+}
+
+//! Handles cancelling a scheduled message that hasn't been sent yet (sender only)
+func cancelScheduledMessage(c echo.Context) error {
+	messageID := c.Param("id")
+	reqCtx := c.Request().Context()
+
+	sender, err := redisCli.HGet(reqCtx, scheduledKeyPrefix+messageID, "sender_id").Result()
+	if errors.Is(err, redis.Nil) {
+		return c.JSON(404, map[string]string{"error": "Scheduled message not found"})
+	}
+	if err != nil {
+		logFor(c).Error("Failed to look up scheduled message", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to cancel scheduled message"})
+	}
+	if sender != authUserID(c) {
+		return c.JSON(403, map[string]string{"error": "Only the sender can cancel a scheduled message"})
+	}
+
+	// ZREM decides the race with the scheduler: if it already removed the entry, the message was sent
+	removed, err := redisCli.ZRem(reqCtx, scheduledSet, messageID).Result()
+	if err != nil {
+		logFor(c).Error("Failed to cancel scheduled message", "error", err, "message_id", messageID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to cancel scheduled message"})
+	}
+	if removed == 0 {
+		return c.JSON(409, map[string]string{"error": "Message has already been sent"})
+	}
+
+	if err := redisCli.Del(reqCtx, scheduledKeyPrefix+messageID).Err(); err != nil {
+		// The message is still cancelled: a hash that is not in the set is never promoted
+		logFor(c).Error("Failed to remove scheduled message payload", "error", err, "message_id", messageID)
+	}
+
+	logFor(c).Info("Scheduled message cancelled", "message_id", messageID, "sender_id", sender)
+	return c.JSON(200, map[string]string{"status": "Scheduled message cancelled"})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//! Stands in for promoteDueScript with the same calls in the same order
+func fakePromoteDue(r *fakeRedis, keys, args []string) string {
+	promoted := 0
+	for i, id := range args {
+		payload, seqKey := keys[2+2*i], keys[3+2*i]
+		if r.run([]string{"ZREM", keys[0], id}) != respInt(1) {
+			continue // cancelled, or another replica got it first
+		}
+		if fields := r.hashes[payload]; len(fields) > 0 {
+			entry := []string{"XADD", keys[1], "*"}
+			for field, value := range fields {
+				entry = append(entry, field, value)
+			}
+			seq := strings.TrimSuffix(strings.TrimPrefix(r.run([]string{"INCR", seqKey}), ":"), "\r\n")
+			r.run(append(entry, "seq", seq))
+			promoted++
+		}
+		r.run([]string{"DEL", payload})
+	}
+	return respInt(int64(promoted))
+}
+
+// The Lua itself needs a real Redis; this covers what promoteDue decides and hands it
+func TestScheduledMessageWaitsForSendAt(t *testing.T) {
+	_, r := useSendFakes(t)
+	r.emulate(promoteDueScript, fakePromoteDue)
+	now := time.Now()
+	t.Cleanup(func() { schedulerNow = time.Now })
+
+	sendAt := now.Add(2 * time.Second).UTC()
+	rec := postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "later", "send_at": "`+sendAt.Format(time.RFC3339Nano)+`"}`, nil)
+	var scheduled map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &scheduled); err != nil || scheduled["status"] != "Message scheduled" {
+		t.Fatalf("send = %d %s, want the message scheduled", rec.Code, rec.Body.String())
+	}
+	// Sent meanwhile, so it takes the conversation's first sequence number
+	if rec := postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "now"}`, nil); rec.Code != 200 {
+		t.Fatalf("send = %d %s", rec.Code, rec.Body.String())
+	}
+
+	// One second in, nothing is due
+	schedulerNow = func() time.Time { return now.Add(time.Second) }
+	promoteDue()
+	if entries := r.entries("message_stream"); len(entries) != 1 {
+		t.Fatalf("stream has %d entries before send_at, want only the immediate one", len(entries))
+	}
+
+	queued := scrapeMetrics(t)["messages_queued_total"]
+	schedulerNow = func() time.Time { return sendAt }
+	promoteDue()
+	entries := r.entries("message_stream")
+	if len(entries) != 2 {
+		t.Fatalf("stream has %d entries at send_at, want 2", len(entries))
+	}
+	promoted := entries[1].Values
+	if promoted["message_id"] != scheduled["message_id"] || promoted["content"] != "later" {
+		t.Errorf("promoted entry = %v, want the scheduled message", promoted)
+	}
+	// Numbered when queued, after the message sent meanwhile, on the counter sendMessage uses
+	if promoted["seq"] != "2" {
+		t.Errorf("seq = %v, want 2", promoted["seq"])
+	}
+	if got, _ := redisCli.Get(ctx, sequenceKey("", aliceID, bobID)).Result(); got != "2" {
+		t.Errorf("conversation counter = %q, want 2", got)
+	}
+	if got := scrapeMetrics(t)["messages_queued_total"] - queued; got != 1 {
+		t.Errorf("messages_queued_total went up by %v on promotion, want 1", got)
+	}
+
+	// Promoted once: the set entry and the payload are gone
+	if left, _ := redisCli.ZRangeByScore(ctx, scheduledSet, &redis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result(); len(left) != 0 {
+		t.Errorf("still scheduled: %v", left)
+	}
+	if n, _ := redisCli.Exists(ctx, scheduledKeyPrefix+scheduled["message_id"]).Result(); n != 0 {
+		t.Error("the scheduled payload was left behind")
+	}
+	promoteDue()
+	if got := len(r.entries("message_stream")); got != 2 {
+		t.Errorf("stream has %d entries after another poll, want still 2", got)
+	}
+}
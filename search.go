@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Lowest word similarity (0-1) a message needs to match a ?mode=trigram search,
+// configured with TRIGRAM_SIMILARITY_THRESHOLD. The default is pg_trgm's own.
+var trigramThreshold = 0.6
+
+// Whether pg_trgm is installed, checked at startup by checkTrigramSearch. Migration 0012 only
+// warns when it may not create the extension; ?mode=trigram then answers 503 instead of failing.
+var trigramAvailable = true
+
+// How each ?mode matches and ranks messages against $2.
+// The expressions must match the GIN indexes (see README).
+var searchModes = map[string]struct{ match, rank string }{
+	"fulltext": {
+		match: "to_tsvector('english', content) @@ plainto_tsquery('english', $2)",
+		rank:  "ts_rank(to_tsvector('english', content), plainto_tsquery('english', $2))",
+	},
+	// Word similarity (<% and word_similarity) rather than plain similarity (% and similarity()):
+	// similarity() compares q with the whole message, so a short query almost never reaches the
+	// threshold against a long message. Word similarity compares q with the closest stretch of
+	// the message, so a short, misspelled or partial q still finds a long message.
+	"trigram": {
+		match: "$2 <% content",
+		rank:  "word_similarity($2, content)",
+	},
+}
+
+// What each ?facets entry counts matches by; NULL leaves a match out of that facet
+var searchFacets = map[string]string{
+	// The other user of a 1-to-1 message
+	"peer": "CASE WHEN conversation_id IS NULL THEN CASE WHEN sender_id = $1 THEN receiver_id ELSE sender_id END END",
+	// The group a group message was sent to
+	"conversation": "conversation_id",
+	"type":         "content_type",
+	// Calendar month in UTC, e.g. 2025-03
+	"period": "to_char(timestamp AT TIME ZONE 'UTC', 'YYYY-MM')",
+}
+
+// Upper bound on the buckets returned per facet; the ones with the most matches are kept
+const maxFacetBuckets = 20
+
+// SearchResults is the search response when ?facets is given
+type SearchResults struct {
+	Messages interface{}            `json:"messages"`
+	Facets   map[string]SearchFacet `json:"facets"`
+}
+
+// SearchFacet counts every match of a search, not just the returned page, by one facet
+type SearchFacet struct {
+	Buckets   []FacetBucket `json:"buckets"`   // most matches first, at most maxFacetBuckets
+	Truncated bool          `json:"truncated"` // more buckets had matches than were returned
+}
+
+// FacetBucket is one value of a facet and how many matches have it
+type FacetBucket struct {
+	Value   string `json:"value"`
+	Matches int64  `json:"matches"`
+}
+
+//! Sets trigramAvailable from whether pg_trgm is installed. On error the mode is left on.
+func checkTrigramSearch(ctx context.Context) {
+	var installed bool
+	err := pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')").Scan(&installed)
+	if err != nil {
+		slog.Error("Failed to check for pg_trgm", "error", err)
+		return
+	}
+	trigramAvailable = installed
+	if !installed {
+		slog.Warn("pg_trgm is not installed, trigram search is disabled")
+	}
+}
+
+//! Parses TRIGRAM_SIMILARITY_THRESHOLD
+func loadSearchConfig() error {
+	if v := os.Getenv("TRIGRAM_SIMILARITY_THRESHOLD"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return fmt.Errorf("invalid TRIGRAM_SIMILARITY_THRESHOLD %q: want a number above 0 and at most 1", v)
+		}
+		trigramThreshold = f
+	}
+	return nil
+}
+
+//! Handles search over the messages the caller sent or received.
+// ?mode=fulltext (the default) uses Postgres text search (to_tsvector/plainto_tsquery);
+// ?mode=trigram uses pg_trgm word similarity, which tolerates typos and partial words
+// (see searchModes for why word similarity); it answers 503 while pg_trgm isn't installed.
+// Both are backed by a GIN index, ordered by relevance then recency, paginated with ?limit and ?offset.
+// ?facets=peer,conversation,type,period adds match counts per facet value (see countFacets).
+func searchMessages(c echo.Context) error {
+	me := authUserID(c)
+
+	q := c.QueryParam("q")
+	if q == "" {
+		return c.JSON(400, map[string]string{"error": "q is required"})
+	}
+	modeName := c.QueryParam("mode")
+	if modeName == "" {
+		modeName = "fulltext"
+	}
+	mode, ok := searchModes[modeName]
+	if !ok {
+		return c.JSON(400, map[string]string{"error": "mode must be fulltext or trigram"})
+	}
+	if modeName == "trigram" && !trigramAvailable {
+		return c.JSON(503, map[string]string{"error": "Trigram search is unavailable: the pg_trgm extension is not installed"})
+	}
+
+	// ?user is optional, but if given it must be the caller: nobody searches someone else's messages
+	if user := c.QueryParam("user"); user != "" && normalizeUserID(user) != me {
+		return c.JSON(403, map[string]string{"error": "You can only search your own messages"})
+	}
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	limit, err := parseLimit(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	offset := 0
+	if v := c.QueryParam("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return c.JSON(400, map[string]string{"error": "offset must be a non-negative integer"})
+		}
+	}
+
+	facets, err := parseFacets(c.QueryParam("facets"))
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE ` + searchScope(mode.match) + `
+		ORDER BY
+			` + mode.rank + ` DESC,
+			` + newestFirst + `
+		LIMIT $3 OFFSET $4
+	`
+
+	// A read-only transaction, so the trigram threshold applies to this query alone
+	reqCtx := c.Request().Context()
+	tx, err := readDB(c).BeginTx(reqCtx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		logFor(c).Error("Failed to start transaction", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+	}
+	defer tx.Rollback(context.Background()) // no-op once rolled back below
+
+	if modeName == "trigram" {
+		_, err = tx.Exec(reqCtx, "SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)",
+			strconv.FormatFloat(trigramThreshold, 'f', -1, 64))
+		if err != nil {
+			logFor(c).Error("Failed to set the similarity threshold", "error", err)
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+		}
+	}
+
+	rows, err := tx.Query(reqCtx, query, me, q, limit, offset)
+	if err != nil {
+		logFor(c).Error("Failed to search messages", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := scanMessage(rows, &msg); err != nil {
+			logFor(c).Error("Failed to scan row", "error", err)
+			return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		logFor(c).Error("Rows iteration error", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+	}
+
+	rows.Close()
+
+	// Facets count every match, in the same transaction so the threshold still applies
+	var counted map[string]SearchFacet
+	if len(facets) > 0 {
+		if counted, err = countFacets(reqCtx, tx, mode.match, facets, me, q); err != nil {
+			logFor(c).Error("Failed to count search facets", "error", err)
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+		}
+	}
+
+	// Hand the transaction's connection back before the previews take another one
+	tx.Rollback(context.Background())
+
+	if err := attachReplyPreviews(reqCtx, readDB(c), messages); err != nil {
+		logFor(c).Error("Failed to load replied-to messages", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to search messages"})
+	}
+
+	if len(facets) > 0 {
+		return c.JSON(200, SearchResults{Messages: messagesForVersion(messages, version), Facets: counted})
+	}
+	return c.JSON(200, messagesForVersion(messages, version))
+}
+
+//! SQL condition for the messages user $1 may search that match: 1-to-1 messages they sent
+// or received, plus their group conversations since they joined
+func searchScope(match string) string {
+	return `(sender_id = $1 OR receiver_id = $1 OR
+			 conversation_id IN (SELECT conversation_id FROM conversation_members WHERE user_id = $1))
+			AND ` + match + `
+			AND ` + visibleMessage + `
+			AND ` + notHiddenFor(1) + `
+			AND ` + sinceJoined(1)
+}
+
+//! Parses ?facets, a comma-separated list of searchFacets names; empty means no facets
+func parseFacets(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var facets []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := searchFacets[name]; !ok {
+			return nil, fmt.Errorf("facets must be a comma-separated list of peer, conversation, type and period")
+		}
+		if !seen[name] {
+			seen[name] = true
+			facets = append(facets, name)
+		}
+	}
+	return facets, nil
+}
+
+//! Counts the matches for q of user me by each facet, in one query: every facet groups the same
+// matches, and only the maxFacetBuckets buckets with the most matches are returned per facet
+func countFacets(ctx context.Context, tx pgx.Tx, match string, facets []string, me, q string) (map[string]SearchFacet, error) {
+	columns := make([]string, len(facets))
+	groups := make([]string, len(facets))
+	for i, name := range facets {
+		column := "by_" + name // prefixed, so no facet name clashes with an SQL keyword
+		columns[i] = searchFacets[name] + " AS " + column
+		groups[i] = "SELECT '" + name + "' AS facet, " + column + " AS value, COUNT(*) AS matches FROM matches WHERE " +
+			column + " IS NOT NULL GROUP BY " + column
+	}
+	query := `
+		WITH matches AS MATERIALIZED (
+			SELECT ` + strings.Join(columns, ", ") + `
+			FROM messages
+			WHERE ` + searchScope(match) + `
+		)
+		SELECT facet, value, matches, buckets FROM (
+			SELECT facet, value, matches,
+				ROW_NUMBER() OVER (PARTITION BY facet ORDER BY matches DESC, value) AS bucket_rank,
+				COUNT(*) OVER (PARTITION BY facet) AS buckets
+			FROM (` + strings.Join(groups, " UNION ALL ") + `) grouped
+		) ranked
+		WHERE bucket_rank <= $3
+		ORDER BY facet, bucket_rank
+	`
+
+	rows, err := tx.Query(ctx, query, me, q, maxFacetBuckets)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Every requested facet is in the response, with no buckets when nothing matched
+	counted := make(map[string]SearchFacet, len(facets))
+	for _, name := range facets {
+		counted[name] = SearchFacet{Buckets: []FacetBucket{}}
+	}
+	for rows.Next() {
+		var name string
+		var bucket FacetBucket
+		var buckets int64
+		if err := rows.Scan(&name, &bucket.Value, &bucket.Matches, &buckets); err != nil {
+			return nil, err
+		}
+		facet := counted[name]
+		facet.Buckets = append(facet.Buckets, bucket)
+		facet.Truncated = buckets > maxFacetBuckets
+		counted[name] = facet
+	}
+	return counted, rows.Err()
+}
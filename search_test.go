@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSearchMessagesValidation(t *testing.T) {
+	// Every case is refused before the database is queried, so no database is needed
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantError  string
+	}{
+		{"missing q", "mode=trigram", 400, "q is required"},
+		{"unknown mode", "q=dinner&mode=fuzzy", 400, "mode must be fulltext or trigram"},
+		{"mode in another case", "q=dinner&mode=Trigram", 400, "mode must be fulltext or trigram"},
+		{"another user", "q=dinner&mode=trigram&user=bob", 403, "You can only search your own messages"},
+		{"bad limit", "q=dinnr&mode=trigram&limit=0", 400, ""},
+		{"bad offset", "q=dinnr&mode=trigram&offset=-1", 400, "offset must be a non-negative integer"},
+		{"unknown facet", "q=dinner&facets=peer,sender", 400, "facets must be a comma-separated list of peer, conversation, type and period"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/messages/search?"+tt.query, nil)
+			c := echo.New().NewContext(req, rec)
+			c.Set(authUserKey, "alice")
+
+			if err := searchMessages(c); err != nil {
+				t.Fatalf("searchMessages() = %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body, err)
+			}
+			if tt.wantError != "" && body["error"] != tt.wantError {
+				t.Errorf("error = %q, want %q", body["error"], tt.wantError)
+			}
+		})
+	}
+}
+
+func TestTrigramSearchWithoutPgTrgm(t *testing.T) {
+	defer func(v bool) { trigramAvailable = v }(trigramAvailable)
+	f := useFakePG(t)
+	f.on("FROM pg_extension", pgRule{Rows: [][]interface{}{{false}}})
+
+	checkTrigramSearch(t.Context())
+	if trigramAvailable {
+		t.Fatal("trigram search is still on without pg_trgm")
+	}
+
+	// The mode is refused up front; full-text search isn't affected
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages/search?q=dinnr&mode=trigram", nil), rec)
+	c.Set(authUserKey, "alice")
+	if err := searchMessages(c); err != nil {
+		t.Fatalf("searchMessages() = %v", err)
+	}
+	if rec.Code != 503 {
+		t.Errorf("status = %d, want 503 (body %s)", rec.Code, rec.Body.String())
+	}
+	if got := f.queriesContaining("<%"); len(got) != 0 {
+		t.Errorf("the trigram query ran: %q", got)
+	}
+}
+
+func TestSearchModes(t *testing.T) {
+	for name, mode := range searchModes {
+		// Both expressions read q from $2, the position searchMessages binds it to
+		if !strings.Contains(mode.match, "$2") || !strings.Contains(mode.rank, "$2") {
+			t.Errorf("mode %s does not use $2 for q: %+v", name, mode)
+		}
+	}
+	if _, ok := searchModes["fulltext"]; !ok {
+		t.Error("searchModes has no fulltext mode, the default")
+	}
+}
+
+func TestLoadSearchConfig(t *testing.T) {
+	defer func(f float64) { trigramThreshold = f }(trigramThreshold)
+
+	tests := []struct {
+		env     string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0.6, false}, // unset keeps the default
+		{"0.3", 0.3, false},
+		{"1", 1, false},
+		{"0", 0.6, true},
+		{"1.5", 0.6, true},
+		{"-0.2", 0.6, true},
+		{"loose", 0.6, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			trigramThreshold = 0.6
+			t.Setenv("TRIGRAM_SIMILARITY_THRESHOLD", tt.env)
+			err := loadSearchConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSearchConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if trigramThreshold != tt.want {
+				t.Errorf("trigramThreshold = %v, want %v", trigramThreshold, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFacets(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"peer", []string{"peer"}, false},
+		{"type, peer,type", []string{"type", "peer"}, false}, // request order, once each
+		{"peer,conversation,type,period", []string{"peer", "conversation", "type", "period"}, false},
+		{"peer,", nil, true},
+		{"Peer", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFacets(tt.in)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseFacets(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSearchFacetsResponse(t *testing.T) {
+	f := useFakePG(t)
+	buckets := [][]interface{}{{"type", "text/plain", int64(7), int64(2)}, {"type", "text/markdown", int64(1), int64(2)}}
+	for i := range maxFacetBuckets {
+		buckets = append(buckets, []interface{}{"peer", fmt.Sprintf("user-%02d", i), int64(maxFacetBuckets - i), int64(maxFacetBuckets + 5)})
+	}
+	f.on("WITH matches AS MATERIALIZED", pgRule{Rows: buckets})
+	f.on("FROM messages", pgRule{Rows: [][]interface{}{}, Cols: len(messageRecord(Message{}))})
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages/search?q=dinner&facets=type,peer,period", nil), rec)
+	c.Set(authUserKey, "alice")
+	if err := searchMessages(c); err != nil {
+		t.Fatalf("searchMessages() = %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	var results struct {
+		Messages []Message              `json:"messages"`
+		Facets   map[string]SearchFacet `json:"facets"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body, err)
+	}
+	if results.Messages == nil || len(results.Messages) != 0 {
+		t.Errorf("messages = %v, want an empty page", results.Messages)
+	}
+
+	types := results.Facets["type"]
+	if len(types.Buckets) != 2 || types.Buckets[0] != (FacetBucket{"text/plain", 7}) || types.Truncated {
+		t.Errorf("type facet = %+v, want text/plain then text/markdown, not truncated", types)
+	}
+	peers := results.Facets["peer"]
+	if len(peers.Buckets) != maxFacetBuckets || !peers.Truncated {
+		t.Errorf("peer facet has %d buckets, truncated %v; want %d and truncated", len(peers.Buckets), peers.Truncated, maxFacetBuckets)
+	}
+	// A facet nothing matched is still there, with no buckets
+	if periods, ok := results.Facets["period"]; !ok || periods.Buckets == nil || len(periods.Buckets) != 0 {
+		t.Errorf("period facet = %+v (present %v), want present and empty", periods, ok)
+	}
+	if _, ok := results.Facets["conversation"]; ok {
+		t.Error("the conversation facet was returned without being asked for")
+	}
+
+	// One query counts every facet, capped in SQL
+	queries := f.queriesContaining("WITH matches AS MATERIALIZED")
+	if len(queries) != 1 {
+		t.Fatalf("%d facet queries, want 1", len(queries))
+	}
+	for _, want := range []string{"GROUP BY by_type", "GROUP BY by_peer", "GROUP BY by_period", fmt.Sprintf("bucket_rank <=  '%d'", maxFacetBuckets)} {
+		if !strings.Contains(queries[0], want) {
+			t.Errorf("facet query lacks %q: %s", want, queries[0])
+		}
+	}
+}
+
+//! Runs GET /messages/search?query as user and returns the IDs found, in order
+func searchAs(t *testing.T, user, query string) []string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages/search?"+query, nil), rec)
+	c.Set(authUserKey, user)
+	if err := searchMessages(c); err != nil {
+		t.Fatalf("searchMessages() = %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	var found []struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &found); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body, err)
+	}
+	ids := make([]string, len(found))
+	for i, m := range found {
+		ids[i] = m.MessageID
+	}
+	return ids
+}
+
+// Ranking and tokenizing are Postgres's, so this runs against a real database only
+func TestSearchMessagesFulltext(t *testing.T) {
+	useTestDB(t)
+	now := time.Now().UTC()
+	for _, m := range []struct {
+		id, sender, receiver, content string
+		age                           time.Duration
+	}{
+		{"shouting", "bob", "alice", "DINNER TONIGHT?", 4 * time.Hour},
+		{"keen", "bob", "alice", "Dinner tonight? Dinner! I mean it, dinner", 3 * time.Hour},
+		{"plain", "alice", "bob", "dinner tonight at eight", 2 * time.Hour},
+		{"one word", "alice", "bob", "still on for dinner?", time.Hour},
+		{"private", "carol", "dave", "dinner tonight, just the two of us", 0},
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: m.sender, ReceiverID: m.receiver, Content: m.content,
+			Timestamp: now.Add(-m.age), Status: "delivered", ContentType: defaultContentType})
+	}
+
+	// Every word must match, in any case; the message saying dinner three times ranks first
+	// although it is older, then equal ranks come newest first
+	if got, want := searchAs(t, "alice", "q=Dinner+tonight"), []string{"keen", "plain", "shouting"}; !slices.Equal(got, want) {
+		t.Errorf("q=Dinner tonight found %q, want %q", got, want)
+	}
+	all := searchAs(t, "alice", "q=dinner")
+	if len(all) != 4 || all[0] != "keen" {
+		t.Errorf("q=dinner found %q, want keen first and four messages", all)
+	}
+	if got := searchAs(t, "alice", "q=dinner&limit=2&offset=2"); !slices.Equal(got, all[2:]) {
+		t.Errorf("second page = %q, want %q", got, all[2:])
+	}
+
+	// carol and dave's message only turns up for them
+	if slices.Contains(all, "private") || slices.Contains(searchAs(t, "bob", "q=dinner"), "private") {
+		t.Error("a private message of other users was found")
+	}
+	if got := searchAs(t, "dave", "q=dinner"); !slices.Equal(got, []string{"private"}) {
+		t.Errorf("dave found %q, want only their own message", got)
+	}
+}
+
+// Grouping and capping are done in SQL, so this runs against a real database only
+func TestSearchFacets(t *testing.T) {
+	useTestDB(t)
+	march := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	april := time.Date(2025, 4, 2, 9, 0, 0, 0, time.UTC)
+	for _, m := range []struct {
+		id, sender, receiver, content, contentType string
+		at                                         time.Time
+	}{
+		{"b1", "bob", "alice", "dinner?", defaultContentType, march},
+		{"b2", "alice", "bob", "**dinner** at eight", "text/markdown", march.Add(time.Hour)},
+		{"b3", "bob", "alice", "dinner was great", defaultContentType, april},
+		{"c1", "alice", "carol", "dinner next week?", defaultContentType, april.Add(time.Hour)},
+		{"c2", "carol", "alice", "lunch instead", defaultContentType, april.Add(2 * time.Hour)}, // no match
+		{"d1", "dave", "erin", "dinner", defaultContentType, april},                             // not alice's
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: m.sender, ReceiverID: m.receiver, Content: m.content,
+			Timestamp: m.at, Status: "delivered", ContentType: m.contentType})
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages/search?q=dinner&limit=1&facets=peer,type,period,conversation", nil), rec)
+	c.Set(authUserKey, "alice")
+	if err := searchMessages(c); err != nil {
+		t.Fatalf("searchMessages() = %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	var results struct {
+		Messages []Message              `json:"messages"`
+		Facets   map[string]SearchFacet `json:"facets"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body, err)
+	}
+
+	// The facets count all four matches, not just the page of one
+	want := map[string][]FacetBucket{
+		"peer":         {{"bob", 3}, {"carol", 1}},
+		"type":         {{defaultContentType, 3}, {"text/markdown", 1}},
+		"period":       {{"2025-03", 2}, {"2025-04", 2}}, // equal counts go by value
+		"conversation": {},
+	}
+	for name, buckets := range want {
+		got := results.Facets[name]
+		if !slices.Equal(got.Buckets, buckets) || got.Truncated {
+			t.Errorf("facet %s = %+v, want %+v, not truncated", name, got, buckets)
+		}
+	}
+	if len(results.Messages) != 1 {
+		t.Errorf("page has %d messages, want 1", len(results.Messages))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Handles listing the caller's sent messages across all conversations, newest first.
+// ?status= narrows it to one delivery status; paging works like getMessages.
+func getSentMessages(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status != "" && !messageStatuses[status] {
+		return c.JSON(400, map[string]string{"error": "status must be sent, delivered or read"})
+	}
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	limit, err := parseLimit(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	// An empty status matches every message, so the SQL text is the same with or without the filter
+	cursorCond, cursorArg := beforeCondition(c.QueryParam("before"), 3)
+	args := []interface{}{authUserID(c), status}
+	if cursorArg != nil {
+		args = append(args, cursorArg)
+	}
+	args = append(args, limit+1)
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE sender_id = $1
+			AND ($2 = '' OR status = $2)
+			AND ` + visibleMessage + `
+			AND ` + notHiddenFor(1) + `
+			AND ` + cursorCond + `
+		ORDER BY ` + newestFirst + `
+		LIMIT $` + strconv.Itoa(len(args))
+
+	return queryAndRespondMessages(c, query, args, limit, version, false)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Runs GET /messages/sent?query as user and returns the status, the IDs listed and next_cursor
+func listSent(t *testing.T, user, query string) (int, []string, *string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/messages/sent?"+query, nil)
+	req.Header.Set("X-API-Version", "3")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, user)
+	if err := getSentMessages(c); err != nil {
+		t.Fatalf("getSentMessages returned %v", err)
+	}
+	if rec.Code != 200 {
+		return rec.Code, nil, nil
+	}
+	var body struct {
+		Messages   []Message `json:"messages"`
+		NextCursor *string   `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body, err)
+	}
+	ids := make([]string, len(body.Messages))
+	for i, m := range body.Messages {
+		ids[i] = m.MessageID
+	}
+	return rec.Code, ids, body.NextCursor
+}
+
+func TestGetSentMessagesValidation(t *testing.T) {
+	// Refused before the database is queried
+	for _, query := range []string{"status=bogus", "status=Read", "status=pending", "limit=0", "limit=-3"} {
+		if code, _, _ := listSent(t, "alice", query); code != 400 {
+			t.Errorf("?%s: status = %d, want 400", query, code)
+		}
+	}
+}
+
+// The status filter and cursor are SQL, so this runs against a real database only
+func TestGetSentMessages(t *testing.T) {
+	useTestDB(t)
+	now := time.Now().UTC()
+	// Newest first: s5 is the latest
+	for i, m := range []struct{ id, sender, receiver, status string }{
+		{"s0", "alice", "bob", "read"},
+		{"s1", "alice", "carol", "sent"},
+		{"s2", "alice", "bob", "delivered"},
+		{"from bob", "bob", "alice", "sent"},
+		{"s3", "alice", "carol", "read"},
+		{"s4", "alice", "bob", "sent"},
+		{"s5", "alice", "dave", "delivered"},
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: m.sender, ReceiverID: m.receiver, Content: "hi",
+			Timestamp: now.Add(time.Duration(i-10) * time.Minute), Status: m.status, Read: m.status == "read",
+			ContentType: defaultContentType, Seq: int64(i + 1)})
+	}
+
+	for status, want := range map[string][]string{
+		"":          {"s5", "s4", "s3", "s2", "s1", "s0"},
+		"sent":      {"s4", "s1"},
+		"delivered": {"s5", "s2"},
+		"read":      {"s3", "s0"},
+	} {
+		if _, got, next := listSent(t, "alice", "status="+status); !slices.Equal(got, want) || next != nil {
+			t.Errorf("status=%q listed %q (next_cursor %v), want %q on one page", status, got, next, want)
+		}
+	}
+
+	// Pages of two walk every message once; the last page is exactly full and has no cursor
+	var seen []string
+	pages, query := 0, "limit=2"
+	for pages < 4 {
+		_, ids, next := listSent(t, "alice", query)
+		seen, pages = append(seen, ids...), pages+1
+		if next == nil {
+			break
+		}
+		query = "limit=2&before=" + *next
+	}
+	if want := []string{"s5", "s4", "s3", "s2", "s1", "s0"}; !slices.Equal(seen, want) || pages != 3 {
+		t.Errorf("paging by 2 listed %q in %d pages, want %q in 3", seen, pages, want)
+	}
+	// A cursor also combines with the filter
+	if _, got, _ := listSent(t, "alice", "status=read&before=s3"); !slices.Equal(got, []string{"s0"}) {
+		t.Errorf("read before s3 listed %q, want [s0]", got)
+	}
+	if _, got, _ := listSent(t, "bob", ""); !slices.Equal(got, []string{"from bob"}) {
+		t.Errorf("bob listed %q, want only their own message", got)
+	}
+}
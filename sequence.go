@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+)
+
+// Redis counters handing out per-conversation sequence numbers:
+// seq:group:<conversation_id> for groups, seq:dm:<user>:<user> for 1-to-1 conversations.
+// Scheduled messages take theirs when promoted, with keys from sequenceKey too (see promoteDueBatch).
+const sequenceKeyPrefix = "seq:"
+
+//! Returns the sequence counter key for a conversation.
+// Both directions of a 1-to-1 conversation share one counter, so replies are ordered too.
+func sequenceKey(conversationID, senderID, receiverID string) string {
+	if conversationID != "" {
+		return sequenceKeyPrefix + "group:" + conversationID
+	}
+	if senderID > receiverID {
+		senderID, receiverID = receiverID, senderID
+	}
+	return sequenceKeyPrefix + "dm:" + senderID + ":" + receiverID
+}
+
+//! Takes the next sequence number in the conversation of a message_stream entry and stores it as values["seq"]
+func assignSequence(ctx context.Context, values map[string]interface{}) error {
+	conversationID, _ := values["conversation_id"].(string)
+	senderID, _ := values["sender_id"].(string)
+	receiverID, _ := values["receiver_id"].(string)
+
+	seq, err := redisCli.Incr(ctx, sequenceKey(conversationID, senderID, receiverID)).Result()
+	if err != nil {
+		return err
+	}
+	values["seq"] = seq
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSequenceKey(t *testing.T) {
+	if a, b := sequenceKey("", aliceID, bobID), sequenceKey("", bobID, aliceID); a != b {
+		t.Errorf("the two directions of a conversation use %q and %q, want one counter", a, b)
+	}
+	if sequenceKey("team", aliceID, "") == sequenceKey("team2", aliceID, "") {
+		t.Error("two groups share a counter")
+	}
+}
+
+//! Sends n messages between alice and bob, both ways, one after the other; contents are "0".."n-1"
+func sendInOrder(t *testing.T, n int) {
+	t.Helper()
+	for i := range n {
+		from, to := aliceID, bobID
+		if i%3 == 1 {
+			from, to = to, from
+		}
+		if rec := postMessage(t, from, `{"receiver_id": "`+to+`", "content": "`+strconv.Itoa(i)+`"}`, nil); rec.Code != 200 {
+			t.Fatalf("send %d = %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRapidSendsAreNumberedInSendOrder(t *testing.T) {
+	_, r := useSendFakes(t)
+	sendInOrder(t, 20)
+
+	// Within the same millisecond or not, seq follows the order the sends were accepted in
+	for i, entry := range r.entries("message_stream") {
+		msg, err := parseStreamMessage(entry.Values)
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		if msg.Content != strconv.Itoa(i) || msg.Seq != int64(i+1) {
+			t.Errorf("entry %d is %q with seq %d, want %q with seq %d", i, msg.Content, msg.Seq, strconv.Itoa(i), i+1)
+		}
+	}
+
+	// Concurrent sends still get distinct numbers, continuing the count
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postMessage(t, aliceID, `{"receiver_id": "`+bobID+`", "content": "race"}`, nil)
+		}()
+	}
+	wg.Wait()
+	var seqs []int64
+	for _, entry := range r.entries("message_stream")[20:] {
+		msg, _ := parseStreamMessage(entry.Values)
+		seqs = append(seqs, msg.Seq)
+	}
+	slices.Sort(seqs)
+	for i, seq := range seqs {
+		if seq != int64(21+i) {
+			t.Fatalf("concurrent sends got seqs %v, want 21..40 once each", seqs)
+		}
+	}
+}
+
+// The tie-break is the ORDER BY, so this runs against a real database only
+func TestHistoryKeepsSendOrder(t *testing.T) {
+	p := useTestDB(t)
+	r := useFakeRedis(t)
+	sendInOrder(t, 20)
+	for _, entry := range r.entries("message_stream") {
+		if _, ok := processMessage(entry); !ok {
+			t.Fatalf("entry %s was not stored", entry.ID)
+		}
+	}
+	// The worst case: every message in the same instant
+	if _, err := p.Exec(t.Context(), "UPDATE messages SET timestamp = '2025-03-15T12:00:00Z'"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/messages?user1="+aliceID+"&user2="+bobID, nil)
+	req.Header.Set("X-API-Version", "3")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(authUserKey, aliceID)
+	if err := getMessages(c); err != nil {
+		t.Fatalf("getMessages returned %v", err)
+	}
+	var body struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	var got []string
+	for _, msg := range body.Messages {
+		got = append(got, msg.Content)
+	}
+	var want []string
+	for i := 19; i >= 0; i-- {
+		want = append(want, strconv.Itoa(i))
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("history = %q, want newest first in send order %q", got, want)
+	}
+}
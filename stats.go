@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ConversationStats is the response for GET /conversations/stats
+type ConversationStats struct {
+	User1             string           `json:"user1"`
+	User2             string           `json:"user2"`
+	TotalMessages     int64            `json:"total_messages"`
+	MessagesPerUser   map[string]int64 `json:"messages_per_user"`
+	FirstMessageAt    *time.Time       `json:"first_message_at"` // null when the conversation is empty
+	LastMessageAt     *time.Time       `json:"last_message_at"`
+	AvgMessagesPerDay float64          `json:"avg_messages_per_day"`
+	MostActiveDay     *string          `json:"most_active_day"` // YYYY-MM-DD
+}
+
+//! Handles fetching aggregate statistics for the conversation between two users
+func getConversationStats(c echo.Context) error {
+	user1 := normalizeUserID(c.QueryParam("user1"))
+	user2 := normalizeUserID(c.QueryParam("user2"))
+
+	if user1 == "" || user2 == "" {
+		return c.JSON(400, map[string]string{"error": "user1 and user2 are required"})
+	}
+
+	// Only the participants can see a conversation's stats
+	other, isPair := pairPeer(authUserID(c), user1, user2)
+	if !isPair {
+		return c.JSON(403, map[string]string{"error": "Not a participant in this conversation"})
+	}
+	if ok, err := requireParticipant(c, other, "Failed to fetch conversation stats"); !ok {
+		return err
+	}
+
+	// All aggregates in one round trip; the most active day is a scalar subquery over the same rows.
+	query := `
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE sender_id = $1),
+			COUNT(*) FILTER (WHERE sender_id = $2),
+			MIN(timestamp),
+			MAX(timestamp),
+			(
+				SELECT timestamp::date
+				FROM messages
+				WHERE
+					((sender_id = $1 AND receiver_id = $2) OR
+					(sender_id = $2 AND receiver_id = $1))
+					AND ` + visibleMessage + `
+					AND ` + notHiddenFor(3) + `
+				GROUP BY 1
+				ORDER BY COUNT(*) DESC, 1 DESC
+				LIMIT 1
+			)
+		FROM messages
+		WHERE
+			((sender_id = $1 AND receiver_id = $2) OR
+			(sender_id = $2 AND receiver_id = $1))
+			AND ` + visibleMessage + `
+			AND ` + notHiddenFor(3) + `
+	`
+
+	stats := ConversationStats{User1: user1, User2: user2}
+	var sentBy1, sentBy2 int64
+	var mostActive *time.Time
+
+	err := readDB(c).QueryRow(c.Request().Context(), query, user1, user2, authUserID(c)).Scan(
+		&stats.TotalMessages, &sentBy1, &sentBy2, &stats.FirstMessageAt, &stats.LastMessageAt, &mostActive)
+	if err != nil {
+		logFor(c).Error("Failed to compute conversation stats", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch conversation stats"})
+	}
+
+	stats.MessagesPerUser = map[string]int64{user1: sentBy1, user2: sentBy2}
+
+	if mostActive != nil {
+		day := mostActive.Format("2006-01-02")
+		stats.MostActiveDay = &day
+	}
+
+	// Average over the calendar days the conversation spans (first and last day inclusive)
+	if stats.FirstMessageAt != nil && stats.LastMessageAt != nil {
+		first := stats.FirstMessageAt.Truncate(24 * time.Hour)
+		last := stats.LastMessageAt.Truncate(24 * time.Hour)
+		days := last.Sub(first).Hours()/24 + 1
+		stats.AvgMessagesPerDay = math.Round(float64(stats.TotalMessages)/days*100) / 100
+	}
+
+	return c.JSON(200, stats)
+}
+
+// ConversationMessageStats is the response for GET /conversations/:otherUser/stats
+type ConversationMessageStats struct {
+	OtherUser        string           `json:"other_user"`
+	TotalMessages    int64            `json:"total_messages"`
+	MessagesByStatus map[string]int64 `json:"messages_by_status"` // every status, zeros included
+	FirstMessageAt   *time.Time       `json:"first_message_at"`   // null when the conversation is empty
+	LastMessageAt    *time.Time       `json:"last_message_at"`
+	TotalCharacters  int64            `json:"total_characters"`   // content length summed over all messages
+	AvgMessageLength float64          `json:"avg_message_length"` // characters, rounded to 2 decimals
+}
+
+//! Handles fetching message counts and sizes for the caller's conversation with otherUser
+// (or a group, by its conversation ID). An empty conversation gets zeros and null timestamps.
+func getConversationMessageStats(c echo.Context) error {
+	other := normalizeUserID(c.Param("otherUser"))
+	if other == "" {
+		return c.JSON(400, map[string]string{"error": "otherUser is required"})
+	}
+	if ok, err := requireParticipant(c, other, "Failed to fetch conversation stats"); !ok {
+		return err
+	}
+
+	// One aggregate pass; COALESCE turns the empty conversation's NULL sums into zeros
+	query := `
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE status = 'sent'),
+			COUNT(*) FILTER (WHERE status = 'delivered'),
+			COUNT(*) FILTER (WHERE status = 'read'),
+			MIN(timestamp),
+			MAX(timestamp),
+			COALESCE(SUM(char_length(content)), 0),
+			COALESCE(AVG(char_length(content)), 0)::float8
+		FROM messages
+		WHERE ` + syncConversation + `
+			AND ` + visibleMessage + `
+			AND ` + notHiddenFor(2) + `
+			AND ` + sinceJoined(2)
+
+	stats := ConversationMessageStats{OtherUser: other}
+	var sent, delivered, read int64
+	var avgLength float64
+
+	err := readDB(c).QueryRow(c.Request().Context(), query, other, authUserID(c)).Scan(
+		&stats.TotalMessages, &sent, &delivered, &read,
+		&stats.FirstMessageAt, &stats.LastMessageAt, &stats.TotalCharacters, &avgLength)
+	if err != nil {
+		logFor(c).Error("Failed to compute conversation message stats", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch conversation stats"})
+	}
+
+	stats.MessagesByStatus = map[string]int64{"sent": sent, "delivered": delivered, "read": read}
+	stats.AvgMessageLength = math.Round(avgLength*100) / 100
+	return c.JSON(200, stats)
+}
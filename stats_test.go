@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Calls getConversationMessageStats as user for their conversation with other
+func messageStatsOf(t *testing.T, user, other string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/conversations/"+other+"/stats", nil), rec)
+	c.Set(authUserKey, user)
+	c.SetParamNames("otherUser")
+	c.SetParamValues(other)
+	if err := getConversationMessageStats(c); err != nil {
+		t.Fatalf("getConversationMessageStats returned %v", err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestConversationMessageStatsResponse(t *testing.T) {
+	f := useFakePG(t)
+	f.on(participantQuery, pgRule{Rows: [][]interface{}{{false}}})
+	if code, _ := messageStatsOf(t, "alice", "group-1"); code != 403 {
+		t.Errorf("non-member: status = %d, want 403", code)
+	}
+	if got := f.queriesContaining("char_length"); len(got) != 0 {
+		t.Errorf("stats were computed for a non-member: %q", got)
+	}
+
+	// An empty conversation: the aggregate row of zeros and NULLs is answered as zeros and nulls
+	f = useFakePG(t)
+	f.on(participantQuery, pgRule{Rows: [][]interface{}{{true}}})
+	f.on("char_length", pgRule{Rows: [][]interface{}{{0, 0, 0, 0, nil, nil, 0, 0.0}}})
+	code, got := messageStatsOf(t, "alice", "bob")
+	want := map[string]interface{}{
+		"other_user":         "bob",
+		"total_messages":     0.0,
+		"messages_by_status": map[string]interface{}{"sent": 0.0, "delivered": 0.0, "read": 0.0},
+		"first_message_at":   nil,
+		"last_message_at":    nil,
+		"total_characters":   0.0,
+		"avg_message_length": 0.0,
+	}
+	if code != 200 || !reflect.DeepEqual(got, want) {
+		t.Errorf("empty conversation: %d %v, want 200 %v", code, got, want)
+	}
+}
+
+// The aggregates are the subject, so this runs against a real database only
+func TestConversationMessageStats(t *testing.T) {
+	useTestDB(t)
+	base := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	for _, m := range []struct {
+		id, sender, receiver, content, status string
+		hour                                  int
+	}{
+		{"m1", "alice", "bob", "hello", "read", 0},
+		{"m2", "bob", "alice", "héllo wörld", "read", 1}, // 11 characters, more bytes
+		{"m3", "alice", "bob", "hi", "delivered", 2},
+		{"m4", "bob", "alice", "hey there", "sent", 3},
+		{"gone", "alice", "bob", "deleted for everyone", "sent", 4},
+		{"hidden", "bob", "alice", "xxxx", "sent", 5}, // deleted for alice only
+		{"other", "alice", "carol", "another conversation", "sent", 6},
+	} {
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: m.sender, ReceiverID: m.receiver, Content: m.content,
+			Timestamp: base.Add(time.Duration(m.hour) * time.Hour), Read: m.status == "read", Status: m.status, ContentType: defaultContentType})
+	}
+	if _, err := pool.Exec(t.Context(), "UPDATE messages SET deleted_at = now() WHERE message_id = 'gone'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hideMessage(t.Context(), "hidden", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(hour int) time.Time { return base.Add(time.Duration(hour) * time.Hour) }
+	tests := []struct {
+		user, other string
+		want        map[string]interface{}
+	}{
+		{"alice", "bob", map[string]interface{}{
+			"other_user":         "bob",
+			"total_messages":     4.0,
+			"messages_by_status": map[string]interface{}{"sent": 1.0, "delivered": 1.0, "read": 2.0},
+			"first_message_at":   at(0),
+			"last_message_at":    at(3),
+			"total_characters":   27.0,
+			"avg_message_length": 6.75,
+		}},
+		// bob still sees the message alice hid
+		{"bob", "alice", map[string]interface{}{
+			"other_user":         "alice",
+			"total_messages":     5.0,
+			"messages_by_status": map[string]interface{}{"sent": 2.0, "delivered": 1.0, "read": 2.0},
+			"first_message_at":   at(0),
+			"last_message_at":    at(5),
+			"total_characters":   31.0,
+			"avg_message_length": 6.2,
+		}},
+		{"alice", "dave", map[string]interface{}{
+			"other_user":         "dave",
+			"total_messages":     0.0,
+			"messages_by_status": map[string]interface{}{"sent": 0.0, "delivered": 0.0, "read": 0.0},
+			"first_message_at":   nil,
+			"last_message_at":    nil,
+			"total_characters":   0.0,
+			"avg_message_length": 0.0,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+" with "+tt.other, func(t *testing.T) {
+			code, got := messageStatsOf(t, tt.user, tt.other)
+			if code != 200 {
+				t.Fatalf("status = %d, want 200 (%v)", code, got)
+			}
+			for key, want := range tt.want {
+				// Timestamps are compared as instants: the offset they are written with depends on the session
+				if s, ok := got[key].(string); ok && want != nil {
+					if at, err := time.Parse(time.RFC3339Nano, s); err == nil && at.Equal(want.(time.Time)) {
+						continue
+					}
+				}
+				if !reflect.DeepEqual(got[key], want) {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
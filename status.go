@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Status every message starts in when it is queued
+const initialStatus = "sent"
+
+// The only status changes allowed: sent -> delivered -> read. A message can be read
+// before its delivery was reported (sent -> read), but never moves backwards.
+var statusTransitions = map[string][]string{
+	"sent":      {"delivered", "read"},
+	"delivered": {"read"},
+	"read":      {},
+}
+
+// Delivery statuses a message moves through
+var messageStatuses = map[string]bool{
+	"sent":      true,
+	"delivered": true,
+	"read":      true,
+}
+
+// Attempts at the compare-and-set in updateMessageStatus before giving up on a message that keeps changing
+const statusUpdateAttempts = 3
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errConcurrentUpdate = errors.New("message is being changed concurrently, try again")
+)
+
+// illegalTransitionError is returned for a status change the graph doesn't allow
+type illegalTransitionError struct {
+	From, To string
+}
+
+func (e *illegalTransitionError) Error() string {
+	return fmt.Sprintf("cannot change status from %q to %q", e.From, e.To)
+}
+
+// staleVersionError is returned when If-Match names an older version than the current one
+type staleVersionError struct {
+	Current int64
+}
+
+func (e *staleVersionError) Error() string {
+	return fmt.Sprintf("message is at version %d", e.Current)
+}
+
+//! Checks that a message may move from status current to next
+func TransitionStatus(current, next string) error {
+	for _, allowed := range statusTransitions[current] {
+		if allowed == next {
+			return nil
+		}
+	}
+	return &illegalTransitionError{From: current, To: next}
+}
+
+//! Moves a message to status next if TransitionStatus allows it and, when expected is set,
+// the message is still at that version. Returns the sender (who gets the receipt) and the new version.
+func updateMessageStatus(ctx context.Context, messageID, next string, expected *int64) (string, int64, error) {
+	for attempt := 0; attempt < statusUpdateAttempts; attempt++ {
+		var current string
+		var version int64
+		err := pool.QueryRow(ctx, "SELECT status, version FROM messages WHERE message_id = $1", messageID).Scan(&current, &version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", 0, errMessageNotFound
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		if expected != nil && *expected != version {
+			return "", 0, &staleVersionError{Current: version}
+		}
+		if err := TransitionStatus(current, next); err != nil {
+			return "", 0, err
+		}
+
+		// Compare-and-set on what was just read, so a concurrent change makes this match nothing
+		var senderID string
+		err = pool.QueryRow(ctx, `
+			UPDATE messages SET status = $1, read = (read OR $1 = 'read'), version = version + 1, changed_at = now()
+			WHERE message_id = $2 AND status = $3 AND version = $4
+			RETURNING sender_id, version`,
+			next, messageID, current, version).Scan(&senderID, &version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue // changed underneath us: re-read and check again
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		return senderID, version, nil
+	}
+	return "", 0, errConcurrentUpdate
+}
+
+//! Writes the response for an error from updateMessageStatus
+func statusUpdateFailed(c echo.Context, messageID string, err error) error {
+	var illegal *illegalTransitionError
+	var stale *staleVersionError
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		return c.JSON(404, map[string]string{"error": "Message not found"})
+	case errors.As(err, &stale):
+		return preconditionFailed(c, stale.Current)
+	case errors.As(err, &illegal):
+		return c.JSON(409, map[string]string{"error": illegal.Error(), "current_status": illegal.From})
+	case errors.Is(err, errConcurrentUpdate):
+		return c.JSON(409, map[string]string{"error": err.Error()})
+	}
+
+	logFor(c).Error("Failed to update message status", "error", err, "message_id", messageID)
+	if ctxErr := requestDone(c); ctxErr != nil {
+		return ctxErr // let the timeout middleware answer
+	}
+	return c.JSON(500, map[string]string{"error": "Failed to update message status"})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTransitionStatus(t *testing.T) {
+	tests := []struct {
+		current, next string
+		allowed       bool
+	}{
+		{"sent", "delivered", true},
+		{"sent", "read", true},
+		{"delivered", "read", true},
+
+		{"sent", "sent", false},
+		{"delivered", "sent", false},
+		{"delivered", "delivered", false},
+		{"read", "sent", false},
+		{"read", "delivered", false},
+		{"read", "read", false},
+
+		{"sent", "archived", false},
+		{"unknown", "read", false},
+		{"", "sent", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.current+"->"+tt.next, func(t *testing.T) {
+			err := TransitionStatus(tt.current, tt.next)
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("TransitionStatus(%q, %q) = %v, want nil", tt.current, tt.next, err)
+				}
+				return
+			}
+			var illegal *illegalTransitionError
+			if !errors.As(err, &illegal) {
+				t.Fatalf("TransitionStatus(%q, %q) = %v, want an *illegalTransitionError", tt.current, tt.next, err)
+			}
+			if illegal.From != tt.current || illegal.To != tt.next {
+				t.Errorf("illegalTransitionError = %+v, want From %q To %q", illegal, tt.current, tt.next)
+			}
+		})
+	}
+}
+
+func TestStatusGraphCoversEveryStatus(t *testing.T) {
+	for status := range messageStatuses {
+		if _, ok := statusTransitions[status]; !ok {
+			t.Errorf("status %q has no entry in statusTransitions", status)
+		}
+	}
+	for from, targets := range statusTransitions {
+		for _, to := range targets {
+			if !messageStatuses[to] {
+				t.Errorf("transition %q -> %q leads to an unknown status", from, to)
+			}
+		}
+	}
+	if !messageStatuses[initialStatus] {
+		t.Errorf("initialStatus %q is not a known status", initialStatus)
+	}
+}
+
+func TestMarkMessageAsDelivered(t *testing.T) {
+	bobsMessage := messageRecord(Message{MessageID: "m1", SenderID: "alice", ReceiverID: "bob",
+		Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1})
+
+	tests := []struct {
+		name        string
+		found       bool
+		status      string // the message's status when the handler runs
+		wantStatus  int
+		wantBody    map[string]string
+		wantReceipt bool
+	}{
+		{"missing", false, "", 404, map[string]string{"error": "Message not found"}, false},
+		{"sent", true, "sent", 200, map[string]string{"message": "Message status updated to delivered"}, true},
+		{"already delivered", true, "delivered", 409, map[string]string{
+			"error": `cannot change status from "delivered" to "delivered"`, "current_status": "delivered"}, false},
+		{"already read", true, "read", 409, map[string]string{
+			"error": `cannot change status from "read" to "delivered"`, "current_status": "read"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			r := useFakeRedis(t)
+			f.on("SELECT status, version FROM messages", pgRule{Rows: [][]interface{}{{tt.status, int64(1)}}})
+			if tt.found {
+				f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{bobsMessage}})
+			} else {
+				f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{}, Cols: 16})
+			}
+			f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+			f.on("UPDATE messages SET status", pgRule{Rows: [][]interface{}{{"alice", int64(2)}}})
+
+			c, rec := messageContext(http.MethodPut, "m1", "bob")
+			if err := markMessageAsDelivered(c); err != nil {
+				t.Fatalf("markMessageAsDelivered returned %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+			}
+			if len(body) != len(tt.wantBody) {
+				t.Errorf("body = %v, want %v", body, tt.wantBody)
+			}
+			for k, v := range tt.wantBody {
+				if body[k] != v {
+					t.Errorf("body[%q] = %q, want %q", k, body[k], v)
+				}
+			}
+
+			// Only the actual transition changes the row and tells the sender
+			if updated := len(f.queriesContaining("UPDATE messages")) > 0; updated != tt.wantReceipt {
+				t.Errorf("message updated = %v, want %v", updated, tt.wantReceipt)
+			}
+			if receipts := r.publishedOn(receiptChannelPrefix + "alice"); (len(receipts) == 1) != tt.wantReceipt {
+				t.Errorf("receipts published: %q, want a receipt: %v", receipts, tt.wantReceipt)
+			}
+			if tt.wantStatus == 200 && rec.Header().Get("ETag") != messageETag(2) {
+				t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), messageETag(2))
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+)
+
+// Order of GET /messages/sync: the reverse of newestFirst, so a client can append as it goes
+const oldestFirst = "timestamp ASC, seq ASC, message_id ASC"
+
+// Messages in the conversation ?conversation= names, as seen by user $2: the group $1, or the
+// 1-to-1 conversation with user $1. Group IDs never match user IDs, so one condition covers both.
+const syncConversation = `(conversation_id = $1 OR (conversation_id IS NULL AND ((sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1))))`
+
+// SyncResponse is the body of GET /messages/sync
+type SyncResponse struct {
+	Messages  interface{} `json:"messages"`   // oldest first, shaped for the API version
+	HasMore   bool        `json:"has_more"`   // more messages after these: call again with since=next_since
+	Reset     bool        `json:"reset"`      // since was unknown, so messages is the latest page rather than a delta
+	NextSince string      `json:"next_since"` // message_id to pass as since next time; empty if there is nothing yet
+}
+
+//! Resolves ?since (a message_id, or a seq number) into the SQL condition for the messages after it,
+// binding to $3. known is false when since is neither a message of the conversation nor a seq it has reached.
+func syncCursor(ctx context.Context, db *pgxpool.Pool, conversation, userID, since string) (cond string, arg interface{}, known bool, err error) {
+	if seq, perr := strconv.ParseInt(since, 10, 64); perr == nil && seq >= 0 {
+		err = db.QueryRow(ctx, `SELECT $3 <= COALESCE(MAX(seq), 0) FROM messages WHERE `+syncConversation,
+			conversation, userID, seq).Scan(&known)
+		return "seq > $3", seq, known, err
+	}
+
+	// Deleted and hidden messages still mark a position, so they are valid cursors
+	err = db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM messages WHERE message_id = $3 AND `+syncConversation+`)`,
+		conversation, userID, since).Scan(&known)
+	return "(timestamp, seq, message_id) > (SELECT timestamp, seq, message_id FROM messages WHERE message_id = $3)", since, known, err
+}
+
+//! Handles catching up on a conversation after being offline: the messages after ?since, oldest first.
+// ?conversation is the other user of a 1-to-1 conversation or a group's conversation ID. Without
+// ?since the conversation is read from the start. A since the server doesn't know (a message from
+// another conversation, or a seq ahead of it) returns the latest page with reset set instead.
+func syncMessages(c echo.Context) error {
+	me := authUserID(c)
+	conversation := normalizeUserID(c.QueryParam("conversation"))
+	if conversation == "" {
+		return c.JSON(400, map[string]string{"error": "conversation is required"})
+	}
+	if ok, err := requireParticipant(c, conversation, "Failed to sync messages"); !ok {
+		return err
+	}
+
+	version, err := apiVersion(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	limit, err := parseLimit(c)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	reqCtx := c.Request().Context()
+	since := c.QueryParam("since")
+	args := []interface{}{conversation, me}
+	cursorCond, known := "TRUE", true
+	if since != "" {
+		var cursorArg interface{}
+		cursorCond, cursorArg, known, err = syncCursor(reqCtx, readDB(c), conversation, me, since)
+		if err != nil {
+			logFor(c).Error("Failed to resolve sync cursor", "error", err, "since", since)
+			if ctxErr := requestDone(c); ctxErr != nil {
+				return ctxErr // let the timeout middleware answer
+			}
+			return c.JSON(500, map[string]string{"error": "Failed to sync messages"})
+		}
+		args = append(args, cursorArg)
+	}
+
+	// A delta reads forward from the cursor; a reset reads the latest page backwards and flips it.
+	// One extra row is fetched to know whether more messages follow.
+	order := oldestFirst
+	if !known {
+		cursorCond, order = "TRUE", newestFirst
+		args = args[:2]
+	}
+	args = append(args, limit+1)
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE ` + syncConversation + `
+			AND ` + visibleMessage + `
+			AND ` + notHiddenFor(2) + `
+			AND ` + sinceJoined(2) + `
+			AND ` + cursorCond + `
+		ORDER BY ` + order + `
+		LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := readDB(c).Query(reqCtx, query, args...)
+	if err != nil {
+		logFor(c).Error("Failed to sync messages", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to sync messages"})
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := scanMessage(rows, &msg); err != nil {
+			logFor(c).Error("Failed to scan row", "error", err)
+			return c.JSON(500, map[string]string{"error": "Failed to sync messages"})
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		logFor(c).Error("Rows iteration error", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to sync messages"})
+	}
+
+	resp := SyncResponse{Reset: !known, NextSince: since}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		resp.HasMore = known // after a reset the page already ends at the newest message
+	}
+	if !known {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+		resp.NextSince = ""
+	}
+	if len(messages) > 0 {
+		resp.NextSince = messages[len(messages)-1].MessageID
+	}
+
+	if err := attachReplyPreviews(reqCtx, readDB(c), messages); err != nil {
+		logFor(c).Error("Failed to load replied-to messages", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to sync messages"})
+	}
+
+	resp.Messages = messagesForVersion(messages, version)
+	return c.JSON(200, resp)
+}
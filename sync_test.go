@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// syncPage is SyncResponse with the messages decoded
+type syncPage struct {
+	Messages  []Message `json:"messages"`
+	HasMore   bool      `json:"has_more"`
+	Reset     bool      `json:"reset"`
+	NextSince string    `json:"next_since"`
+}
+
+//! Calls syncMessages as user with query and decodes a 200 answer
+func syncAs(t *testing.T, user, query string) (int, syncPage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages/sync?"+query, nil), rec)
+	c.Set(authUserKey, user)
+	if err := syncMessages(c); err != nil {
+		t.Fatalf("syncMessages returned %v", err)
+	}
+	var page syncPage
+	if rec.Code == 200 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, page
+}
+
+//! Returns the IDs of messages, in order
+func messageIDs(messages []Message) string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.MessageID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestSyncMessagesValidation(t *testing.T) {
+	f := useFakePG(t)
+	// alice takes part in the conversation with bob but isn't a member of group-1
+	f.on(participantQuery, pgRule{Answer: func(query string) [][]interface{} {
+		return [][]interface{}{{!strings.Contains(query, "group-1")}}
+	}})
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", 400},
+		{"conversation=bob&limit=0", 400},
+		{"conversation=group-1", 403}, // not a member
+	} {
+		if code, _ := syncAs(t, "alice", tt.query); code != tt.want {
+			t.Errorf("%q: status = %d, want %d", tt.query, code, tt.want)
+		}
+	}
+}
+
+// The shaping of the answer: the SQL itself is covered by TestSyncMessages
+func TestSyncMessagesResponse(t *testing.T) {
+	rows := func(ids ...string) [][]interface{} {
+		var out [][]interface{}
+		for i, id := range ids {
+			out = append(out, messageRecord(Message{MessageID: id, SenderID: "bob", ReceiverID: "alice", Content: "hi",
+				Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1, Seq: int64(i + 1)}))
+		}
+		return out
+	}
+	tests := []struct {
+		name, query   string
+		known         bool
+		newest        bool // the page is read newest first
+		rows          [][]interface{}
+		wantIDs       string
+		wantMore      bool
+		wantReset     bool
+		wantNextSince string
+	}{
+		{"delta", "since=m2&limit=2", true, false, rows("m3", "m4", "m5"), "m3,m4", true, false, "m4"},
+		{"last delta", "since=m4&limit=2", true, false, rows("m5"), "m5", false, false, "m5"},
+		// Nothing new: the same cursor comes back
+		{"empty delta", "since=m5", true, false, nil, "", false, false, "m5"},
+		// The latest page is read backwards, then returned oldest first
+		{"unknown cursor", "since=gone&limit=2", false, true, rows("m5", "m4", "m3"), "m4,m5", false, true, "m5"},
+		{"unknown cursor, no messages", "since=gone", false, true, nil, "", false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			f.on(participantQuery, pgRule{Rows: [][]interface{}{{true}}})
+			f.on("SELECT EXISTS (SELECT 1 FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{{tt.known}}})
+			order := oldestFirst
+			if tt.newest {
+				order = newestFirst
+			}
+			f.on("ORDER BY "+order, pgRule{Rows: tt.rows})
+
+			code, page := syncAs(t, "alice", "conversation=bob&"+tt.query)
+			if code != 200 {
+				t.Fatalf("status = %d, want 200 (queries %q)", code, f.queriesContaining("FROM messages"))
+			}
+			if got := messageIDs(page.Messages); got != tt.wantIDs {
+				t.Errorf("messages = %q, want %q", got, tt.wantIDs)
+			}
+			if page.HasMore != tt.wantMore || page.Reset != tt.wantReset || page.NextSince != tt.wantNextSince {
+				t.Errorf("has_more %v, reset %v, next_since %q; want %v, %v, %q",
+					page.HasMore, page.Reset, page.NextSince, tt.wantMore, tt.wantReset, tt.wantNextSince)
+			}
+			if page.Messages == nil {
+				t.Error("messages is null, want []")
+			}
+		})
+	}
+}
+
+// Cursor resolution and the delta query are SQL, so this runs against a real database only
+func TestSyncMessages(t *testing.T) {
+	useTestDB(t)
+	base := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		sender, receiver := "alice", "bob"
+		if i%2 == 0 {
+			sender, receiver = receiver, sender
+		}
+		insertTestMessage(t, Message{MessageID: fmt.Sprintf("m%d", i), SenderID: sender, ReceiverID: receiver, Content: "hi",
+			Timestamp: base.Add(time.Duration(i) * time.Minute), Status: "sent", ContentType: defaultContentType, Seq: int64(i)})
+	}
+	// Another conversation, newer than all of them
+	insertTestMessage(t, Message{MessageID: "other", SenderID: "alice", ReceiverID: "carol", Content: "hi",
+		Timestamp: base.Add(time.Hour), Status: "sent", ContentType: defaultContentType, Seq: 1})
+
+	tests := []struct {
+		name, query   string
+		wantIDs       string
+		wantMore      bool
+		wantReset     bool
+		wantNextSince string
+	}{
+		{"from the start", "", "m1,m2,m3,m4,m5", false, false, "m5"},
+		{"delta", "since=m2", "m3,m4,m5", false, false, "m5"},
+		{"delta in pages", "since=m2&limit=2", "m3,m4", true, false, "m4"},
+		{"delta by seq", "since=3", "m4,m5", false, false, "m5"},
+		{"empty delta", "since=m5", "", false, false, "m5"},
+		{"empty delta by seq", "since=5", "", false, false, "5"},
+		{"unknown message", "since=gone&limit=2", "m4,m5", false, true, "m5"},
+		{"message of another conversation", "since=other&limit=2", "m4,m5", false, true, "m5"},
+		{"seq ahead of the conversation", "since=99", "m1,m2,m3,m4,m5", false, true, "m5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, page := syncAs(t, "bob", "conversation=alice&"+tt.query)
+			if code != 200 {
+				t.Fatalf("status = %d, want 200", code)
+			}
+			if got := messageIDs(page.Messages); got != tt.wantIDs {
+				t.Errorf("messages = %q, want %q", got, tt.wantIDs)
+			}
+			if page.HasMore != tt.wantMore || page.Reset != tt.wantReset || page.NextSince != tt.wantNextSince {
+				t.Errorf("has_more %v, reset %v, next_since %q; want %v, %v, %q",
+					page.HasMore, page.Reset, page.NextSince, tt.wantMore, tt.wantReset, tt.wantNextSince)
+			}
+		})
+	}
+}
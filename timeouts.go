@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Per-route request timeouts, keyed by "METHOD /path" as registered with Echo.
+// Slow endpoints get more room; the hot send path fails fast.
+var routeTimeouts = map[string]time.Duration{
+	"GET /messages":            10 * time.Second,
+	"POST /messages":           3 * time.Second,
+	"POST /drafts/:id/send":    3 * time.Second, // the send path, like POST /messages
+	"GET /conversations/stats": 15 * time.Second,
+	"GET /messages/search":     15 * time.Second,
+	"POST /attachments":        60 * time.Second,
+	"POST /messages/batch":     15 * time.Second, // validates up to maxBatchSize messages
+	"POST /stop-redis":         30 * time.Second, // waits for the workers to finish their current batch
+	"POST /restart-redis":      30 * time.Second,
+}
+
+// Timeout for routes that are not in routeTimeouts
+var defaultRouteTimeout = 5 * time.Second
+
+// Upper bound on one database or Redis call made outside a request (the worker's insert
+// transaction, stream bookkeeping, the scheduler and the expiry sweep), configured with OPERATION_TIMEOUT.
+// Requests are bounded by their route timeout instead.
+var operationTimeout = 5 * time.Second
+
+//! Derives the context for one background operation, cancelled after operationTimeout
+func operationContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, operationTimeout)
+}
+
+//! Applies ROUTE_TIMEOUTS and DEFAULT_ROUTE_TIMEOUT on top of the built-in timeouts.
+// ROUTE_TIMEOUTS format: "GET /messages=10s,POST /messages=2s"
+func loadRouteTimeouts() error {
+	if v := os.Getenv("DEFAULT_ROUTE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid DEFAULT_ROUTE_TIMEOUT %q", v)
+		}
+		defaultRouteTimeout = d
+	}
+
+	v := os.Getenv("ROUTE_TIMEOUTS")
+	if v == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		route, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid ROUTE_TIMEOUTS entry %q: want \"METHOD /path=duration\"", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout in ROUTE_TIMEOUTS entry %q", entry)
+		}
+		routeTimeouts[strings.TrimSpace(route)] = d
+	}
+	return nil
+}
+
+//! Middleware that gives each request a context deadline based on its matched route.
+// Must be registered with e.Use so the route (c.Path()) is already resolved.
+func routeTimeoutMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		timeout, ok := routeTimeouts[c.Request().Method+" "+c.Path()]
+		if !ok {
+			timeout = defaultRouteTimeout
+		}
+
+		reqCtx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+		c.SetRequest(c.Request().WithContext(reqCtx))
+
+		err := next(c)
+
+		// The handler gave up because of the deadline and hasn't written a response yet
+		if errors.Is(reqCtx.Err(), context.DeadlineExceeded) && !c.Response().Committed {
+			logFor(c).Warn("Request timed out", "timeout", timeout.String(), "method", c.Request().Method, "path", c.Path())
+			return c.JSON(504, map[string]string{"error": "Request timed out"})
+		}
+		return err
+	}
+}
+
+//! Returns the request context's error once the client has gone away or the route
+// deadline has passed, so handlers can return it instead of reporting a generic 500.
+func requestDone(c echo.Context) error {
+	return c.Request().Context().Err()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLoadRouteTimeouts(t *testing.T) {
+	oldRoutes, oldDefault := routeTimeouts, defaultRouteTimeout
+	t.Cleanup(func() { routeTimeouts, defaultRouteTimeout = oldRoutes, oldDefault })
+
+	tests := []struct {
+		name, routes, def string
+		wantErr           bool
+	}{
+		{"unset", "", "", false},
+		{"valid", "GET /messages=2s, POST /messages=500ms", "7s", false},
+		{"no duration", "GET /messages", "", true},
+		{"bad duration", "GET /messages=soon", "", true},
+		{"zero", "GET /messages=0s", "", true},
+		{"bad default", "", "-1s", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routeTimeouts, defaultRouteTimeout = map[string]time.Duration{"GET /messages": 10 * time.Second}, 5*time.Second
+			t.Setenv("ROUTE_TIMEOUTS", tt.routes)
+			t.Setenv("DEFAULT_ROUTE_TIMEOUT", tt.def)
+			if err := loadRouteTimeouts(); (err != nil) != tt.wantErr {
+				t.Fatalf("loadRouteTimeouts() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	if routeTimeouts["GET /messages"] != 10*time.Second {
+		t.Errorf("a refused ROUTE_TIMEOUTS changed GET /messages to %v", routeTimeouts["GET /messages"])
+	}
+
+	routeTimeouts = map[string]time.Duration{}
+	t.Setenv("ROUTE_TIMEOUTS", "GET /messages=2s, POST /messages=500ms")
+	t.Setenv("DEFAULT_ROUTE_TIMEOUT", "7s")
+	if err := loadRouteTimeouts(); err != nil {
+		t.Fatal(err)
+	}
+	if routeTimeouts["GET /messages"] != 2*time.Second || routeTimeouts["POST /messages"] != 500*time.Millisecond || defaultRouteTimeout != 7*time.Second {
+		t.Errorf("routeTimeouts = %v, default %v", routeTimeouts, defaultRouteTimeout)
+	}
+}
+
+//! Gives route a timeout of d for the rest of the test
+func useRouteTimeout(t *testing.T, route string, d time.Duration) {
+	old, had := routeTimeouts[route]
+	routeTimeouts[route] = d
+	t.Cleanup(func() {
+		if had {
+			routeTimeouts[route] = old
+		} else {
+			delete(routeTimeouts, route)
+		}
+	})
+}
+
+//! Serves req through the timeout middleware and handler, authenticated as user.
+// Fails the test if no answer comes within 2 seconds.
+func serveWithTimeout(t *testing.T, method, path string, handler echo.HandlerFunc, user string, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+	e.Use(routeTimeoutMiddleware)
+	e.Add(method, path, handler, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(authUserKey, user)
+			return next(c)
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.ServeHTTP(rec, req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s %s is still waiting on the blocked dependency", method, path)
+	}
+	return rec
+}
+
+func TestStuckDatabaseTimesOut(t *testing.T) {
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	f.on("FROM messages", pgRule{Rows: [][]interface{}{}, Cols: 16, Wait: stuck})
+	useRouteTimeout(t, "GET /messages", 50*time.Millisecond)
+
+	rec := serveWithTimeout(t, http.MethodGet, "/messages", getMessages, "alice",
+		httptest.NewRequest(http.MethodGet, "/messages?user1=alice&user2=bob", nil))
+	if rec.Code != 504 || !strings.Contains(rec.Body.String(), "Request timed out") {
+		t.Errorf("response = %d %s, want 504 Request timed out", rec.Code, rec.Body.String())
+	}
+}
+
+// A Redis that accepts connections and never answers; the client is built like the server's own
+func useBlockedRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn) // held open, never read
+			mu.Unlock()
+		}
+	}()
+	opts := redisOptions(Config{RedisAddr: ln.Addr().String()})
+	opts.Protocol, opts.DisableIndentity = 2, true
+	cli := redis.NewClient(opts)
+	old := redisCli
+	redisCli = cli
+	t.Cleanup(func() {
+		redisCli = old
+		cli.Close()
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+func TestStuckRedisTimesOut(t *testing.T) {
+	f := useFakePG(t)
+	f.on("FROM blocks", pgRule{Rows: [][]interface{}{{false}}})
+	useBlockedRedis(t)
+	// Well under the client's 3s read timeout: only the request's deadline can end the wait in time
+	useRouteTimeout(t, "POST /messages", 50*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader(`{"receiver_id": "`+bobID+`", "content": "hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serveWithTimeout(t, http.MethodPost, "/messages", sendMessage, aliceID, req)
+	if rec.Code != 504 {
+		t.Errorf("response = %d %s, want 504", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStuckDatabaseFailsWorkerAttempt(t *testing.T) {
+	f := useFakePG(t)
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1", Wait: stuck})
+	old := operationTimeout
+	operationTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { operationTimeout = old })
+
+	entry, err := parseStreamMessage(validStreamEntry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := storeMessage(entry.MessageID, entry)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		// The attempt fails, so withRetry tries again and the entry stays pending if it never recovers
+		if err == nil {
+			t.Error("storeMessage succeeded against a stuck database")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("storeMessage is still waiting on the stuck database")
+	}
+}
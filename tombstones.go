@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Deletions are published on a per-participant channel (deletions:<user_id>), like receipts,
+// so a subscriber only hears about messages of conversations its user takes part in.
+const deletionChannelPrefix = "deletions:"
+
+// Tombstone stands in for a deleted message: in lists read with ?tombstones=true, and as the
+// payload of a deletion event. Clients show "This message was deleted" in its place.
+type Tombstone struct {
+	MessageID string    `json:"message_id"`
+	Deleted   bool      `json:"deleted"` // always true
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Selected after messageColumns by lists with tombstones: NULL for a visible message, otherwise
+// when it was deleted. An expired message the sweeper hasn't reached yet counts from its expiry.
+const tombstoneColumn = "CASE WHEN " + visibleMessage + " THEN NULL ELSE COALESCE(deleted_at, expires_at) END"
+
+//! Reads ?tombstones: whether a list returns deleted messages as tombstones rather than leaving them out
+func parseTombstones(c echo.Context) (bool, error) {
+	v := c.QueryParam("tombstones")
+	if v == "" {
+		return false, nil
+	}
+	tombstones, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("tombstones must be true or false")
+	}
+	return tombstones, nil
+}
+
+//! Returns the SQL a list selects and filters by: visible messages only, or every message
+// with tombstoneColumn after messageColumns. Hidden-for-me messages are left out either way.
+func listedMessages(tombstones bool) (columns, cond string) {
+	if tombstones {
+		return messageColumns + ", " + tombstoneColumn, "TRUE"
+	}
+	return messageColumns, visibleMessage
+}
+
+//! Publishes a deletion event to each participant's deletion channel, the sender's included,
+// so their other devices drop the message too. Best-effort like receipts: the delete is committed.
+func publishDeletion(reqCtx context.Context, messageID string, deletedAt time.Time, participants []string) {
+	payload, err := json.Marshal(Tombstone{MessageID: messageID, Deleted: true, DeletedAt: deletedAt})
+	if err != nil {
+		slog.Error("Failed to encode deletion event", "error", err, "message_id", messageID)
+		return
+	}
+
+	pipe := redisCli.Pipeline()
+	for _, userID := range participants {
+		pipe.Publish(reqCtx, deletionChannelPrefix+userID, payload)
+	}
+	if _, err := pipe.Exec(reqCtx); err != nil {
+		slog.Error("Failed to publish deletion event", "error", err, "message_id", messageID)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Calls getMessages for alice and bob as alice with query, and decodes the page as generic JSON
+func historyWithTombstones(t *testing.T, query string) (int, []map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/messages?user1=alice&user2=bob&"+query, nil), rec)
+	c.Set(authUserKey, "alice")
+	if err := getMessages(c); err != nil {
+		t.Fatalf("getMessages returned %v", err)
+	}
+	var page []map[string]interface{}
+	if rec.Code == 200 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, page
+}
+
+func TestGetMessagesTombstones(t *testing.T) {
+	deletedAt := time.Date(2025, 3, 15, 12, 30, 0, 0, time.UTC)
+	record := func(id string, deleted *time.Time) []interface{} {
+		return append(messageRecord(Message{MessageID: id, SenderID: "alice", ReceiverID: "bob", Content: "secret",
+			Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1}), deleted)
+	}
+	f := useFakePG(t)
+	f.on("conversation_members", pgRule{Rows: [][]interface{}{{true}}})
+	f.on(tombstoneColumn, pgRule{Rows: [][]interface{}{record("live", nil), record("gone", &deletedAt)}})
+	f.on("ORDER BY "+newestFirst, pgRule{Rows: [][]interface{}{messageRecord(Message{MessageID: "live", SenderID: "alice",
+		ReceiverID: "bob", Content: "secret", Timestamp: time.Now(), Status: "sent", ContentType: defaultContentType, Version: 1})}})
+
+	code, page := historyWithTombstones(t, "tombstones=true")
+	if code != 200 || len(page) != 2 {
+		t.Fatalf("status = %d, page = %v; want 200 and 2 entries", code, page)
+	}
+	if page[0]["message_id"] != "live" || page[0]["content"] != "secret" {
+		t.Errorf("live message = %v", page[0])
+	}
+	// Nothing of the deleted message is left but its ID and when it went
+	want := map[string]interface{}{"message_id": "gone", "deleted": true, "deleted_at": deletedAt.Format(time.RFC3339)}
+	if !reflect.DeepEqual(page[1], want) {
+		t.Errorf("tombstone = %v, want %v", page[1], want)
+	}
+	if got := f.queriesContaining("AND " + visibleMessage); len(got) != 0 {
+		t.Errorf("deleted messages were filtered out: %q", got)
+	}
+
+	// Without the flag deleted messages are filtered out, as before
+	for _, query := range []string{"", "tombstones=false"} {
+		if code, page := historyWithTombstones(t, query); code != 200 || len(page) != 1 || page[0]["message_id"] != "live" {
+			t.Errorf("%q: status = %d, page = %v; want only the live message", query, code, page)
+		}
+	}
+	if code, _ := historyWithTombstones(t, "tombstones=maybe"); code != 400 {
+		t.Errorf("tombstones=maybe: status = %d, want 400", code)
+	}
+}
+
+// Which rows become tombstones is decided in SQL, so this runs against a real database only
+func TestTombstonesInHistory(t *testing.T) {
+	useTestDB(t)
+	base := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	expired := base.Add(10 * time.Minute)
+	for i, m := range []Message{
+		{MessageID: "live"},
+		{MessageID: "gone"},
+		{MessageID: "expired", ExpiresAt: &expired}, // past its expiry, not swept yet
+		{MessageID: "hidden"},                       // deleted for alice only
+	} {
+		m.SenderID, m.ReceiverID, m.Content, m.Status, m.ContentType = "alice", "bob", "hi", "sent", defaultContentType
+		m.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		insertTestMessage(t, m)
+	}
+	if _, err := pool.Exec(t.Context(), "UPDATE messages SET deleted_at = now() WHERE message_id = 'gone'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hideMessage(t.Context(), "hidden", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	code, page := historyWithTombstones(t, "tombstones=true")
+	if code != 200 {
+		t.Fatalf("status = %d", code)
+	}
+	var got []string
+	for _, entry := range page {
+		id := entry["message_id"].(string)
+		if entry["deleted"] == true {
+			id += " (deleted)"
+		}
+		got = append(got, id)
+	}
+	if want := "expired (deleted),gone (deleted),live"; strings.Join(got, ",") != want {
+		t.Errorf("history = %v, want %s", got, want)
+	}
+	if at, _ := time.Parse(time.RFC3339, page[0]["deleted_at"].(string)); !at.Equal(expired) {
+		t.Errorf("deleted_at of the expired message = %v, want its expiry %v", page[0]["deleted_at"], expired)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// UnreadCount is one conversation's badge count
+type UnreadCount struct {
+	OtherUserID string `json:"other_user_id"`
+	UnreadCount int64  `json:"unread_count"`
+}
+
+//! Handles fetching the caller's unread message counts, grouped by sender
+func getUnreadCounts(c echo.Context) error {
+	me := authUserID(c)
+
+	// ?user is optional, but if given it must be the caller
+	if user := c.QueryParam("user"); user != "" && normalizeUserID(user) != me {
+		return c.JSON(403, map[string]string{"error": "You can only see your own unread counts"})
+	}
+
+	// One grouped query over the caller's unread inbox; group messages have no receiver_id and are not counted
+	query := `
+		SELECT sender_id, COUNT(*)
+		FROM messages
+		WHERE receiver_id = $1 AND read = FALSE AND ` + visibleMessage + ` AND ` + notHiddenFor(1) + `
+		GROUP BY sender_id
+		ORDER BY COUNT(*) DESC, sender_id
+	`
+
+	rows, err := readDB(c).Query(c.Request().Context(), query, me)
+	if err != nil {
+		logFor(c).Error("Failed to count unread messages", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch unread counts"})
+	}
+	defer rows.Close()
+
+	counts := []UnreadCount{}
+	var total int64
+	for rows.Next() {
+		var uc UnreadCount
+		if err := rows.Scan(&uc.OtherUserID, &uc.UnreadCount); err != nil {
+			logFor(c).Error("Failed to scan row", "error", err)
+			return c.JSON(500, map[string]string{"error": "Failed to fetch unread counts"})
+		}
+		total += uc.UnreadCount
+		counts = append(counts, uc)
+	}
+	if err := rows.Err(); err != nil {
+		logFor(c).Error("Rows iteration error", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to fetch unread counts"})
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"conversations": counts,
+		"total":         total,
+	})
+}
+
+//! Handles marking every unread message from :otherUser to the caller as read, in one statement.
+// Already-read messages and those the caller deleted for themselves aren't touched, and each
+// updated message gets a read receipt.
+func markConversationRead(c echo.Context) error {
+	me := authUserID(c)
+	other := normalizeUserID(c.Param("otherUser"))
+	if other == "" {
+		return c.JSON(400, map[string]string{"error": "otherUser is required"})
+	}
+
+	// Unread messages are 'sent' or 'delivered', both of which TransitionStatus allows to move to 'read'
+	query := `
+		UPDATE messages SET read = TRUE, status = 'read', version = version + 1, changed_at = now()
+		WHERE receiver_id = $1 AND sender_id = $2 AND read = FALSE
+			AND conversation_id IS NULL
+			AND ` + visibleMessage + `
+			AND ` + notHiddenFor(1) + `
+		RETURNING message_id
+	`
+
+	rows, err := pool.Query(c.Request().Context(), query, me, other)
+	if err != nil {
+		logFor(c).Error("Failed to mark conversation as read", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to mark conversation as read"})
+	}
+	defer rows.Close()
+
+	updated := []string{}
+	for rows.Next() {
+		var messageID string
+		if err := rows.Scan(&messageID); err != nil {
+			logFor(c).Error("Failed to scan row", "error", err)
+			return c.JSON(500, map[string]string{"error": "Failed to mark conversation as read"})
+		}
+		updated = append(updated, messageID)
+	}
+	if err := rows.Err(); err != nil {
+		logFor(c).Error("Rows iteration error", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to mark conversation as read"})
+	}
+
+	// The other user sent all of these, so they get the receipts
+	for _, messageID := range updated {
+		publishReceipt(c.Request().Context(), other, messageID, "read")
+		emitWebhookEvent("message.read", messageID)
+	}
+
+	logFor(c).Info("Conversation marked as read", "receiver_id", me, "sender_id", other, "count", len(updated))
+	return c.JSON(200, map[string]int{"updated": len(updated)})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The counts are one grouped query, so this runs against a real database only
+func TestGetUnreadCounts(t *testing.T) {
+	p := useTestDB(t)
+	now := time.Now().UTC()
+	n := 0
+	insert := func(sender, receiver string, read bool) string {
+		n++
+		id := fmt.Sprintf("m%02d", n)
+		insertTestMessage(t, Message{MessageID: id, SenderID: sender, ReceiverID: receiver, Content: "hi",
+			Timestamp: now.Add(time.Duration(n) * time.Second), Read: read, Status: "delivered", ContentType: defaultContentType})
+		return id
+	}
+
+	for range 3 {
+		insert("bob", "alice", false)
+	}
+	insert("bob", "alice", true) // already read
+	insert("carol", "alice", false)
+	insert("carol", "alice", false)
+	deleted := insert("carol", "alice", false)
+	hidden := insert("carol", "alice", false)
+	insert("alice", "bob", false)  // sent by alice, unread by bob
+	insert("carol", "dave", false) // someone else's inbox
+	insert("dave", "alice", true)  // nothing unread from dave
+	if _, err := p.Exec(t.Context(), "UPDATE messages SET deleted_at = now() WHERE message_id = $1", deleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exec(t.Context(), "INSERT INTO message_hidden (message_id, user_id) VALUES ($1, 'alice')", hidden); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/unread", nil), rec)
+	c.Set(authUserKey, "alice")
+	if err := getUnreadCounts(c); err != nil {
+		t.Fatalf("getUnreadCounts() = %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Conversations []UnreadCount `json:"conversations"`
+		Total         int64         `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body, err)
+	}
+
+	// Most unread first; deleted and hidden messages don't count
+	want := []UnreadCount{{OtherUserID: "bob", UnreadCount: 3}, {OtherUserID: "carol", UnreadCount: 2}}
+	if !slices.Equal(body.Conversations, want) || body.Total != 5 {
+		t.Errorf("unread counts = %+v, total %d; want %+v, total 5", body.Conversations, body.Total, want)
+	}
+}
+
+// The UPDATE's filter is the subject, so this runs against a real database only
+func TestMarkConversationRead(t *testing.T) {
+	p := useTestDB(t)
+	now := time.Now().UTC()
+	for i, m := range []struct {
+		id, sender, receiver string
+		read                 bool
+	}{
+		{"from bob 1", "bob", "alice", false},
+		{"from bob 2", "bob", "alice", false},
+		{"already read", "bob", "alice", true},
+		{"to bob", "alice", "bob", false},
+		{"from carol", "carol", "alice", false},
+	} {
+		status := "delivered"
+		if m.read {
+			status = "read"
+		}
+		insertTestMessage(t, Message{MessageID: m.id, SenderID: m.sender, ReceiverID: m.receiver, Content: "hi",
+			Timestamp: now.Add(time.Duration(i) * time.Second), Read: m.read, Status: status, ContentType: defaultContentType})
+	}
+	state := func() map[string]string {
+		rows, err := p.Query(t.Context(), "SELECT message_id, status, read, version FROM messages")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		states := map[string]string{}
+		for rows.Next() {
+			var id, status string
+			var read bool
+			var version int64
+			if err := rows.Scan(&id, &status, &read, &version); err != nil {
+				t.Fatal(err)
+			}
+			states[id] = fmt.Sprintf("%s read=%v v%d", status, read, version)
+		}
+		return states
+	}
+	markRead := func() int {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/conversations/bob/read", nil), rec)
+		c.SetParamNames("otherUser")
+		c.SetParamValues("bob")
+		c.Set(authUserKey, "alice")
+		if err := markConversationRead(c); err != nil || rec.Code != 200 {
+			t.Fatalf("markConversationRead = %v, %d %s", err, rec.Code, rec.Body.String())
+		}
+		var body map[string]int
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body["updated"]
+	}
+	useFakeRedis(t) // for the receipts
+	before := state()
+
+	if n := markRead(); n != 2 {
+		t.Errorf("updated = %d, want the 2 unread messages from bob", n)
+	}
+	after := state()
+	for id, want := range map[string]string{
+		"from bob 1":   "read read=true v2",
+		"from bob 2":   "read read=true v2",
+		"already read": before["already read"], // not touched again
+		"to bob":       before["to bob"],       // alice's own message
+		"from carol":   before["from carol"],   // another conversation
+	} {
+		if after[id] != want {
+			t.Errorf("%s: %s, want %s", id, after[id], want)
+		}
+	}
+
+	// Nothing left to mark
+	if n := markRead(); n != 0 {
+		t.Errorf("second call updated = %d, want 0", n)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// How user IDs are normalized before they are stored or compared.
+// Configured with USER_ID_NORMALIZATION:
+//   - "trim" (default): strip surrounding whitespace
+//   - "lower": trim and lowercase, for case-insensitive IDs
+//   - "none": use IDs exactly as sent
+var userIDNormalization = "trim"
+
+//! Validates and applies USER_ID_NORMALIZATION
+func loadUserIDNormalization() error {
+	v := os.Getenv("USER_ID_NORMALIZATION")
+	if v == "" {
+		return nil
+	}
+	switch v {
+	case "trim", "lower", "none":
+		userIDNormalization = v
+		return nil
+	}
+	return fmt.Errorf("invalid USER_ID_NORMALIZATION %q: want trim, lower or none", v)
+}
+
+//! Normalizes a user ID so "User1" and " user1 " resolve to the same user (per policy)
+func normalizeUserID(id string) string {
+	switch userIDNormalization {
+	case "none":
+		return id
+	case "lower":
+		return strings.ToLower(strings.TrimSpace(id))
+	default:
+		return strings.TrimSpace(id)
+	}
+}
+
+//! Reports whether id is a UUID in the canonical 36-character form (8-4-4-4-12 hex)
+func isUUID(id string) bool {
+	if len(id) != 36 {
+		return false // uuid.Parse also accepts urn:uuid: and {braced} forms
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
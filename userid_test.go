@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestNormalizeUserID(t *testing.T) {
+	defer func(policy string) { userIDNormalization = policy }(userIDNormalization)
+
+	tests := []struct {
+		policy string
+		id     string
+		want   string
+	}{
+		{"trim", "user1", "user1"},
+		{"trim", "  user1 ", "user1"},
+		{"trim", "\tUser1\n", "User1"},
+		{"trim", "", ""},
+		{"lower", "User1", "user1"},
+		{"lower", " USER1  ", "user1"},
+		{"lower", "user1", "user1"},
+		{"none", " User1 ", " User1 "},
+		{"none", "user1", "user1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.id, func(t *testing.T) {
+			userIDNormalization = tt.policy
+			if got := normalizeUserID(tt.id); got != tt.want {
+				t.Errorf("normalizeUserID(%q) with %q = %q, want %q", tt.id, tt.policy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizedIDsShareAConversation(t *testing.T) {
+	defer func(policy string) { userIDNormalization = policy }(userIDNormalization)
+	userIDNormalization = "lower"
+
+	// However each side writes the IDs, and whichever side sends, it is one conversation
+	want := sequenceKey("", normalizeUserID("alice"), normalizeUserID("bob"))
+	for _, ids := range [][2]string{
+		{"Alice", "bob"},
+		{" alice", "BOB "},
+		{"BOB", "alice"},
+		{"\tBob\n", " ALICE "},
+	} {
+		if got := sequenceKey("", normalizeUserID(ids[0]), normalizeUserID(ids[1])); got != want {
+			t.Errorf("conversation of %q and %q = %q, want %q", ids[0], ids[1], got, want)
+		}
+	}
+}
+
+func TestLoadUserIDNormalization(t *testing.T) {
+	defer func(policy string) { userIDNormalization = policy }(userIDNormalization)
+
+	tests := []struct {
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"", "trim", false}, // unset keeps the default
+		{"trim", "trim", false},
+		{"lower", "lower", false},
+		{"none", "none", false},
+		{"upper", "trim", true},
+		{"LOWER", "trim", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			userIDNormalization = "trim"
+			t.Setenv("USER_ID_NORMALIZATION", tt.env)
+			err := loadUserIDNormalization()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadUserIDNormalization() error = %v, want error %v", err, tt.wantErr)
+			}
+			if userIDNormalization != tt.want {
+				t.Errorf("userIDNormalization = %q, want %q", userIDNormalization, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUUID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"3f2a8c1d-6b4e-4f9a-9d2c-7e1b5a0c8f62", true},
+		{"3F2A8C1D-6B4E-4F9A-9D2C-7E1B5A0C8F62", true},
+		{"", false},
+		{"not-a-uuid", false},
+		{"3f2a8c1d6b4e4f9a9d2c7e1b5a0c8f62", false},
+		{"{3f2a8c1d-6b4e-4f9a-9d2c-7e1b5a0c8f62}", false},
+		{"urn:uuid:3f2a8c1d-6b4e-4f9a-9d2c-7e1b5a0c8f62", false},
+	}
+	for _, tt := range tests {
+		if got := isUUID(tt.id); got != tt.want {
+			t.Errorf("isUUID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Event that makes a webhook a delivery channel for its owner's incoming messages, e.g. for a bot:
+// every message sent to them, content included. Nothing is POSTed until the owner verified the URL.
+const incomingWebhookEvent = "message.incoming"
+
+// Event of the challenge POSTed by POST /webhooks/:id/verify
+const verifyWebhookEvent = "webhook.verify"
+
+// Receipt channel marking a message delivered through a recipient's webhook
+const webhookReceiptVia = "webhook"
+
+// WebhookChallenge is the body of a verification request, and what the endpoint must answer with
+type WebhookChallenge struct {
+	Event     string `json:"event,omitempty"`
+	WebhookID string `json:"webhook_id,omitempty"`
+	Challenge string `json:"challenge"`
+}
+
+//! Handles proving that the caller controls one of their webhook URLs: a signed challenge is POSTed
+// to it, and the endpoint must answer 2xx with {"challenge": ...} echoing it. Needed before
+// message.incoming deliveries; verifying again (after fixing the endpoint, say) is allowed.
+func verifyWebhook(c echo.Context) error {
+	reqCtx := c.Request().Context()
+	d := webhookDelivery{WebhookID: c.Param("id"), Event: verifyWebhookEvent, DeliveryID: uuid.New().String()}
+	err := pool.QueryRow(reqCtx, "SELECT url, secret FROM webhooks WHERE webhook_id = $1 AND owner_id = $2",
+		d.WebhookID, authUserID(c)).Scan(&d.URL, &d.Secret)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(404, map[string]string{"error": "Webhook not found"})
+	}
+	if err != nil {
+		logFor(c).Error("Failed to load webhook", "error", err, "webhook_id", d.WebhookID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to verify webhook"})
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		logFor(c).Error("Failed to generate webhook challenge", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to verify webhook"})
+	}
+	challenge := hex.EncodeToString(nonce)
+	if d.Body, err = json.Marshal(WebhookChallenge{Event: verifyWebhookEvent, WebhookID: d.WebhookID, Challenge: challenge}); err != nil {
+		logFor(c).Error("Failed to encode webhook challenge", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to verify webhook"})
+	}
+
+	answer, err := exchangeWebhook(reqCtx, d)
+	if err != nil {
+		logFor(c).Info("Webhook verification failed", "error", err, "webhook_id", d.WebhookID)
+		return c.JSON(400, map[string]string{"error": "Webhook verification failed: " + err.Error()})
+	}
+	var echoed WebhookChallenge
+	if json.Unmarshal(answer, &echoed) != nil || subtle.ConstantTimeCompare([]byte(echoed.Challenge), []byte(challenge)) != 1 {
+		return c.JSON(400, map[string]string{"error": "Webhook did not answer with the challenge"})
+	}
+
+	var verifiedAt time.Time
+	err = pool.QueryRow(reqCtx, "UPDATE webhooks SET verified_at = now() WHERE webhook_id = $1 RETURNING verified_at",
+		d.WebhookID).Scan(&verifiedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.JSON(404, map[string]string{"error": "Webhook not found"}) // deleted meanwhile
+	}
+	if err != nil {
+		logFor(c).Error("Failed to mark webhook verified", "error", err, "webhook_id", d.WebhookID)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to verify webhook"})
+	}
+
+	logFor(c).Info("Webhook verified", "webhook_id", d.WebhookID)
+	return c.JSON(200, map[string]interface{}{"webhook_id": d.WebhookID, "verified_at": verifiedAt})
+}
+
+//! Records a message a recipient's webhook accepted and tells the sender, with a receipt
+// marked as delivered through a webhook. Best-effort: the endpoint already has the message.
+func recordWebhookDelivery(d webhookDelivery, attempts int64) {
+	opCtx, cancel := operationContext()
+	defer cancel()
+
+	_, err := pool.Exec(opCtx, `
+		INSERT INTO webhook_message_deliveries (message_id, webhook_id, user_id, delivery_id, attempts)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (message_id, webhook_id) DO NOTHING`,
+		d.MessageID, d.WebhookID, d.OwnerID, d.DeliveryID, attempts)
+	if err != nil {
+		slog.Error("Failed to record webhook delivery", "error", err, "webhook_id", d.WebhookID, "message_id", d.MessageID)
+	}
+	publishReceiptVia(context.Background(), d.SenderID, d.MessageID, "delivered", webhookReceiptVia, d.OwnerID)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//! Starts a test endpoint for verification: /echo answers with the challenge it was sent,
+// /wrong with another one, /fail with a 500
+func challengeReceiver(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Signature") != webhookSignature("s3cret", body) || r.Header.Get("X-Webhook-Event") != verifyWebhookEvent {
+			w.WriteHeader(401)
+			return
+		}
+		var challenge WebhookChallenge
+		json.Unmarshal(body, &challenge)
+		json.NewEncoder(w).Encode(map[string]string{"challenge": challenge.Challenge})
+	})
+	mux.HandleFunc("/wrong", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"challenge": "guessed"}`))
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(500) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	srv := challengeReceiver(t)
+	allowLoopbackWebhooks(t, srv)
+	verifiedAt := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		path       string // of the registered URL; empty when alice has no such webhook
+		wantStatus int
+	}{
+		{"challenge echoed", "/echo", 200},
+		{"wrong challenge", "/wrong", 400},
+		{"endpoint fails", "/fail", 400},
+		{"not the caller's webhook", "", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakePG(t)
+			var rows [][]interface{}
+			if tt.path != "" {
+				rows = [][]interface{}{{srv.URL + tt.path, "s3cret"}}
+			}
+			f.on("UPDATE webhooks SET verified_at", pgRule{Rows: [][]interface{}{{verifiedAt}}})
+			f.on("FROM webhooks WHERE webhook_id", pgRule{Rows: rows, Cols: 2})
+
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/webhooks/w1/verify", nil), rec)
+			c.SetParamNames("id")
+			c.SetParamValues("w1")
+			c.Set(authUserKey, "alice")
+			if err := verifyWebhook(c); err != nil {
+				t.Fatalf("verifyWebhook() = %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if got := len(f.queriesContaining("UPDATE webhooks SET verified_at")); (got == 1) != (tt.wantStatus == 200) {
+				t.Errorf("%d verification updates, want one only on success", got)
+			}
+			// Only the owner's webhook is looked up
+			if lookups := f.queriesContaining("FROM webhooks WHERE webhook_id"); len(lookups) != 1 || !strings.Contains(lookups[0], "'alice'") {
+				t.Errorf("lookups = %q, want one scoped to alice", lookups)
+			}
+		})
+	}
+}
+
+func TestIncomingWebhookDelivery(t *testing.T) {
+	srv, received := webhookReceiver(t, 200)
+	allowLoopbackWebhooks(t, srv)
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("INSERT INTO webhook_message_deliveries", pgRule{Tag: "INSERT 0 1"})
+
+	d := testDelivery(srv.URL + "/hook")
+	d.Event, d.MessageID, d.SenderID, d.OwnerID = incomingWebhookEvent, "m1", "alice", "bot"
+	deliverWebhook(d, 2)
+	<-received
+
+	// The accepted delivery is recorded, and the sender hears the message went through bot's webhook
+	inserts := f.queriesContaining("INSERT INTO webhook_message_deliveries")
+	if len(inserts) != 1 || !strings.Contains(inserts[0], "'bot'") {
+		t.Errorf("inserts = %q, want one for bot", inserts)
+	}
+	receipts := r.publishedOn(receiptChannelPrefix + "alice")
+	if len(receipts) != 1 {
+		t.Fatalf("%d receipts, want 1", len(receipts))
+	}
+	var receipt receiptEvent
+	if err := json.Unmarshal([]byte(receipts[0]), &receipt); err != nil {
+		t.Fatalf("decoding receipt %q: %v", receipts[0], err)
+	}
+	if receipt.MessageID != "m1" || receipt.Status != "delivered" || receipt.Via != webhookReceiptVia || receipt.UserID != "bot" {
+		t.Errorf("receipt = %+v, want m1 delivered via webhook to bot", receipt)
+	}
+
+	// Other events are not deliveries of the message
+	d.Event = "message.read"
+	deliverWebhook(d, 1)
+	<-received
+	if n := len(f.queriesContaining("INSERT INTO webhook_message_deliveries")); n != 1 {
+		t.Errorf("%d deliveries recorded after a message.read event, want still 1", n)
+	}
+}
+
+func TestIncomingWebhooksLookup(t *testing.T) {
+	f := useFakePG(t)
+	f.on("FROM messages WHERE message_id", pgRule{Rows: [][]interface{}{{"alice", "bot", "", "hello bot", time.Now()}}})
+	f.on("FROM webhooks", pgRule{Rows: [][]interface{}{}, Cols: 4})
+
+	dispatchWebhookEvent(webhookEvent{Event: incomingWebhookEvent, MessageID: "m1", At: time.Now()})
+	lookups := f.queriesContaining("FROM webhooks")
+	if len(lookups) != 1 {
+		t.Fatalf("%d webhook lookups, want 1", len(lookups))
+	}
+	// Recipients only (never the sender), and only verified webhooks
+	for _, want := range []string{"owner_id <>  'alice'", "verified_at IS NOT NULL"} {
+		if !strings.Contains(lookups[0], want) {
+			t.Errorf("lookup lacks %q: %s", want, lookups[0])
+		}
+	}
+}
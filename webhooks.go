@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Events a webhook can subscribe to
+var webhookEventTypes = map[string]bool{
+	"message.sent":       true, // stored by the worker
+	"message.delivered":  true,
+	"message.read":       true,
+	incomingWebhookEvent: true, // messages to the owner, as a delivery channel (see webhookchannel.go)
+}
+
+// Webhook delivery, configured with WEBHOOK_TIMEOUT and WEBHOOK_MAX_ATTEMPTS.
+// Failed attempts are retried after 1s, 2s, 4s, ... (capped at webhookMaxDelay);
+// after the last one the delivery goes to webhook_dead_letters.
+var (
+	webhookTimeout     = 5 * time.Second
+	webhookMaxAttempts = int64(6)
+)
+
+const (
+	webhookBaseDelay   = time.Second
+	webhookMaxDelay    = 5 * time.Minute
+	webhookQueueSize   = 1000 // events waiting for a dispatcher; further events are dropped
+	webhookDispatchers = 4
+
+	// How often the dispatchers check whether any webhook is registered at all
+	webhookRefreshInterval = 10 * time.Second
+)
+
+var errWebhookAddress = errors.New("webhook url must not point to a loopback, private or link-local address")
+
+// Client for webhook deliveries. Every connection is checked against disallowedWebhookIP after
+// DNS resolution, so a hostname re-pointed at an internal address after registration is still
+// refused. Redirects are not followed: the 3xx answer counts as a failed attempt. No proxy,
+// so the address checked is the one actually connected to. Each attempt is bounded by webhookTimeout.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || disallowedWebhookIP(ip) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Whether any webhook is registered, refreshed every webhookRefreshInterval.
+// While it is false, events are not queued and no message is looked up for them.
+var webhooksRegistered atomic.Bool
+
+// Webhook is a registered endpoint. Secret is only returned when the webhook is created.
+type Webhook struct {
+	WebhookID  string     `json:"webhook_id"`
+	URL        string     `json:"url"`
+	Events     []string   `json:"events"`
+	Secret     string     `json:"secret,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	VerifiedAt *time.Time `json:"verified_at"` // null until POST /webhooks/:id/verify succeeds
+}
+
+// Request body for POST /webhooks
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// WebhookPayload is the JSON body POSTed to a webhook
+type WebhookPayload struct {
+	DeliveryID string         `json:"delivery_id"` // the same on every retry, so receivers can drop duplicates
+	Event      string         `json:"event"`
+	OccurredAt string         `json:"occurred_at"` // RFC3339
+	Message    WebhookMessage `json:"message"`
+}
+
+// WebhookMessage is the message a webhook event is about
+type WebhookMessage struct {
+	MessageID      string `json:"message_id"`
+	SenderID       string `json:"sender_id"`
+	ReceiverID     string `json:"receiver_id"`       // empty for group messages
+	ConversationID string `json:"conversation_id"`   // empty for 1-to-1 messages
+	Status         string `json:"status"`            // the status the event is about
+	Content        string `json:"content,omitempty"` // message.sent and message.incoming only
+	Timestamp      string `json:"timestamp"`
+}
+
+// webhookEvent is an event waiting for its webhooks to be looked up
+type webhookEvent struct {
+	Event     string
+	MessageID string
+	At        time.Time
+}
+
+// webhookDelivery is one event for one webhook, kept across retries
+type webhookDelivery struct {
+	WebhookID  string
+	OwnerID    string
+	URL        string
+	Secret     string
+	Event      string
+	DeliveryID string
+	MessageID  string
+	SenderID   string // of the message, who gets the receipt for a message.incoming delivery
+	Body       []byte
+}
+
+var webhookEvents = make(chan webhookEvent, webhookQueueSize)
+
+// Deliveries in progress, including those waiting for their next attempt; stopWebhookDispatchers waits for them
+var webhookDeliveries sync.WaitGroup
+
+// The running dispatchers; stopWebhookDispatchers waits for them too
+var webhookDispatching sync.WaitGroup
+
+// Closed by stopWebhookDispatchers: waiting retries make their next attempt right away
+var webhooksStopping = make(chan struct{})
+
+//! Handles registering a webhook for the caller's messages
+func createWebhook(c echo.Context) error {
+	var req webhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(400, map[string]string{"error": "Invalid input"})
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.JSON(400, map[string]string{"error": "url must be an absolute http or https URL"})
+	}
+
+	// The server will POST to this URL, so it must not reach anything internal
+	if err := checkWebhookHost(c.Request().Context(), u.Hostname()); err != nil {
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+	if len(req.Events) == 0 {
+		return c.JSON(400, map[string]string{"error": "events is required"})
+	}
+	for _, event := range req.Events {
+		if !webhookEventTypes[event] {
+			return c.JSON(400, map[string]string{"error": fmt.Sprintf("unknown event %q: want message.sent, message.delivered, message.read or message.incoming", event)})
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logFor(c).Error("Failed to generate webhook secret", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to create webhook"})
+	}
+
+	hook := Webhook{
+		WebhookID: uuid.New().String(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    hex.EncodeToString(secret),
+	}
+	err = pool.QueryRow(c.Request().Context(), `
+		INSERT INTO webhooks (webhook_id, owner_id, url, events, secret) VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`,
+		hook.WebhookID, authUserID(c), hook.URL, hook.Events, hook.Secret).Scan(&hook.CreatedAt)
+	if err != nil {
+		logFor(c).Error("Failed to create webhook", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to create webhook"})
+	}
+
+	webhooksRegistered.Store(true) // other replicas notice on their next refresh
+	logFor(c).Info("Webhook created", "webhook_id", hook.WebhookID, "events", hook.Events)
+	return c.JSON(201, hook)
+}
+
+//! Resolves a webhook host and rejects it if any of its addresses is loopback, private or link-local
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host %q", host)
+	}
+	for _, addr := range addrs {
+		if disallowedWebhookIP(addr.IP) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+//! Reports whether a webhook must not be delivered to ip: loopback, private (RFC 1918 / RFC 4193),
+// link-local (including the 169.254.169.254 metadata address), unspecified or multicast
+func disallowedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast()
+}
+
+//! Handles listing the caller's webhooks (without their secrets)
+func listWebhooks(c echo.Context) error {
+	rows, err := pool.Query(c.Request().Context(), `
+		SELECT webhook_id, url, events, created_at, verified_at FROM webhooks
+		WHERE owner_id = $1
+		ORDER BY created_at, webhook_id`, authUserID(c))
+	if err != nil {
+		logFor(c).Error("Failed to list webhooks", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to list webhooks"})
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.WebhookID, &hook.URL, &hook.Events, &hook.CreatedAt, &hook.VerifiedAt); err != nil {
+			logFor(c).Error("Failed to scan row", "error", err)
+			return c.JSON(500, map[string]string{"error": "Failed to list webhooks"})
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		logFor(c).Error("Rows iteration error", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to list webhooks"})
+	}
+
+	return c.JSON(200, hooks)
+}
+
+//! Handles removing one of the caller's webhooks
+func deleteWebhook(c echo.Context) error {
+	result, err := pool.Exec(c.Request().Context(),
+		"DELETE FROM webhooks WHERE webhook_id = $1 AND owner_id = $2", c.Param("id"), authUserID(c))
+	if err != nil {
+		logFor(c).Error("Failed to delete webhook", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to delete webhook"})
+	}
+	if result.RowsAffected() == 0 {
+		return c.JSON(404, map[string]string{"error": "Webhook not found"})
+	}
+	return c.JSON(200, map[string]string{"status": "Webhook deleted"})
+}
+
+//! Queues a webhook event for a message without blocking the caller; a no-op when no webhook is registered.
+// Best-effort like the pub/sub events: when the queue is full the event is dropped, logged and counted.
+func emitWebhookEvent(event, messageID string) {
+	if !webhooksRegistered.Load() {
+		return
+	}
+	select {
+	case webhookEvents <- webhookEvent{Event: event, MessageID: messageID, At: time.Now()}:
+	default:
+		webhookEventsDropped.Inc()
+		slog.Warn("Webhook queue full, dropping event", "event", event, "message_id", messageID)
+	}
+}
+
+//! Updates webhooksRegistered from the webhooks table. On error it is left as it was.
+func refreshWebhooksRegistered() {
+	opCtx, cancel := operationContext()
+	defer cancel()
+
+	var exists bool
+	if err := pool.QueryRow(opCtx, "SELECT EXISTS (SELECT 1 FROM webhooks)").Scan(&exists); err != nil {
+		slog.Error("Failed to check for registered webhooks", "error", err)
+		return
+	}
+	webhooksRegistered.Store(exists)
+}
+
+//! Starts the goroutines that look up the webhooks for each queued event and deliver it.
+// They run for the life of the process: the HTTP handlers emit events too, not just the workers.
+func startWebhookDispatchers() {
+	// Assume there are webhooks until the first check says otherwise, so no event is missed
+	webhooksRegistered.Store(true)
+	go func() {
+		for {
+			refreshWebhooksRegistered()
+			time.Sleep(webhookRefreshInterval)
+		}
+	}()
+
+	for i := 0; i < webhookDispatchers; i++ {
+		webhookDispatching.Add(1)
+		go func() {
+			defer webhookDispatching.Done()
+			for {
+				select {
+				case event := <-webhookEvents:
+					dispatchWebhookEvent(event)
+				case <-webhooksStopping:
+					// Dispatch what is already queued, then exit
+					for {
+						select {
+						case event := <-webhookEvents:
+							dispatchWebhookEvent(event)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+}
+
+//! Drains webhook delivery on shutdown, once nothing emits events any more: dispatches the queued
+// events and waits for every delivery. Retries waiting for their backoff are attempted right away;
+// one that fails again is dead-lettered instead of waiting, so no delivery is lost.
+// Gives up when ctx ends.
+func stopWebhookDispatchers(ctx context.Context) {
+	close(webhooksStopping)
+	done := make(chan struct{})
+	go func() {
+		webhookDispatching.Wait() // no new deliveries after this
+		webhookDeliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("Webhook deliveries drained")
+	case <-ctx.Done():
+		slog.Error("Webhook deliveries still running at shutdown", "error", ctx.Err())
+	}
+}
+
+//! Reports whether stopWebhookDispatchers has been called
+func webhooksShuttingDown() bool {
+	select {
+	case <-webhooksStopping:
+		return true
+	default:
+		return false
+	}
+}
+
+//! Runs a delivery in the background, tracked in webhookDeliveries
+func goDeliverWebhook(d webhookDelivery, attempt int64) {
+	webhookDeliveries.Add(1)
+	go func() {
+		defer webhookDeliveries.Done()
+		deliverWebhook(d, attempt)
+	}()
+}
+
+//! Sends one event to every webhook subscribed to it whose owner is a participant
+// of the message: its sender, its receiver, or a member of its group.
+// message.incoming only goes to the recipients' webhooks, and only to verified ones.
+func dispatchWebhookEvent(event webhookEvent) {
+	opCtx, cancel := operationContext()
+	defer cancel()
+
+	msg := WebhookMessage{MessageID: event.MessageID, Status: webhookStatus(event.Event)}
+	var content string
+	var sentAt time.Time
+	err := pool.QueryRow(opCtx, `
+		SELECT sender_id, receiver_id, COALESCE(conversation_id, ''), content, timestamp
+		FROM messages WHERE message_id = $1`, event.MessageID).
+		Scan(&msg.SenderID, &msg.ReceiverID, &msg.ConversationID, &content, &sentAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return // deleted in the meantime
+	}
+	if err != nil {
+		slog.Error("Failed to load message for webhooks", "error", err, "message_id", event.MessageID)
+		return
+	}
+	msg.Timestamp = sentAt.UTC().Format(time.RFC3339Nano)
+	if event.Event == "message.sent" || event.Event == incomingWebhookEvent {
+		msg.Content = content
+	}
+
+	rows, err := pool.Query(opCtx, `
+		SELECT webhook_id, owner_id, url, secret FROM webhooks
+		WHERE $1 = ANY(events)
+			AND (owner_id = $2 OR owner_id = $3
+				OR owner_id IN (SELECT user_id FROM conversation_members WHERE conversation_id = $4))
+			AND ($1 <> '`+incomingWebhookEvent+`' OR (owner_id <> $2 AND verified_at IS NOT NULL))`,
+		event.Event, msg.SenderID, msg.ReceiverID, msg.ConversationID)
+	if err != nil {
+		slog.Error("Failed to look up webhooks", "error", err, "message_id", event.MessageID)
+		return
+	}
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.WebhookID, &d.OwnerID, &d.URL, &d.Secret); err != nil {
+			rows.Close()
+			slog.Error("Failed to scan webhook", "error", err)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to look up webhooks", "error", err, "message_id", event.MessageID)
+		return
+	}
+
+	for _, d := range deliveries {
+		d.Event = event.Event
+		d.DeliveryID = uuid.New().String()
+		d.MessageID, d.SenderID = event.MessageID, msg.SenderID
+		d.Body, err = json.Marshal(WebhookPayload{
+			DeliveryID: d.DeliveryID,
+			Event:      event.Event,
+			OccurredAt: event.At.UTC().Format(time.RFC3339Nano),
+			Message:    msg,
+		})
+		if err != nil {
+			slog.Error("Failed to encode webhook payload", "error", err, "webhook_id", d.WebhookID)
+			continue
+		}
+		goDeliverWebhook(d, 1)
+	}
+}
+
+//! Returns the message status a webhook event reports ("message.read" -> "read")
+func webhookStatus(event string) string {
+	switch event {
+	case "message.delivered":
+		return "delivered"
+	case "message.read":
+		return "read"
+	}
+	return initialStatus
+}
+
+//! Makes one delivery attempt; on failure schedules the next one with backoff,
+// or dead-letters the delivery once webhookMaxAttempts is reached or on shutdown.
+func deliverWebhook(d webhookDelivery, attempt int64) {
+	err := postWebhook(d)
+	if err == nil {
+		if d.Event == incomingWebhookEvent {
+			recordWebhookDelivery(d, attempt)
+		}
+		return
+	}
+
+	if attempt >= webhookMaxAttempts || webhooksShuttingDown() {
+		slog.Error("Webhook delivery failed, dead-lettering", "error", err, "webhook_id", d.WebhookID, "delivery_id", d.DeliveryID, "attempts", attempt)
+		deadLetterWebhook(d, attempt, err)
+		return
+	}
+
+	delay := min(webhookBaseDelay<<(attempt-1), webhookMaxDelay)
+	slog.Warn("Webhook delivery failed, retrying", "error", err, "webhook_id", d.WebhookID, "delivery_id", d.DeliveryID, "attempt", attempt, "delay", delay.String())
+	webhookDeliveries.Add(1)
+	go func() {
+		defer webhookDeliveries.Done()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-webhooksStopping: // shutting down: try once more now
+		}
+		deliverWebhook(d, attempt+1)
+	}()
+}
+
+//! POSTs a delivery, signed with the webhook's secret. Anything but a 2xx answer is an error.
+func postWebhook(d webhookDelivery) error {
+	_, err := exchangeWebhook(ctx, d)
+	return err
+}
+
+//! POSTs a delivery like postWebhook and returns the start (up to 64 KiB) of the endpoint's answer
+func exchangeWebhook(parent context.Context, d webhookDelivery) ([]byte, error) {
+	reqCtx, cancel := context.WithTimeout(parent, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", webhookSignature(d.Secret, d.Body))
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.DeliveryID)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)) // reading it lets the connection be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return answer, nil
+}
+
+//! Returns the X-Signature header for a body: "sha256=" + hex HMAC-SHA256 keyed with the secret
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//! Records a delivery that kept failing, so it can be inspected or replayed by hand
+func deadLetterWebhook(d webhookDelivery, attempts int64, lastErr error) {
+	opCtx, cancel := operationContext()
+	defer cancel()
+
+	_, err := pool.Exec(opCtx, `
+		INSERT INTO webhook_dead_letters (webhook_id, delivery_id, event, payload, attempts, last_error)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		d.WebhookID, d.DeliveryID, d.Event, string(d.Body), attempts, lastErr.Error())
+	if err != nil {
+		slog.Error("Failed to dead-letter webhook delivery", "error", err, "webhook_id", d.WebhookID, "delivery_id", d.DeliveryID)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	secret := "5e3c9f0a"
+	body := []byte(`{"delivery_id":"d1","event":"message.sent"}`)
+
+	sig := webhookSignature(secret, body)
+
+	// What a receiver does: recompute the HMAC of the raw body and compare in constant time
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		t.Errorf("webhookSignature() = %q, want %q", sig, want)
+	}
+
+	if webhookSignature("other-secret", body) == sig {
+		t.Error("a different secret gave the same signature")
+	}
+	if webhookSignature(secret, append(body, ' ')) == sig {
+		t.Error("a different body gave the same signature")
+	}
+}
+
+// A webhook request as the test server received it
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+//! Starts a test receiver answering status, recording each request on the returned channel.
+// /redirect answers 302 to /landed, which records a request too.
+func webhookReceiver(t *testing.T, status int) (*httptest.Server, chan receivedWebhook) {
+	t.Helper()
+	received := make(chan receivedWebhook, 10)
+	mux := http.NewServeMux()
+	record := func(w http.ResponseWriter, r *http.Request, status int) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedWebhook{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) { record(w, r, status) })
+	mux.HandleFunc("/landed", func(w http.ResponseWriter, r *http.Request) { record(w, r, 200) })
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/landed", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+//! Lets deliveries reach the loopback test server for the rest of the test, keeping the
+// production client's redirect policy
+func allowLoopbackWebhooks(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	old := webhookClient
+	t.Cleanup(func() { webhookClient = old })
+	webhookClient = &http.Client{Transport: srv.Client().Transport, CheckRedirect: old.CheckRedirect}
+}
+
+func testDelivery(url string) webhookDelivery {
+	return webhookDelivery{
+		WebhookID:  "w1",
+		URL:        url,
+		Secret:     "s3cret",
+		Event:      "message.read",
+		DeliveryID: "d1",
+		Body:       []byte(`{"delivery_id":"d1","event":"message.read"}`),
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	srv, received := webhookReceiver(t, 204)
+	allowLoopbackWebhooks(t, srv)
+
+	d := testDelivery(srv.URL + "/hook")
+	if err := postWebhook(d); err != nil {
+		t.Fatalf("postWebhook() = %v, want nil", err)
+	}
+
+	got := <-received
+	if string(got.body) != string(d.Body) {
+		t.Errorf("body = %s, want %s", got.body, d.Body)
+	}
+	if sig := got.header.Get("X-Signature"); sig != webhookSignature(d.Secret, got.body) {
+		t.Errorf("X-Signature = %q does not match the received body", sig)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":       "application/json",
+		"X-Webhook-Event":    "message.read",
+		"X-Webhook-Delivery": "d1",
+	} {
+		if v := got.header.Get(header); v != want {
+			t.Errorf("%s = %q, want %q", header, v, want)
+		}
+	}
+}
+
+func TestPostWebhookFailures(t *testing.T) {
+	t.Run("non-2xx answer", func(t *testing.T) {
+		srv, received := webhookReceiver(t, 500)
+		allowLoopbackWebhooks(t, srv)
+		if err := postWebhook(testDelivery(srv.URL + "/hook")); err == nil {
+			t.Error("postWebhook() = nil for a 500 answer, want an error")
+		}
+		<-received
+	})
+
+	t.Run("redirect is not followed", func(t *testing.T) {
+		srv, received := webhookReceiver(t, 200)
+		allowLoopbackWebhooks(t, srv)
+		if err := postWebhook(testDelivery(srv.URL + "/redirect")); err == nil {
+			t.Error("postWebhook() = nil for a 302 answer, want an error")
+		}
+		select {
+		case <-received:
+			t.Error("the redirect target was called")
+		default:
+		}
+	})
+
+	t.Run("loopback address", func(t *testing.T) {
+		// The production client refuses to connect, even though the server is up
+		srv, received := webhookReceiver(t, 200)
+		err := postWebhook(testDelivery(srv.URL + "/hook"))
+		if !errors.Is(err, errWebhookAddress) {
+			t.Errorf("postWebhook() = %v, want %v", err, errWebhookAddress)
+		}
+		select {
+		case <-received:
+			t.Error("the loopback server was called")
+		default:
+		}
+	})
+}
+
+func TestDisallowedWebhookIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.10", true},
+		{"fd00::1", true},
+		{"169.254.169.254", true}, // cloud metadata
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := disallowedWebhookIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("disallowedWebhookIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWebhookHost(t *testing.T) {
+	// IP literals resolve without DNS
+	for _, host := range []string{"127.0.0.1", "10.0.0.5", "169.254.169.254", "::1"} {
+		if err := checkWebhookHost(t.Context(), host); !errors.Is(err, errWebhookAddress) {
+			t.Errorf("checkWebhookHost(%q) = %v, want %v", host, err, errWebhookAddress)
+		}
+	}
+	if err := checkWebhookHost(t.Context(), "93.184.215.14"); err != nil {
+		t.Errorf("checkWebhookHost(public address) = %v, want nil", err)
+	}
+	if err := checkWebhookHost(t.Context(), "no-such-host.invalid"); err == nil {
+		t.Error("checkWebhookHost(unresolvable host) = nil, want an error")
+	}
+}
+
+func TestEmitWebhookEvent(t *testing.T) {
+	defer webhooksRegistered.Store(webhooksRegistered.Load())
+	drain := func() {
+		for len(webhookEvents) > 0 {
+			<-webhookEvents
+		}
+	}
+	drain()
+	defer drain()
+
+	// Without webhooks nothing is queued
+	webhooksRegistered.Store(false)
+	emitWebhookEvent("message.sent", "m1")
+	if n := len(webhookEvents); n != 0 {
+		t.Fatalf("%d events queued without webhooks, want 0", n)
+	}
+
+	webhooksRegistered.Store(true)
+	emitWebhookEvent("message.sent", "m1")
+	if n := len(webhookEvents); n != 1 {
+		t.Fatalf("%d events queued, want 1", n)
+	}
+
+	// A full queue drops the event and counts it
+	for len(webhookEvents) < cap(webhookEvents) {
+		webhookEvents <- webhookEvent{Event: "message.sent", MessageID: "filler"}
+	}
+	before := testutil.ToFloat64(webhookEventsDropped)
+	emitWebhookEvent("message.read", "m2")
+	if dropped := testutil.ToFloat64(webhookEventsDropped) - before; dropped != 1 {
+		t.Errorf("webhook_events_dropped_total grew by %v, want 1", dropped)
+	}
+}
+
+func TestStopWebhookDispatchersDrainsRetries(t *testing.T) {
+	srv, received := webhookReceiver(t, 500)
+	allowLoopbackWebhooks(t, srv)
+	f := useFakePG(t)
+	f.on("INSERT INTO webhook_dead_letters", pgRule{Tag: "INSERT 0 1"})
+	old := webhooksStopping
+	webhooksStopping = make(chan struct{})
+	t.Cleanup(func() { webhooksStopping = old })
+
+	// The first attempt fails and the retry waits for its backoff
+	deliverWebhook(testDelivery(srv.URL+"/hook"), 1)
+	<-received
+
+	// Shutdown retries it right away and dead-letters it when that fails too, instead of dropping it
+	start := time.Now()
+	stopCtx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	stopWebhookDispatchers(stopCtx)
+	if elapsed := time.Since(start); elapsed >= webhookBaseDelay {
+		t.Errorf("shutdown took %v, want the retry made without waiting out its %v backoff", elapsed, webhookBaseDelay)
+	}
+	select {
+	case <-received:
+	default:
+		t.Error("the retry was not attempted before shutdown finished")
+	}
+	letters := f.queriesContaining("INSERT INTO webhook_dead_letters")
+	if len(letters) != 1 || !strings.Contains(letters[0], " '2'") {
+		t.Errorf("dead letters = %q, want one after 2 attempts", letters)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// workerManager runs the background goroutines: the stream workers, the scheduler and the
+// expiry sweeper. Each run gets a fresh quit channel, so they can be stopped and started
+// again any number of times; Start and Stop are no-ops when already running or stopped.
+type workerManager struct {
+	mu      sync.Mutex                    // serializes Start, Stop and Restart
+	quit    atomic.Pointer[chan struct{}] // the current run's quit channel, closed by Stop
+	wg      sync.WaitGroup                // the current run's goroutines
+	running bool
+	prepare func() error // runs before each start; an error aborts the start
+	jobs    []func()     // the goroutines of each run
+}
+
+// The process-wide manager, created in main
+var workers *workerManager
+
+// consumerRegistry holds the consumer names of this process's running stream workers
+type consumerRegistry struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// Consumers of this replica, reported by GET /admin/workers
+var runningConsumers = &consumerRegistry{names: map[string]bool{}}
+
+//! Records that a stream worker is reading as name
+func (r *consumerRegistry) add(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names[name] = true
+}
+
+//! Records that the stream worker reading as name has exited
+func (r *consumerRegistry) remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.names, name)
+}
+
+//! Returns the running consumers' names, sorted
+func (r *consumerRegistry) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// backlogDrain tracks the startup backlog drain of the current run
+type backlogDrain struct {
+	mu        sync.Mutex
+	started   bool  // the run started with at least drainThreshold entries undelivered
+	backlog   int64 // undelivered entries when the run started
+	processed int64 // entries read in drain batches so far
+	active    int   // workers still reading drain batches
+	draining  bool  // workers may still join the drain
+}
+
+// The current run's drain, reset by each start
+var drain = &backlogDrain{}
+
+//! Starts a drain if backlog reaches drainThreshold, replacing the previous run's
+func (d *backlogDrain) begin(backlog int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = backlog >= drainThreshold
+	d.backlog, d.processed, d.active = backlog, 0, 0
+	d.draining = d.started
+	if d.started {
+		slog.Info("Backlog found, draining", "backlog", backlog, "batch_size", drainBatchSize)
+	}
+}
+
+//! Enlists a worker in the drain. Returns false once there is nothing (left) to drain.
+func (d *backlogDrain) join() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		return false
+	}
+	d.active++
+	return true
+}
+
+//! Counts entries read in a drain batch
+func (d *backlogDrain) add(read int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.processed += read
+	slog.Info("Draining backlog", "processed", d.processed, "backlog", d.backlog, "consumers", d.active)
+}
+
+//! Takes a worker out of the drain, after a short batch or when it stops.
+// The drain is over once one worker has caught up, or every worker has left.
+func (d *backlogDrain) leave(caughtUp bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active--
+	if caughtUp && d.draining {
+		d.draining = false // the others leave after their current batch
+		slog.Info("Backlog drained, back to steady state", "processed", d.processed)
+	}
+	if d.active == 0 {
+		d.draining = false // also when stopped before catching up; the next start measures again
+	}
+}
+
+//! Returns the drain's progress, or nil if the run started without a backlog
+func (d *backlogDrain) status() *DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.started {
+		return nil
+	}
+	return &DrainStatus{Draining: d.active > 0, Backlog: d.backlog, Processed: d.processed, Consumers: d.active}
+}
+
+// WorkerStatus is the body of GET /admin/workers
+type WorkerStatus struct {
+	Running        bool            `json:"running"`
+	Consumers      []string        `json:"consumers"`       // this replica's running stream workers
+	GroupConsumers []GroupConsumer `json:"group_consumers"` // every consumer in message_group, across replicas (XINFO CONSUMERS)
+	Drain          *DrainStatus    `json:"drain"`           // null when the run started without a backlog
+}
+
+// DrainStatus is the startup backlog drain in GET /admin/workers
+type DrainStatus struct {
+	Draining  bool  `json:"draining"`
+	Backlog   int64 `json:"backlog"`   // undelivered entries when the run started
+	Processed int64 `json:"processed"` // entries read in drain batches so far
+	Consumers int   `json:"consumers"` // workers still reading drain batches
+}
+
+// GroupConsumer is one consumer of message_group in GET /admin/workers
+type GroupConsumer struct {
+	Name        string  `json:"name"`
+	Pending     int64   `json:"pending"`      // entries it read but has not ACKed
+	IdleSeconds float64 `json:"idle_seconds"` // since its last read or claim
+}
+
+//! Creates a stopped manager that runs count stream workers per run, plus the scheduler and the expiry sweeper.
+// When a run starts with a backlog, drainCount more workers help drain it and then exit.
+func newWorkerManager(count, drainCount int) *workerManager {
+	jobs := make([]func(), 0, count+drainCount+2)
+	for i := 1; i <= count+drainCount; i++ {
+		index := i
+		if i <= count {
+			jobs = append(jobs, func() { startWorker(index) })
+		} else {
+			jobs = append(jobs, func() { startDrainWorker(index) })
+		}
+	}
+	jobs = append(jobs, runScheduler, runExpirySweeper)
+	return newManager(prepareStreamWorkers, jobs)
+}
+
+//! Creates the consumer group and measures the backlog the run starts with
+func prepareStreamWorkers() error {
+	if err := createConsumerGroup(); err != nil {
+		return err
+	}
+	drain.begin(groupBacklog())
+	return nil
+}
+
+//! Creates a stopped manager that calls prepare and then runs jobs, each in its own goroutine, on every start
+func newManager(prepare func() error, jobs []func()) *workerManager {
+	m := &workerManager{prepare: prepare, jobs: jobs}
+	quit := make(chan struct{})
+	close(quit) // nothing is running yet
+	m.quit.Store(&quit)
+	return m
+}
+
+//! Creates the stream's consumer group, unless it already exists
+func createConsumerGroup() error {
+	_, err := redisCli.XGroupCreateMkStream(ctx, "message_stream", "message_group", "$").Result()
+	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("create consumer group: %w", err)
+	}
+	return nil
+}
+
+//! Returns the channel that is closed when the current run must stop.
+// Goroutines of a run always see their own run's channel: Stop waits for them all
+// before a later Start can replace it.
+func (m *workerManager) stopping() <-chan struct{} {
+	return *m.quit.Load()
+}
+
+//! Starts a goroutine belonging to the current run
+func (m *workerManager) goRun(fn func()) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done() // lets Stop wait for the current message to finish
+		fn()
+	}()
+}
+
+//! Starts the stream workers, the scheduler and the expiry sweeper.
+// Returns false if they were already running.
+func (m *workerManager) Start() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return false, nil
+	}
+	if err := m.start(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//! Stops every goroutine of the current run and waits for them to exit (each finishes the
+// message it is processing first). Returns false if nothing was running.
+func (m *workerManager) Stop() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return false
+	}
+	m.stop()
+	return true
+}
+
+//! Stops the current run, if any, and starts a new one
+func (m *workerManager) Restart() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		m.stop()
+	}
+	return m.start()
+}
+
+//! Reports whether a run is in progress
+func (m *workerManager) Running() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running
+}
+
+//! Launches a run; m.mu must be held
+func (m *workerManager) start() error {
+	if m.prepare != nil {
+		if err := m.prepare(); err != nil {
+			return err
+		}
+	}
+
+	quit := make(chan struct{})
+	m.quit.Store(&quit)
+	m.running = true
+
+	//! The go keyword starts each worker in a separate goroutine  (like a background thread).
+	//! This allows the server and workers to run concurrently without blocking each other.
+	slog.Info("Starting Redis stream workers", "goroutines", len(m.jobs))
+	for _, job := range m.jobs {
+		m.goRun(job)
+	}
+	return nil
+}
+
+//! Ends the current run and waits for its goroutines; m.mu must be held
+func (m *workerManager) stop() {
+	close(*m.quit.Load())
+	m.wg.Wait()
+	m.running = false
+	slog.Info("Redis stream workers stopped")
+}
+
+//! Handles stopping the workers without stopping the server
+func stopRedisWorker(c echo.Context) error {
+	if !workers.Stop() {
+		return c.JSON(200, map[string]string{"status": "Redis worker already stopped"})
+	}
+	return c.JSON(200, map[string]string{"status": "Redis worker stopped"})
+}
+
+//! Handles starting the workers again after /stop-redis
+func startRedisWorker(c echo.Context) error {
+	started, err := workers.Start()
+	if err != nil {
+		logFor(c).Error("Failed to start Redis worker", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to start Redis worker"})
+	}
+	if !started {
+		return c.JSON(200, map[string]string{"status": "Redis worker already running"})
+	}
+	return c.JSON(200, map[string]string{"status": "Redis worker started"})
+}
+
+//! Handles stopping the workers (if running) and starting them again
+func restartRedisWorker(c echo.Context) error {
+	if err := workers.Restart(); err != nil {
+		logFor(c).Error("Failed to restart Redis worker", "error", err)
+		return c.JSON(500, map[string]string{"error": "Failed to restart Redis worker"})
+	}
+	return c.JSON(200, map[string]string{"status": "Redis worker restarted"})
+}
+
+//! Handles reporting whether the workers run and under which consumer names.
+// Shows this replica's consumers next to every consumer registered in message_group,
+// so operators can tell which replica holds which pending entries.
+func getWorkerStatus(c echo.Context) error {
+	infos, err := redisCli.XInfoConsumers(c.Request().Context(), "message_stream", "message_group").Result()
+	if err != nil {
+		logFor(c).Error("Failed to read consumers", "error", err)
+		if ctxErr := requestDone(c); ctxErr != nil {
+			return ctxErr // let the timeout middleware answer
+		}
+		return c.JSON(500, map[string]string{"error": "Failed to read worker status"})
+	}
+
+	status := WorkerStatus{
+		Running:        workers.Running(),
+		Consumers:      runningConsumers.list(),
+		GroupConsumers: make([]GroupConsumer, len(infos)),
+		Drain:          drain.status(),
+	}
+	for i, info := range infos {
+		status.GroupConsumers[i] = GroupConsumer{Name: info.Name, Pending: info.Pending, IdleSeconds: info.Idle.Seconds()}
+	}
+	return c.JSON(200, status)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//! Returns a manager whose run is n goroutines that wait for the stop signal, counting how many are running
+func blockingManager(n int, prepare func() error) (*workerManager, *atomic.Int32) {
+	var active atomic.Int32
+	var m *workerManager
+	jobs := make([]func(), n)
+	for i := range jobs {
+		jobs[i] = func() {
+			active.Add(1)
+			defer active.Add(-1)
+			<-m.stopping()
+			time.Sleep(time.Millisecond) // Stop must wait for this too
+		}
+	}
+	m = newManager(prepare, jobs)
+	return m, &active
+}
+
+//! Waits until want goroutines of the run are active
+func waitActive(t *testing.T, active *atomic.Int32, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for active.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines active, want %d", active.Load(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerManagerStartStop(t *testing.T) {
+	m, active := blockingManager(3, nil)
+
+	if m.Running() {
+		t.Fatal("new manager is running")
+	}
+	if m.Stop() {
+		t.Error("Stop() on a new manager = true, want false")
+	}
+
+	started, err := m.Start()
+	if err != nil || !started {
+		t.Fatalf("Start() = %v, %v, want true, nil", started, err)
+	}
+	waitActive(t, active, 3)
+
+	// A second start leaves the running goroutines alone
+	started, err = m.Start()
+	if err != nil || started {
+		t.Fatalf("second Start() = %v, %v, want false, nil", started, err)
+	}
+	waitActive(t, active, 3)
+
+	if !m.Stop() {
+		t.Fatal("Stop() = false, want true")
+	}
+	if n := active.Load(); n != 0 {
+		t.Errorf("%d goroutines still active after Stop returned, want 0", n)
+	}
+	if m.Running() {
+		t.Error("Running() = true after Stop")
+	}
+	if m.Stop() {
+		t.Error("second Stop() = true, want false")
+	}
+
+	// Stopped managers can start again, with a fresh stop signal
+	started, err = m.Start()
+	if err != nil || !started {
+		t.Fatalf("Start() after Stop = %v, %v, want true, nil", started, err)
+	}
+	waitActive(t, active, 3)
+	select {
+	case <-m.stopping():
+		t.Error("the new run's stop signal is already closed")
+	default:
+	}
+	m.Stop()
+}
+
+func TestWorkerManagerRestart(t *testing.T) {
+	m, active := blockingManager(2, nil)
+
+	// Restart starts a stopped manager
+	if err := m.Restart(); err != nil {
+		t.Fatalf("Restart() = %v", err)
+	}
+	waitActive(t, active, 2)
+	first := m.stopping()
+
+	if err := m.Restart(); err != nil {
+		t.Fatalf("second Restart() = %v", err)
+	}
+	select {
+	case <-first:
+	default:
+		t.Error("Restart did not stop the previous run")
+	}
+	waitActive(t, active, 2)
+	if !m.Running() {
+		t.Error("Running() = false after Restart")
+	}
+	m.Stop()
+}
+
+func TestWorkerManagerPrepareError(t *testing.T) {
+	errNoRedis := errors.New("connection refused")
+	fail := true
+	m, active := blockingManager(2, func() error {
+		if fail {
+			return errNoRedis
+		}
+		return nil
+	})
+
+	if started, err := m.Start(); !errors.Is(err, errNoRedis) || started {
+		t.Fatalf("Start() = %v, %v, want false, %v", started, err, errNoRedis)
+	}
+	if m.Running() || active.Load() != 0 {
+		t.Fatal("a failed start left the manager running")
+	}
+
+	fail = false
+	if started, err := m.Start(); err != nil || !started {
+		t.Fatalf("Start() once prepare succeeds = %v, %v, want true, nil", started, err)
+	}
+	waitActive(t, active, 2)
+	m.Stop()
+}
+
+//! Starts n stream workers as the process-wide manager; they are stopped when the test ends
+func startStreamWorkers(t *testing.T, n int) {
+	t.Helper()
+	jobs := make([]func(), n)
+	for i := range jobs {
+		index := i + 1
+		jobs[i] = func() { startWorker(index) }
+	}
+	old := workers
+	workers = newManager(createConsumerGroup, jobs)
+	t.Cleanup(func() {
+		workers.Stop()
+		workers = old
+	})
+	if _, err := workers.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+}
+
+//! Waits until the stream entry has been acknowledged
+func waitAcked(t *testing.T, r *fakeRedis, streamID string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(r.acks(), streamID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not acked; acked %v", streamID, r.acks())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkerPoolStoresEachMessageOnce(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 1"})
+	f.on("conversation_mutes", pgRule{Rows: [][]interface{}{}, Cols: 1})
+
+	const poolSize, total = 4, 100
+	startStreamWorkers(t, poolSize)
+
+	for i := range total {
+		values := validStreamEntry()
+		values["message_id"] = fmt.Sprintf("m%03d", i)
+		values["seq"] = strconv.Itoa(i + 1)
+		if err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: values}).Err(); err != nil {
+			t.Fatalf("XADD: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.acks()) < total || len(r.consumers("message_stream", "message_group")) < poolSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d entries acked by consumers %v", len(r.acks()), total, r.consumers("message_stream", "message_group"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	workers.Stop()
+
+	inserts := f.queriesContaining("INSERT INTO messages")
+	for i := range total {
+		id := fmt.Sprintf("m%03d", i)
+		if n := countArg(inserts, id); n != 1 {
+			t.Errorf("%s inserted %d times, want once", id, n)
+		}
+	}
+	acked := map[string]int{}
+	for _, id := range r.acks() {
+		acked[id]++
+	}
+	for _, e := range r.entries("message_stream") {
+		if acked[e.ID] != 1 {
+			t.Errorf("entry %s acked %d times, want once", e.ID, acked[e.ID])
+		}
+	}
+	if pending := r.pending("message_stream", "message_group"); len(pending) != 0 {
+		t.Errorf("entries left pending: %v", pending)
+	}
+	// Every worker joined the group under its own name
+	if got := r.consumers("message_stream", "message_group"); len(got) != poolSize {
+		t.Errorf("consumers = %v, want %d distinct names", got, poolSize)
+	}
+}
+
+//! Counts the recorded prepared executions whose first argument is id
+func countArg(queries []string, id string) int {
+	n := 0
+	for _, q := range queries {
+		if strings.HasSuffix(q, " -- $1 = "+id) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWorkerReclaimsDeadConsumersEntry(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 1"})
+	f.on("conversation_mutes", pgRule{Rows: [][]interface{}{}, Cols: 1})
+	minIdle := claimMinIdle
+	claimMinIdle = 20 * time.Millisecond
+	t.Cleanup(func() { claimMinIdle = minIdle })
+
+	// A consumer reads an entry and dies before storing or ACKing it
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	streamID, err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: validStreamEntry()}).Result()
+	if err != nil {
+		t.Fatalf("XADD: %v", err)
+	}
+	err = redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "message_group", Consumer: "dead-worker-1", Streams: []string{"message_stream", ">"}, Count: 1,
+	}).Err()
+	if err != nil {
+		t.Fatalf("XREADGROUP: %v", err)
+	}
+
+	// Not idle long enough yet: a live consumer leaves it alone
+	old := workers
+	workers = newManager(nil, nil)
+	t.Cleanup(func() { workers = old })
+	reclaimStale("live-worker-1")
+	if got := f.queriesContaining("INSERT INTO messages"); len(got) != 0 {
+		t.Fatalf("an entry pending for less than claimMinIdle was reprocessed")
+	}
+
+	// The new worker claims it on startup and processes it as its own
+	time.Sleep(claimMinIdle)
+	startStreamWorkers(t, 1)
+	waitAcked(t, r, streamID)
+	if got := f.queriesContaining("INSERT INTO messages"); countArg(got, "3f2a8c1d-6b4e-4f9a-9d2c-7e1b5a0c8f62") != 1 {
+		t.Errorf("inserts = %q, want the reclaimed message once", got)
+	}
+	if pending := r.pending("message_stream", "message_group"); len(pending) != 0 {
+		t.Errorf("entries left pending: %v", pending)
+	}
+}
+
+func TestWorkerStatus(t *testing.T) {
+	useFakePG(t)
+	r := useFakeRedis(t)
+
+	// Another replica's worker holds an entry
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: map[string]interface{}{"content": "hi"}}).Err(); err != nil {
+		t.Fatalf("XADD: %v", err)
+	}
+	err := redisCli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "message_group", Consumer: "other-host-worker-1", Streams: []string{"message_stream", ">"}, Count: 1,
+	}).Err()
+	if err != nil {
+		t.Fatalf("XREADGROUP: %v", err)
+	}
+
+	t.Setenv("POD_NAME", "api-0")
+	startStreamWorkers(t, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.consumers("message_stream", "message_group")) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("consumers = %v, want 3", r.consumers("message_stream", "message_group"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var status WorkerStatus
+	if code := callAdmin(t, getWorkerStatus, http.MethodGet, "", &status); code != 200 {
+		t.Fatalf("status = %d", code)
+	}
+	if !status.Running || !slices.Equal(status.Consumers, []string{"api-0-worker-1", "api-0-worker-2"}) {
+		t.Errorf("running = %v, consumers = %v; want true and this replica's two workers", status.Running, status.Consumers)
+	}
+	var names []string
+	for _, consumer := range status.GroupConsumers {
+		names = append(names, consumer.Name)
+		if consumer.Name == "other-host-worker-1" && consumer.Pending != 1 {
+			t.Errorf("%s pending = %d, want 1", consumer.Name, consumer.Pending)
+		}
+	}
+	if !slices.Equal(names, []string{"api-0-worker-1", "api-0-worker-2", "other-host-worker-1"}) {
+		t.Errorf("group consumers = %v, want both replicas' workers", names)
+	}
+
+	// Stopped workers leave the list, but stay registered in the group
+	workers.Stop()
+	callAdmin(t, getWorkerStatus, http.MethodGet, "", &status)
+	if status.Running || len(status.Consumers) != 0 || len(status.GroupConsumers) != 3 {
+		t.Errorf("after Stop: %+v, want not running, no consumers, 3 group consumers", status)
+	}
+}
+
+//! Sets the backlog drain settings for the rest of the test
+func useDrainSettings(t *testing.T, threshold, batchSize int64) {
+	oldThreshold, oldBatchSize := drainThreshold, drainBatchSize
+	drainThreshold, drainBatchSize = threshold, batchSize
+	t.Cleanup(func() { drainThreshold, drainBatchSize = oldThreshold, oldBatchSize })
+}
+
+//! Starts one stream worker and two drain workers as the process-wide manager, like newWorkerManager(1, 2)
+func startDrainingWorkers(t *testing.T) {
+	t.Helper()
+	old := workers
+	workers = newManager(prepareStreamWorkers, []func(){
+		func() { startWorker(1) },
+		func() { startDrainWorker(2) },
+		func() { startDrainWorker(3) },
+	})
+	t.Cleanup(func() {
+		workers.Stop()
+		workers = old
+	})
+	if _, err := workers.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+}
+
+func TestWorkerBacklogDrain(t *testing.T) {
+	f := useFakePG(t)
+	r := useFakeRedis(t)
+	f.on("INSERT INTO messages", pgRule{Tag: "INSERT 0 1"})
+	f.on("UPDATE messages SET status = 'delivered'", pgRule{Tag: "UPDATE 1"})
+	f.on("conversation_mutes", pgRule{Rows: [][]interface{}{}, Cols: 1})
+	useDrainSettings(t, 20, 10)
+	t.Setenv("POD_NAME", "api-0")
+
+	// An outage left 45 entries queued
+	if err := createConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	const total = 45
+	for i := range total {
+		values := validStreamEntry()
+		values["message_id"] = fmt.Sprintf("m%03d", i)
+		values["seq"] = strconv.Itoa(i + 1)
+		if err := redisCli.XAdd(ctx, &redis.XAddArgs{Stream: "message_stream", Values: values}).Err(); err != nil {
+			t.Fatalf("XADD: %v", err)
+		}
+	}
+
+	startDrainingWorkers(t)
+	var status WorkerStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		callAdmin(t, getWorkerStatus, http.MethodGet, "", &status)
+		if status.Drain != nil && !status.Drain.Draining && len(status.Consumers) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v, drain = %+v; want the drain finished", status, status.Drain)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The drain workers helped, then exited; the steady worker stays
+	if got := r.consumers("message_stream", "message_group"); len(got) != 3 {
+		t.Errorf("group consumers = %v, want the worker and both drain workers", got)
+	}
+	if !slices.Equal(status.Consumers, []string{"api-0-worker-1"}) {
+		t.Errorf("consumers = %v, want only api-0-worker-1", status.Consumers)
+	}
+	if d := status.Drain; d.Backlog != total || d.Processed != total || d.Consumers != 0 {
+		t.Errorf("drain = %+v, want backlog and processed %d, no consumers", d, total)
+	}
+	if len(r.acks()) != total {
+		t.Errorf("%d entries acked, want %d", len(r.acks()), total)
+	}
+	inserts := f.queriesContaining("INSERT INTO messages")
+	for i := range total {
+		if id := fmt.Sprintf("m%03d", i); countArg(inserts, id) != 1 {
+			t.Errorf("%s inserted %d times, want once", id, countArg(inserts, id))
+		}
+	}
+
+	// A restart without a backlog reports no drain and leaves the drain workers out
+	if err := workers.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	callAdmin(t, getWorkerStatus, http.MethodGet, "", &status)
+	if status.Drain != nil || len(status.Consumers) > 1 {
+		t.Errorf("after a restart: consumers = %v, drain = %+v; want one consumer and no drain", status.Consumers, status.Drain)
+	}
+}